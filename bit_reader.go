@@ -0,0 +1,165 @@
+package media_utils
+
+// bit_reader reads MSB-first bit fields. Reading past the end of data sets
+// err and returns zeros, so callers can check the error once after a run of reads.
+type bit_reader struct {
+	data []byte
+	pos uint64 // bit position
+	err error
+}
+
+func new_bit_reader(data []byte) *bit_reader {
+	return &bit_reader{data: data}
+}
+
+func (r *bit_reader) bits_left() uint64 {
+	total := uint64(len(r.data)) * 8
+	if r.pos >= total {
+		return 0
+	}
+
+	return total - r.pos
+}
+
+func (r *bit_reader) read_bits(n uint) uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	if uint64(n) > r.bits_left() {
+		r.err = parse_error(ErrTruncated, "bitstream_overrun", uint64(len(r.data)), "")
+		r.pos = uint64(len(r.data)) * 8
+		return 0
+	}
+
+	var v uint64
+	for i := uint(0); i < n; i++ {
+		b := r.data[r.pos >> 3] >> (7 - r.pos & 7) & 1
+		v = v << 1 | uint64(b)
+		r.pos++
+	}
+
+	return v
+}
+
+func (r *bit_reader) read_flag() bool {
+	return r.read_bits(1) == 1
+}
+
+func (r *bit_reader) skip_bits(n uint64) {
+	if r.err != nil {
+		return
+	}
+
+	if n > r.bits_left() {
+		r.err = parse_error(ErrTruncated, "bitstream_overrun", uint64(len(r.data)), "")
+		r.pos = uint64(len(r.data)) * 8
+		return
+	}
+
+	r.pos += n
+}
+
+// read_bytes returns the next n bytes. The reader must be byte aligned.
+func (r *bit_reader) read_bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if r.pos & 7 != 0 {
+		r.err = parse_error(ErrInvalidData, "bitstream_not_byte_aligned", r.pos >> 3, "")
+		return nil
+	}
+
+	if n > r.bits_left() / 8 {
+		r.err = parse_error(ErrTruncated, "bitstream_overrun", uint64(len(r.data)), "")
+		r.pos = uint64(len(r.data)) * 8
+		return nil
+	}
+
+	p := r.pos >> 3
+	r.pos += n * 8
+	return r.data[p : p+n]
+}
+
+// byte_pos returns the number of whole bytes consumed.
+func (r *bit_reader) byte_pos() uint64 {
+	return (r.pos + 7) >> 3
+}
+
+// read_ue reads an unsigned Exp-Golomb code.
+func (r *bit_reader) read_ue() uint64 {
+	leading_zero_bits := uint(0)
+	for !r.read_flag() {
+		if r.err != nil {
+			return 0
+		}
+
+		leading_zero_bits++
+		if leading_zero_bits > 32 {
+			r.err = parse_error(ErrInvalidData, "invalid_exp_golomb_code", r.pos >> 3, "")
+			return 0
+		}
+	}
+
+	return (uint64(1) << leading_zero_bits) - 1 + r.read_bits(leading_zero_bits)
+}
+
+// read_se reads a signed Exp-Golomb code.
+func (r *bit_reader) read_se() int64 {
+	k := r.read_ue()
+	if k & 1 == 1 {
+		return int64((k + 1) / 2)
+	}
+
+	return -int64(k / 2)
+}
+
+// bit_writer packs MSB-first bit fields.
+type bit_writer struct {
+	data []byte
+	nbits uint
+}
+
+func (w *bit_writer) write_bits(n uint, v uint64) {
+	for i := int(n) - 1; i >= 0; i-- {
+		if w.nbits & 7 == 0 {
+			w.data = append(w.data, 0)
+		}
+
+		if (v >> uint(i)) & 1 == 1 {
+			w.data[len(w.data) - 1] |= 0x80 >> (w.nbits & 7)
+		}
+
+		w.nbits++
+	}
+}
+
+func (w *bit_writer) write_flag(f bool) {
+	if f {
+		w.write_bits(1, 1)
+	} else {
+		w.write_bits(1, 0)
+	}
+}
+
+// write_bytes appends whole bytes. The writer must be byte aligned.
+func (w *bit_writer) write_bytes(d []byte) {
+	w.data = append(w.data, d...)
+	w.nbits += uint(len(d)) * 8
+}
+
+func (w *bit_writer) write_ue(v uint64) {
+	v++
+	n := uint(0)
+	for t := v; t > 1; t >>= 1 {
+		n++
+	}
+
+	w.write_bits(n, 0)
+	w.write_bits(n + 1, v)
+}
+
+func (w *bit_writer) bytes() []byte {
+	return w.data
+}
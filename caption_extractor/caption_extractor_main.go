@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"github.com/maxutility2011/media_utils"
+)
+
+func main() {
+	inputPtr := flag.String("input", "", "Input MP4 file path (progressive or fragmented, with moov)")
+	initPtr := flag.String("init", "", "Init segment path, for media segments given as trailing arguments")
+	trackPtr := flag.Uint("track", 0, "Video track ID (default: the first video track)")
+	formatPtr := flag.String("format", "srt", "Output format: srt or vtt")
+	outputPtr := flag.String("output", "", "Output path prefix; one file per caption channel is written as <prefix>_CC1.srt etc. (default: input name)")
+	absolutePtr := flag.Bool("absolute", false, "Keep media timestamps instead of starting at the first video sample")
+	flag.Parse()
+
+	if (*inputPtr == "") == (*initPtr == "") {
+		fmt.Printf("Either an input MP4 file or an init segment followed by media segments is required.\n")
+		os.Exit(1)
+	}
+
+	if *formatPtr != "srt" && *formatPtr != "vtt" {
+		fmt.Printf("Unsupported output format: %s\n", *formatPtr)
+		os.Exit(1)
+	}
+
+	moovPath := *inputPtr
+	dataPaths := flag.Args()
+	if *inputPtr != "" {
+		dataPaths = append([]string{*inputPtr}, dataPaths...)
+	} else {
+		moovPath = *initPtr
+	}
+
+	moovData, err := os.ReadFile(moovPath)
+	if err != nil {
+		fmt.Printf("Error: Failed to read file: %s. Error: %v\n", moovPath, err)
+		os.Exit(1)
+	}
+
+	tracks, err := media_utils.GetTracks(moovData)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse tracks of %s. Error: %v\n", moovPath, err)
+		os.Exit(1)
+	}
+
+	track, err := media_utils.FindTrack(tracks, uint32(*trackPtr), "vide")
+	if err != nil {
+		fmt.Printf("Error: Failed to find the video track. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	extractor, err := media_utils.NewCaptionExtractor(track)
+	if err != nil {
+		fmt.Printf("Error: Cannot extract captions of track %d (%s). Error: %v\n", track.Track_id, track.Codec, err)
+		os.Exit(1)
+	}
+
+	firstPts := int64(-1)
+	for _, path := range dataPaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Error: Failed to read file: %s. Error: %v\n", path, err)
+			os.Exit(1)
+		}
+
+		var samples []media_utils.Mp4_sample
+		if path == *inputPtr {
+			samples, err = media_utils.GetTrackSamples(data, track)
+			if err != nil {
+				fmt.Printf("Error: Failed to read the sample table of %s. Error: %v\n", path, err)
+				os.Exit(1)
+			}
+		}
+
+		fragmentSamples, err := media_utils.GetFragmentSamples(data, tracks)
+		if err != nil {
+			fmt.Printf("Error: Failed to read the fragments of %s. Error: %v\n", path, err)
+			os.Exit(1)
+		}
+
+		samples = append(samples, fragmentSamples...)
+		for _, sample := range samples {
+			if sample.Track_id != track.Track_id {
+				continue
+			}
+
+			if firstPts < 0 || sample.Pts < firstPts {
+				firstPts = sample.Pts
+			}
+
+			err = extractor.AddSample(sample)
+			if err != nil {
+				fmt.Printf("Error: Failed to parse sample at offset %d of %s. Error: %v\n", sample.Offset, path, err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	captionTracks := extractor.Finish()
+	if len(captionTracks) == 0 {
+		fmt.Printf("No CEA-608/708 captions found in track %d\n", track.Track_id)
+		os.Exit(1)
+	}
+
+	prefix := *outputPtr
+	if prefix == "" {
+		prefix = strings.TrimSuffix(moovPath, filepath.Ext(moovPath))
+	}
+
+	offset := media_utils.MediaTimeToDuration(firstPts, track.Timescale)
+	for _, c := range captionTracks {
+		cues := c.Cues
+		if !*absolutePtr && firstPts > 0 {
+			for i := range cues {
+				cues[i].Start -= offset
+				cues[i].End -= offset
+			}
+		}
+
+		outputPath := prefix + "_" + c.Channel + "." + *formatPtr
+		out, err := os.Create(outputPath)
+		if err != nil {
+			fmt.Printf("Error: Failed to create output file: %s. Error: %v\n", outputPath, err)
+			os.Exit(1)
+		}
+
+		w := bufio.NewWriter(out)
+		if *formatPtr == "vtt" {
+			err = media_utils.WriteWebVtt(w, cues)
+		} else {
+			err = media_utils.WriteSrt(w, cues)
+		}
+
+		if err == nil {
+			err = w.Flush()
+		}
+
+		out.Close()
+		if err != nil {
+			fmt.Printf("Error: Failed to write output file: %s. Error: %v\n", outputPath, err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%s: %d cues written to %s\n", c.Channel, len(cues), outputPath)
+	}
+}
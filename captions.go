@@ -0,0 +1,228 @@
+package media_utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cc_data cc_type values
+const (
+	Cc_type_ntsc_field_1 = 0
+	Cc_type_ntsc_field_2 = 1
+	Cc_type_dtvcc_packet_data = 2
+	Cc_type_dtvcc_packet_start = 3
+)
+
+// Cc_data_pair is one valid cc_data_1/cc_data_2 construct of ATSC A/53 cc_data.
+type Cc_data_pair struct {
+	Cc_type uint8
+	Data [2]byte
+}
+
+type Caption_cue struct {
+	Start time.Duration
+	End time.Duration
+	Text string
+}
+
+// Caption_track holds the cues of one CEA-608 channel (CC1-CC4) or CEA-708
+// service (SERVICE1-SERVICE63).
+type Caption_track struct {
+	Channel string
+	Cues []Caption_cue
+
+	text string // currently shown text
+	start time.Duration
+}
+
+// show records a change of the text on screen at time t.
+func (c *Caption_track) show(text string, t time.Duration) {
+	if text == c.text {
+		return
+	}
+
+	if c.text != "" && t > c.start {
+		c.Cues = append(c.Cues, Caption_cue{Start: c.start, End: t, Text: c.text})
+	}
+
+	if c.text == "" || t > c.start {
+		c.start = t
+	}
+
+	c.text = text
+}
+
+// ParseA53CcData decodes the cc_data of a user_data_registered_itu_t_t35 SEI
+// payload carrying ATSC A/53 (GA94) captions. It returns false if the payload
+// is not A/53 cc_data.
+func ParseA53CcData(payload []byte) ([]Cc_data_pair, bool) {
+	p := 0
+	if len(payload) < 1 || payload[0] != 0xB5 { // itu_t_t35_country_code: United States
+		return nil, false
+	}
+
+	p++
+	if len(payload) - p < 8 || get_uint16(uint32(p), payload) != 0x0031 || get_uint32(uint32(p + 2), payload) != mp4_fourcc('G', 'A', '9', '4') || payload[p+6] != 0x03 {
+		return nil, false
+	}
+
+	p += 7
+	if payload[p] & 0x40 == 0 { // process_cc_data_flag
+		return nil, true
+	}
+
+	cc_count := int(payload[p] & 0x1F)
+	p += 2 // cc_count byte, em_data
+	var pairs []Cc_data_pair
+	for i := 0; i < cc_count && len(payload) - p >= 3; i++ {
+		if payload[p] & 0x04 != 0 { // cc_valid
+			pairs = append(pairs, Cc_data_pair{Cc_type: payload[p] & 0x03, Data: [2]byte{payload[p+1], payload[p+2]}})
+		}
+
+		p += 3
+	}
+
+	return pairs, true
+}
+
+type cc_sample struct {
+	pts int64
+	pairs []Cc_data_pair
+}
+
+// Caption_extractor decodes CEA-608 and CEA-708 captions carried in the SEI of
+// H.264/HEVC video samples.
+type Caption_extractor struct {
+	analyzer *Nal_analyzer
+	timescale uint32
+	samples []cc_sample
+	end_pts int64
+}
+
+func NewCaptionExtractor(track Track_info) (*Caption_extractor, error) {
+	analyzer, err := NewNalAnalyzer(track)
+	if err != nil {
+		return nil, err
+	}
+
+	if track.Timescale == 0 {
+		return nil, errors.New("invalid_timescale")
+	}
+
+	return &Caption_extractor{analyzer: analyzer, timescale: track.Timescale}, nil
+}
+
+// AddSample collects the cc_data of a video sample. Samples may be added in
+// decode order; captions are decoded in presentation order by Finish.
+func (e *Caption_extractor) AddSample(sample Mp4_sample) error {
+	pic, err := e.analyzer.AnalyzeSample(sample)
+	if err != nil {
+		return err
+	}
+
+	if end := sample.Pts + int64(sample.Duration); end > e.end_pts {
+		e.end_pts = end
+	}
+
+	var pairs []Cc_data_pair
+	for _, nalu := range pic.Nal_units {
+		for _, m := range nalu.Sei_messages {
+			if m.Payload_type != Sei_user_data_registered_itu_t_t35 {
+				continue
+			}
+
+			if p, ok := ParseA53CcData(m.Payload); ok {
+				pairs = append(pairs, p...)
+			}
+		}
+	}
+
+	if len(pairs) > 0 {
+		e.samples = append(e.samples, cc_sample{pts: sample.Pts, pairs: pairs})
+	}
+
+	return nil
+}
+
+// MediaTimeToDuration converts a media time in the given timescale to a time.Duration.
+func MediaTimeToDuration(t int64, timescale uint32) time.Duration {
+	return time.Duration(t / int64(timescale)) * time.Second + time.Duration(t % int64(timescale)) * time.Second / time.Duration(timescale)
+}
+
+// Finish decodes the collected cc_data and returns the caption tracks that
+// have cues, CEA-608 channels first. Cue times are media times of the track.
+func (e *Caption_extractor) Finish() []*Caption_track {
+	sort.SliceStable(e.samples, func(i, j int) bool { return e.samples[i].pts < e.samples[j].pts })
+
+	cea608 := new_cea608_decoder()
+	cea708 := new_cea708_decoder()
+	for _, s := range e.samples {
+		t := MediaTimeToDuration(s.pts, e.timescale)
+		for _, pair := range s.pairs {
+			switch pair.Cc_type {
+			case Cc_type_ntsc_field_1, Cc_type_ntsc_field_2:
+				cea608.decode(int(pair.Cc_type), pair.Data, t)
+			case Cc_type_dtvcc_packet_start:
+				cea708.decode(true, pair.Data, t)
+			case Cc_type_dtvcc_packet_data:
+				cea708.decode(false, pair.Data, t)
+			}
+		}
+	}
+
+	end := MediaTimeToDuration(e.end_pts, e.timescale)
+	var tracks []*Caption_track
+	for _, c := range append(cea608.tracks(), cea708.tracks()...) {
+		c.show("", end)
+		if len(c.Cues) > 0 {
+			tracks = append(tracks, c)
+		}
+	}
+
+	return tracks
+}
+
+func format_cue_time(d time.Duration, fraction_separator string) string {
+	ms := d.Milliseconds()
+	if ms < 0 {
+		ms = 0
+	}
+
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms / 3600000, ms / 60000 % 60, ms / 1000 % 60, fraction_separator, ms % 1000)
+}
+
+// WriteSrt writes the cues as SubRip subtitles.
+func WriteSrt(w io.Writer, cues []Caption_cue) error {
+	for i, cue := range cues {
+		_, err := fmt.Fprintf(w, "%d\n%s --> %s\n%s\n\n", i + 1, format_cue_time(cue.Start, ","), format_cue_time(cue.End, ","), cue.Text)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteWebVtt writes the cues as a WebVTT file.
+func WriteWebVtt(w io.Writer, cues []Caption_cue) error {
+	_, err := io.WriteString(w, "WEBVTT\n\n")
+	if err != nil {
+		return err
+	}
+
+	for _, cue := range cues {
+		// "-->" must not appear in cue text
+		text := strings.ReplaceAll(strings.ReplaceAll(cue.Text, "&", "&amp;"), "<", "&lt;")
+		text = strings.ReplaceAll(text, "-->", "--&gt;")
+		_, err = fmt.Fprintf(w, "%s --> %s\n%s\n\n", format_cue_time(cue.Start, "."), format_cue_time(cue.End, "."), text)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package media_utils
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// captions_test_cc_data returns the A/53 SEI payload of the cc_data triplets
+// (cc_valid and cc_type, then the two bytes).
+func captions_test_cc_data(triplets ...[3]byte) []byte {
+	payload := []byte{0xB5, 0x00, 0x31, 'G', 'A', '9', '4', 0x03, 0x40 | byte(len(triplets)), 0xFF}
+	for _, triplet := range triplets {
+		payload = append(payload, triplet[:]...)
+	}
+
+	return append(payload, 0xFF)
+}
+
+// captions_test_sample returns an H.264 sample of the mux_test_tracks video
+// track with a user_data_registered_itu_t_t35 SEI message of payload.
+func captions_test_sample(pts int64, payload []byte) Mp4_sample {
+	sei := []byte{0x06, Sei_user_data_registered_itu_t_t35}
+	for n := len(payload); ; n -= 255 {
+		sei = append(sei, byte(min(n, 255)))
+		if n < 255 {
+			break
+		}
+	}
+
+	sei = append(append(sei, payload...), 0x80)
+	data := append(append_uint32(nil, uint32(len(sei))), sei...)
+	return Mp4_sample{Track_id: 1, Dts: pts, Pts: pts, Duration: 3000, Size: uint32(len(data)), Data: data}
+}
+
+// captions_test_extract returns the caption tracks of samples of the cc_data
+// payloads, one a second.
+func captions_test_extract(t *testing.T, payloads ...[]byte) []*Caption_track {
+	t.Helper()
+	e, err := NewCaptionExtractor(mux_test_tracks(48000)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, payload := range payloads {
+		err = e.AddSample(captions_test_sample(int64(i) * 90000, payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return e.Finish()
+}
+
+// cea608_test_field_1 and cea608_test_field_2 return the cc_data triplets of
+// the byte pairs of an NTSC field. The parity bits, which the decoder drops,
+// are left out.
+func cea608_test_field_1(pairs ...[2]byte) [][3]byte {
+	var triplets [][3]byte
+	for _, pair := range pairs {
+		triplets = append(triplets, [3]byte{0xFC, pair[0], pair[1]})
+	}
+
+	return triplets
+}
+
+func cea608_test_field_2(pairs ...[2]byte) [][3]byte {
+	var triplets [][3]byte
+	for _, pair := range pairs {
+		triplets = append(triplets, [3]byte{0xFD, pair[0], pair[1]})
+	}
+
+	return triplets
+}
+
+func TestCea608PopOn(t *testing.T) {
+	rcl := [2]byte{0x14, 0x20}
+	eoc := [2]byte{0x14, 0x2F}
+	edm := [2]byte{0x14, 0x2C}
+	tracks := captions_test_extract(t,
+		// Control codes are sent twice, and act once
+		captions_test_cc_data(cea608_test_field_1(rcl, rcl, [2]byte{0x14, 0x70}, [2]byte{'H', 'i'}, [2]byte{0x11, 0x37})...),
+		// Row 2, an extended character replacing the e ahead of it
+		captions_test_cc_data(cea608_test_field_1([2]byte{0x11, 0x40}, [2]byte{'N', 'o'}, [2]byte{'e', 0}, [2]byte{0x12, 0x36}, [2]byte{'l', 0}, eoc, eoc)...),
+		captions_test_cc_data(cea608_test_field_1(rcl, [2]byte{'B', 'y'}, [2]byte{'e', 0})...),
+		captions_test_cc_data(cea608_test_field_1(eoc)...),
+		captions_test_cc_data(cea608_test_field_1(edm)...))
+
+	want := []Caption_cue{
+		{1 * time.Second, 3 * time.Second, "Noël\nHi♪"},
+		{3 * time.Second, 4 * time.Second, "Bye"},
+	}
+
+	if len(tracks) != 1 || tracks[0].Channel != "CC1" || !reflect.DeepEqual(tracks[0].Cues, want) {
+		t.Fatalf("tracks %+v", tracks)
+	}
+
+	var out bytes.Buffer
+	err := WriteSrt(&out, want)
+	if err != nil || out.String() != "1\n00:00:01,000 --> 00:00:03,000\nNoël\nHi♪\n\n2\n00:00:03,000 --> 00:00:04,000\nBye\n\n" {
+		t.Errorf("SRT output %q: %v", out.String(), err)
+	}
+}
+
+func TestCea608RollUp(t *testing.T) {
+	// CC3: the first channel of field 2, in roll-up mode with 3 rows
+	ru3 := [2]byte{0x14, 0x26}
+	cr := [2]byte{0x14, 0x2D}
+	tracks := captions_test_extract(t,
+		captions_test_cc_data(cea608_test_field_2(ru3, [2]byte{'A', 'A'})...),
+		captions_test_cc_data(cea608_test_field_2(cr, [2]byte{'B', 'B'})...),
+		captions_test_cc_data(cea608_test_field_2(cr, [2]byte{'C', 'C'})...),
+		captions_test_cc_data(cea608_test_field_2(cr)...),
+		captions_test_cc_data(cea608_test_field_2([2]byte{0x14, 0x2C})...))
+
+	want := []Caption_cue{
+		{1 * time.Second, 2 * time.Second, "AA"},
+		{2 * time.Second, 3 * time.Second, "AA\nBB"},
+		{3 * time.Second, 4 * time.Second, "BB\nCC"},
+	}
+
+	if len(tracks) != 1 || tracks[0].Channel != "CC3" || !reflect.DeepEqual(tracks[0].Cues, want) {
+		t.Fatalf("tracks %+v", tracks)
+	}
+}
+
+// cea708_test_packet returns the cc_data triplets of a DTVCC packet of one
+// service block.
+func cea708_test_packet(service int, block ...byte) [][3]byte {
+	packet := append([]byte{0, byte(service << 5 | len(block))}, block...)
+	if len(packet) % 2 != 0 {
+		packet = append(packet, 0)
+	}
+
+	packet[0] = byte(len(packet) / 2)
+	triplets := [][3]byte{{0xFF, packet[0], packet[1]}}
+	for p := 2; p < len(packet); p += 2 {
+		triplets = append(triplets, [3]byte{0xFE, packet[p], packet[p + 1]})
+	}
+
+	return triplets
+}
+
+func TestCea708(t *testing.T) {
+	// DF0: a visible window of two rows
+	define := []byte{0x98, 0x20, 0, 0, 0x01, 0, 0}
+	tracks := captions_test_extract(t,
+		captions_test_cc_data(cea708_test_packet(1, append(define, 'H', 'i', 0x10, 0x25, 0x0D, 0x7F, 0x03)...)...),
+		captions_test_cc_data(cea708_test_packet(2, append(define, 'T', 'w', 'o', 0x03)...)...),
+		// CLW: clear window 0
+		captions_test_cc_data(cea708_test_packet(1, 0x88, 0x01)...),
+		nil)
+
+	if len(tracks) != 2 || tracks[0].Channel != "SERVICE1" || tracks[1].Channel != "SERVICE2" {
+		t.Fatalf("tracks %+v", tracks)
+	}
+
+	want := []Caption_cue{{0, 2 * time.Second, "Hi…\n♪"}}
+	if !reflect.DeepEqual(tracks[0].Cues, want) {
+		t.Errorf("SERVICE1 cues %+v", tracks[0].Cues)
+	}
+
+	// Shown until the end of the last sample
+	want = []Caption_cue{{1 * time.Second, 3 * time.Second + time.Second / 30, "Two"}}
+	if !reflect.DeepEqual(tracks[1].Cues, want) {
+		t.Errorf("SERVICE2 cues %+v", tracks[1].Cues)
+	}
+}
+
+// FuzzCaptionExtractor checks the A/53 cc_data parser and that the cues of
+// two samples lie within the samples.
+func FuzzCaptionExtractor(f *testing.F) {
+	// Hi, popped on at the first sample and erased at the second
+	f.Add(captions_test_cc_data([3]byte{0xFC, 0x94, 0x20}, [3]byte{0xFC, 0xC8, 0xE9}, [3]byte{0xFC, 0x94, 0x2F}), captions_test_cc_data([3]byte{0xFC, 0x94, 0x2C}))
+	f.Fuzz(func(t *testing.T, a []byte, b []byte) {
+		if pairs, ok := ParseA53CcData(a); !ok && pairs != nil || len(pairs) * 3 > len(a) {
+			t.Fatalf("%d pairs in %d bytes", len(pairs), len(a))
+		}
+
+		e, err := NewCaptionExtractor(mux_test_tracks(48000)[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e.AddSample(captions_test_sample(0, a)) != nil || e.AddSample(captions_test_sample(3000, b)) != nil {
+			return
+		}
+
+		for _, track := range e.Finish() {
+			for _, cue := range track.Cues {
+				if cue.Start < 0 || cue.End < cue.Start || cue.End > MediaTimeToDuration(6000, 90000) {
+					t.Fatalf("%s cue %v to %v", track.Channel, cue.Start, cue.End)
+				}
+			}
+		}
+	})
+}
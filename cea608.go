@@ -0,0 +1,280 @@
+package media_utils
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	cea608_rows = 15
+	cea608_columns = 32
+)
+
+const (
+	cea608_mode_pop_on = iota
+	cea608_mode_roll_up
+	cea608_mode_paint_on
+	cea608_mode_text
+)
+
+// Characters of the basic set that differ from ASCII
+var cea608_basic_chars = map[byte]rune{
+	0x2A: 'á', 0x5C: 'é', 0x5E: 'í', 0x5F: 'ó', 0x60: 'ú', 0x7B: 'ç', 0x7C: '÷', 0x7D: 'Ñ', 0x7E: 'ñ', 0x7F: '█',
+}
+
+// Special North American characters, second byte 0x30-0x3F after 0x11
+var cea608_special_chars = []rune("®°½¿™¢£♪à èâêîôû")
+
+// Extended characters, second byte 0x20-0x3F after 0x12 and 0x13
+var cea608_extended_chars = [2][]rune{
+	[]rune("ÁÉÓÚÜü‘¡*'—©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»"),
+	[]rune("ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤¦ÅåØø┌┐└┘"),
+}
+
+// Rows addressed by preamble address codes: first byte 0x10-0x17, the second
+// byte bit 0x20 selecting the second row of the pair
+var cea608_pac_rows = [8][2]int{
+	{11, 11}, {1, 2}, {3, 4}, {12, 13}, {14, 15}, {5, 6}, {7, 8}, {9, 10},
+}
+
+type cea608_screen [cea608_rows][cea608_columns]rune
+
+func (s *cea608_screen) clear() {
+	*s = cea608_screen{}
+}
+
+func (s *cea608_screen) text() string {
+	var lines []string
+	for _, row := range s {
+		line := strings.TrimRight(strings.Map(func(r rune) rune {
+			if r == 0 {
+				return ' '
+			}
+
+			return r
+		}, string(row[:])), " ")
+
+		line = strings.TrimLeft(line, " ")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// cea608_channel is the caption state of one data channel (CC1-CC4).
+type cea608_channel struct {
+	track *Caption_track
+	mode int
+	roll_up_rows int
+	displayed cea608_screen
+	non_displayed cea608_screen
+	row int // 0-based
+	column int
+}
+
+func (c *cea608_channel) memory() *cea608_screen {
+	if c.mode == cea608_mode_pop_on {
+		return &c.non_displayed
+	}
+
+	return &c.displayed
+}
+
+func (c *cea608_channel) write_char(r rune, t time.Duration) {
+	if c.mode == cea608_mode_text {
+		return
+	}
+
+	if c.column < cea608_columns {
+		c.memory()[c.row][c.column] = r
+		c.column++
+	}
+
+	if c.mode == cea608_mode_paint_on {
+		c.track.show(c.displayed.text(), t)
+	}
+}
+
+func (c *cea608_channel) backspace() {
+	if c.column > 0 {
+		c.column--
+		c.memory()[c.row][c.column] = 0
+	}
+}
+
+// roll_up scrolls the roll-up window ending at the cursor row up by one row.
+func (c *cea608_channel) roll_up() {
+	top := c.row - c.roll_up_rows + 1
+	if top < 0 {
+		top = 0
+	}
+
+	for r := 0; r < cea608_rows; r++ {
+		if r < top || r > c.row {
+			c.displayed[r] = [cea608_columns]rune{}
+		}
+	}
+
+	for r := top; r < c.row; r++ {
+		c.displayed[r] = c.displayed[r + 1]
+	}
+
+	c.displayed[c.row] = [cea608_columns]rune{}
+}
+
+func (c *cea608_channel) control(code byte, t time.Duration) {
+	switch code {
+	case 0x20: // RCL resume caption loading
+		c.mode = cea608_mode_pop_on
+	case 0x21: // BS backspace
+		c.backspace()
+		if c.mode == cea608_mode_paint_on {
+			c.track.show(c.displayed.text(), t)
+		}
+	case 0x24: // DER delete to end of row
+		for i := c.column; i < cea608_columns; i++ {
+			c.memory()[c.row][i] = 0
+		}
+	case 0x25, 0x26, 0x27: // RU2, RU3, RU4
+		if c.mode != cea608_mode_roll_up {
+			c.displayed.clear()
+			c.non_displayed.clear()
+			c.track.show("", t)
+			c.row = cea608_rows - 1
+		}
+
+		c.mode = cea608_mode_roll_up
+		c.roll_up_rows = int(code) - 0x23
+		c.column = 0
+	case 0x29: // RDC resume direct captioning
+		c.mode = cea608_mode_paint_on
+	case 0x2A, 0x2B: // TR text restart, RTD resume text display
+		c.mode = cea608_mode_text
+	case 0x2C: // EDM erase displayed memory
+		c.displayed.clear()
+		c.track.show("", t)
+	case 0x2D: // CR carriage return
+		if c.mode == cea608_mode_roll_up {
+			c.roll_up()
+			c.track.show(c.displayed.text(), t)
+		}
+
+		c.column = 0
+	case 0x2E: // ENM erase non-displayed memory
+		c.non_displayed.clear()
+	case 0x2F: // EOC end of caption
+		c.displayed, c.non_displayed = c.non_displayed, c.displayed
+		c.mode = cea608_mode_pop_on
+		c.track.show(c.displayed.text(), t)
+	}
+}
+
+// preamble_address moves the cursor to the row and indent of a PAC.
+func (c *cea608_channel) preamble_address(b1 byte, b2 byte) {
+	row := cea608_pac_rows[b1 & 0x07][(b2 >> 5) & 0x01] - 1
+	if c.mode == cea608_mode_roll_up && row != c.row {
+		// Move the roll-up window to the new base row
+		var moved cea608_screen
+		for i := 0; i < c.roll_up_rows; i++ {
+			if row - i >= 0 && c.row - i >= 0 {
+				moved[row - i] = c.displayed[c.row - i]
+			}
+		}
+
+		c.displayed = moved
+	}
+
+	c.row = row
+	c.column = 0
+	if b2 & 0x10 != 0 {
+		c.column = int(b2 & 0x0E) * 2
+	}
+}
+
+// cea608_decoder decodes the byte pairs of both NTSC fields into channels
+// CC1/CC2 (field 1) and CC3/CC4 (field 2).
+type cea608_decoder struct {
+	channels [4]*cea608_channel
+	current [2]int // data channel of each field selected by the last control code
+	last_control [2][2]byte
+}
+
+func new_cea608_decoder() *cea608_decoder {
+	d := &cea608_decoder{}
+	for i := range d.channels {
+		d.channels[i] = &cea608_channel{track: &Caption_track{Channel: "CC" + string(rune('1' + i))}, row: cea608_rows - 1, roll_up_rows: 2}
+	}
+
+	return d
+}
+
+func (d *cea608_decoder) tracks() []*Caption_track {
+	var tracks []*Caption_track
+	for _, c := range d.channels {
+		tracks = append(tracks, c.track)
+	}
+
+	return tracks
+}
+
+func (d *cea608_decoder) decode(field int, data [2]byte, t time.Duration) {
+	b1 := data[0] & 0x7F // drop the parity bits
+	b2 := data[1] & 0x7F
+	if b1 == 0 && b2 == 0 {
+		return
+	}
+
+	if b1 >= 0x10 && b1 <= 0x1F {
+		// Control codes are transmitted twice; act on the first only.
+		if d.last_control[field] == [2]byte{b1, b2} {
+			d.last_control[field] = [2]byte{}
+			return
+		}
+
+		d.last_control[field] = [2]byte{b1, b2}
+		d.current[field] = int(b1 >> 3 & 0x01)
+		c := d.channels[field * 2 + d.current[field]]
+		b1 &^= 0x08
+		switch {
+		case (b1 == 0x14 || b1 == 0x15) && b2 >= 0x20 && b2 <= 0x2F:
+			c.control(b2, t)
+		case b1 == 0x17 && b2 >= 0x21 && b2 <= 0x23: // tab offsets
+			c.column += int(b2) - 0x20
+			if c.column >= cea608_columns {
+				c.column = cea608_columns - 1
+			}
+		case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2F: // mid-row codes display as a space
+			c.write_char(' ', t)
+		case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3F:
+			c.write_char(cea608_special_chars[b2 - 0x30], t)
+		case (b1 == 0x12 || b1 == 0x13) && b2 >= 0x20 && b2 <= 0x3F:
+			// Extended characters replace the standard character sent ahead of them
+			c.backspace()
+			c.write_char(cea608_extended_chars[b1 - 0x12][b2 - 0x20], t)
+		case b2 >= 0x40:
+			c.preamble_address(b1, b2)
+		}
+
+		return
+	}
+
+	d.last_control[field] = [2]byte{}
+	if b1 < 0x20 {
+		return
+	}
+
+	c := d.channels[field * 2 + d.current[field]]
+	for _, b := range []byte{b1, b2} {
+		if b < 0x20 {
+			continue
+		}
+
+		if r, ok := cea608_basic_chars[b]; ok {
+			c.write_char(r, t)
+		} else {
+			c.write_char(rune(b), t)
+		}
+	}
+}
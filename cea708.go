@@ -0,0 +1,341 @@
+package media_utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const cea708_windows = 8
+
+// Parameter byte counts of the C1 commands 0x80-0x9F
+var cea708_c1_param_sizes = [32]int{
+	0, 0, 0, 0, 0, 0, 0, 0, // CW0-CW7
+	1, 1, 1, 1, 1, 1, 0, 0, // CLW, DSW, HDW, TGW, DLW, DLY, DLC, RST
+	2, 3, 2, 0, 0, 0, 0, 4, // SPA, SPC, SPL, reserved, SWA
+	6, 6, 6, 6, 6, 6, 6, 6, // DF0-DF7
+}
+
+// G2 characters that have a text representation
+var cea708_g2_chars = map[byte]rune{
+	0x20: ' ', 0x21: ' ', 0x25: '…', 0x2A: 'Š', 0x2C: 'Œ', 0x30: '█', 0x31: '‘', 0x32: '’', 0x33: '“', 0x34: '”',
+	0x35: '•', 0x39: '™', 0x3A: 'š', 0x3C: 'œ', 0x3D: '℠', 0x3F: 'Ÿ', 0x76: '⅛', 0x77: '⅜', 0x78: '⅝', 0x79: '⅞',
+	0x7A: '│', 0x7B: '┐', 0x7C: '└', 0x7D: '─', 0x7E: '┘', 0x7F: '┌',
+}
+
+type cea708_window struct {
+	defined bool
+	visible bool
+	row_count int
+	rows [][]rune
+	row int
+	column int
+}
+
+func (w *cea708_window) clear() {
+	w.rows = make([][]rune, w.row_count)
+	w.row = 0
+	w.column = 0
+}
+
+func (w *cea708_window) write_char(r rune) {
+	if w.row >= len(w.rows) {
+		return
+	}
+
+	for len(w.rows[w.row]) <= w.column {
+		w.rows[w.row] = append(w.rows[w.row], ' ')
+	}
+
+	w.rows[w.row][w.column] = r
+	w.column++
+}
+
+func (w *cea708_window) carriage_return() {
+	w.row++
+	w.column = 0
+	if w.row >= len(w.rows) {
+		// Scroll up
+		copy(w.rows, w.rows[1:])
+		w.rows[len(w.rows) - 1] = nil
+		w.row = len(w.rows) - 1
+	}
+}
+
+func (w *cea708_window) text() string {
+	var lines []string
+	for _, row := range w.rows {
+		if line := strings.TrimSpace(string(row)); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// cea708_service is the window state of one caption service.
+type cea708_service struct {
+	track *Caption_track
+	windows [cea708_windows]cea708_window
+	current int
+}
+
+func (s *cea708_service) window() *cea708_window {
+	w := &s.windows[s.current]
+	if !w.defined {
+		return nil
+	}
+
+	return w
+}
+
+func (s *cea708_service) text() string {
+	var parts []string
+	for i := range s.windows {
+		w := &s.windows[i]
+		if w.defined && w.visible {
+			if text := w.text(); text != "" {
+				parts = append(parts, text)
+			}
+		}
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+func (s *cea708_service) write_char(r rune) {
+	if w := s.window(); w != nil {
+		w.write_char(r)
+	}
+}
+
+// command runs the C1 command cmd with its parameters.
+func (s *cea708_service) command(cmd byte, params []byte) {
+	for_windows := func(bitmap byte, f func(w *cea708_window)) {
+		for i := 0; i < cea708_windows; i++ {
+			if bitmap & (1 << uint(i)) != 0 && s.windows[i].defined {
+				f(&s.windows[i])
+			}
+		}
+	}
+
+	switch {
+	case cmd <= 0x87: // CWx set current window
+		s.current = int(cmd - 0x80)
+	case cmd == 0x88: // CLW clear windows
+		for_windows(params[0], func(w *cea708_window) { w.clear() })
+	case cmd == 0x89: // DSW display windows
+		for_windows(params[0], func(w *cea708_window) { w.visible = true })
+	case cmd == 0x8A: // HDW hide windows
+		for_windows(params[0], func(w *cea708_window) { w.visible = false })
+	case cmd == 0x8B: // TGW toggle windows
+		for_windows(params[0], func(w *cea708_window) { w.visible = !w.visible })
+	case cmd == 0x8C: // DLW delete windows
+		for_windows(params[0], func(w *cea708_window) { *w = cea708_window{} })
+	case cmd == 0x8F: // RST reset
+		s.windows = [cea708_windows]cea708_window{}
+	case cmd == 0x92: // SPL set pen location
+		if w := s.window(); w != nil {
+			row := int(params[0] & 0x0F)
+			if row < len(w.rows) {
+				w.row = row
+			}
+
+			w.column = int(params[1] & 0x3F)
+		}
+	case cmd >= 0x98: // DFx define window
+		s.current = int(cmd - 0x98)
+		w := &s.windows[s.current]
+		row_count := int(params[3] & 0x0F) + 1
+		if !w.defined || w.row_count != row_count {
+			w.row_count = row_count
+			w.clear()
+		}
+
+		w.defined = true
+		w.visible = params[0] & 0x20 != 0
+	}
+}
+
+// decode_service_block decodes the data of one service block.
+func (s *cea708_service) decode_service_block(d []byte, t time.Duration) {
+	p := 0
+	for p < len(d) {
+		c := d[p]
+		p++
+		switch {
+		case c == 0x10: // EXT1: G2, G3, C2 and C3 code sets
+			if p >= len(d) {
+				return
+			}
+
+			e := d[p]
+			p++
+			switch {
+			case e < 0x08:
+			case e < 0x10:
+				p += 1
+			case e < 0x18:
+				p += 2
+			case e < 0x20:
+				p += 3
+			case e < 0x80:
+				if r, ok := cea708_g2_chars[e]; ok {
+					s.write_char(r)
+				}
+			case e < 0x88:
+				p += 4
+			case e < 0x90:
+				p += 5
+			case e == 0xA0:
+				s.write_char('㏄') // G3 CC icon
+			}
+		case c < 0x20: // C0
+			switch {
+			case c == 0x03: // ETX
+				s.track.show(s.text(), t)
+			case c == 0x08: // BS
+				if w := s.window(); w != nil && w.column > 0 {
+					w.column--
+					if w.row < len(w.rows) && w.column < len(w.rows[w.row]) {
+						w.rows[w.row][w.column] = ' '
+					}
+				}
+			case c == 0x0C: // FF form feed
+				if w := s.window(); w != nil {
+					w.clear()
+				}
+			case c == 0x0D: // CR
+				if w := s.window(); w != nil {
+					w.carriage_return()
+				}
+
+				s.track.show(s.text(), t)
+			case c == 0x0E: // HCR horizontal carriage return
+				if w := s.window(); w != nil && w.row < len(w.rows) {
+					w.rows[w.row] = nil
+					w.column = 0
+				}
+			case c >= 0x18:
+				p += 2
+			case c >= 0x11:
+				p += 1
+			}
+		case c < 0x80: // G0
+			if c == 0x7F {
+				s.write_char('♪')
+			} else {
+				s.write_char(rune(c))
+			}
+		case c < 0xA0: // C1
+			n := cea708_c1_param_sizes[c - 0x80]
+			if len(d) - p < n {
+				return
+			}
+
+			s.command(c, d[p : p+n])
+			p += n
+			if c >= 0x88 && c != 0x8D && c != 0x8E {
+				// Commands changing what is on screen
+				s.track.show(s.text(), t)
+			}
+		default: // G1: ISO 8859-1
+			s.write_char(rune(c))
+		}
+	}
+}
+
+// cea708_decoder reassembles DTVCC caption channel packets and decodes their
+// service blocks.
+type cea708_decoder struct {
+	packet []byte
+	services map[int]*cea708_service
+}
+
+func new_cea708_decoder() *cea708_decoder {
+	return &cea708_decoder{services: make(map[int]*cea708_service)}
+}
+
+func (d *cea708_decoder) tracks() []*Caption_track {
+	var numbers []int
+	for n := range d.services {
+		numbers = append(numbers, n)
+	}
+
+	sort.Ints(numbers)
+	var tracks []*Caption_track
+	for _, n := range numbers {
+		tracks = append(tracks, d.services[n].track)
+	}
+
+	return tracks
+}
+
+func (d *cea708_decoder) decode(start bool, data [2]byte, t time.Duration) {
+	if start {
+		d.decode_packet(t)
+		d.packet = d.packet[:0]
+	} else if len(d.packet) == 0 {
+		return // data without a packet start
+	}
+
+	d.packet = append(d.packet, data[0], data[1])
+	if d.packet_size() <= len(d.packet) {
+		d.decode_packet(t)
+		d.packet = d.packet[:0]
+	}
+}
+
+// packet_size returns the size of the current packet including its header.
+func (d *cea708_decoder) packet_size() int {
+	size_code := int(d.packet[0] & 0x3F)
+	if size_code == 0 {
+		return 128
+	}
+
+	return size_code * 2
+}
+
+func (d *cea708_decoder) decode_packet(t time.Duration) {
+	if len(d.packet) == 0 {
+		return
+	}
+
+	end := d.packet_size()
+	if end > len(d.packet) {
+		end = len(d.packet)
+	}
+
+	p := 1
+	for p < end {
+		service_number := int(d.packet[p] >> 5)
+		block_size := int(d.packet[p] & 0x1F)
+		p++
+		if service_number == 0 {
+			break // null block: padding
+		}
+
+		if service_number == 7 {
+			if p >= end {
+				break
+			}
+
+			service_number = int(d.packet[p] & 0x3F)
+			p++
+		}
+
+		if end - p < block_size {
+			break
+		}
+
+		s, ok := d.services[service_number]
+		if !ok {
+			s = &cea708_service{track: &Caption_track{Channel: fmt.Sprintf("SERVICE%d", service_number)}}
+			d.services[service_number] = s
+		}
+
+		s.decode_service_block(d.packet[p : p+block_size], t)
+		p += block_size
+	}
+}
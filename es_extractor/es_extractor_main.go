@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"github.com/maxutility2011/media_utils"
+)
+
+func main() {
+	inputPtr := flag.String("input", "", "Input MP4 file path (progressive or fragmented, with moov)")
+	initPtr := flag.String("init", "", "Init segment path, for media segments given as trailing arguments")
+	trackPtr := flag.Uint("track", 0, "Track ID to extract (default: the first track of -type)")
+	typePtr := flag.String("type", "video", "Track type to extract when -track is not given: video or audio")
+	outputPtr := flag.String("output", "", "Output elementary stream path (default: input name with .h264/.h265/.aac)")
+	flag.Parse()
+
+	if (*inputPtr == "") == (*initPtr == "") {
+		fmt.Printf("Either an input MP4 file or an init segment followed by media segments is required.\n")
+		os.Exit(1)
+	}
+
+	moovPath := *inputPtr
+	dataPaths := flag.Args()
+	if *inputPtr != "" {
+		dataPaths = append([]string{*inputPtr}, dataPaths...)
+	} else {
+		moovPath = *initPtr
+	}
+
+	moovData, err := os.ReadFile(moovPath)
+	if err != nil {
+		fmt.Printf("Error: Failed to read file: %s. Error: %v\n", moovPath, err)
+		os.Exit(1)
+	}
+
+	tracks, err := media_utils.GetTracks(moovData)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse tracks of %s. Error: %v\n", moovPath, err)
+		os.Exit(1)
+	}
+
+	handlerType := "vide"
+	if *typePtr == "audio" {
+		handlerType = "soun"
+	}
+
+	track, err := media_utils.FindTrack(tracks, uint32(*trackPtr), handlerType)
+	if err != nil {
+		fmt.Printf("Error: Failed to find the track to extract. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	outputPath := *outputPtr
+	if outputPath == "" {
+		outputPath = strings.TrimSuffix(moovPath, filepath.Ext(moovPath)) + media_utils.EsFileExtension(track)
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		fmt.Printf("Error: Failed to create output file: %s. Error: %v\n", outputPath, err)
+		os.Exit(1)
+	}
+
+	defer out.Close()
+
+	w := bufio.NewWriterSize(out, 1 << 20)
+	es, err := media_utils.NewEsWriter(track, w)
+	if err != nil {
+		fmt.Printf("Error: Cannot extract track %d (%s). Error: %v\n", track.Track_id, track.Codec, err)
+		os.Exit(1)
+	}
+
+	sampleCount := 0
+	for _, path := range dataPaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Error: Failed to read file: %s. Error: %v\n", path, err)
+			os.Exit(1)
+		}
+
+		var samples []media_utils.Mp4_sample
+		if path == *inputPtr {
+			samples, err = media_utils.GetTrackSamples(data, track)
+			if err != nil {
+				fmt.Printf("Error: Failed to read the sample table of %s. Error: %v\n", path, err)
+				os.Exit(1)
+			}
+		}
+
+		fragmentSamples, err := media_utils.GetFragmentSamples(data, tracks)
+		if err != nil {
+			fmt.Printf("Error: Failed to read the fragments of %s. Error: %v\n", path, err)
+			os.Exit(1)
+		}
+
+		samples = append(samples, fragmentSamples...)
+		for _, sample := range samples {
+			if sample.Track_id != track.Track_id {
+				continue
+			}
+
+			err = es.WriteSample(sample)
+			if err != nil {
+				fmt.Printf("Error: Failed to write sample at offset %d of %s. Error: %v\n", sample.Offset, path, err)
+				os.Exit(1)
+			}
+
+			sampleCount++
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		fmt.Printf("Error: Failed to write output file: %s. Error: %v\n", outputPath, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Extracted %d samples of track %d (%s) to %s\n", sampleCount, track.Track_id, track.Codec, outputPath)
+}
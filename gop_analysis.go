@@ -0,0 +1,117 @@
+package media_utils
+
+// Gop_info describes one GOP, from a key picture to the next one in decode order.
+type Gop_info struct {
+	Start_dts int64
+	Start_pts int64
+	Key_type string // "" if the samples ahead of the first key picture of a segment
+	Picture_count int
+	Duration uint64
+	Leading_pictures int // pictures after the key picture in decode order but before it in presentation order
+	Open bool // leading pictures reference the previous GOP
+	Sap_type uint8 // 1-3, 0 if the GOP does not start with a key picture
+	Picture_types string // e.g. "IBBPBBP"
+}
+
+// Sync_mismatch reports a sample whose container sync or dependency flags
+// disagree with its bitstream.
+type Sync_mismatch struct {
+	Sample_index int
+	Dts int64
+	Reason string
+}
+
+type Gop_report struct {
+	Sample_count int
+	Gops []Gop_info
+	Starts_with_key_picture bool
+	Starts_with_idr bool
+	Sap_type uint8 // of the first sample
+	Sync_mismatches []Sync_mismatch
+}
+
+func gop_sap_type(gop *Gop_info) uint8 {
+	switch {
+	case gop.Key_type == "":
+		return 0
+	case gop.Open:
+		return 3
+	case gop.Leading_pictures > 0:
+		return 2
+	}
+
+	return 1
+}
+
+// sample_depends_on returns sample_depends_on from the trun sample flags or,
+// without them, from the sdtp entry.
+func sample_depends_on(sample Mp4_sample) uint8 {
+	if depends_on := SampleDependsOn(sample.Flags); depends_on != 0 {
+		return depends_on
+	}
+
+	return sample.Sample_dependency >> 4 & 0x03
+}
+
+// AnalyzeGops builds the GOP structure of the samples of one segment, given
+// in decode order, and checks the sync and dependency flags of the samples
+// against the bitstream.
+func (a *Nal_analyzer) AnalyzeGops(samples []Mp4_sample) (Gop_report, error) {
+	report := Gop_report{Sample_count: len(samples)}
+	var gop *Gop_info
+	for i, sample := range samples {
+		pic, err := a.AnalyzeSample(sample)
+		if err != nil {
+			return report, err
+		}
+
+		if pic.Key_type != "" || gop == nil {
+			if gop != nil {
+				gop.Sap_type = gop_sap_type(gop)
+				report.Gops = append(report.Gops, *gop)
+			}
+
+			gop = &Gop_info{Start_dts: sample.Dts, Start_pts: sample.Pts, Key_type: pic.Key_type}
+		} else if sample.Pts < gop.Start_pts {
+			gop.Leading_pictures++
+			if pic.Is_rasl || (a.codec == es_codec_avc && gop.Key_type == "I") {
+				gop.Open = true
+			}
+		}
+
+		gop.Picture_count++
+		gop.Duration += uint64(sample.Duration)
+		if pic.Picture_type == "" {
+			gop.Picture_types += "?"
+		} else {
+			gop.Picture_types += pic.Picture_type
+		}
+
+		if i == 0 {
+			report.Starts_with_key_picture = pic.Key_type != ""
+			report.Starts_with_idr = pic.Key_type == "IDR"
+		}
+
+		key := pic.Key_type != ""
+		if sample.Is_sync && !key {
+			report.Sync_mismatches = append(report.Sync_mismatches, Sync_mismatch{Sample_index: i, Dts: sample.Dts, Reason: "flagged_sync_but_not_key_picture"})
+		} else if !sample.Is_sync && pic.Is_irap {
+			report.Sync_mismatches = append(report.Sync_mismatches, Sync_mismatch{Sample_index: i, Dts: sample.Dts, Reason: pic.Key_type + "_not_flagged_sync"})
+		}
+
+		depends_on := sample_depends_on(sample)
+		if depends_on == 2 && pic.Picture_type != "" && pic.Picture_type != "I" {
+			report.Sync_mismatches = append(report.Sync_mismatches, Sync_mismatch{Sample_index: i, Dts: sample.Dts, Reason: "flagged_independent_but_" + pic.Picture_type + "_picture"})
+		} else if depends_on == 1 && pic.Is_irap {
+			report.Sync_mismatches = append(report.Sync_mismatches, Sync_mismatch{Sample_index: i, Dts: sample.Dts, Reason: "flagged_dependent_but_" + pic.Key_type})
+		}
+	}
+
+	if gop != nil {
+		gop.Sap_type = gop_sap_type(gop)
+		report.Gops = append(report.Gops, *gop)
+		report.Sap_type = report.Gops[0].Sap_type
+	}
+
+	return report, nil
+}
@@ -0,0 +1,158 @@
+package media_utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+// H.264 slices of each type, first_mb_in_slice 0
+var gop_test_idr = []byte{0x65, 0x88}
+var gop_test_i = []byte{0x41, 0x88}
+var gop_test_p = []byte{0x41, 0x9A}
+var gop_test_b = []byte{0x01, 0x9E}
+
+// A recovery point SEI, which makes an H.264 I picture a key picture
+var gop_test_recovery_point = []byte{0x06, Sei_recovery_point, 1, 0x80, 0x80}
+
+// gop_test_sample returns a sample of the mux_test_tracks video track
+// decoded at frame dts and presented at frame pts.
+func gop_test_sample(dts int64, pts int64, is_sync bool, nalus ...[]byte) Mp4_sample {
+	s := es_test_sample(is_sync, nalus...)
+	s.Dts, s.Pts, s.Duration = dts * 3000, pts * 3000, 3000
+	return s
+}
+
+func gop_test_report(t *testing.T, samples ...Mp4_sample) Gop_report {
+	t.Helper()
+	a, err := NewNalAnalyzer(mux_test_tracks(48000)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := a.AnalyzeGops(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return report
+}
+
+func TestAnalyzeGopsClosed(t *testing.T) {
+	report := gop_test_report(t,
+		gop_test_sample(0, 0, true, gop_test_idr),
+		gop_test_sample(1, 1, false, gop_test_p),
+		gop_test_sample(2, 2, false, gop_test_p),
+		gop_test_sample(3, 3, true, gop_test_idr),
+		gop_test_sample(4, 4, false, gop_test_p))
+
+	want := []Gop_info{
+		{Start_dts: 0, Start_pts: 0, Key_type: "IDR", Picture_count: 3, Duration: 9000, Sap_type: 1, Picture_types: "IPP"},
+		{Start_dts: 9000, Start_pts: 9000, Key_type: "IDR", Picture_count: 2, Duration: 6000, Sap_type: 1, Picture_types: "IP"},
+	}
+
+	if !reflect.DeepEqual(report.Gops, want) || report.Sample_count != 5 || !report.Starts_with_idr || report.Sap_type != 1 || len(report.Sync_mismatches) != 0 {
+		t.Errorf("report %+v", report)
+	}
+
+	// Leading pictures decodable from the IDR
+	report = gop_test_report(t,
+		gop_test_sample(0, 2, true, gop_test_idr),
+		gop_test_sample(1, 0, false, gop_test_b),
+		gop_test_sample(2, 1, false, gop_test_b),
+		gop_test_sample(3, 4, false, gop_test_p),
+		gop_test_sample(4, 3, false, gop_test_b))
+	if len(report.Gops) != 1 || report.Gops[0].Leading_pictures != 2 || report.Gops[0].Open || report.Gops[0].Sap_type != 2 || report.Gops[0].Picture_types != "IBBPB" {
+		t.Errorf("report %+v", report)
+	}
+}
+
+func TestAnalyzeGopsOpen(t *testing.T) {
+	// An I picture with a recovery point whose B pictures reference the
+	// previous GOP, starting a segment after a P picture
+	report := gop_test_report(t,
+		gop_test_sample(0, 0, false, gop_test_p),
+		gop_test_sample(1, 3, true, gop_test_recovery_point, gop_test_i),
+		gop_test_sample(2, 1, false, gop_test_b),
+		gop_test_sample(3, 2, false, gop_test_b))
+
+	want := []Gop_info{
+		{Start_dts: 0, Start_pts: 0, Picture_count: 1, Duration: 3000, Sap_type: 0, Picture_types: "P"},
+		{Start_dts: 3000, Start_pts: 9000, Key_type: "I", Picture_count: 3, Duration: 9000, Leading_pictures: 2, Open: true, Sap_type: 3, Picture_types: "IBB"},
+	}
+
+	if !reflect.DeepEqual(report.Gops, want) || report.Starts_with_key_picture || report.Starts_with_idr || report.Sap_type != 0 {
+		t.Errorf("report %+v", report)
+	}
+
+	// HEVC CRA: RASL pictures make the GOP open, RADL pictures do not
+	a, err := NewNalAnalyzer(Track_info{Track_id: 1, Codec: "hvc1", Hvcc: &Hvcc_config{Nal_length_size: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cra := []byte{21 << 1, 1, 0x80}
+	rasl := []byte{8 << 1, 1, 0x80}
+	radl := []byte{7 << 1, 1, 0x80}
+	for _, tc := range []struct {
+		leading []byte
+		sap_type uint8
+	}{{rasl, 3}, {radl, 2}} {
+		report, err = a.AnalyzeGops([]Mp4_sample{gop_test_sample(0, 1, true, cra), gop_test_sample(1, 0, false, tc.leading)})
+		if err != nil || len(report.Gops) != 1 || report.Gops[0].Key_type != "CRA" || report.Gops[0].Leading_pictures != 1 || report.Sap_type != tc.sap_type {
+			t.Errorf("leading NAL type %d: %+v %v", tc.leading[0] >> 1, report, err)
+		}
+	}
+}
+
+func TestAnalyzeGopsSyncMismatches(t *testing.T) {
+	p := gop_test_sample(1, 1, true, gop_test_p)
+	p.Flags = 2 << 24 // sample_depends_on: independent
+	report := gop_test_report(t, gop_test_sample(0, 0, false, gop_test_idr), p)
+	want := []Sync_mismatch{
+		{Sample_index: 0, Dts: 0, Reason: "IDR_not_flagged_sync"},
+		{Sample_index: 1, Dts: 3000, Reason: "flagged_sync_but_not_key_picture"},
+		{Sample_index: 1, Dts: 3000, Reason: "flagged_independent_but_P_picture"},
+	}
+
+	if !reflect.DeepEqual(report.Sync_mismatches, want) {
+		t.Errorf("sync mismatches %+v", report.Sync_mismatches)
+	}
+}
+
+// FuzzAnalyzeGops checks that the GOPs of a video track hold all its samples.
+func FuzzAnalyzeGops(f *testing.F) {
+	f.Add(fuzz_init(), fuzz_segment())
+	f.Fuzz(func(t *testing.T, init_data []byte, seg_data []byte) {
+		tracks, samples := fuzz_samples(init_data, seg_data)
+		for _, track := range tracks {
+			a, err := NewNalAnalyzer(track)
+			if err != nil {
+				continue
+			}
+
+			var track_samples []Mp4_sample
+			for _, sample := range samples {
+				if sample.Track_id == track.Track_id {
+					track_samples = append(track_samples, sample)
+				}
+			}
+
+			report, err := a.AnalyzeGops(track_samples)
+			if err != nil {
+				continue
+			}
+
+			pictures := 0
+			for _, gop := range report.Gops {
+				pictures += gop.Picture_count
+				if gop.Sap_type > 3 || len(gop.Picture_types) != gop.Picture_count {
+					t.Fatalf("GOP %+v", gop)
+				}
+			}
+
+			if pictures != report.Sample_count || report.Sample_count != len(track_samples) {
+				t.Fatalf("%d pictures in the GOPs of %d samples", pictures, report.Sample_count)
+			}
+		}
+	})
+}
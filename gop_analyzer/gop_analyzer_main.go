@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"github.com/maxutility2011/media_utils"
+)
+
+func printReport(name string, report media_utils.Gop_report, timescale uint32) {
+	fmt.Printf("%s: samples=%d gops=%d starts_with_key_picture=%v starts_with_idr=%v sap_type=%d\n",
+		name, report.Sample_count, len(report.Gops), report.Starts_with_key_picture, report.Starts_with_idr, report.Sap_type)
+
+	for _, gop := range report.Gops {
+		keyType := gop.Key_type
+		if keyType == "" {
+			keyType = "none"
+		}
+
+		closed := "closed"
+		if gop.Open {
+			closed = "open"
+		}
+
+		fmt.Printf("  gop dts=%d pts=%d key=%s pictures=%d duration=%.3fs leading=%d %s sap_type=%d %s\n",
+			gop.Start_dts, gop.Start_pts, keyType, gop.Picture_count, float64(gop.Duration) / float64(timescale),
+			gop.Leading_pictures, closed, gop.Sap_type, gop.Picture_types)
+	}
+
+	for _, m := range report.Sync_mismatches {
+		fmt.Printf("  mismatch sample=%d dts=%d %s\n", m.Sample_index, m.Dts, m.Reason)
+	}
+}
+
+func main() {
+	inputPtr := flag.String("input", "", "Input MP4 file path (progressive or fragmented, with moov)")
+	initPtr := flag.String("init", "", "Init segment path, for media segments given as trailing arguments")
+	trackPtr := flag.Uint("track", 0, "Track ID to analyze (default: the first video track)")
+	naluPtr := flag.Bool("nalus", false, "Print the NAL units of every sample")
+	flag.Parse()
+
+	if (*inputPtr == "") == (*initPtr == "") {
+		fmt.Printf("Either an input MP4 file or an init segment followed by media segments is required.\n")
+		os.Exit(1)
+	}
+
+	moovPath := *inputPtr
+	dataPaths := flag.Args()
+	if *inputPtr != "" {
+		dataPaths = append([]string{*inputPtr}, dataPaths...)
+	} else {
+		moovPath = *initPtr
+	}
+
+	moovData, err := os.ReadFile(moovPath)
+	if err != nil {
+		fmt.Printf("Error: Failed to read file: %s. Error: %v\n", moovPath, err)
+		os.Exit(1)
+	}
+
+	tracks, err := media_utils.GetTracks(moovData)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse tracks of %s. Error: %v\n", moovPath, err)
+		os.Exit(1)
+	}
+
+	track, err := media_utils.FindTrack(tracks, uint32(*trackPtr), "vide")
+	if err != nil {
+		fmt.Printf("Error: Failed to find the track to analyze. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	analyzer, err := media_utils.NewNalAnalyzer(track)
+	if err != nil {
+		fmt.Printf("Error: Cannot analyze track %d (%s). Error: %v\n", track.Track_id, track.Codec, err)
+		os.Exit(1)
+	}
+
+	for _, path := range dataPaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Error: Failed to read file: %s. Error: %v\n", path, err)
+			os.Exit(1)
+		}
+
+		var samples []media_utils.Mp4_sample
+		if path == *inputPtr {
+			samples, err = media_utils.GetTrackSamples(data, track)
+			if err != nil {
+				fmt.Printf("Error: Failed to read the sample table of %s. Error: %v\n", path, err)
+				os.Exit(1)
+			}
+		}
+
+		fragmentSamples, err := media_utils.GetFragmentSamples(data, tracks)
+		if err != nil {
+			fmt.Printf("Error: Failed to read the fragments of %s. Error: %v\n", path, err)
+			os.Exit(1)
+		}
+
+		samples = append(samples, fragmentSamples...)
+		var trackSamples []media_utils.Mp4_sample
+		for _, sample := range samples {
+			if sample.Track_id == track.Track_id {
+				trackSamples = append(trackSamples, sample)
+			}
+		}
+
+		if *naluPtr {
+			for i, sample := range trackSamples {
+				pic, err := analyzer.AnalyzeSample(sample)
+				if err != nil {
+					fmt.Printf("Error: Failed to parse sample %d of %s. Error: %v\n", i, path, err)
+					os.Exit(1)
+				}
+
+				fmt.Printf("sample=%d dts=%d pts=%d sync=%v type=%s key=%s", i, sample.Dts, sample.Pts, sample.Is_sync, pic.Picture_type, pic.Key_type)
+				for _, nalu := range pic.Nal_units {
+					fmt.Printf(" %s", nalu.Type_name)
+					if nalu.Slice_type != "" {
+						fmt.Printf("(%s)", nalu.Slice_type)
+					}
+
+					for _, m := range nalu.Sei_messages {
+						fmt.Printf("[sei %d]", m.Payload_type)
+					}
+				}
+
+				fmt.Printf("\n")
+			}
+		}
+
+		report, err := analyzer.AnalyzeGops(trackSamples)
+		if err != nil {
+			fmt.Printf("Error: Failed to analyze %s. Error: %v\n", path, err)
+			os.Exit(1)
+		}
+
+		printReport(path, report, track.Timescale)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"github.com/maxutility2011/media_utils"
+)
+
+func main() {
+	inputPtr := flag.String("input", "", "Init segment or MP4 file path")
+	trackPtr := flag.Uint("track", 0, "Video track ID (default: the first video track)")
+	videoRangePtr := flag.String("video_range", "", "Expected VIDEO-RANGE from the master playlist (SDR, PQ or HLG)")
+	codecsPtr := flag.String("codecs", "", "CODECS (and SUPPLEMENTAL-CODECS) from the master playlist, to check the Dolby Vision codec string against")
+	segmentPtr := flag.String("segment", "", "Media segment of an init segment input, whose first samples are searched for an alternative transfer characteristics SEI")
+	flag.Parse()
+
+	if *inputPtr == "" {
+		fmt.Printf("Input file path is required.\n")
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(*inputPtr)
+	if err != nil {
+		fmt.Printf("Error: Failed to read file: %s. Error: %v\n", *inputPtr, err)
+		os.Exit(1)
+	}
+
+	tracks, err := media_utils.GetTracks(data)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse tracks of %s. Error: %v\n", *inputPtr, err)
+		os.Exit(1)
+	}
+
+	track, err := media_utils.FindTrack(tracks, uint32(*trackPtr), "vide")
+	if err != nil {
+		fmt.Printf("Error: Failed to find the video track. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The first samples, for the alternative transfer characteristics SEI
+	var samples []media_utils.Mp4_sample
+	if *segmentPtr != "" {
+		seg_data, err := os.ReadFile(*segmentPtr)
+		if err != nil {
+			fmt.Printf("Error: Failed to read file: %s. Error: %v\n", *segmentPtr, err)
+			os.Exit(1)
+		}
+
+		samples, err = media_utils.GetFragmentSamples(seg_data, tracks)
+		if err != nil {
+			fmt.Printf("Error: Failed to parse the samples of %s. Error: %v\n", *segmentPtr, err)
+			os.Exit(1)
+		}
+	} else {
+		samples, _ = media_utils.GetTrackSamples(data, track)
+	}
+
+	info, err := media_utils.GetHdrInfo(track, samples[:min(len(samples), 10)]...)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse the colour boxes of track %d. Error: %v\n", track.Track_id, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Track %d (%s)\n", track.Track_id, track.Codec)
+	if info.Colr != nil {
+		if info.Colr.Icc_profile != nil {
+			fmt.Printf("colr: %s, %d bytes ICC profile\n", info.Colr.Colour_type, len(info.Colr.Icc_profile))
+		} else {
+			fmt.Printf("colr: %s, primaries=%d transfer=%d matrix=%d full_range=%v\n", info.Colr.Colour_type,
+				info.Colr.Colour_primaries, info.Colr.Transfer_characteristics, info.Colr.Matrix_coefficients, info.Colr.Full_range)
+		}
+	}
+
+	if colr := info.Sps_colour; colr != nil {
+		fmt.Printf("SPS VUI: primaries=%d transfer=%d matrix=%d full_range=%v\n", colr.Colour_primaries, colr.Transfer_characteristics, colr.Matrix_coefficients, colr.Full_range)
+	}
+
+	if info.Alternative_transfer != 0 {
+		fmt.Printf("Alternative transfer characteristics SEI: preferred transfer=%d\n", info.Alternative_transfer)
+	}
+
+	if info.Mdcv != nil {
+		p := info.Mdcv.Display_primaries
+		fmt.Printf("mdcv: G(%.4f,%.4f) B(%.4f,%.4f) R(%.4f,%.4f) WP(%.4f,%.4f) luminance %.4f-%.1f cd/m2\n",
+			float64(p[0][0]) * 0.00002, float64(p[0][1]) * 0.00002, float64(p[1][0]) * 0.00002, float64(p[1][1]) * 0.00002,
+			float64(p[2][0]) * 0.00002, float64(p[2][1]) * 0.00002,
+			float64(info.Mdcv.White_point[0]) * 0.00002, float64(info.Mdcv.White_point[1]) * 0.00002,
+			info.Mdcv.MinLuminance(), info.Mdcv.MaxLuminance())
+	}
+
+	if info.Clli != nil {
+		fmt.Printf("clli: MaxCLL=%d MaxFALL=%d\n", info.Clli.Max_content_light_level, info.Clli.Max_pic_average_light_level)
+	}
+
+	if dv := info.Dolby_vision; dv != nil {
+		fmt.Printf("%s: version %d.%d profile=%d level=%d rpu=%v el=%v bl=%v bl_compatibility_id=%d\n", dv.Box_type,
+			dv.Version_major, dv.Version_minor, dv.Profile, dv.Level, dv.Rpu_present, dv.El_present, dv.Bl_present, dv.Bl_signal_compatibility_id)
+		fmt.Printf("Dolby Vision codec: %s", info.Dolby_vision_codec)
+		if info.Supplemental_brand != "" {
+			fmt.Printf(" (SUPPLEMENTAL-CODECS %s/%s)", info.Dolby_vision_codec, info.Supplemental_brand)
+		}
+
+		fmt.Printf("\n")
+	}
+
+	fmt.Printf("VIDEO-RANGE: %s\n", info.Video_range)
+
+	ok := true
+	if *videoRangePtr != "" && *videoRangePtr != info.Video_range {
+		fmt.Printf("Mismatch: playlist VIDEO-RANGE=%s, stream is %s\n", *videoRangePtr, info.Video_range)
+		ok = false
+	}
+
+	if *codecsPtr != "" && info.Dolby_vision_codec != "" && !strings.Contains(*codecsPtr, info.Dolby_vision_codec) {
+		fmt.Printf("Mismatch: playlist codecs %s do not include %s\n", *codecsPtr, info.Dolby_vision_codec)
+		ok = false
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
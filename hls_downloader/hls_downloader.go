@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"net/http"
 	"encoding/json"
+	"github.com/maxutility2011/media_utils"
 )
 
 type Rendition struct {
@@ -27,6 +28,16 @@ type Rendition struct {
 	Closed_captions string
 }
 
+// Scte35Marker is a SCTE-35 splice_info_section carried in an EXT-X-DATERANGE
+// SCTE35-CMD, SCTE35-OUT or SCTE35-IN attribute of a media playlist.
+type Scte35Marker struct {
+	Playlist string
+	Id string
+	Start_date string
+	Attribute string
+	Splice_info media_utils.Splice_info_section
+}
+
 type Media struct {
 	Type string
 	Uri string
@@ -87,10 +98,69 @@ func downloadObject(urlStr string, dstFolder string) ([]byte, string, error) {
     return data, local_path, err
 }
 
+// parseAttributeList splits the attribute list of a playlist tag into
+// key/value pairs. Quoted values are returned without the quotes.
+func parseAttributeList(line string) map[string]string {
+	attributes := make(map[string]string)
+	posColon := strings.Index(line, ":")
+	if posColon < 0 {
+		return attributes
+	}
+
+	var key string
+	start := posColon + 1
+	inQuotes := false
+	for i := posColon + 1; i <= len(line); i++ {
+		if i == len(line) || (line[i] == ',' && !inQuotes) {
+			if key != "" {
+				attributes[key] = strings.Trim(line[start:i], "\"")
+			}
+
+			key = ""
+			start = i + 1
+		} else if line[i] == '"' {
+			inQuotes = !inQuotes
+		} else if line[i] == '=' && !inQuotes && key == "" {
+			key = strings.TrimSpace(line[start:i])
+			start = i + 1
+		}
+	}
+
+	return attributes
+}
+
+func parseScte35Markers(playlistUrl string, data []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "#EXT-X-DATERANGE") {
+			continue
+		}
+
+		attributes := parseAttributeList(line)
+		for _, attr := range []string{"SCTE35-CMD", "SCTE35-OUT", "SCTE35-IN"} {
+			val, ok := attributes[attr]
+			if !ok {
+				continue
+			}
+
+			sis, err := media_utils.ParseSpliceInfoSectionHex(val)
+			if err != nil {
+				fmt.Printf("Failed to decode %s of DATERANGE %s. Error: %v\n", attr, attributes["ID"], err)
+				continue
+			}
+
+			fmt.Printf("DATERANGE %s %s: splice_command_type: %d, descriptors: %d\n", attributes["ID"], attr, sis.Splice_command_type, len(sis.Descriptors))
+			scte35Markers = append(scte35Markers, Scte35Marker{Playlist: playlistUrl, Id: attributes["ID"], Start_date: attributes["START-DATE"], Attribute: attr, Splice_info: sis})
+		}
+	}
+}
+
 func parseVarPlaylistData(varPlaylistUrl string, data []byte, dstFolder string) error {
 	var err error
+	parseScte35Markers(varPlaylistUrl, data)
 	if !downloadSegments {
-		fmt.Println("Flag downloadSegments not set. Don't download segments\n")
+		fmt.Println("Flag downloadSegments not set. Don't download segments")
 		return nil
 	}
 
@@ -164,8 +234,9 @@ func parseVarPlaylistData(varPlaylistUrl string, data []byte, dstFolder string)
 
 func parseMediaPlaylistData(mediaPlaylistUrl string, data []byte, dstFolder string) error {
 	var err error
+	parseScte35Markers(mediaPlaylistUrl, data)
 	if !downloadSegments {
-		fmt.Println("Flag downloadSegments not set. Don't download segments\n")
+		fmt.Println("Flag downloadSegments not set. Don't download segments")
 		return nil
 	}
 
@@ -502,12 +573,33 @@ func dumpRenditionInfo() {
 	fmt.Println("JSON data written to renditions.json")
 }
 
+func dumpScte35Markers() {
+	if len(scte35Markers) == 0 {
+		return
+	}
+
+	mBytes, err := json.MarshalIndent(scte35Markers, "", "  ")
+	if err != nil {
+		fmt.Println("Error marshaling JSON:", err)
+		return
+	}
+
+	err = os.WriteFile("scte35.json", mBytes, 0644)
+	if err != nil {
+		fmt.Println("Error writing file:", err)
+		return
+	}
+
+	fmt.Println("SCTE-35 markers written to scte35.json")
+}
+
 var working_directory string
 var input_playlist_local_path string
 var isVariantPlaylist bool = false
 var masterPlaylistBaseUrl string
 var renditionTable = make(map[string]Rendition)
 var mediaTable = make(map[string]Media)
+var scte35Markers []Scte35Marker
 var downloadSegments bool = false
 var outputRenditionInfo bool = false
 var keepSegmentStructure bool = true
@@ -593,4 +685,6 @@ func main() {
 	} else {
 		parseVarPlaylistData(*playlistPtr, downloadedData, working_directory)
 	}
+
+	dumpScte35Markers()
 }
\ No newline at end of file
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"github.com/maxutility2011/media_utils"
+)
+
+func TestParseScte35Markers(t *testing.T) {
+	scte35Markers = nil
+	playlist := "#EXTM3U\n" +
+		"#EXT-X-TARGETDURATION:6\n" +
+		"#EXT-X-PROGRAM-DATE-TIME:2026-01-01T00:00:00Z\n" +
+		`#EXT-X-DATERANGE:ID="splice-6FFFFFF0",CLASS="a,b",START-DATE="2026-01-01T00:00:06Z",PLANNED-DURATION=60.6,SCTE35-OUT=0xFC302F000000000000FFFFF014054800008F7FEFFE7369C02EFE0052CCF500000000000A0008435545490000013562DBA30A` + "\n" +
+		"#EXTINF:6.0,\n" +
+		"seg1.ts\n" +
+		// A section that does not decode is skipped
+		`#EXT-X-DATERANGE:ID="splice-6FFFFFF0",START-DATE="2026-01-01T00:01:06Z",SCTE35-IN=0xFC30` + "\n"
+	parseScte35Markers("http://example.com/video.m3u8", []byte(playlist))
+
+	if len(scte35Markers) != 1 {
+		t.Fatalf("%d markers", len(scte35Markers))
+	}
+
+	m := scte35Markers[0]
+	if m.Playlist != "http://example.com/video.m3u8" || m.Id != "splice-6FFFFFF0" || m.Start_date != "2026-01-01T00:00:06Z" || m.Attribute != "SCTE35-OUT" {
+		t.Errorf("marker %+v", m)
+	}
+
+	si := m.Splice_info.Splice_insert
+	if m.Splice_info.Splice_command_type != media_utils.Splice_insert_command || si == nil || si.Splice_event_id != 0x4800008F || !si.Out_of_network_indicator {
+		t.Errorf("splice_insert %+v", si)
+	}
+}
@@ -0,0 +1,181 @@
+package media_utils
+
+import (
+	"strings"
+	"unicode/utf16"
+)
+
+type Id3_frame struct {
+	Id string
+	Flags uint16
+	Description string // TXXX description or PRIV owner identifier
+	Text string // Decoded value of text (T***) and URL (W***) frames
+	Data []byte // Raw frame payload
+}
+
+type Id3_tag struct {
+	Version uint8
+	Revision uint8
+	Flags uint8
+	Frames []Id3_frame
+}
+
+func get_syncsafe_uint32(p uint32, d []byte) uint32 {
+	return uint32(d[p] & 0x7F) << 21 | uint32(d[p+1] & 0x7F) << 14 | uint32(d[p+2] & 0x7F) << 7 | uint32(d[p+3] & 0x7F)
+}
+
+// decode_id3_text converts an ID3v2 encoded string to UTF-8.
+// Encodings: 0 = ISO-8859-1, 1 = UTF-16 with BOM, 2 = UTF-16BE, 3 = UTF-8.
+func decode_id3_text(encoding byte, d []byte) string {
+	switch encoding {
+	case 0:
+		runes := make([]rune, len(d))
+		for i, c := range d {
+			runes[i] = rune(c)
+		}
+
+		return strings.TrimRight(string(runes), "\x00")
+	case 1, 2:
+		big_endian := true
+		if encoding == 1 && len(d) >= 2 {
+			if d[0] == 0xFF && d[1] == 0xFE {
+				big_endian = false
+				d = d[2:]
+			} else if d[0] == 0xFE && d[1] == 0xFF {
+				d = d[2:]
+			}
+		}
+
+		units := make([]uint16, 0, len(d) / 2)
+		for i := 0; i + 1 < len(d); i += 2 {
+			if big_endian {
+				units = append(units, uint16(d[i]) << 8 | uint16(d[i+1]))
+			} else {
+				units = append(units, uint16(d[i+1]) << 8 | uint16(d[i]))
+			}
+		}
+
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	default:
+		return strings.TrimRight(string(d), "\x00")
+	}
+}
+
+// split_id3_terminated splits d at the first string terminator of the given
+// encoding (one zero byte, or two aligned zero bytes for UTF-16).
+func split_id3_terminated(encoding byte, d []byte) ([]byte, []byte) {
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i + 1 < len(d); i += 2 {
+			if d[i] == 0 && d[i+1] == 0 {
+				return d[:i], d[i+2:]
+			}
+		}
+
+		return d, nil
+	}
+
+	for i, c := range d {
+		if c == 0 {
+			return d[:i], d[i+1:]
+		}
+	}
+
+	return d, nil
+}
+
+func parse_id3_frame(id string, flags uint16, payload []byte) Id3_frame {
+	frame := Id3_frame{Id: id, Flags: flags, Data: payload}
+	if len(payload) == 0 {
+		return frame
+	}
+
+	if id == "PRIV" {
+		owner, _ := split_id3_terminated(0, payload)
+		frame.Description = string(owner)
+	} else if id == "TXXX" || id == "WXXX" {
+		encoding := payload[0]
+		desc, value := split_id3_terminated(encoding, payload[1:])
+		frame.Description = decode_id3_text(encoding, desc)
+		if id == "TXXX" {
+			frame.Text = decode_id3_text(encoding, value)
+		} else {
+			frame.Text = decode_id3_text(0, value)
+		}
+	} else if id[0] == 'T' {
+		frame.Text = decode_id3_text(payload[0], payload[1:])
+	} else if id[0] == 'W' {
+		frame.Text = decode_id3_text(0, payload)
+	}
+
+	return frame
+}
+
+// ParseId3 decodes an ID3v2.3 or ID3v2.4 tag, such as the message_data of
+// an emsg box with scheme "https://aomedia.org/emsg/ID3".
+func ParseId3(data []byte) (Id3_tag, error) {
+	var tag Id3_tag
+	if len(data) < 10 || string(data[0:3]) != "ID3" {
+		return tag, parse_error(ErrInvalidData, "invalid_id3_header", 0, "")
+	}
+
+	tag.Version = data[3]
+	tag.Revision = data[4]
+	tag.Flags = data[5]
+	if tag.Version != 3 && tag.Version != 4 {
+		return tag, parse_error(ErrUnsupportedVersion, "unsupported_id3_version", 3, "")
+	}
+
+	tag_size := get_syncsafe_uint32(6, data)
+	if uint64(tag_size) + 10 > uint64(len(data)) {
+		return tag, parse_error(ErrTruncated, "incomplete_id3_tag", 6, "")
+	}
+
+	p := uint32(10)
+	end := tag_size + 10
+
+	// Skip the extended header
+	if tag.Flags & 0x40 != 0 {
+		if end - p < 4 {
+			return tag, parse_error(ErrTruncated, "incomplete_id3_extended_header", uint64(p), "")
+		}
+
+		var ext_size uint32
+		if tag.Version == 4 {
+			ext_size = get_syncsafe_uint32(p, data)
+		} else {
+			ext_size = get_uint32(p, data) + 4
+		}
+
+		if ext_size > end - p {
+			return tag, parse_error(ErrTruncated, "incomplete_id3_extended_header", uint64(p), "")
+		}
+
+		p += ext_size
+	}
+
+	for end - p >= 10 {
+		// Padding
+		if data[p] == 0 {
+			break
+		}
+
+		id := string(data[p : p+4])
+		var frame_size uint32
+		if tag.Version == 4 {
+			frame_size = get_syncsafe_uint32(p + 4, data)
+		} else {
+			frame_size = get_uint32(p + 4, data)
+		}
+
+		flags := get_uint16(p + 8, data)
+		p += 10
+		if frame_size > end - p {
+			return tag, parse_error(ErrTruncated, "incomplete_id3_frame", uint64(p - 10), "")
+		}
+
+		tag.Frames = append(tag.Frames, parse_id3_frame(id, flags, data[p : p+frame_size]))
+		p += frame_size
+	}
+
+	return tag, nil
+}
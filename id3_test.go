@@ -0,0 +1,25 @@
+package media_utils
+
+import (
+	"testing"
+)
+
+// FuzzParseId3 checks that the frames of a tag lie within the tag.
+func FuzzParseId3(f *testing.F) {
+	f.Add([]byte("ID3\x04\x00\x00\x00\x00\x00\x10PRIV\x00\x00\x00\x06\x00\x00a\x00bcde"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tag, err := ParseId3(data)
+		if err != nil {
+			return
+		}
+
+		size := 0
+		for _, frame := range tag.Frames {
+			size += 10 + len(frame.Data)
+		}
+
+		if size > len(data) {
+			t.Fatalf("%d bytes of frames in %d bytes", size, len(data))
+		}
+	})
+}
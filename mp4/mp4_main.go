@@ -0,0 +1,1097 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"github.com/maxutility2011/media_utils"
+)
+
+const usage = `Usage: mp4 <command> [flags] [file]
+
+Commands:
+  dump      print the box tree with offsets and decoded fields
+  info      summarize tracks, codecs and durations
+  samples   list the timing, size and offset of every sample
+  set-tfdt  rewrite baseMediaDecodeTime of the first tfdt to an output file
+  diff      compare the box trees of two files (exit status 1 if they differ)
+  framehash hash every sample, like ffmpeg framemd5, of a file or of an init
+            segment (-init) and its media segments
+  timeline  check the decode time continuity of the media segments of an
+            init segment (-init) (exit status 1 on discontinuities)
+  subtitles extract a wvtt or stpp track to a WebVTT or TTML file, from a
+            file or from an init segment (-init) and its media segments
+  srt       extract a tx3g or QuickTime text track of a file to SubRip
+  chapters  print the chapters (chapter track or Nero chpl) of a file as JSON
+  metadata  print the iTunes (ilst) and QuickTime udta metadata of a file, or
+            set and remove entries and write the file to -output
+  fragment  remux a progressive file to fragmented MP4: a single file, or an
+            init segment and media segments in a directory (-output-dir)
+  parts     split a media segment of an init segment (-init) into LL-HLS
+            parts (CMAF chunks) and print their EXT-X-PART tags
+  repair    repair a truncated or corrupted media segment to -output and
+            report the dropped boxes and lost samples
+  cmaf      check a CMAF header and its media segments against the CMAF
+            structural constraints (exit status 1 if a check fails)
+
+The input is read from stdin if the file is omitted or "-".
+Run "mp4 <command> -h" for the flags of a command.
+`
+
+// readInput reads the file at path, or stdin for "" and "-".
+func readInput(path string) ([]byte, error) {
+	if path == "" || path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+
+	return os.ReadFile(path)
+}
+
+func inputName(path string) string {
+	if path == "" || path == "-" {
+		return "stdin"
+	}
+
+	return path
+}
+
+func writeJson(v any) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Printf("Error: Failed to marshal JSON. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(string(out))
+}
+
+// parseFlags parses the flags of a command and reads its input file.
+func parseFlags(fs *flag.FlagSet, args []string) []byte {
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fmt.Printf("Error: Only one input file is accepted.\n")
+		os.Exit(1)
+	}
+
+	data, err := readInput(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(fs.Arg(0)), err)
+		os.Exit(1)
+	}
+
+	return data
+}
+
+func dump(args []string) {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	jsonPtr := fs.Bool("json", false, "Print the box tree as JSON")
+	data := parseFlags(fs, args)
+
+	// A truncated file still dumps the boxes parsed before the error
+	boxes, parseErr := media_utils.ParseBoxes(data)
+	infos := media_utils.DescribeBoxes(boxes)
+	if *jsonPtr {
+		writeJson(infos)
+	} else {
+		media_utils.WriteBoxTree(os.Stdout, infos)
+	}
+
+	if parseErr != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", parseErr)
+		os.Exit(1)
+	}
+}
+
+type trackSummary struct {
+	Track_id uint32
+	Handler_type string
+	Codec string
+	Width uint16
+	Height uint16
+	Channel_count uint16
+	Sample_rate uint32
+	Language string
+	Timescale uint32
+	Duration uint64
+	Duration_seconds float64
+	Sample_count int
+	Video_range string
+}
+
+// trackSamples returns the samples of the sample tables and the fragments in data.
+func trackSamples(data []byte, tracks []media_utils.Track_info) ([]media_utils.Mp4_sample, error) {
+	var samples []media_utils.Mp4_sample
+	for _, track := range tracks {
+		s, err := media_utils.GetTrackSamples(data, track)
+		if err != nil {
+			return nil, err
+		}
+
+		samples = append(samples, s...)
+	}
+
+	s, err := media_utils.GetFragmentSamples(data, tracks)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(samples, s...), nil
+}
+
+func info(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	jsonPtr := fs.Bool("json", false, "Print the summary as JSON")
+	data := parseFlags(fs, args)
+
+	tracks, err := media_utils.GetTracks(data)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse tracks. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	samples, err := trackSamples(data, tracks)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse samples. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var summaries []trackSummary
+	for _, track := range tracks {
+		s := trackSummary{Track_id: track.Track_id, Handler_type: track.Handler_type, Codec: track.CodecString(), Width: track.Width, Height: track.Height,
+			Channel_count: track.Channel_count, Sample_rate: track.Sample_rate, Language: track.Language, Timescale: track.Timescale, Duration: track.Duration}
+
+		// Fragmented files have no duration in mdhd: sum the fragment samples
+		fragmentDuration := uint64(0)
+		for _, sample := range samples {
+			if sample.Track_id == track.Track_id {
+				s.Sample_count++
+				fragmentDuration += uint64(sample.Duration)
+			}
+		}
+
+		if s.Duration == 0 {
+			s.Duration = fragmentDuration
+		}
+
+		if track.Timescale != 0 {
+			s.Duration_seconds = float64(s.Duration) / float64(track.Timescale)
+		}
+
+		if track.Handler_type == "vide" {
+			if hdr, err := media_utils.GetHdrInfo(track); err == nil {
+				s.Video_range = hdr.Video_range
+			}
+		}
+
+		summaries = append(summaries, s)
+	}
+
+	if *jsonPtr {
+		writeJson(summaries)
+		return
+	}
+
+	for _, s := range summaries {
+		fmt.Printf("Track %d: %s %s", s.Track_id, s.Handler_type, s.Codec)
+		if s.Width != 0 {
+			fmt.Printf(" %dx%d", s.Width, s.Height)
+		}
+
+		if s.Video_range != "" {
+			fmt.Printf(" %s", s.Video_range)
+		}
+
+		if s.Sample_rate != 0 {
+			fmt.Printf(" %d Hz %d channels", s.Sample_rate, s.Channel_count)
+		}
+
+		fmt.Printf(", language %s, timescale %d, duration %d (%.3f s), %d samples\n", s.Language, s.Timescale, s.Duration, s.Duration_seconds, s.Sample_count)
+	}
+}
+
+func samples(args []string) {
+	fs := flag.NewFlagSet("samples", flag.ExitOnError)
+	trackPtr := fs.Uint("track", 0, "Only list the samples of this track ID")
+	initPtr := fs.String("init", "", "Init segment path, when the input is a media segment")
+	jsonPtr := fs.Bool("json", false, "Print the samples as JSON")
+	data := parseFlags(fs, args)
+
+	moovData := data
+	if *initPtr != "" {
+		var err error
+		moovData, err = os.ReadFile(*initPtr)
+		if err != nil {
+			fmt.Printf("Error: Failed to read file: %s. Error: %v\n", *initPtr, err)
+			os.Exit(1)
+		}
+	}
+
+	tracks, err := media_utils.GetTracks(moovData)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse tracks. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var all []media_utils.Mp4_sample
+	if *initPtr != "" {
+		all, err = media_utils.GetFragmentSamples(data, tracks)
+	} else {
+		all, err = trackSamples(data, tracks)
+	}
+
+	if err != nil {
+		fmt.Printf("Error: Failed to parse samples. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var listed []media_utils.Mp4_sample
+	for _, s := range all {
+		if *trackPtr == 0 || s.Track_id == uint32(*trackPtr) {
+			s.Data = nil
+			listed = append(listed, s)
+		}
+	}
+
+	if *jsonPtr {
+		writeJson(listed)
+		return
+	}
+
+	fmt.Printf("%-6s %-8s %-12s %-12s %-9s %-9s %-12s %s\n", "track", "index", "dts", "pts", "duration", "size", "offset", "sync")
+	index := make(map[uint32]int)
+	for _, s := range listed {
+		fmt.Printf("%-6d %-8d %-12d %-12d %-9d %-9d %-12d %v\n", s.Track_id, index[s.Track_id], s.Dts, s.Pts, s.Duration, s.Size, s.Offset, s.Is_sync)
+		index[s.Track_id]++
+	}
+}
+
+func setTfdt(args []string) {
+	fs := flag.NewFlagSet("set-tfdt", flag.ExitOnError)
+	valuePtr := fs.Uint64("value", 0, "New baseMediaDecodeTime")
+	outputPtr := fs.String("output", "", "Output file path (required)")
+	data := parseFlags(fs, args)
+
+	if *outputPtr == "" {
+		fmt.Printf("Output file path is required.\n")
+		os.Exit(1)
+	}
+
+	before, err := media_utils.GetTfdt(data)
+	if err != nil {
+		fmt.Printf("Error: Failed to read the tfdt. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = media_utils.SetTfdtUint64(data, *valuePtr)
+	if err != nil {
+		fmt.Printf("Error: Failed to set the tfdt. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = os.WriteFile(*outputPtr, data, 0644)
+	if err != nil {
+		fmt.Printf("Error: Failed to write file: %s. Error: %v\n", *outputPtr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("tfdt version %d baseMediaDecodeTime %d -> %d, written to %s\n", before.Header.Version, before.BaseMediaDecodeTime(), *valuePtr, *outputPtr)
+}
+
+func diff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	jsonPtr := fs.Bool("json", false, "Print the differences as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fmt.Printf("Two input files are required.\n")
+		os.Exit(1)
+	}
+
+	var trees [2][]*media_utils.Mp4_box
+	for i := range trees {
+		data, err := readInput(fs.Arg(i))
+		if err != nil {
+			fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(fs.Arg(i)), err)
+			os.Exit(1)
+		}
+
+		// Compare what parses of a truncated file
+		trees[i], err = media_utils.ParseBoxes(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s: %v\n", inputName(fs.Arg(i)), err)
+		}
+	}
+
+	diffs := media_utils.DiffBoxes(trees[0], trees[1])
+	if *jsonPtr {
+		writeJson(diffs)
+	} else {
+		media_utils.WriteBoxDiff(os.Stdout, diffs)
+	}
+
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+}
+
+func framehash(args []string) {
+	fs := flag.NewFlagSet("framehash", flag.ExitOnError)
+	hashPtr := fs.String("hash", "md5", "Hash function: md5, sha1 or sha256")
+	trackPtr := fs.Uint("track", 0, "Only hash the samples of this track ID")
+	initPtr := fs.String("init", "", "Init segment path; the inputs are then its media segments, in order")
+	fs.Parse(args)
+
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	if *initPtr == "" && len(inputs) > 1 {
+		fmt.Printf("Error: Media segments require an init segment (-init).\n")
+		os.Exit(1)
+	}
+
+	moovPath := inputs[0]
+	if *initPtr != "" {
+		moovPath = *initPtr
+	}
+
+	moovData, err := readInput(moovPath)
+	if err != nil {
+		fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(moovPath), err)
+		os.Exit(1)
+	}
+
+	tracks, err := media_utils.GetTracks(moovData)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse tracks. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *trackPtr != 0 {
+		track, err := media_utils.FindTrack(tracks, uint32(*trackPtr), "")
+		if err != nil {
+			fmt.Printf("Error: Failed to find track %d.\n", *trackPtr)
+			os.Exit(1)
+		}
+
+		tracks = []media_utils.Track_info{track}
+	}
+
+	hasher, err := media_utils.NewFrameHasher(tracks, *hashPtr)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, input := range inputs {
+		data := moovData
+		if *initPtr != "" {
+			data, err = readInput(input)
+			if err != nil {
+				fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(input), err)
+				os.Exit(1)
+			}
+		}
+
+		var samples []media_utils.Mp4_sample
+		if *initPtr != "" {
+			samples, err = media_utils.GetFragmentSamples(data, tracks)
+		} else {
+			samples, err = trackSamples(data, tracks)
+		}
+
+		if err != nil {
+			fmt.Printf("Error: Failed to parse samples of %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+
+		err = hasher.AddSamples(samples)
+		if err != nil {
+			fmt.Printf("Error: Failed to hash samples of %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+	}
+
+	hasher.Write(os.Stdout)
+}
+
+func timeline(args []string) {
+	fs := flag.NewFlagSet("timeline", flag.ExitOnError)
+	initPtr := fs.String("init", "", "Init segment path (required)")
+	tolerancePtr := fs.Uint64("tolerance", 0, "Ignore discontinuities of up to this many ticks")
+	jsonPtr := fs.Bool("json", false, "Print the fragments and issues as JSON")
+	fs.Parse(args)
+	if *initPtr == "" || fs.NArg() == 0 {
+		fmt.Printf("Error: An init segment (-init) and at least one media segment are required.\n")
+		os.Exit(1)
+	}
+
+	initData, err := readInput(*initPtr)
+	if err != nil {
+		fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(*initPtr), err)
+		os.Exit(1)
+	}
+
+	tracks, err := media_utils.GetTracks(initData)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse tracks. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	validator := media_utils.NewTimelineValidator(tracks)
+	validator.Tolerance = *tolerancePtr
+	for _, input := range fs.Args() {
+		data, err := readInput(input)
+		if err != nil {
+			fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+
+		issues, err := validator.AddSegment(data)
+		if err != nil {
+			fmt.Printf("Error: Failed to parse %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+
+		if !*jsonPtr {
+			for _, issue := range issues {
+				fmt.Printf("%s: %s\n", inputName(input), issue.String())
+			}
+		}
+	}
+
+	if *jsonPtr {
+		writeJson(struct {
+			Fragments []media_utils.Fragment_timing
+			Issues []media_utils.Timeline_issue
+		}{validator.Fragments, validator.Issues})
+	} else if len(validator.Issues) == 0 {
+		fmt.Printf("%d fragments, no discontinuities\n", len(validator.Fragments))
+	}
+
+	if len(validator.Issues) > 0 {
+		os.Exit(1)
+	}
+}
+
+func subtitles(args []string) {
+	fs := flag.NewFlagSet("subtitles", flag.ExitOnError)
+	trackPtr := fs.Uint("track", 0, "Track ID (default: the first wvtt or stpp track)")
+	initPtr := fs.String("init", "", "Init segment path; the inputs are then its media segments, in order")
+	sampleRelativePtr := fs.Bool("sample-relative", false, "TTML times are relative to each sample instead of the track")
+	fs.Parse(args)
+
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	if *initPtr == "" && len(inputs) > 1 {
+		fmt.Printf("Error: Media segments require an init segment (-init).\n")
+		os.Exit(1)
+	}
+
+	moovPath := inputs[0]
+	if *initPtr != "" {
+		moovPath = *initPtr
+	}
+
+	moovData, err := readInput(moovPath)
+	if err != nil {
+		fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(moovPath), err)
+		os.Exit(1)
+	}
+
+	tracks, err := media_utils.GetTracks(moovData)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse tracks. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var track *media_utils.Track_info
+	for i := range tracks {
+		if (*trackPtr == 0 && (tracks[i].Codec == "wvtt" || tracks[i].Codec == "stpp")) || tracks[i].Track_id == uint32(*trackPtr) {
+			track = &tracks[i]
+			break
+		}
+	}
+
+	if track == nil {
+		fmt.Printf("Error: Failed to find a wvtt or stpp track.\n")
+		os.Exit(1)
+	}
+
+	// Both extractors take samples and write a file
+	var extractor interface {
+		AddSamples([]media_utils.Mp4_sample) error
+		Write(io.Writer) error
+	}
+
+	if track.Codec == "stpp" {
+		ttml, err := media_utils.NewTtmlExtractor(*track)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		ttml.Sample_relative = *sampleRelativePtr
+		extractor = ttml
+	} else {
+		extractor, err = media_utils.NewWebvttExtractor(*track)
+		if err != nil {
+			fmt.Printf("Error: Track %d is %s, not wvtt or stpp.\n", track.Track_id, track.Codec)
+			os.Exit(1)
+		}
+	}
+
+	for _, input := range inputs {
+		data := moovData
+		var samples []media_utils.Mp4_sample
+		if *initPtr != "" {
+			data, err = readInput(input)
+			if err != nil {
+				fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(input), err)
+				os.Exit(1)
+			}
+
+			samples, err = media_utils.GetFragmentSamples(data, tracks)
+		} else {
+			samples, err = trackSamples(data, []media_utils.Track_info{*track})
+		}
+
+		if err != nil {
+			fmt.Printf("Error: Failed to parse samples of %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+
+		err = extractor.AddSamples(samples)
+		if err != nil {
+			fmt.Printf("Error: Failed to extract the cues of %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+	}
+
+	err = extractor.Write(os.Stdout)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func srt(args []string) {
+	fs := flag.NewFlagSet("srt", flag.ExitOnError)
+	trackPtr := fs.Uint("track", 0, "Track ID (default: the first text track that is not a chapter track)")
+	data := parseFlags(fs, args)
+
+	tracks, err := media_utils.GetTracks(data)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse tracks. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	chapterTracks := make(map[uint32]bool)
+	for _, id := range media_utils.ChapterTrackIds(tracks) {
+		chapterTracks[id] = true
+	}
+
+	var track *media_utils.Track_info
+	for i := range tracks {
+		if *trackPtr == 0 && (tracks[i].Codec == "tx3g" || tracks[i].Codec == "text") && !chapterTracks[tracks[i].Track_id] || tracks[i].Track_id == uint32(*trackPtr) {
+			track = &tracks[i]
+			break
+		}
+	}
+
+	if track == nil {
+		fmt.Printf("Error: Failed to find a tx3g or text track.\n")
+		os.Exit(1)
+	}
+
+	cues, err := media_utils.GetTextCues(data, *track)
+	if err != nil {
+		fmt.Printf("Error: Failed to read the cues of track %d. Error: %v\n", track.Track_id, err)
+		os.Exit(1)
+	}
+
+	media_utils.WriteSrt(os.Stdout, cues)
+}
+
+func chapters(args []string) {
+	fs := flag.NewFlagSet("chapters", flag.ExitOnError)
+	data := parseFlags(fs, args)
+
+	chapters, err := media_utils.GetChapters(data)
+	if err != nil {
+		fmt.Printf("Error: Failed to read chapters. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if chapters == nil {
+		chapters = []media_utils.Chapter{}
+	}
+
+	writeJson(chapters)
+}
+
+// stringList collects the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// metadataKey maps a common name (title, artist...) to its atom type.
+func metadataKey(name string) string {
+	if key, ok := media_utils.Metadata_keys[name]; ok {
+		return key
+	}
+
+	return name
+}
+
+func metadata(args []string) {
+	fs := flag.NewFlagSet("metadata", flag.ExitOnError)
+	var sets, setFiles, removes stringList
+	fs.Var(&sets, "set", "key=value text entry to set, repeatable. Keys are atom types (\"©nam\", \"----:com.apple.iTunes:NAME\") or title, artist, album, album_artist, date, genre, comment, description, encoder")
+	fs.Var(&setFiles, "set-file", "key=path entry to set to the content of a file, repeatable, e.g. cover=art.jpg")
+	fs.Var(&removes, "remove", "key of an entry to remove, repeatable")
+	quicktimePtr := fs.Bool("quicktime", false, "-set and -remove apply to the QuickTime udta ©xxx atoms instead of ilst")
+	outputPtr := fs.String("output", "", "Output file for -set, -set-file and -remove")
+	jsonPtr := fs.Bool("json", false, "Print the metadata as JSON")
+	data := parseFlags(fs, args)
+
+	var items []media_utils.Metadata_item
+	for _, set := range sets {
+		key, value, ok := strings.Cut(set, "=")
+		if !ok {
+			fmt.Printf("Error: -set %s is not key=value.\n", set)
+			os.Exit(1)
+		}
+
+		items = append(items, media_utils.Metadata_item{Key: metadataKey(key), Type: media_utils.Metadata_type_utf8, Value: []byte(value), Quicktime: *quicktimePtr})
+	}
+
+	for _, set := range setFiles {
+		key, path, ok := strings.Cut(set, "=")
+		if !ok {
+			fmt.Printf("Error: -set-file %s is not key=path.\n", set)
+			os.Exit(1)
+		}
+
+		value, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Error: Failed to read %s. Error: %v\n", path, err)
+			os.Exit(1)
+		}
+
+		dataType := uint32(media_utils.Metadata_type_binary)
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".jpg", ".jpeg":
+			dataType = media_utils.Metadata_type_jpeg
+		case ".png":
+			dataType = media_utils.Metadata_type_png
+		case ".txt":
+			dataType = media_utils.Metadata_type_utf8
+		}
+
+		items = append(items, media_utils.Metadata_item{Key: metadataKey(key), Type: dataType, Value: value, Quicktime: *quicktimePtr})
+	}
+
+	for _, key := range removes {
+		items = append(items, media_utils.Metadata_item{Key: metadataKey(key), Quicktime: *quicktimePtr})
+	}
+
+	if len(items) > 0 {
+		if *outputPtr == "" {
+			fmt.Printf("Error: Setting metadata requires an output file (-output).\n")
+			os.Exit(1)
+		}
+
+		out, err := media_utils.SetMetadata(data, items)
+		if err != nil {
+			fmt.Printf("Error: Failed to set metadata. Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		err = os.WriteFile(*outputPtr, out, 0644)
+		if err != nil {
+			fmt.Printf("Error: Failed to write %s. Error: %v\n", *outputPtr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	items, err := media_utils.GetMetadata(data)
+	if err != nil {
+		fmt.Printf("Error: Failed to read metadata. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *jsonPtr {
+		type metadataEntry struct {
+			Key string
+			Type uint32
+			Value string
+			Quicktime bool
+		}
+
+		entries := []metadataEntry{}
+		for _, item := range items {
+			entries = append(entries, metadataEntry{item.Key, item.Type, item.String(), item.Quicktime})
+		}
+
+		writeJson(entries)
+		return
+	}
+
+	for _, item := range items {
+		source := "ilst"
+		if item.Quicktime {
+			source = "udta"
+		}
+
+		fmt.Printf("%s %s: %s\n", source, item.Key, item.String())
+	}
+}
+
+func fragment(args []string) {
+	fs := flag.NewFlagSet("fragment", flag.ExitOnError)
+	segmentDurationPtr := fs.Uint("segment-duration", 2000, "Target segment duration in ms; segments start at video sync samples. 0: a segment per sync sample")
+	chunkDurationPtr := fs.Uint("chunk-duration", 0, "Split segments into moof/mdat chunks of this many ms")
+	chunkSyncPtr := fs.Bool("chunk-sync", false, "Also start a chunk at every video sync sample")
+	cmafPtr := fs.Bool("cmaf", false, "Write the CMAF brands (single track only)")
+	outputPtr := fs.String("output", "", "Output file for the init segment followed by the media segments")
+	outputDirPtr := fs.String("output-dir", "", "Output directory for init.mp4 and seg_<n>.m4s")
+	data := parseFlags(fs, args)
+	if (*outputPtr == "") == (*outputDirPtr == "") {
+		fmt.Printf("Error: One of -output and -output-dir is required.\n")
+		os.Exit(1)
+	}
+
+	tracks, err := media_utils.GetTracks(data)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse tracks. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	samples, err := trackSamples(data, tracks)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse samples. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Interleave the tracks by decode time
+	timescales := make(map[uint32]int64)
+	for _, track := range tracks {
+		timescales[track.Track_id] = int64(track.Timescale)
+	}
+
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Dts * timescales[samples[j].Track_id] < samples[j].Dts * timescales[samples[i].Track_id]
+	})
+
+	var output *os.File
+	if *outputPtr != "" {
+		output, err = os.Create(*outputPtr)
+	} else {
+		output, err = os.Create(filepath.Join(*outputDirPtr, "init.mp4"))
+	}
+
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	defer output.Close()
+	muxer, err := media_utils.NewFmp4Muxer(output, tracks)
+	if err != nil {
+		fmt.Printf("Error: Failed to create the muxer. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	muxer.Segment_duration = uint32(*segmentDurationPtr)
+	muxer.Chunk_duration = uint32(*chunkDurationPtr)
+	muxer.Chunk_sync_samples = *chunkSyncPtr
+	muxer.Cmaf = *cmafPtr
+	var segment *os.File
+	if *outputDirPtr != "" {
+		muxer.New_segment = func(index int) (io.Writer, error) {
+			if segment != nil {
+				segment.Close()
+			}
+
+			var err error
+			segment, err = os.Create(filepath.Join(*outputDirPtr, fmt.Sprintf("seg_%d.m4s", index + 1)))
+			return segment, err
+		}
+	}
+
+	err = muxer.WriteInit()
+	for i := 0; err == nil && i < len(samples); i++ {
+		err = muxer.WriteSample(samples[i])
+	}
+
+	if err == nil {
+		err = muxer.Flush()
+	}
+
+	if segment != nil {
+		segment.Close()
+	}
+
+	if err != nil {
+		fmt.Printf("Error: Failed to write fragmented MP4. Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func parts(args []string) {
+	fs := flag.NewFlagSet("parts", flag.ExitOnError)
+	initPtr := fs.String("init", "", "Init segment path (required)")
+	durationPtr := fs.Uint("duration", 1000, "Part duration in ms")
+	outputPtr := fs.String("output", "", "Output file for the chunked segment")
+	outputDirPtr := fs.String("output-dir", "", "Output directory for the part files <segment>.part<n>.m4s")
+	jsonPtr := fs.Bool("json", false, "Print the parts as JSON")
+	data := parseFlags(fs, args)
+	if *initPtr == "" {
+		fmt.Printf("Error: An init segment (-init) is required.\n")
+		os.Exit(1)
+	}
+
+	initData, err := readInput(*initPtr)
+	if err != nil {
+		fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(*initPtr), err)
+		os.Exit(1)
+	}
+
+	tracks, err := media_utils.GetTracks(initData)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse tracks. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	llParts, err := media_utils.SplitSegment(data, tracks, uint32(*durationPtr))
+	if err != nil {
+		fmt.Printf("Error: Failed to split %s. Error: %v\n", inputName(fs.Arg(0)), err)
+		os.Exit(1)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(inputName(fs.Arg(0))), filepath.Ext(fs.Arg(0)))
+	var chunked []byte
+	uris := make([]string, len(llParts))
+	for i, part := range llParts {
+		chunked = append(chunked, part.Data...)
+		uris[i] = fmt.Sprintf("%s.part%d.m4s", name, part.Index)
+		if *outputDirPtr != "" {
+			err = os.WriteFile(filepath.Join(*outputDirPtr, uris[i]), part.Data, 0644)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if *outputPtr != "" {
+		err = os.WriteFile(*outputPtr, chunked, 0644)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *jsonPtr {
+		type partInfo struct {
+			Index int
+			Uri string
+			Start float64
+			Duration float64
+			Independent bool
+			Size int
+		}
+
+		var infos []partInfo
+		for i, part := range llParts {
+			infos = append(infos, partInfo{part.Index, uris[i], part.Start, part.Duration, part.Independent, len(part.Data)})
+		}
+
+		writeJson(infos)
+		return
+	}
+
+	for i, part := range llParts {
+		independent := ""
+		if part.Independent {
+			independent = ",INDEPENDENT=YES"
+		}
+
+		fmt.Printf("#EXT-X-PART:DURATION=%.5f,URI=\"%s\"%s\n", part.Duration, uris[i], independent)
+	}
+}
+
+func repair(args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	initPtr := fs.String("init", "", "Init segment path, for the trex default sample sizes")
+	outputPtr := fs.String("output", "", "Output file for the repaired segment")
+	jsonPtr := fs.Bool("json", false, "Print the report as JSON")
+	data := parseFlags(fs, args)
+	var tracks []media_utils.Track_info
+	if *initPtr != "" {
+		initData, err := readInput(*initPtr)
+		if err != nil {
+			fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(*initPtr), err)
+			os.Exit(1)
+		}
+
+		tracks, err = media_utils.GetTracks(initData)
+		if err != nil {
+			fmt.Printf("Error: Failed to parse tracks. Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	repaired, report, err := media_utils.RepairSegment(data, tracks)
+	if err != nil {
+		fmt.Printf("Error: Failed to repair %s. Error: %v\n", inputName(fs.Arg(0)), err)
+		os.Exit(1)
+	}
+
+	if *outputPtr != "" {
+		err = os.WriteFile(*outputPtr, repaired, 0644)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *jsonPtr {
+		writeJson(report)
+		return
+	}
+
+	for _, issue := range report.Issues {
+		fmt.Println(issue.String())
+	}
+
+	lost := fmt.Sprint(report.Lost_samples)
+	if report.Lost_samples < 0 {
+		lost = "unknown number of"
+	}
+
+	fmt.Printf("%d issues, %s samples lost, %d -> %d bytes\n", len(report.Issues), lost, report.Input_size, report.Output_size)
+}
+
+func cmaf(args []string) {
+	fs := flag.NewFlagSet("cmaf", flag.ExitOnError)
+	jsonPtr := fs.Bool("json", false, "Print the checks as JSON")
+	failuresPtr := fs.Bool("failures", false, "Only print the failed checks")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Printf("Error: A CMAF header and optionally its media segments are required.\n")
+		os.Exit(1)
+	}
+
+	checker := media_utils.NewCmafChecker()
+	for i, input := range fs.Args() {
+		data, err := readInput(input)
+		if err != nil {
+			fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+
+		if i == 0 {
+			err = checker.CheckHeader(data)
+		} else {
+			err = checker.CheckSegment(data)
+		}
+
+		if err != nil {
+			fmt.Printf("Error: Failed to parse %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+	}
+
+	var checks []media_utils.Cmaf_check
+	for _, check := range checker.Checks {
+		if !*failuresPtr || !check.Passed {
+			checks = append(checks, check)
+		}
+	}
+
+	if *jsonPtr {
+		writeJson(struct {
+			Passed bool
+			Checks []media_utils.Cmaf_check
+		}{checker.Passed(), checks})
+	} else {
+		for _, check := range checks {
+			fmt.Println(check.String())
+		}
+
+		if checker.Passed() {
+			fmt.Printf("PASS\n")
+		} else {
+			fmt.Printf("FAIL\n")
+		}
+	}
+
+	if !checker.Passed() {
+		os.Exit(1)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "dump":
+		dump(args)
+	case "info":
+		info(args)
+	case "samples":
+		samples(args)
+	case "set-tfdt":
+		setTfdt(args)
+	case "diff":
+		diff(args)
+	case "framehash":
+		framehash(args)
+	case "timeline":
+		timeline(args)
+	case "subtitles":
+		subtitles(args)
+	case "srt":
+		srt(args)
+	case "chapters":
+		chapters(args)
+	case "metadata":
+		metadata(args)
+	case "fragment":
+		fragment(args)
+	case "parts":
+		parts(args)
+	case "repair":
+		repair(args)
+	case "cmaf":
+		cmaf(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Printf("Unknown command: %s\n\n%s", os.Args[1], usage)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,391 @@
+package media_utils
+
+import (
+	"strings"
+)
+
+// Mp4_box is a node of a parsed box tree. Container boxes have their child
+// boxes in Children and, if the box has fields ahead of the children (stsd,
+// meta, sample entries...), those fields in Payload. Leaf boxes keep their
+// payload, i.e. the bytes following the box header, in Payload. Payload slices
+// reference the parsed data and are not copied.
+type Mp4_box struct {
+	Type uint32
+	Offset uint64 // file offset of the box header
+	Size uint64 // box size including the header, as parsed
+	Header_size uint32
+	Payload []byte
+	Children []*Mp4_box
+	Parent *Mp4_box
+	children_err error // why a container box was kept as a leaf
+}
+
+// Boxes that only hold other boxes
+var mp4_container_boxes = map[uint32]bool{
+	mp4_fourcc('m', 'o', 'o', 'v'): true,
+	mp4_fourcc('t', 'r', 'a', 'k'): true,
+	mp4_fourcc('m', 'd', 'i', 'a'): true,
+	mp4_fourcc('m', 'i', 'n', 'f'): true,
+	mp4_fourcc('s', 't', 'b', 'l'): true,
+	mp4_fourcc('e', 'd', 't', 's'): true,
+	mp4_fourcc('d', 'i', 'n', 'f'): true,
+	mp4_fourcc('m', 'v', 'e', 'x'): true,
+	mp4_fourcc('m', 'o', 'o', 'f'): true,
+	mp4_fourcc('t', 'r', 'a', 'f'): true,
+	mp4_fourcc('m', 'f', 'r', 'a'): true,
+	mp4_fourcc('u', 'd', 't', 'a'): true,
+	mp4_fourcc('t', 'r', 'e', 'f'): true,
+	mp4_fourcc('s', 'i', 'n', 'f'): true,
+	mp4_fourcc('s', 'c', 'h', 'i'): true,
+	mp4_fourcc('i', 'l', 's', 't'): true,
+	mp4_fourcc('v', 't', 't', 'c'): true,
+}
+
+// Visual sample entries: 8 bytes SampleEntry + 70 bytes VisualSampleEntry fields
+var mp4_visual_sample_entries = map[uint32]bool{
+	mp4_fourcc('a', 'v', 'c', '1'): true,
+	mp4_fourcc('a', 'v', 'c', '3'): true,
+	mp4_fourcc('h', 'v', 'c', '1'): true,
+	mp4_fourcc('h', 'e', 'v', '1'): true,
+	mp4_fourcc('d', 'v', 'h', '1'): true,
+	mp4_fourcc('d', 'v', 'h', 'e'): true,
+	mp4_fourcc('d', 'v', 'a', '1'): true,
+	mp4_fourcc('d', 'v', 'a', 'v'): true,
+	mp4_fourcc('a', 'v', '0', '1'): true,
+	mp4_fourcc('v', 'p', '0', '8'): true,
+	mp4_fourcc('v', 'p', '0', '9'): true,
+	mp4_fourcc('m', 'p', '4', 'v'): true,
+	mp4_fourcc('e', 'n', 'c', 'v'): true,
+}
+
+// Audio sample entries: 8 bytes SampleEntry + 20 bytes AudioSampleEntry fields
+var mp4_audio_sample_entries = map[uint32]bool{
+	mp4_fourcc('m', 'p', '4', 'a'): true,
+	mp4_fourcc('a', 'c', '-', '3'): true,
+	mp4_fourcc('e', 'c', '-', '3'): true,
+	mp4_fourcc('a', 'c', '-', '4'): true,
+	mp4_fourcc('O', 'p', 'u', 's'): true,
+	mp4_fourcc('f', 'L', 'a', 'C'): true,
+	mp4_fourcc('a', 'l', 'a', 'c'): true,
+	mp4_fourcc('e', 'n', 'c', 'a'): true,
+}
+
+// container_prefix_size tells whether a box holds child boxes and how many
+// payload bytes precede the first child.
+func container_prefix_size(box_type uint32, payload []byte) (uint32, bool) {
+	if mp4_container_boxes[box_type] {
+		return 0, true
+	}
+
+	if mp4_visual_sample_entries[box_type] {
+		return 78, true
+	}
+
+	if mp4_audio_sample_entries[box_type] {
+		// QuickTime sound sample description versions 1 and 2 have extra fields
+		if len(payload) >= 10 {
+			switch get_uint16(8, payload) {
+			case 1:
+				return 44, true
+			case 2:
+				return 64, true
+			}
+		}
+
+		return 28, true
+	}
+
+	switch box_type {
+	case mp4_fourcc('s', 't', 's', 'd'), mp4_fourcc('d', 'r', 'e', 'f'):
+		// version, flags, entry_count
+		return 8, true
+	case mp4_fourcc('w', 'v', 't', 't'):
+		return 8, true
+	case mp4_fourcc('t', 'x', '3', 'g'):
+		return 38, true
+	case mp4_fourcc('m', 'e', 't', 'a'):
+		// ISO meta is a full box; QuickTime meta is a plain container
+		if len(payload) >= 8 && get_uint32(4, payload) == mp4_fourcc('h', 'd', 'l', 'r') {
+			return 0, true
+		}
+
+		return 4, true
+	}
+
+	return 0, false
+}
+
+func parse_box_children(d []byte, start uint64, end uint64, parent *Mp4_box) ([]*Mp4_box, error) {
+	var boxes []*Mp4_box
+	parent_path := ""
+	if parent != nil {
+		parent_path = parent.Path()
+	}
+
+	p := start
+	for p < end {
+		if end - p < 8 {
+			return boxes, parse_error(ErrTruncated, "incomplete_box_header", p, parent_path)
+		}
+
+		box := &Mp4_box{Offset: p, Parent: parent}
+		box_size := uint64(get_uint32(0, d[p:]))
+		box.Type = get_uint32(4, d[p:])
+		box.Header_size = 8
+		if box_size == 1 {
+			if end - p < 16 {
+				return boxes, parse_error(ErrTruncated, "incomplete_box_header", p, box_path(parent_path, box.Type))
+			}
+
+			box_size = get_uint64(p + 8, d)
+			box.Header_size = 16
+		} else if box_size == 0 {
+			box_size = end - p
+		}
+
+		if box_size < uint64(box.Header_size) {
+			return boxes, parse_error(ErrInvalidData, "invalid_box_size", p, box_path(parent_path, box.Type))
+		}
+
+		if box_size > end - p {
+			return boxes, parse_error(ErrTruncated, "incomplete_" + box.TypeString(), p, box_path(parent_path, box.Type))
+		}
+
+		box.Size = box_size
+		payload := d[p + uint64(box.Header_size) : p + box_size]
+		prefix, is_container := container_prefix_size(box.Type, payload)
+		if parent != nil && parent.Type == mp4_fourcc('i', 'l', 's', 't') {
+			// Every ilst item, including the ---- freeform atom, holds mean/name/data boxes
+			prefix, is_container = 0, true
+		}
+
+		// A container whose content does not parse as boxes (e.g. a QuickTime
+		// udta ending with a 32-bit zero terminator) is kept as a leaf so that
+		// it serializes back unchanged.
+		box.Payload = payload
+		if is_container && uint64(prefix) <= uint64(len(payload)) {
+			children, err := parse_box_children(d, p + uint64(box.Header_size) + uint64(prefix), p + box_size, box)
+			if err == nil {
+				box.Payload = payload[:prefix]
+				box.Children = children
+			} else {
+				box.children_err = err
+			}
+		}
+
+		boxes = append(boxes, box)
+		p += box_size
+	}
+
+	return boxes, nil
+}
+
+// ParseBoxes parses data into a tree of boxes and returns the top-level boxes.
+func ParseBoxes(data []byte) ([]*Mp4_box, error) {
+	return parse_box_children(data, 0, uint64(len(data)), nil)
+}
+
+// TypeString returns the box type as text, e.g. "moov".
+func (box *Mp4_box) TypeString() string {
+	return fourcc_string(box.Type)
+}
+
+// Path returns the slash separated types from the top level down to this box,
+// e.g. "moof/traf/tfdt".
+func (box *Mp4_box) Path() string {
+	if box.Parent == nil {
+		return box.TypeString()
+	}
+
+	return box.Parent.Path() + "/" + box.TypeString()
+}
+
+// Child returns the first child box of the given type, or nil.
+func (box *Mp4_box) Child(box_type uint32) *Mp4_box {
+	for _, c := range box.Children {
+		if c.Type == box_type {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// ChildrenOfType returns the child boxes of the given type.
+func (box *Mp4_box) ChildrenOfType(box_type uint32) []*Mp4_box {
+	var children []*Mp4_box
+	for _, c := range box.Children {
+		if c.Type == box_type {
+			children = append(children, c)
+		}
+	}
+
+	return children
+}
+
+func find_boxes_in(boxes []*Mp4_box, types []string, found []*Mp4_box) []*Mp4_box {
+	for _, b := range boxes {
+		if types[0] != "*" && b.TypeString() != types[0] {
+			continue
+		}
+
+		if len(types) == 1 {
+			found = append(found, b)
+		} else {
+			found = find_boxes_in(b.Children, types[1:], found)
+		}
+	}
+
+	return found
+}
+
+// FindBoxes returns all boxes matching a slash separated path of box types
+// relative to boxes, e.g. "moov/trak/mdia/mdhd". "*" matches any type.
+func FindBoxes(boxes []*Mp4_box, path string) []*Mp4_box {
+	return find_boxes_in(boxes, strings.Split(path, "/"), nil)
+}
+
+// FindBox returns the first box matching path (see FindBoxes), or nil.
+func FindBox(boxes []*Mp4_box, path string) *Mp4_box {
+	found := FindBoxes(boxes, path)
+	if len(found) == 0 {
+		return nil
+	}
+
+	return found[0]
+}
+
+// Find returns the first descendant matching path relative to this box, or nil.
+func (box *Mp4_box) Find(path string) *Mp4_box {
+	return FindBox(box.Children, path)
+}
+
+// FindAll returns all descendants matching path relative to this box.
+func (box *Mp4_box) FindAll(path string) []*Mp4_box {
+	return FindBoxes(box.Children, path)
+}
+
+// Version returns the version of a full box.
+func (box *Mp4_box) Version() uint8 {
+	if len(box.Payload) < 4 {
+		return 0
+	}
+
+	return box.Payload[0]
+}
+
+// Flags returns the flags of a full box.
+func (box *Mp4_box) Flags() uint32 {
+	if len(box.Payload) < 4 {
+		return 0
+	}
+
+	return get_uint32(0, box.Payload) & 0x00FFFFFF
+}
+
+func (box *Mp4_box) content_size() uint64 {
+	content_size := uint64(len(box.Payload))
+	for _, c := range box.Children {
+		content_size += c.EncodedSize()
+	}
+
+	return content_size
+}
+
+// EncodedSize returns the size the box serializes to, with the sizes of
+// modified children recomputed. A box parsed with a 64-bit largesize keeps
+// it, so that the offsets of the data after its header do not change.
+func (box *Mp4_box) EncodedSize() uint64 {
+	content_size := box.content_size()
+	if content_size + 8 > 0xFFFFFFFF || box.Header_size == 16 {
+		return content_size + 16
+	}
+
+	return content_size + 8
+}
+
+func (box *Mp4_box) append_to(out []byte) []byte {
+	box_size := box.EncodedSize()
+	if box_size > 0xFFFFFFFF || box.Header_size == 16 {
+		out = append_uint32(out, 1)
+		out = append_uint32(out, box.Type)
+		out = append_uint64(out, box_size)
+	} else {
+		out = append_uint32(out, uint32(box_size))
+		out = append_uint32(out, box.Type)
+	}
+
+	out = append(out, box.Payload...)
+	for _, c := range box.Children {
+		out = c.append_to(out)
+	}
+
+	return out
+}
+
+// Bytes serializes the box and its children.
+func (box *Mp4_box) Bytes() []byte {
+	return box.append_to(make([]byte, 0, box.EncodedSize()))
+}
+
+// SerializeBoxes serializes a list of boxes, such as the result of ParseBoxes.
+func SerializeBoxes(boxes []*Mp4_box) []byte {
+	var total uint64
+	for _, b := range boxes {
+		total += b.EncodedSize()
+	}
+
+	out := make([]byte, 0, total)
+	for _, b := range boxes {
+		out = b.append_to(out)
+	}
+
+	return out
+}
+
+// NewBox creates a leaf box with the given payload.
+func NewBox(box_type uint32, payload []byte) *Mp4_box {
+	return &Mp4_box{Type: box_type, Header_size: 8, Payload: payload}
+}
+
+// NewFullBox creates a leaf full box: version and flags followed by payload.
+func NewFullBox(box_type uint32, version uint8, flags uint32, payload []byte) *Mp4_box {
+	p := make([]byte, 0, 4 + len(payload))
+	p = append_uint32(p, uint32(version) << 24 | flags & 0x00FFFFFF)
+	p = append(p, payload...)
+	return NewBox(box_type, p)
+}
+
+// NewContainerBox creates a container box holding children.
+func NewContainerBox(box_type uint32, children ...*Mp4_box) *Mp4_box {
+	box := &Mp4_box{Type: box_type, Header_size: 8}
+	for _, c := range children {
+		box.AddChild(c)
+	}
+
+	return box
+}
+
+// AddChild appends a child box.
+func (box *Mp4_box) AddChild(child *Mp4_box) {
+	child.Parent = box
+	box.Children = append(box.Children, child)
+}
+
+// InsertChild inserts a child box at index i.
+func (box *Mp4_box) InsertChild(i int, child *Mp4_box) {
+	child.Parent = box
+	box.Children = append(box.Children, nil)
+	copy(box.Children[i+1:], box.Children[i:])
+	box.Children[i] = child
+}
+
+// RemoveChild removes a child box; it does nothing if child is not found.
+func (box *Mp4_box) RemoveChild(child *Mp4_box) {
+	for i, c := range box.Children {
+		if c == child {
+			box.Children = append(box.Children[:i], box.Children[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package media_utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// largesize_segment returns a media segment of track 1 whose mdat has a
+// 64-bit largesize header: two samples of 3 and 2 bytes.
+func largesize_segment() []byte {
+	tfhd := NewFullBox(mp4_fourcc('t', 'f', 'h', 'd'), 0, Tfhd_default_base_is_moof | Tfhd_default_sample_duration_present, append_uint32(append_uint32(nil, 1), 1024))
+	tfdt := NewFullBox(mp4_fourcc('t', 'f', 'd', 't'), 1, 0, append_uint64(nil, 90000))
+	trun := NewFullBox(mp4_fourcc('t', 'r', 'u', 'n'), 0, Trun_data_offset_present | Trun_sample_size_present, append_uint32(append_uint32(append_uint32(append_uint32(nil, 2), 0), 3), 2))
+	traf := NewContainerBox(mp4_fourcc('t', 'r', 'a', 'f'), tfhd, tfdt, trun)
+	moof := NewContainerBox(mp4_fourcc('m', 'o', 'o', 'f'), NewFullBox(mp4_fourcc('m', 'f', 'h', 'd'), 0, 0, append_uint32(nil, 1)), traf).Bytes()
+	set_uint32(uint32(len(moof) - 12), moof, uint32(len(moof) + 16))
+
+	mdat := &Mp4_box{Type: mp4_fourcc('m', 'd', 'a', 't'), Header_size: 16, Payload: []byte{1, 2, 3, 4, 5}}
+	return append(moof, mdat.Bytes()...)
+}
+
+func TestSerializeKeepsLargesize(t *testing.T) {
+	seg := largesize_segment()
+	boxes, err := ParseBoxes(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out := SerializeBoxes(boxes); !bytes.Equal(out, seg) {
+		t.Fatalf("serialized %d bytes, want the %d bytes parsed", len(out), len(seg))
+	}
+}
+
+func TestRewriteLargesizeMdat(t *testing.T) {
+	init_data := mux_test_init(t)
+	rewriter, err := NewTrackRewriter(init_data, []Track_rewrite{{Track_id: 1, New_track_id: 3, New_timescale: 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	new_init, err := rewriter.Rewrite(init_data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seg, err := rewriter.Rewrite(largesize_segment())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, err := GetTracks(new_init)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples, err := GetFragmentSamples(seg, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(samples) != 2 || !bytes.Equal(samples[0].Data, []byte{1, 2, 3}) || !bytes.Equal(samples[1].Data, []byte{4, 5}) {
+		t.Fatalf("samples after rewrite: %+v", samples)
+	}
+}
+
+// TestRewriteRemapsAndRescales moves track 1 to ID 11 at 1000 Hz and track 2 to
+// ID 12, and checks every box carrying a track ID or a media time.
+func TestRewriteRemapsAndRescales(t *testing.T) {
+	boxes, err := ParseBoxes(mux_test_init(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moov := FindBoxes(boxes, "moov")[0]
+	traks := moov.ChildrenOfType(mp4_fourcc('t', 'r', 'a', 'k'))
+	elst := NewFullBox(mp4_fourcc('e', 'l', 's', 't'), 0, 0, append_uint32(append_uint32(append_uint32(append_uint32(nil, 1), 1000), 3000), 1 << 16))
+	traks[0].AddChild(NewContainerBox(mp4_fourcc('e', 'd', 't', 's'), elst))
+	traks[1].AddChild(NewContainerBox(mp4_fourcc('t', 'r', 'e', 'f'), NewBox(mp4_fourcc('s', 'y', 'n', 'c'), append_uint32(nil, 1))))
+	init_data := SerializeBoxes(boxes)
+
+	// Ten seconds in, after a sidx of the video track
+	tracks := mux_test_tracks(48000)
+	var out bytes.Buffer
+	m, err := NewFmp4Muxer(&out, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Segment_duration = 10000
+	err = m.WriteInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	init_size := out.Len()
+	for i := 0; i < 60; i++ {
+		m.WriteSample(mux_test_video_sample(i, 900000))
+		for j := i * 94 / 60; j < (i + 1) * 94 / 60; j++ {
+			m.WriteSample(mux_test_audio_sample(j, 480000))
+		}
+	}
+
+	err = m.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seg := out.Bytes()[init_size:]
+	styp_size := get_uint32(0, seg)
+	sidx := Sidx_box{Reference_id: 1, Timescale: 90000, Earliest_presentation_time: 903000, References: []Sidx_reference{{Referenced_size: uint32(len(seg)) - styp_size, Subsegment_duration: 180000, Starts_with_sap: true, Sap_type: 1}}}
+	seg = bytes.Join([][]byte{seg[:styp_size], NewBox(mp4_fourcc('s', 'i', 'd', 'x'), sidx_payload(sidx)).Bytes(), seg[styp_size:]}, nil)
+
+	tracks, err = GetTracks(init_data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old_samples, err := GetFragmentSamples(seg, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewriter, err := NewTrackRewriter(init_data, []Track_rewrite{{Track_id: 1, New_track_id: 11, New_timescale: 1000}, {Track_id: 2, New_track_id: 12}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	new_init, err := rewriter.Rewrite(init_data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	new_seg, err := rewriter.Rewrite(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tkhd and mdhd
+	new_tracks, err := GetTracks(new_init)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(new_tracks) != 2 || new_tracks[0].Track_id != 11 || new_tracks[0].Timescale != 1000 || new_tracks[1].Track_id != 12 || new_tracks[1].Timescale != 48000 {
+		t.Fatalf("tracks after rewrite: %+v", new_tracks)
+	}
+
+	new_boxes, err := ParseBoxes(new_init)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	new_moov := FindBoxes(new_boxes, "moov")[0]
+	var trex_ids []uint32
+	for _, trex := range new_moov.FindAll("mvex/trex") {
+		trex_ids = append(trex_ids, get_uint32(4, trex.Payload))
+	}
+
+	if len(trex_ids) != 2 || trex_ids[0] != 11 || trex_ids[1] != 12 {
+		t.Errorf("trex track IDs %v, want [11 12]", trex_ids)
+	}
+
+	if sync := new_moov.Find("trak/tref/sync"); sync == nil || get_uint32(0, sync.Payload) != 11 {
+		t.Errorf("tref after rewrite: %v", sync)
+	}
+
+	// The edit keeps its movie timescale duration; 3000 at 90 kHz is 33 ms
+	if elst := new_moov.Find("trak/edts/elst"); elst == nil || get_uint32(8, elst.Payload) != 1000 || get_uint32(12, elst.Payload) != 33 {
+		t.Errorf("elst after rewrite: %v", elst)
+	}
+
+	// sidx
+	new_sidx, err := GetSidx(new_seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if new_sidx.Reference_id != 11 || new_sidx.Timescale != 1000 || new_sidx.Earliest_presentation_time != 10033 || len(new_sidx.References) != 1 ||
+		new_sidx.References[0].Subsegment_duration != 2000 || !new_sidx.References[0].Starts_with_sap || new_sidx.References[0].Sap_type != 1 {
+		t.Errorf("sidx after rewrite: %+v", new_sidx)
+	}
+
+	// tfhd, tfdt and trun
+	seg_boxes, err := ParseBoxes(new_seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tfhd := range FindBoxes(seg_boxes, "moof/traf/tfhd") {
+		if id := get_uint32(4, tfhd.Payload); id != 11 && id != 12 {
+			t.Errorf("tfhd track ID %d", id)
+		}
+	}
+
+	new_samples, err := GetFragmentSamples(new_seg, new_tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(new_samples) != len(old_samples) {
+		t.Fatalf("%d samples after rewrite, want %d", len(new_samples), len(old_samples))
+	}
+
+	for i, old := range old_samples {
+		want := old
+		want.Track_id += 10
+		if old.Track_id == 1 {
+			scale := func(t int64) int64 { return int64(scale_time(uint64(t), 90000, 1000)) }
+			want.Dts = scale(old.Dts)
+			want.Pts = scale(old.Pts)
+			want.Duration = uint32(scale(old.Dts + int64(old.Duration)) - want.Dts)
+		}
+
+		s := new_samples[i]
+		if s.Track_id != want.Track_id || s.Dts != want.Dts || s.Pts != want.Pts || s.Duration != want.Duration || !bytes.Equal(s.Data, old.Data) {
+			t.Fatalf("sample %d after rewrite: %d %d/%d %d, want %d %d/%d %d", i, s.Track_id, s.Dts, s.Pts, s.Duration, want.Track_id, want.Dts, want.Pts, want.Duration)
+		}
+	}
+
+	if new_samples[0].Dts != 10000 {
+		t.Errorf("tfdt after rewrite: %d, want 10000", new_samples[0].Dts)
+	}
+}
+
+// FuzzParseBoxes checks that a parsed box tree serializes to data that parses
+// back to the same tree.
+func FuzzParseBoxes(f *testing.F) {
+	f.Add(fuzz_init())
+	f.Add(fuzz_segment())
+	f.Add(largesize_segment())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		boxes, err := ParseBoxes(data)
+		if err != nil {
+			return
+		}
+
+		DescribeBoxes(boxes)
+		out := SerializeBoxes(boxes)
+		again, err := ParseBoxes(out)
+		if err != nil {
+			t.Fatalf("serialized boxes do not parse: %v", err)
+		}
+
+		if !bytes.Equal(SerializeBoxes(again), out) {
+			t.Fatalf("serialized boxes changed after parsing back")
+		}
+	})
+}
+
+// FuzzTrackRewriter checks that a rewritten init segment has the new track ID
+// and timescale.
+func FuzzTrackRewriter(f *testing.F) {
+	f.Add(fuzz_init(), fuzz_segment())
+	f.Add(largesize_progressive_file(), largesize_segment())
+	f.Fuzz(func(t *testing.T, init_data []byte, seg_data []byte) {
+		rewriter, err := NewTrackRewriter(init_data, []Track_rewrite{{Track_id: 1, New_track_id: 2, New_timescale: 1000}})
+		if err != nil {
+			return
+		}
+
+		rewriter.Rewrite(seg_data)
+		tracks, err := GetTracks(init_data)
+		if err != nil {
+			return
+		}
+
+		new_init, err := rewriter.Rewrite(init_data)
+		if err != nil {
+			return
+		}
+
+		new_tracks, err := GetTracks(new_init)
+		if err != nil || len(new_tracks) != len(tracks) {
+			t.Fatalf("rewritten init segment: %d tracks, %v", len(new_tracks), err)
+		}
+
+		for i, track := range tracks {
+			if track.Track_id == 1 && (new_tracks[i].Track_id != 2 || new_tracks[i].Timescale != 1000) {
+				t.Fatalf("track 1 rewritten to %d at %d Hz", new_tracks[i].Track_id, new_tracks[i].Timescale)
+			}
+		}
+	})
+}
+
+// FuzzTfra checks that a tfra payload serializes back to a payload parsing to
+// the same fields.
+func FuzzTfra(f *testing.F) {
+	f.Add(tfra_payload(tfra_fields{track_id: 1, length_sizes: 0x15, entries: []tfra_entry{{time: 1 << 33, moof_offset: 100, traf_number: 1, trun_number: 1, sample_number: 1}}}))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		tfra, err := parse_tfra(payload)
+		if err != nil {
+			return
+		}
+
+		again, err := parse_tfra(tfra_payload(tfra))
+		if err != nil || !bytes.Equal(tfra_payload(again), tfra_payload(tfra)) {
+			t.Fatalf("tfra %+v read back as %+v: %v", tfra, again, err)
+		}
+	})
+}
@@ -0,0 +1,324 @@
+package media_utils
+
+import (
+	"fmt"
+)
+
+// Cmaf_check is the result of one CMAF (ISO/IEC 23000-19) conformance rule
+// applied to a box of a CMAF header or of a media segment.
+type Cmaf_check struct {
+	Rule string
+	Clause string // clause of ISO/IEC 23000-19
+	Segment_index int // -1 for the CMAF header
+	Path string
+	Passed bool
+	Message string
+}
+
+func (check Cmaf_check) String() string {
+	result := "FAIL"
+	if check.Passed {
+		result = "PASS"
+	}
+
+	segment := "header"
+	if check.Segment_index >= 0 {
+		segment = fmt.Sprintf("segment %d", check.Segment_index)
+	}
+
+	s := fmt.Sprintf("%s %s [%s] %s", result, check.Rule, check.Clause, segment)
+	if check.Path != "" {
+		s += " " + check.Path
+	}
+
+	if check.Message != "" {
+		s += ": " + check.Message
+	}
+
+	return s
+}
+
+// CMAF rules
+const (
+	Cmaf_header_brand = "header_brand" // ftyp lists cmfc or cmf2
+	Cmaf_single_track = "single_track" // one trak per CMAF header
+	Cmaf_mvex_trex = "mvex_trex" // moov/mvex with a trex for the track
+	Cmaf_empty_sample_tables = "empty_sample_tables" // no samples in the moov
+	Cmaf_segment_brand = "segment_brand" // styp, when present, lists a CMAF brand
+	Cmaf_single_traf = "single_traf" // one traf per moof
+	Cmaf_default_base_is_moof = "default_base_is_moof" // tfhd data offsets are relative to the moof
+	Cmaf_tfdt_present = "tfdt_present"
+	Cmaf_trun_data_in_mdat = "trun_data_in_mdat" // trun data offsets point into the following mdat
+)
+
+var cmaf_rule_clauses = map[string]string{
+	Cmaf_header_brand: "7.2",
+	Cmaf_single_track: "7.3.1",
+	Cmaf_mvex_trex: "7.3.1",
+	Cmaf_empty_sample_tables: "7.3.1",
+	Cmaf_segment_brand: "7.2",
+	Cmaf_single_traf: "7.3.2",
+	Cmaf_default_base_is_moof: "7.3.2",
+	Cmaf_tfdt_present: "7.3.2",
+	Cmaf_trun_data_in_mdat: "7.3.2",
+}
+
+var cmaf_header_brands = []string{"cmfc", "cmf2"}
+var cmaf_segment_brands = []string{"cmfc", "cmf2", "cmfl", "cmff", "cmfs"}
+
+// Cmaf_checker checks a CMAF header and the media segments of its track
+// against the structural constraints of CMAF. Every rule applied records a
+// passed or failed Cmaf_check.
+type Cmaf_checker struct {
+	Checks []Cmaf_check
+
+	tracks []Track_info
+	segment_index int
+}
+
+func NewCmafChecker() *Cmaf_checker {
+	return &Cmaf_checker{segment_index: -1}
+}
+
+func (c *Cmaf_checker) check(rule string, box *Mp4_box, passed bool, format string, args ...any) {
+	path := ""
+	if box != nil {
+		path = box.Path()
+	}
+
+	c.Checks = append(c.Checks, Cmaf_check{Rule: rule, Clause: cmaf_rule_clauses[rule], Segment_index: c.segment_index, Path: path, Passed: passed, Message: fmt.Sprintf(format, args...)})
+}
+
+// Passed returns whether no check failed.
+func (c *Cmaf_checker) Passed() bool {
+	for _, check := range c.Checks {
+		if !check.Passed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// box_brands returns the major and compatible brands of an ftyp or styp box.
+func box_brands(box *Mp4_box) []string {
+	var brands []string
+	d := box.Payload
+	for p := 0; p + 4 <= len(d); p += 4 {
+		if p == 4 {
+			continue // minor_version
+		}
+
+		brands = append(brands, fourcc_string(get_uint32(uint32(p), d)))
+	}
+
+	return brands
+}
+
+func has_brand(brands []string, wanted []string) bool {
+	for _, brand := range brands {
+		for _, w := range wanted {
+			if brand == w {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// sample_table_entry_count returns the entry or sample count of a sample table box.
+func sample_table_entry_count(box *Mp4_box) (uint32, bool) {
+	offset := uint32(4) // stts, stsc, stss, ctts, stco, co64: after version and flags
+	switch box.Type {
+	case mp4_fourcc('s', 't', 's', 'z'), mp4_fourcc('s', 't', 'z', '2'):
+		offset = 8
+	}
+
+	if uint32(len(box.Payload)) < offset + 4 {
+		return 0, false
+	}
+
+	return get_uint32(offset, box.Payload), true
+}
+
+// CheckHeader checks the CMAF header (init segment) in data.
+func (c *Cmaf_checker) CheckHeader(data []byte) error {
+	boxes, err := ParseBoxes(data)
+	if err != nil {
+		return err
+	}
+
+	ftyp := FindBox(boxes, "ftyp")
+	if ftyp == nil {
+		c.check(Cmaf_header_brand, nil, false, "no ftyp")
+	} else {
+		brands := box_brands(ftyp)
+		c.check(Cmaf_header_brand, ftyp, has_brand(brands, cmaf_header_brands), "brands %v", brands)
+	}
+
+	moov := FindBox(boxes, "moov")
+	if moov == nil {
+		return box_not_found(nil, "moov")
+	}
+
+	c.tracks, err = GetTracks(data)
+	if err != nil {
+		return err
+	}
+
+	c.check(Cmaf_single_track, moov, len(c.tracks) == 1, "%d tracks", len(c.tracks))
+
+	mvex := moov.Child(mp4_fourcc('m', 'v', 'e', 'x'))
+	if mvex == nil {
+		c.check(Cmaf_mvex_trex, moov, false, "no mvex")
+	} else {
+		trex_ids := make(map[uint32]bool)
+		for _, trex := range mvex.ChildrenOfType(mp4_fourcc('t', 'r', 'e', 'x')) {
+			if len(trex.Payload) >= 8 {
+				trex_ids[get_uint32(4, trex.Payload)] = true
+			}
+		}
+
+		for _, track := range c.tracks {
+			c.check(Cmaf_mvex_trex, mvex, trex_ids[track.Track_id], "trex for track %d", track.Track_id)
+		}
+	}
+
+	sample_tables := []string{"stts", "stsc", "stsz", "stz2", "stco", "co64", "ctts", "stss"}
+	for _, track := range c.tracks {
+		stbl := track.Trak.Find("mdia/minf/stbl")
+		if stbl == nil {
+			c.check(Cmaf_empty_sample_tables, track.Trak, false, "no stbl")
+			continue
+		}
+
+		for _, name := range sample_tables {
+			box := stbl.Child(mp4_fourcc(name[0], name[1], name[2], name[3]))
+			if box == nil {
+				continue
+			}
+
+			count, ok := sample_table_entry_count(box)
+			if !ok {
+				c.check(Cmaf_empty_sample_tables, box, false, "incomplete_%s", name)
+				continue
+			}
+
+			c.check(Cmaf_empty_sample_tables, box, count == 0, "%d entries", count)
+		}
+	}
+
+	return nil
+}
+
+// CheckSegment checks the next media segment (CMAF fragments or chunks). The
+// header is needed first for the trex default sample sizes.
+func (c *Cmaf_checker) CheckSegment(data []byte) error {
+	if c.segment_index < 0 {
+		c.segment_index = 0
+	}
+
+	defer func() { c.segment_index++ }()
+
+	boxes, err := ParseBoxes(data)
+	if err != nil {
+		return err
+	}
+
+	if styp := FindBox(boxes, "styp"); styp != nil {
+		brands := box_brands(styp)
+		c.check(Cmaf_segment_brand, styp, has_brand(brands, cmaf_segment_brands), "brands %v", brands)
+	}
+
+	for i, moof := range boxes {
+		if moof.Type != mp4_fourcc('m', 'o', 'o', 'f') {
+			continue
+		}
+
+		var mdat *Mp4_box
+		if i + 1 < len(boxes) && boxes[i + 1].Type == mp4_fourcc('m', 'd', 'a', 't') {
+			mdat = boxes[i + 1]
+		}
+
+		trafs := moof.ChildrenOfType(mp4_fourcc('t', 'r', 'a', 'f'))
+		c.check(Cmaf_single_traf, moof, len(trafs) == 1, "%d traf boxes", len(trafs))
+		for _, traf := range trafs {
+			err = c.check_traf(moof, traf, mdat)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Cmaf_checker) check_traf(moof *Mp4_box, traf *Mp4_box, mdat *Mp4_box) error {
+	tfhd_box := traf.Child(mp4_fourcc('t', 'f', 'h', 'd'))
+	if tfhd_box == nil {
+		return box_not_found(traf, "tfhd")
+	}
+
+	tfhd, err := parse_tfhd(tfhd_box.Payload)
+	if err != nil {
+		return in_box(err, tfhd_box)
+	}
+
+	base_is_moof := tfhd.Header.Flag & Tfhd_default_base_is_moof != 0 && tfhd.Header.Flag & Tfhd_base_data_offset_present == 0
+	c.check(Cmaf_default_base_is_moof, tfhd_box, base_is_moof, "tfhd flags 0x%06x", tfhd.Header.Flag)
+
+	tfdt := traf.Child(mp4_fourcc('t', 'f', 'd', 't'))
+	c.check(Cmaf_tfdt_present, traf, tfdt != nil, "")
+
+	default_sample_size := uint32(0)
+	if track, err := FindTrack(c.tracks, tfhd.Track_id, ""); err == nil {
+		default_sample_size = track.Default_sample_size
+	}
+
+	if tfhd.Header.Flag & Tfhd_default_sample_size_present != 0 {
+		default_sample_size = tfhd.Default_sample_size
+	}
+
+	// Without data offsets, the samples of the truns follow each other from
+	// the start of the mdat data
+	next_offset := uint64(0)
+	if mdat != nil {
+		next_offset = mdat.Offset + uint64(mdat.Header_size)
+	}
+
+	for _, trun_box := range traf.ChildrenOfType(mp4_fourcc('t', 'r', 'u', 'n')) {
+		trun, err := parse_trun(trun_box.Payload)
+		if err != nil {
+			return in_box(err, trun_box)
+		}
+
+		size := uint64(0)
+		for _, s := range trun.Samples {
+			if trun.Header.Flag & Trun_sample_size_present != 0 {
+				size += uint64(s.Size)
+			} else {
+				size += uint64(default_sample_size)
+			}
+		}
+
+		start := next_offset
+		if trun.Header.Flag & Trun_data_offset_present != 0 {
+			start = uint64(int64(moof.Offset) + int64(trun.Data_offset))
+		}
+
+		next_offset = start + size
+		switch {
+		case mdat == nil:
+			c.check(Cmaf_trun_data_in_mdat, trun_box, false, "no mdat follows the moof")
+		case trun.Header.Flag & Trun_data_offset_present == 0:
+			c.check(Cmaf_trun_data_in_mdat, trun_box, false, "no data_offset")
+		default:
+			data_start := mdat.Offset + uint64(mdat.Header_size)
+			data_end := mdat.Offset + mdat.Size
+			c.check(Cmaf_trun_data_in_mdat, trun_box, start >= data_start && start + size <= data_end, "samples at [%d, %d), mdat data at [%d, %d)", start, start + size, data_start, data_end)
+		}
+	}
+
+	return nil
+}
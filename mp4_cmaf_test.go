@@ -0,0 +1,193 @@
+package media_utils
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// cmaf_test_files returns the CMAF header and a media segment of the
+// mux_test_tracks video track.
+func cmaf_test_files(t *testing.T) ([]byte, []byte) {
+	var out bytes.Buffer
+	m, err := NewFmp4Muxer(&out, mux_test_tracks(48000)[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Cmaf = true
+	err = m.WriteInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	init_size := out.Len()
+	for i := 0; i < 30; i++ {
+		err = m.WriteSample(mux_test_video_sample(i, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = m.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Bytes()[:init_size], out.Bytes()[init_size:]
+}
+
+// cmaf_test_failed returns the rules of the failed checks, in check order.
+func cmaf_test_failed(c *Cmaf_checker) []string {
+	var rules []string
+	for _, check := range c.Checks {
+		if !check.Passed {
+			rules = append(rules, check.Rule)
+		}
+	}
+
+	return rules
+}
+
+func TestCmafCheckerPass(t *testing.T) {
+	init_data, seg := cmaf_test_files(t)
+	c := NewCmafChecker()
+	err := c.CheckHeader(init_data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.CheckSegment(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.CheckSegment(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Passed() {
+		t.Errorf("failed %v", cmaf_test_failed(c))
+	}
+
+	// Every rule applies to the muxer output
+	rules := make(map[string]bool)
+	for _, check := range c.Checks {
+		rules[check.Rule] = true
+	}
+
+	if len(rules) != len(cmaf_rule_clauses) {
+		t.Errorf("rules checked %v", rules)
+	}
+
+	if s := c.Checks[0].String(); s != "PASS header_brand [7.2] header ftyp: brands [iso6 iso6 mp41 cmfc]" {
+		t.Errorf("first check %q", s)
+	}
+
+	if last := c.Checks[len(c.Checks) - 1]; last.Segment_index != 1 || last.Rule != Cmaf_trun_data_in_mdat || last.Path != "moof/traf/trun" {
+		t.Errorf("last check %v", last)
+	}
+}
+
+func TestCmafCheckerHeaderFail(t *testing.T) {
+	// Two tracks, without CMAF brands
+	c := NewCmafChecker()
+	err := c.CheckHeader(mux_test_init(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed := cmaf_test_failed(c); !reflect.DeepEqual(failed, []string{Cmaf_header_brand, Cmaf_single_track}) || c.Passed() {
+		t.Errorf("failed %v", failed)
+	}
+
+	// A sample in the moov, and no mvex
+	init_data, _ := cmaf_test_files(t)
+	boxes, err := ParseBoxes(init_data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moov := FindBox(boxes, "moov")
+	moov.RemoveChild(moov.Child(mp4_fourcc('m', 'v', 'e', 'x')))
+	moov.Find("trak/mdia/minf/stbl/stts").Payload = append_uint32(append_uint32(append_uint32(nil, 0), 1), 1)
+	c = NewCmafChecker()
+	err = c.CheckHeader(SerializeBoxes(boxes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed := cmaf_test_failed(c)
+	if !reflect.DeepEqual(failed, []string{Cmaf_mvex_trex, Cmaf_empty_sample_tables}) {
+		t.Fatalf("failed %v", failed)
+	}
+
+	for _, check := range c.Checks {
+		if !check.Passed && check.Rule == Cmaf_empty_sample_tables && (check.Path != "moov/trak/mdia/minf/stbl/stts" || check.Message != "1 entries") {
+			t.Errorf("check %v", check)
+		}
+	}
+}
+
+func TestCmafCheckerSegmentFail(t *testing.T) {
+	init_data, _ := cmaf_test_files(t)
+	c := NewCmafChecker()
+	err := c.CheckHeader(init_data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A styp without CMAF brands and a traf with an explicit base_data_offset,
+	// without tfdt, whose trun data_offset 0 points at the moof
+	err = c.CheckSegment(emsg_test_segment())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The traf of each track in one moof, without CMAF brands
+	_, seg := mux_test_segment(t)
+	err = c.CheckSegment(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failed []string
+	for _, check := range c.Checks {
+		if !check.Passed {
+			failed = append(failed, fmt.Sprintf("%d %s %s", check.Segment_index, check.Rule, check.Path))
+		}
+	}
+
+	want := []string{
+		"0 segment_brand styp",
+		"0 default_base_is_moof moof/traf/tfhd",
+		"0 tfdt_present moof/traf",
+		"0 trun_data_in_mdat moof/traf/trun",
+		"1 segment_brand styp",
+		"1 single_traf moof",
+	}
+
+	if !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed %q", failed)
+	}
+}
+
+// FuzzCmafChecker checks that every check names a rule of ISO/IEC 23000-19
+// and the header or segment it applies to.
+func FuzzCmafChecker(f *testing.F) {
+	f.Add(fuzz_init(), fuzz_segment())
+	f.Fuzz(func(t *testing.T, init_data []byte, seg_data []byte) {
+		c := NewCmafChecker()
+		c.CheckHeader(init_data)
+		header_checks := len(c.Checks)
+		c.CheckSegment(seg_data)
+		c.Passed()
+		for i, check := range c.Checks {
+			if check.Clause == "" || check.Clause != cmaf_rule_clauses[check.Rule] || (check.Segment_index < 0) != (i < header_checks) {
+				t.Fatalf("check %d: %v", i, check)
+			}
+		}
+	})
+}
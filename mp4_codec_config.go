@@ -0,0 +1,685 @@
+package media_utils
+
+// Avcc_config is an AVCDecoderConfigurationRecord (avcC).
+type Avcc_config struct {
+	Configuration_version uint8
+	Profile uint8
+	Profile_compatibility uint8
+	Level uint8
+	Nal_length_size uint8
+	Sps [][]byte
+	Pps [][]byte
+}
+
+type Hvcc_nal_array struct {
+	Array_completeness bool
+	Nal_unit_type uint8
+	Nalus [][]byte
+}
+
+// Hvcc_config is an HEVCDecoderConfigurationRecord (hvcC).
+type Hvcc_config struct {
+	Configuration_version uint8
+	General_profile_space uint8
+	General_tier_flag bool
+	General_profile_idc uint8
+	General_profile_compatibility_flags uint32
+	General_constraint_indicator_flags uint64 // 48 bits
+	General_level_idc uint8
+	Chroma_format_idc uint8
+	Bit_depth_luma uint8
+	Bit_depth_chroma uint8
+	Nal_length_size uint8
+	Arrays []Hvcc_nal_array
+}
+
+// Audio_specific_config is the MPEG-4 AudioSpecificConfig of an esds.
+type Audio_specific_config struct {
+	Audio_object_type uint8
+	Sampling_frequency_index uint8
+	Sampling_frequency uint32
+	Channel_configuration uint8
+
+	// Explicitly signaled SBR/PS (HE-AAC v1/v2): Audio_object_type is 5 or 29
+	// and the AAC core is described by the fields below.
+	Extension_sampling_frequency_index uint8
+	Core_audio_object_type uint8
+
+	Data []byte
+}
+
+// Esds_config holds the fields of an esds ES_Descriptor relevant to decoding.
+type Esds_config struct {
+	Es_id uint16
+	Object_type_indication uint8
+	Stream_type uint8
+	Buffer_size uint32
+	Max_bitrate uint32
+	Avg_bitrate uint32
+	Decoder_specific_info []byte
+}
+
+var aac_sampling_frequencies = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// ParseAvcc decodes an avcC box payload.
+func ParseAvcc(payload []byte) (Avcc_config, error) {
+	var avcc Avcc_config
+	if len(payload) < 6 {
+		return avcc, parse_error(ErrTruncated, "incomplete_avcC", 0, "")
+	}
+
+	avcc.Configuration_version = payload[0]
+	avcc.Profile = payload[1]
+	avcc.Profile_compatibility = payload[2]
+	avcc.Level = payload[3]
+	avcc.Nal_length_size = payload[4] & 0x03 + 1
+
+	p := 6
+	num_sps := int(payload[5] & 0x1F)
+	for i := 0; i < num_sps; i++ {
+		if len(payload) - p < 2 {
+			return avcc, parse_error(ErrTruncated, "incomplete_avcC", uint64(p), "")
+		}
+
+		n := int(get_uint16(uint32(p), payload))
+		p += 2
+		if len(payload) - p < n {
+			return avcc, parse_error(ErrTruncated, "incomplete_avcC", uint64(p), "")
+		}
+
+		avcc.Sps = append(avcc.Sps, payload[p : p+n])
+		p += n
+	}
+
+	if len(payload) - p < 1 {
+		return avcc, parse_error(ErrTruncated, "incomplete_avcC", uint64(p), "")
+	}
+
+	num_pps := int(payload[p])
+	p++
+	for i := 0; i < num_pps; i++ {
+		if len(payload) - p < 2 {
+			return avcc, parse_error(ErrTruncated, "incomplete_avcC", uint64(p), "")
+		}
+
+		n := int(get_uint16(uint32(p), payload))
+		p += 2
+		if len(payload) - p < n {
+			return avcc, parse_error(ErrTruncated, "incomplete_avcC", uint64(p), "")
+		}
+
+		avcc.Pps = append(avcc.Pps, payload[p : p+n])
+		p += n
+	}
+
+	return avcc, nil
+}
+
+// ParseHvcc decodes an hvcC box payload.
+func ParseHvcc(payload []byte) (Hvcc_config, error) {
+	var hvcc Hvcc_config
+	if len(payload) < 23 {
+		return hvcc, parse_error(ErrTruncated, "incomplete_hvcC", 0, "")
+	}
+
+	hvcc.Configuration_version = payload[0]
+	hvcc.General_profile_space = payload[1] >> 6
+	hvcc.General_tier_flag = payload[1] & 0x20 != 0
+	hvcc.General_profile_idc = payload[1] & 0x1F
+	hvcc.General_profile_compatibility_flags = get_uint32(2, payload)
+	hvcc.General_constraint_indicator_flags = uint64(get_uint16(6, payload)) << 32 | uint64(get_uint32(8, payload))
+	hvcc.General_level_idc = payload[12]
+	hvcc.Chroma_format_idc = payload[16] & 0x03
+	hvcc.Bit_depth_luma = payload[17] & 0x07 + 8
+	hvcc.Bit_depth_chroma = payload[18] & 0x07 + 8
+	hvcc.Nal_length_size = payload[21] & 0x03 + 1
+
+	p := 23
+	num_arrays := int(payload[22])
+	for i := 0; i < num_arrays; i++ {
+		if len(payload) - p < 3 {
+			return hvcc, parse_error(ErrTruncated, "incomplete_hvcC", uint64(p), "")
+		}
+
+		var array Hvcc_nal_array
+		array.Array_completeness = payload[p] & 0x80 != 0
+		array.Nal_unit_type = payload[p] & 0x3F
+		num_nalus := int(get_uint16(uint32(p + 1), payload))
+		p += 3
+		for j := 0; j < num_nalus; j++ {
+			if len(payload) - p < 2 {
+				return hvcc, parse_error(ErrTruncated, "incomplete_hvcC", uint64(p), "")
+			}
+
+			n := int(get_uint16(uint32(p), payload))
+			p += 2
+			if len(payload) - p < n {
+				return hvcc, parse_error(ErrTruncated, "incomplete_hvcC", uint64(p), "")
+			}
+
+			array.Nalus = append(array.Nalus, payload[p : p+n])
+			p += n
+		}
+
+		hvcc.Arrays = append(hvcc.Arrays, array)
+	}
+
+	return hvcc, nil
+}
+
+// ParameterSets returns the VPS, SPS and PPS NAL units of the hvcC in that order.
+func (hvcc Hvcc_config) ParameterSets() [][]byte {
+	var nalus [][]byte
+	for _, nal_type := range []uint8{32, 33, 34} {
+		for _, array := range hvcc.Arrays {
+			if array.Nal_unit_type == nal_type {
+				nalus = append(nalus, array.Nalus...)
+			}
+		}
+	}
+
+	return nalus
+}
+
+// read_descriptor_header reads an MPEG-4 descriptor tag and its expandable size.
+func read_descriptor_header(d []byte, p int) (uint8, int, int, error) {
+	if len(d) - p < 2 {
+		return 0, 0, p, parse_error(ErrTruncated, "incomplete_descriptor", uint64(p), "")
+	}
+
+	tag := d[p]
+	p++
+	size := 0
+	for i := 0; i < 4; i++ {
+		if p >= len(d) {
+			return 0, 0, p, parse_error(ErrTruncated, "incomplete_descriptor", uint64(p), "")
+		}
+
+		b := d[p]
+		p++
+		size = size << 7 | int(b & 0x7F)
+		if b & 0x80 == 0 {
+			break
+		}
+	}
+
+	if len(d) - p < size {
+		return 0, 0, p, parse_error(ErrTruncated, "incomplete_descriptor", uint64(p), "")
+	}
+
+	return tag, size, p, nil
+}
+
+// ParseEsds decodes an esds box payload (version, flags and ES_Descriptor).
+func ParseEsds(payload []byte) (Esds_config, error) {
+	var esds Esds_config
+	if len(payload) < 4 {
+		return esds, parse_error(ErrTruncated, "incomplete_esds", 0, "")
+	}
+
+	tag, size, p, err := read_descriptor_header(payload, 4)
+	if err != nil {
+		return esds, err
+	}
+
+	if tag != 0x03 || size < 3 {
+		return esds, parse_error(ErrInvalidData, "invalid_es_descriptor", 4, "")
+	}
+
+	end := p + size
+	esds.Es_id = get_uint16(uint32(p), payload)
+	flags := payload[p+2]
+	p += 3
+	if flags & 0x80 != 0 {
+		p += 2 // dependsOn_ES_ID
+	}
+
+	if flags & 0x40 != 0 {
+		if p >= end {
+			return esds, parse_error(ErrTruncated, "incomplete_esds", 0, "")
+		}
+
+		p += 1 + int(payload[p]) // URLstring
+	}
+
+	if flags & 0x20 != 0 {
+		p += 2 // OCR_ES_Id
+	}
+
+	for p < end {
+		tag, size, body, err := read_descriptor_header(payload[:end], p)
+		if err != nil {
+			return esds, err
+		}
+
+		if tag == 0x04 && size >= 13 {
+			esds.Object_type_indication = payload[body]
+			esds.Stream_type = payload[body+1] >> 2
+			esds.Buffer_size = get_uint32(uint32(body + 1), payload) & 0x00FFFFFF
+			esds.Max_bitrate = get_uint32(uint32(body + 5), payload)
+			esds.Avg_bitrate = get_uint32(uint32(body + 9), payload)
+
+			q := body + 13
+			for q < body + size {
+				sub_tag, sub_size, sub_body, err := read_descriptor_header(payload[:body+size], q)
+				if err != nil {
+					return esds, err
+				}
+
+				if sub_tag == 0x05 {
+					esds.Decoder_specific_info = payload[sub_body : sub_body+sub_size]
+				}
+
+				q = sub_body + sub_size
+			}
+		}
+
+		p = body + size
+	}
+
+	return esds, nil
+}
+
+func read_audio_object_type(r *bit_reader) uint8 {
+	aot := uint8(r.read_bits(5))
+	if aot == 31 {
+		aot = 32 + uint8(r.read_bits(6))
+	}
+
+	return aot
+}
+
+func read_sampling_frequency(r *bit_reader) (uint8, uint32) {
+	index := uint8(r.read_bits(4))
+	if index == 0x0F {
+		return index, uint32(r.read_bits(24))
+	}
+
+	if int(index) < len(aac_sampling_frequencies) {
+		return index, aac_sampling_frequencies[index]
+	}
+
+	return index, 0
+}
+
+// ParseAudioSpecificConfig decodes the leading fields of an MPEG-4 AudioSpecificConfig.
+func ParseAudioSpecificConfig(data []byte) (Audio_specific_config, error) {
+	var asc Audio_specific_config
+	asc.Data = data
+	r := new_bit_reader(data)
+	asc.Audio_object_type = read_audio_object_type(r)
+	asc.Sampling_frequency_index, asc.Sampling_frequency = read_sampling_frequency(r)
+	asc.Channel_configuration = uint8(r.read_bits(4))
+	asc.Core_audio_object_type = asc.Audio_object_type
+	if asc.Audio_object_type == 5 || asc.Audio_object_type == 29 {
+		asc.Extension_sampling_frequency_index, _ = read_sampling_frequency(r)
+		asc.Core_audio_object_type = read_audio_object_type(r)
+	}
+
+	if r.err != nil {
+		return asc, parse_error(ErrTruncated, "incomplete_audio_specific_config", 0, "")
+	}
+
+	return asc, nil
+}
+
+// Adts_header holds the fields of an ADTS frame header of AAC in MPEG-2 TS.
+type Adts_header struct {
+	Audio_object_type uint8 // profile + 1
+	Sampling_frequency_index uint8
+	Sampling_frequency uint32
+	Channel_configuration uint8
+	Header_size int // 7, or 9 with a CRC
+	Frame_length int // including the header
+}
+
+// ParseAdtsHeader decodes the ADTS header at the start of d.
+func ParseAdtsHeader(d []byte) (Adts_header, error) {
+	var h Adts_header
+	if len(d) < 7 {
+		return h, parse_error(ErrTruncated, "incomplete_adts_header", 0, "")
+	}
+
+	if d[0] != 0xFF || d[1] & 0xF0 != 0xF0 {
+		return h, parse_error(ErrInvalidData, "invalid_adts_syncword", 0, "")
+	}
+
+	h.Header_size = 7
+	if d[1] & 0x01 == 0 {
+		h.Header_size = 9 // protection_absent 0: CRC
+	}
+
+	h.Audio_object_type = d[2] >> 6 + 1
+	h.Sampling_frequency_index = d[2] >> 2 & 0x0F
+	if int(h.Sampling_frequency_index) < len(aac_sampling_frequencies) {
+		h.Sampling_frequency = aac_sampling_frequencies[h.Sampling_frequency_index]
+	}
+
+	h.Channel_configuration = (d[2] & 0x01) << 2 | d[3] >> 6
+	h.Frame_length = int(d[3] & 0x03) << 11 | int(d[4]) << 3 | int(d[5]) >> 5
+	if h.Frame_length < h.Header_size {
+		return h, parse_error(ErrInvalidData, "invalid_adts_frame_length", 3, "")
+	}
+
+	return h, nil
+}
+
+// AudioSpecificConfig returns the 2-byte AudioSpecificConfig of the stream.
+func (h Adts_header) AudioSpecificConfig() []byte {
+	v := uint16(h.Audio_object_type) << 11 | uint16(h.Sampling_frequency_index) << 7 | uint16(h.Channel_configuration) << 3
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+// avc_sps_chroma_format reads chroma_format_idc and the bit depths from the
+// SPS of a High profile stream. It returns 4:2:0 8-bit for other profiles.
+func avc_sps_chroma_format(sps []byte) (uint8, uint8, uint8) {
+	rbsp := NalToRbsp(sps)
+	if len(rbsp) < 4 {
+		return 1, 8, 8
+	}
+
+	switch rbsp[1] {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+	default:
+		return 1, 8, 8
+	}
+
+	r := new_bit_reader(rbsp[4:])
+	r.read_ue() // seq_parameter_set_id
+	chroma_format_idc := uint8(r.read_ue())
+	if chroma_format_idc == 3 {
+		r.read_flag() // separate_colour_plane_flag
+	}
+
+	bit_depth_luma := uint8(r.read_ue()) + 8
+	bit_depth_chroma := uint8(r.read_ue()) + 8
+	return chroma_format_idc & 0x03, bit_depth_luma, bit_depth_chroma
+}
+
+// skip_avc_scaling_list skips a scaling_list of an SPS or PPS.
+func skip_avc_scaling_list(r *bit_reader, size int) {
+	last, next := int64(8), int64(8)
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			next = (last + r.read_se() + 256) % 256
+		}
+
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// avc_sps_dimensions returns the cropped picture size of an H.264 SPS.
+func avc_sps_dimensions(sps []byte) (uint16, uint16, error) {
+	_, width, height, err := read_avc_sps(sps)
+	return width, height, err
+}
+
+// read_avc_sps reads an H.264 SPS up to vui_parameters_present_flag and
+// returns the reader there and the cropped picture size.
+func read_avc_sps(sps []byte) (*bit_reader, uint16, uint16, error) {
+	rbsp := NalToRbsp(sps)
+	if len(rbsp) < 4 {
+		return nil, 0, 0, parse_error(ErrTruncated, "incomplete_sps", 0, "")
+	}
+
+	r := new_bit_reader(rbsp[4:])
+	r.read_ue() // seq_parameter_set_id
+	chroma_format_idc := uint64(1)
+	switch rbsp[1] {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma_format_idc = r.read_ue()
+		if chroma_format_idc == 3 {
+			r.read_flag() // separate_colour_plane_flag
+		}
+
+		r.read_ue() // bit_depth_luma_minus8
+		r.read_ue() // bit_depth_chroma_minus8
+		r.read_flag() // qpprime_y_zero_transform_bypass_flag
+		if r.read_flag() { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chroma_format_idc == 3 {
+				lists = 12
+			}
+
+			for i := 0; i < lists; i++ {
+				if r.read_flag() {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+
+					skip_avc_scaling_list(r, size)
+				}
+			}
+		}
+	}
+
+	r.read_ue() // log2_max_frame_num_minus4
+	switch r.read_ue() { // pic_order_cnt_type
+	case 0:
+		r.read_ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.read_flag() // delta_pic_order_always_zero_flag
+		r.read_se() // offset_for_non_ref_pic
+		r.read_se() // offset_for_top_to_bottom_field
+		cycle := r.read_ue()
+		for i := uint64(0); i < cycle && r.err == nil; i++ {
+			r.read_se()
+		}
+	}
+
+	r.read_ue() // max_num_ref_frames
+	r.read_flag() // gaps_in_frame_num_value_allowed_flag
+	width := (r.read_ue() + 1) * 16
+	map_units := r.read_ue() + 1
+	frame_mbs_only := r.read_bits(1)
+	if frame_mbs_only == 0 {
+		r.read_flag() // mb_adaptive_frame_field_flag
+	}
+
+	height := (2 - frame_mbs_only) * map_units * 16
+	r.read_flag() // direct_8x8_inference_flag
+	if r.read_flag() { // frame_cropping_flag
+		crop_x, crop_y := uint64(1), 2 - frame_mbs_only
+		switch chroma_format_idc {
+		case 1:
+			crop_x, crop_y = 2, 2 * (2 - frame_mbs_only)
+		case 2:
+			crop_x = 2
+		}
+
+		left, right, top, bottom := r.read_ue(), r.read_ue(), r.read_ue(), r.read_ue()
+		width -= crop_x * (left + right)
+		height -= crop_y * (top + bottom)
+	}
+
+	if r.err != nil {
+		return nil, 0, 0, parse_error(ErrTruncated, "incomplete_sps", 0, "")
+	}
+
+	return r, uint16(width), uint16(height), nil
+}
+
+// hevc_sps_config returns the profile, tier, level and format fields of an
+// hvcC, without the parameter set arrays, and the cropped picture size of an
+// HEVC SPS.
+func hevc_sps_config(sps []byte) (Hvcc_config, uint16, uint16, error) {
+	_, hvcc, _, width, height, err := read_hevc_sps(sps)
+	return hvcc, width, height, err
+}
+
+// read_hevc_sps reads an HEVC SPS up to the bit depths and returns the reader
+// there, the hvcC fields, sps_max_sub_layers_minus1 and the cropped picture size.
+func read_hevc_sps(sps []byte) (*bit_reader, Hvcc_config, int, uint16, uint16, error) {
+	var hvcc Hvcc_config
+	rbsp := NalToRbsp(sps)
+	if len(rbsp) < 3 {
+		return nil, hvcc, 0, 0, 0, parse_error(ErrTruncated, "incomplete_sps", 0, "")
+	}
+
+	r := new_bit_reader(rbsp[2:])
+	r.read_bits(4) // sps_video_parameter_set_id
+	max_sub_layers_minus1 := int(r.read_bits(3))
+	r.read_flag() // sps_temporal_id_nesting_flag
+	hvcc.General_profile_space = uint8(r.read_bits(2))
+	hvcc.General_tier_flag = r.read_flag()
+	hvcc.General_profile_idc = uint8(r.read_bits(5))
+	hvcc.General_profile_compatibility_flags = uint32(r.read_bits(32))
+	hvcc.General_constraint_indicator_flags = r.read_bits(48)
+	hvcc.General_level_idc = uint8(r.read_bits(8))
+	profile_present := make([]bool, max_sub_layers_minus1)
+	level_present := make([]bool, max_sub_layers_minus1)
+	for i := 0; i < max_sub_layers_minus1; i++ {
+		profile_present[i] = r.read_flag()
+		level_present[i] = r.read_flag()
+	}
+
+	if max_sub_layers_minus1 > 0 {
+		r.skip_bits(uint64(8 - max_sub_layers_minus1) * 2) // reserved_zero_2bits
+	}
+
+	for i := 0; i < max_sub_layers_minus1; i++ {
+		if profile_present[i] {
+			r.skip_bits(88)
+		}
+
+		if level_present[i] {
+			r.skip_bits(8)
+		}
+	}
+
+	r.read_ue() // sps_seq_parameter_set_id
+	hvcc.Chroma_format_idc = uint8(r.read_ue())
+	if hvcc.Chroma_format_idc == 3 {
+		r.read_flag() // separate_colour_plane_flag
+	}
+
+	width := r.read_ue()
+	height := r.read_ue()
+	if r.read_flag() { // conformance_window_flag
+		sub_width, sub_height := uint64(1), uint64(1)
+		switch hvcc.Chroma_format_idc {
+		case 1:
+			sub_width, sub_height = 2, 2
+		case 2:
+			sub_width = 2
+		}
+
+		left, right, top, bottom := r.read_ue(), r.read_ue(), r.read_ue(), r.read_ue()
+		width -= sub_width * (left + right)
+		height -= sub_height * (top + bottom)
+	}
+
+	hvcc.Bit_depth_luma = uint8(r.read_ue()) + 8
+	hvcc.Bit_depth_chroma = uint8(r.read_ue()) + 8
+	if r.err != nil {
+		return nil, hvcc, 0, 0, 0, parse_error(ErrTruncated, "incomplete_sps", 0, "")
+	}
+
+	return r, hvcc, max_sub_layers_minus1, uint16(width), uint16(height), nil
+}
+
+// BuildAvcc encodes an avcC box payload. High profile records get the chroma
+// format and bit depths of their first SPS.
+func BuildAvcc(avcc Avcc_config) []byte {
+	nal_length_size := avcc.Nal_length_size
+	if nal_length_size == 0 {
+		nal_length_size = 4
+	}
+
+	d := []byte{1, avcc.Profile, avcc.Profile_compatibility, avcc.Level, 0xFC | (nal_length_size - 1), 0xE0 | uint8(len(avcc.Sps))}
+	for _, sps := range avcc.Sps {
+		d = append(append_uint16(d, uint16(len(sps))), sps...)
+	}
+
+	d = append(d, uint8(len(avcc.Pps)))
+	for _, pps := range avcc.Pps {
+		d = append(append_uint16(d, uint16(len(pps))), pps...)
+	}
+
+	switch avcc.Profile {
+	case 100, 110, 122, 144:
+		chroma_format_idc, bit_depth_luma, bit_depth_chroma := uint8(1), uint8(8), uint8(8)
+		if len(avcc.Sps) > 0 {
+			chroma_format_idc, bit_depth_luma, bit_depth_chroma = avc_sps_chroma_format(avcc.Sps[0])
+		}
+
+		d = append(d, 0xFC | chroma_format_idc, 0xF8 | (bit_depth_luma - 8) & 0x07, 0xF8 | (bit_depth_chroma - 8) & 0x07, 0)
+	}
+
+	return d
+}
+
+// BuildHvcc encodes an hvcC box payload. Fields not kept in Hvcc_config
+// (min_spatial_segmentation, parallelismType, frame rate and temporal layers)
+// are written as unknown.
+func BuildHvcc(hvcc Hvcc_config) []byte {
+	nal_length_size := hvcc.Nal_length_size
+	if nal_length_size == 0 {
+		nal_length_size = 4
+	}
+
+	b1 := hvcc.General_profile_space << 6 | hvcc.General_profile_idc & 0x1F
+	if hvcc.General_tier_flag {
+		b1 |= 0x20
+	}
+
+	d := []byte{1, b1}
+	d = append_uint32(d, hvcc.General_profile_compatibility_flags)
+	d = append_uint16(d, uint16(hvcc.General_constraint_indicator_flags >> 32))
+	d = append_uint32(d, uint32(hvcc.General_constraint_indicator_flags))
+	d = append(d, hvcc.General_level_idc, 0xF0, 0, 0xFC, 0xFC | hvcc.Chroma_format_idc & 0x03)
+	d = append(d, 0xF8 | (max(hvcc.Bit_depth_luma, 8) - 8) & 0x07, 0xF8 | (max(hvcc.Bit_depth_chroma, 8) - 8) & 0x07)
+	d = append(d, 0, 0, nal_length_size - 1, uint8(len(hvcc.Arrays)))
+	for _, array := range hvcc.Arrays {
+		b := array.Nal_unit_type & 0x3F
+		if array.Array_completeness {
+			b |= 0x80
+		}
+
+		d = append_uint16(append(d, b), uint16(len(array.Nalus)))
+		for _, nalu := range array.Nalus {
+			d = append(append_uint16(d, uint16(len(nalu))), nalu...)
+		}
+	}
+
+	return d
+}
+
+// append_descriptor appends an MPEG-4 descriptor with its expandable size.
+func append_descriptor(d []byte, tag uint8, body []byte) []byte {
+	d = append(d, tag)
+	size := len(body)
+	for shift := 21; shift > 0; shift -= 7 {
+		if size >> shift != 0 {
+			d = append(d, 0x80 | uint8(size >> shift & 0x7F))
+		}
+	}
+
+	d = append(d, uint8(size & 0x7F))
+	return append(d, body...)
+}
+
+// BuildEsds encodes an esds box payload: version, flags and an ES_Descriptor
+// with its DecoderConfigDescriptor, DecoderSpecificInfo and SLConfigDescriptor.
+func BuildEsds(esds Esds_config) []byte {
+	stream_type := esds.Stream_type
+	if stream_type == 0 {
+		stream_type = 0x05 // audio
+	}
+
+	config := []byte{esds.Object_type_indication, stream_type << 2 | 1}
+	config = append(config, uint8(esds.Buffer_size >> 16), uint8(esds.Buffer_size >> 8), uint8(esds.Buffer_size))
+	config = append_uint32(append_uint32(config, esds.Max_bitrate), esds.Avg_bitrate)
+	if len(esds.Decoder_specific_info) > 0 {
+		config = append_descriptor(config, 0x05, esds.Decoder_specific_info)
+	}
+
+	es := append_uint16(nil, esds.Es_id)
+	es = append(es, 0) // flags
+	es = append_descriptor(es, 0x04, config)
+	es = append_descriptor(es, 0x06, []byte{0x02})
+	return append_descriptor(append_uint32(nil, 0), 0x03, es)
+}
@@ -0,0 +1,41 @@
+package media_utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzCodecConfig checks that the avcC, hvcC and esds payloads serialize back
+// to payloads parsing to the same configuration, and the ADTS header sizes.
+func FuzzCodecConfig(f *testing.F) {
+	f.Add([]byte{1, 0x64, 0, 0x1f, 0xff, 0xe1, 0, 4, 0x67, 0x64, 0, 0x1f, 1, 0, 2, 0x68, 0xee})
+	f.Add([]byte{0, 0, 0, 0, 0x03, 0x19, 0, 1, 0, 0x04, 0x11, 0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x05, 0x02, 0x12, 0x10, 0x06, 0x01, 0x02})
+	f.Add([]byte{0xFF, 0xF1, 0x50, 0x80, 0x02, 0x1F, 0xFC})
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		if avcc, err := ParseAvcc(payload); err == nil {
+			again, err := ParseAvcc(BuildAvcc(avcc))
+			if err != nil || !bytes.Equal(BuildAvcc(again), BuildAvcc(avcc)) {
+				t.Fatalf("avcC %+v read back as %+v: %v", avcc, again, err)
+			}
+		}
+
+		if hvcc, err := ParseHvcc(payload); err == nil {
+			again, err := ParseHvcc(BuildHvcc(hvcc))
+			if err != nil || !bytes.Equal(BuildHvcc(again), BuildHvcc(hvcc)) {
+				t.Fatalf("hvcC %+v read back as %+v: %v", hvcc, again, err)
+			}
+		}
+
+		if esds, err := ParseEsds(payload); err == nil {
+			again, err := ParseEsds(BuildEsds(esds))
+			if err != nil || !bytes.Equal(BuildEsds(again), BuildEsds(esds)) {
+				t.Fatalf("esds %+v read back as %+v: %v", esds, again, err)
+			}
+		}
+
+		ParseAudioSpecificConfig(payload)
+		if h, err := ParseAdtsHeader(payload); err == nil && ((h.Header_size != 7 && h.Header_size != 9) || h.Frame_length < h.Header_size) {
+			t.Fatalf("ADTS header %+v", h)
+		}
+	})
+}
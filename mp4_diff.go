@@ -0,0 +1,277 @@
+package media_utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// Box_diff kinds
+const (
+	Box_added = "added"
+	Box_removed = "removed"
+	Box_changed = "changed"
+)
+
+// Box_difference is one difference between two box trees. Path indexes
+// repeated sibling boxes, e.g. "moov/trak[1]/mdia/mdhd". Old and New hold the
+// box size of a removed or added box. For a changed box, Field is the decoded
+// field that changed, or "payload" when only the bytes differ, summarized as
+// "<sha256 prefix> (<size> bytes)". An mdat is only compared by its payload.
+type Box_difference struct {
+	Kind string
+	Path string
+	Field string
+	Old any
+	New any
+	Old_offset uint64
+	New_offset uint64
+}
+
+// Above this many child pairs the children are aligned by position instead
+// of by longest common subsequence.
+const max_box_alignment_cells = 1 << 20
+
+// box_alignment_key identifies the boxes that align with each other: the
+// type, and the track ID for trak and traf boxes.
+func box_alignment_key(box *Mp4_box) string {
+	key := box.TypeString()
+	var track_id any
+	switch box.Type {
+	case mp4_fourcc('t', 'r', 'a', 'k'):
+		if tkhd := box.Child(mp4_fourcc('t', 'k', 'h', 'd')); tkhd != nil {
+			fields, _ := decode_tkhd(tkhd)
+			track_id = fields.Get("track_id")
+		}
+	case mp4_fourcc('t', 'r', 'a', 'f'):
+		if tfhd := box.Child(mp4_fourcc('t', 'f', 'h', 'd')); tfhd != nil {
+			fields, _ := decode_tfhd(tfhd)
+			track_id = fields.Get("track_id")
+		}
+	}
+
+	if track_id != nil {
+		key += fmt.Sprintf("#%v", track_id)
+	}
+
+	return key
+}
+
+// align_boxes pairs the boxes of a and b by the longest common subsequence of
+// their alignment keys. Unpaired boxes have a nil partner.
+func align_boxes(a []*Mp4_box, b []*Mp4_box) [][2]*Mp4_box {
+	var pairs [][2]*Mp4_box
+	if len(a) * len(b) > max_box_alignment_cells {
+		for i := 0; i < len(a) || i < len(b); i++ {
+			var pair [2]*Mp4_box
+			if i < len(a) {
+				pair[0] = a[i]
+			}
+
+			if i < len(b) {
+				pair[1] = b[i]
+			}
+
+			pairs = append(pairs, pair)
+		}
+
+		return pairs
+	}
+
+	key_a := make([]string, len(a))
+	for i, box := range a {
+		key_a[i] = box_alignment_key(box)
+	}
+
+	key_b := make([]string, len(b))
+	for i, box := range b {
+		key_b[i] = box_alignment_key(box)
+	}
+
+	// lcs[i][j]: length of the common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a) + 1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b) + 1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if key_a[i] == key_b[j] {
+				lcs[i][j] = lcs[i + 1][j + 1] + 1
+			} else if lcs[i + 1][j] >= lcs[i][j + 1] {
+				lcs[i][j] = lcs[i + 1][j]
+			} else {
+				lcs[i][j] = lcs[i][j + 1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && key_a[i] == key_b[j]:
+			pairs = append(pairs, [2]*Mp4_box{a[i], b[j]})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i + 1][j] >= lcs[i][j + 1]):
+			pairs = append(pairs, [2]*Mp4_box{a[i], nil})
+			i++
+		default:
+			pairs = append(pairs, [2]*Mp4_box{nil, b[j]})
+			j++
+		}
+	}
+
+	return pairs
+}
+
+func payload_summary(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return fmt.Sprintf("%s (%d bytes)", hex.EncodeToString(sum[:8]), len(payload))
+}
+
+func payloads_equal(a []byte, b []byte) bool {
+	return len(a) == len(b) && string(a) == string(b)
+}
+
+// diff_box_pairs compares aligned sibling boxes under parent_path.
+func diff_box_pairs(a []*Mp4_box, b []*Mp4_box, parent_path string, diffs []Box_difference) []Box_difference {
+	pairs := align_boxes(a, b)
+
+	// Number the repeated types, separately in each tree
+	count_a := make(map[uint32]int)
+	count_b := make(map[uint32]int)
+	for _, pair := range pairs {
+		if pair[0] != nil {
+			count_a[pair[0].Type]++
+		}
+
+		if pair[1] != nil {
+			count_b[pair[1].Type]++
+		}
+	}
+
+	index_a := make(map[uint32]int)
+	index_b := make(map[uint32]int)
+	for _, pair := range pairs {
+		old_box, new_box := pair[0], pair[1]
+		var path string
+		if old_box != nil {
+			path = box_diff_path(parent_path, old_box.Type, index_a[old_box.Type], count_a[old_box.Type] > 1 || count_b[old_box.Type] > 1)
+			index_a[old_box.Type]++
+		}
+
+		if new_box != nil {
+			if old_box == nil {
+				path = box_diff_path(parent_path, new_box.Type, index_b[new_box.Type], count_a[new_box.Type] > 1 || count_b[new_box.Type] > 1)
+			}
+
+			index_b[new_box.Type]++
+		}
+
+		switch {
+		case new_box == nil:
+			diffs = append(diffs, Box_difference{Kind: Box_removed, Path: path, Old: old_box.Size, Old_offset: old_box.Offset})
+		case old_box == nil:
+			diffs = append(diffs, Box_difference{Kind: Box_added, Path: path, New: new_box.Size, New_offset: new_box.Offset})
+		default:
+			diffs = diff_boxes(old_box, new_box, path, diffs)
+		}
+	}
+
+	return diffs
+}
+
+func box_diff_path(parent_path string, box_type uint32, index int, indexed bool) string {
+	path := box_path(parent_path, box_type)
+	if indexed {
+		path += fmt.Sprintf("[%d]", index)
+	}
+
+	return path
+}
+
+// diff_boxes compares two aligned boxes of the same type and their children.
+func diff_boxes(old_box *Mp4_box, new_box *Mp4_box, path string, diffs []Box_difference) []Box_difference {
+	changed := func(field string, old_value any, new_value any) {
+		diffs = append(diffs, Box_difference{Kind: Box_changed, Path: path, Field: field, Old: old_value, New: new_value, Old_offset: old_box.Offset, New_offset: new_box.Offset})
+	}
+
+	old_fields, old_err := decode_box_fields(old_box)
+	new_fields, new_err := decode_box_fields(new_box)
+	// The payload summary of an mdat already gives its data_size
+	if old_box.Type == mp4_fourcc('m', 'd', 'a', 't') {
+		old_fields, new_fields = nil, nil
+	}
+
+	if old_err != nil {
+		old_fields = append(old_fields, Box_field{"error", old_err.Error()})
+	}
+
+	if new_err != nil {
+		new_fields = append(new_fields, Box_field{"error", new_err.Error()})
+	}
+
+	fields_changed := false
+	for _, f := range old_fields {
+		new_value := new_fields.Get(f.Name)
+		if fmt.Sprint(f.Value) != fmt.Sprint(new_value) {
+			changed(f.Name, f.Value, new_value)
+			fields_changed = true
+		}
+	}
+
+	for _, f := range new_fields {
+		if old_fields.Get(f.Name) == nil {
+			changed(f.Name, nil, f.Value)
+			fields_changed = true
+		}
+	}
+
+	// Bytes not covered by the decoded fields, e.g. sample data
+	if !fields_changed && !payloads_equal(old_box.Payload, new_box.Payload) {
+		changed("payload", payload_summary(old_box.Payload), payload_summary(new_box.Payload))
+	}
+
+	return diff_box_pairs(old_box.Children, new_box.Children, path, diffs)
+}
+
+// DiffBoxes aligns two box trees and reports the added and removed boxes and
+// the changed fields of the boxes present in both. Box offsets are not
+// compared: a box moving is only reported through what made it move.
+func DiffBoxes(old_boxes []*Mp4_box, new_boxes []*Mp4_box) []Box_difference {
+	return diff_box_pairs(old_boxes, new_boxes, "", nil)
+}
+
+func diff_value(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "(none)"
+	case string:
+		return v
+	}
+
+	return format_field_value(v)
+}
+
+// WriteBoxDiff writes one line per difference: "+" added, "-" removed, "~" changed.
+func WriteBoxDiff(w io.Writer, diffs []Box_difference) error {
+	for _, d := range diffs {
+		var err error
+		switch d.Kind {
+		case Box_added:
+			_, err = fmt.Fprintf(w, "+ %s at offset %d, size %v\n", d.Path, d.New_offset, d.New)
+		case Box_removed:
+			_, err = fmt.Fprintf(w, "- %s at offset %d, size %v\n", d.Path, d.Old_offset, d.Old)
+		default:
+			_, err = fmt.Fprintf(w, "~ %s %s: %s -> %s\n", d.Path, d.Field, diff_value(d.Old), diff_value(d.New))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
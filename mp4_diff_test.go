@@ -0,0 +1,41 @@
+package media_utils
+
+import (
+	"io"
+	"testing"
+)
+
+func TestDiffBoxesMdat(t *testing.T) {
+	old_mdat := NewBox(mp4_fourcc('m', 'd', 'a', 't'), []byte("abcd"))
+	if info := DescribeBox(old_mdat); info.Fields.Get("data_size") != 4 {
+		t.Errorf("mdat fields %+v", info.Fields)
+	}
+
+	// Same size, and a different size: the payload is reported either way
+	for _, data := range []string{"abce", "abcdef"} {
+		new_mdat := NewBox(mp4_fourcc('m', 'd', 'a', 't'), []byte(data))
+		diffs := DiffBoxes([]*Mp4_box{old_mdat}, []*Mp4_box{new_mdat})
+		if len(diffs) != 1 || diffs[0].Kind != Box_changed || diffs[0].Field != "payload" || diffs[0].Old != payload_summary(old_mdat.Payload) || diffs[0].New != payload_summary(new_mdat.Payload) {
+			t.Errorf("mdat %q differences %+v", data, diffs)
+		}
+	}
+}
+
+// FuzzDiffBoxes checks that a box tree has no difference with itself.
+func FuzzDiffBoxes(f *testing.F) {
+	f.Add(fuzz_init(), fuzz_segment())
+	f.Fuzz(func(t *testing.T, a []byte, b []byte) {
+		a_boxes, err := ParseBoxes(a)
+		if err != nil {
+			return
+		}
+
+		if diffs := DiffBoxes(a_boxes, a_boxes); len(diffs) != 0 {
+			t.Fatalf("differences with itself: %+v", diffs)
+		}
+
+		if b_boxes, err := ParseBoxes(b); err == nil {
+			WriteBoxDiff(io.Discard, DiffBoxes(a_boxes, b_boxes))
+		}
+	})
+}
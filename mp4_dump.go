@@ -0,0 +1,772 @@
+package media_utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Box_field is one decoded field of a box, e.g. {"timescale", 90000}.
+type Box_field struct {
+	Name string
+	Value any
+}
+
+// Box_fields keeps the fields in box order. It marshals to a JSON object.
+type Box_fields []Box_field
+
+func (fields Box_fields) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		name, err := json.Marshal(f.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := json.Marshal(f.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Get returns the value of the field called name, or nil.
+func (fields Box_fields) Get(name string) any {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+
+	return nil
+}
+
+// Box_info describes a box of a parsed tree: where it is and what its known
+// fields decode to. Fields that fail to decode are reported in an "error" field.
+type Box_info struct {
+	Type string
+	Path string
+	Offset uint64
+	Size uint64
+	Fields Box_fields
+	Children []Box_info
+}
+
+// DescribeBoxes decodes the fields of boxes and their descendants.
+func DescribeBoxes(boxes []*Mp4_box) []Box_info {
+	var infos []Box_info
+	for _, box := range boxes {
+		infos = append(infos, DescribeBox(box))
+	}
+
+	return infos
+}
+
+// DescribeBox decodes the fields of box and its descendants.
+func DescribeBox(box *Mp4_box) Box_info {
+	info := Box_info{Type: box.TypeString(), Path: box.Path(), Offset: box.Offset, Size: box.Size}
+	fields, err := decode_box_fields(box)
+	info.Fields = fields
+	if err != nil {
+		info.Fields = append(info.Fields, Box_field{"error", err.Error()})
+	}
+
+	info.Children = DescribeBoxes(box.Children)
+	return info
+}
+
+func format_field_value(v any) string {
+	switch v := v.(type) {
+	case string:
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			return strconv.Quote(v)
+		}
+
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	}
+
+	return fmt.Sprint(v)
+}
+
+// String returns the fields as space separated name=value pairs.
+func (fields Box_fields) String() string {
+	var parts []string
+	for _, f := range fields {
+		parts = append(parts, f.Name + "=" + format_field_value(f.Value))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func write_box_tree(w io.Writer, infos []Box_info, depth int) error {
+	for _, info := range infos {
+		line := fmt.Sprintf("%s[%s] offset=%d size=%d", strings.Repeat("  ", depth), info.Type, info.Offset, info.Size)
+		if len(info.Fields) > 0 {
+			line += " " + info.Fields.String()
+		}
+
+		_, err := fmt.Fprintln(w, line)
+		if err != nil {
+			return err
+		}
+
+		err = write_box_tree(w, info.Children, depth + 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteBoxTree writes one line per box, children indented below their parent:
+//
+//	[moof] offset=1024 size=612
+//	  [mfhd] offset=1032 size=16 sequence_number=1
+func WriteBoxTree(w io.Writer, infos []Box_info) error {
+	return write_box_tree(w, infos, 0)
+}
+
+// uuid_string formats 16 bytes, e.g. a KID or a DRM system ID, as a UUID.
+func uuid_string(b []byte) string {
+	h := hex.EncodeToString(b)
+	if len(h) != 32 {
+		return h
+	}
+
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// fixed_16_16 converts a 16.16 fixed point value.
+func fixed_16_16(v uint32) float64 {
+	return float64(v) / 65536
+}
+
+// Decoders of the fields of the known boxes
+var box_field_decoders = map[uint32]func(box *Mp4_box) (Box_fields, error){
+	mp4_fourcc('f', 't', 'y', 'p'): decode_brands,
+	mp4_fourcc('s', 't', 'y', 'p'): decode_brands,
+	mp4_fourcc('m', 'v', 'h', 'd'): decode_mvhd,
+	mp4_fourcc('t', 'k', 'h', 'd'): decode_tkhd,
+	mp4_fourcc('m', 'd', 'h', 'd'): decode_mdhd,
+	mp4_fourcc('h', 'd', 'l', 'r'): decode_hdlr,
+	mp4_fourcc('m', 'e', 'h', 'd'): decode_mehd,
+	mp4_fourcc('t', 'r', 'e', 'x'): decode_trex,
+	mp4_fourcc('m', 'f', 'h', 'd'): decode_mfhd,
+	mp4_fourcc('t', 'f', 'h', 'd'): decode_tfhd,
+	mp4_fourcc('t', 'f', 'd', 't'): decode_tfdt,
+	mp4_fourcc('t', 'r', 'u', 'n'): decode_trun,
+	mp4_fourcc('s', 'i', 'd', 'x'): decode_sidx,
+	mp4_fourcc('s', 't', 's', 'd'): decode_entry_count,
+	mp4_fourcc('s', 't', 't', 's'): decode_entry_count,
+	mp4_fourcc('c', 't', 't', 's'): decode_entry_count,
+	mp4_fourcc('s', 't', 's', 's'): decode_entry_count,
+	mp4_fourcc('s', 't', 's', 'c'): decode_entry_count,
+	mp4_fourcc('s', 't', 'c', 'o'): decode_entry_count,
+	mp4_fourcc('c', 'o', '6', '4'): decode_entry_count,
+	mp4_fourcc('e', 'l', 's', 't'): decode_elst,
+	mp4_fourcc('s', 'a', 'i', 'o'): decode_entry_count,
+	mp4_fourcc('s', 't', 's', 'z'): decode_stsz,
+	mp4_fourcc('s', 't', 'z', '2'): decode_stsz,
+	mp4_fourcc('s', 'd', 't', 'p'): decode_sdtp,
+	mp4_fourcc('a', 'v', 'c', 'C'): decode_avcc,
+	mp4_fourcc('h', 'v', 'c', 'C'): decode_hvcc,
+	mp4_fourcc('e', 's', 'd', 's'): decode_esds,
+	mp4_fourcc('b', 't', 'r', 't'): decode_btrt,
+	mp4_fourcc('p', 'a', 's', 'p'): decode_pasp,
+	mp4_fourcc('c', 'o', 'l', 'r'): decode_colr,
+	mp4_fourcc('m', 'd', 'c', 'v'): decode_mdcv,
+	mp4_fourcc('c', 'l', 'l', 'i'): decode_clli,
+	mp4_fourcc('d', 'v', 'c', 'C'): decode_dolby_vision,
+	mp4_fourcc('d', 'v', 'v', 'C'): decode_dolby_vision,
+	mp4_fourcc('d', 'v', 'w', 'C'): decode_dolby_vision,
+	mp4_fourcc('e', 'm', 's', 'g'): decode_emsg,
+	mp4_fourcc('p', 'r', 'f', 't'): decode_prft,
+	mp4_fourcc('f', 'r', 'm', 'a'): decode_frma,
+	mp4_fourcc('s', 'c', 'h', 'm'): decode_schm,
+	mp4_fourcc('t', 'e', 'n', 'c'): decode_tenc,
+	mp4_fourcc('p', 's', 's', 'h'): decode_pssh,
+	mp4_fourcc('s', 'e', 'n', 'c'): decode_senc,
+	mp4_fourcc('s', 'a', 'i', 'z'): decode_saiz,
+	mp4_fourcc('m', 'd', 'a', 't'): decode_mdat,
+}
+
+func decode_box_fields(box *Mp4_box) (Box_fields, error) {
+	if mp4_visual_sample_entries[box.Type] {
+		return decode_visual_sample_entry(box)
+	}
+
+	if mp4_audio_sample_entries[box.Type] {
+		return decode_audio_sample_entry(box)
+	}
+
+	decode, ok := box_field_decoders[box.Type]
+	if !ok {
+		return nil, nil
+	}
+
+	fields, err := decode(box)
+	return fields, in_box(err, box)
+}
+
+// full_box_fields returns the version and flags fields of a full box.
+func full_box_fields(box *Mp4_box) Box_fields {
+	return Box_fields{{"version", box.Version()}, {"flags", fmt.Sprintf("0x%06x", box.Flags())}}
+}
+
+func decode_brands(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if len(d) < 8 {
+		return nil, incomplete_box(box)
+	}
+
+	var brands []string
+	for p := 8; p + 4 <= len(d); p += 4 {
+		brands = append(brands, fourcc_string(get_uint32(uint32(p), d)))
+	}
+
+	return Box_fields{{"major_brand", fourcc_string(get_uint32(0, d))}, {"minor_version", get_uint32(4, d)}, {"compatible_brands", brands}}, nil
+}
+
+func decode_mvhd(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	fields := full_box_fields(box)
+	if box.Version() == 1 {
+		if len(d) < 116 {
+			return fields, incomplete_box(box)
+		}
+
+		return append(fields, Box_field{"timescale", get_uint32(20, d)}, Box_field{"duration", get_uint64(24, d)}, Box_field{"next_track_id", get_uint32(112, d)}), nil
+	}
+
+	if len(d) < 100 {
+		return fields, incomplete_box(box)
+	}
+
+	return append(fields, Box_field{"timescale", get_uint32(12, d)}, Box_field{"duration", uint64(get_uint32(16, d))}, Box_field{"next_track_id", get_uint32(96, d)}), nil
+}
+
+func decode_tkhd(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	fields := full_box_fields(box)
+	track_id_offset, duration, size_offset := uint32(12), uint64(0), uint32(76)
+	if box.Version() == 1 {
+		track_id_offset, size_offset = 20, 88
+	}
+
+	if uint32(len(d)) < size_offset + 8 {
+		return fields, incomplete_box(box)
+	}
+
+	if box.Version() == 1 {
+		duration = get_uint64(28, d)
+	} else {
+		duration = uint64(get_uint32(20, d))
+	}
+
+	return append(fields, Box_field{"track_id", get_uint32(track_id_offset, d)}, Box_field{"duration", duration},
+		Box_field{"width", fixed_16_16(get_uint32(size_offset, d))}, Box_field{"height", fixed_16_16(get_uint32(size_offset + 4, d))}), nil
+}
+
+func decode_mdhd(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	fields := full_box_fields(box)
+	if box.Version() == 1 {
+		if len(d) < 34 {
+			return fields, incomplete_box(box)
+		}
+
+		return append(fields, Box_field{"timescale", get_uint32(20, d)}, Box_field{"duration", get_uint64(24, d)}, Box_field{"language", mdhd_language(get_uint16(32, d))}), nil
+	}
+
+	if len(d) < 22 {
+		return fields, incomplete_box(box)
+	}
+
+	return append(fields, Box_field{"timescale", get_uint32(12, d)}, Box_field{"duration", uint64(get_uint32(16, d))}, Box_field{"language", mdhd_language(get_uint16(20, d))}), nil
+}
+
+func decode_hdlr(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if len(d) < 20 {
+		return nil, incomplete_box(box)
+	}
+
+	name := d[20:]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+
+	return Box_fields{{"handler_type", fourcc_string(get_uint32(8, d))}, {"name", string(name)}}, nil
+}
+
+func decode_mehd(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if box.Version() == 1 {
+		if len(d) < 12 {
+			return nil, incomplete_box(box)
+		}
+
+		return Box_fields{{"fragment_duration", get_uint64(4, d)}}, nil
+	}
+
+	if len(d) < 8 {
+		return nil, incomplete_box(box)
+	}
+
+	return Box_fields{{"fragment_duration", uint64(get_uint32(4, d))}}, nil
+}
+
+func decode_trex(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if len(d) < 24 {
+		return nil, incomplete_box(box)
+	}
+
+	return Box_fields{{"track_id", get_uint32(4, d)}, {"default_sample_description_index", get_uint32(8, d)}, {"default_sample_duration", get_uint32(12, d)},
+		{"default_sample_size", get_uint32(16, d)}, {"default_sample_flags", fmt.Sprintf("0x%08x", get_uint32(20, d))}}, nil
+}
+
+func decode_mfhd(box *Mp4_box) (Box_fields, error) {
+	if len(box.Payload) < 8 {
+		return nil, incomplete_box(box)
+	}
+
+	return Box_fields{{"sequence_number", get_uint32(4, box.Payload)}}, nil
+}
+
+func decode_tfhd(box *Mp4_box) (Box_fields, error) {
+	tfhd, err := parse_tfhd(box.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := Box_fields{{"flags", fmt.Sprintf("0x%06x", tfhd.Header.Flag)}, {"track_id", tfhd.Track_id}}
+	flag := tfhd.Header.Flag
+	if flag & Tfhd_base_data_offset_present != 0 {
+		fields = append(fields, Box_field{"base_data_offset", tfhd.Base_data_offset})
+	}
+
+	if flag & Tfhd_sample_description_index_present != 0 {
+		fields = append(fields, Box_field{"sample_description_index", tfhd.Sample_description_index})
+	}
+
+	if flag & Tfhd_default_sample_duration_present != 0 {
+		fields = append(fields, Box_field{"default_sample_duration", tfhd.Default_sample_duration})
+	}
+
+	if flag & Tfhd_default_sample_size_present != 0 {
+		fields = append(fields, Box_field{"default_sample_size", tfhd.Default_sample_size})
+	}
+
+	if flag & Tfhd_default_sample_flags_present != 0 {
+		fields = append(fields, Box_field{"default_sample_flags", fmt.Sprintf("0x%08x", tfhd.Default_sample_flags)})
+	}
+
+	if flag & Tfhd_default_base_is_moof != 0 {
+		fields = append(fields, Box_field{"default_base_is_moof", true})
+	}
+
+	return fields, nil
+}
+
+func decode_tfdt(box *Mp4_box) (Box_fields, error) {
+	t, err := parse_tfdt(box.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return Box_fields{{"version", box.Version()}, {"base_media_decode_time", t}}, nil
+}
+
+func decode_trun(box *Mp4_box) (Box_fields, error) {
+	trun, err := parse_trun(box.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := Box_fields{{"version", trun.Header.Version}, {"flags", fmt.Sprintf("0x%06x", trun.Header.Flag)}, {"sample_count", len(trun.Samples)}}
+	if trun.Header.Flag & Trun_data_offset_present != 0 {
+		fields = append(fields, Box_field{"data_offset", trun.Data_offset})
+	}
+
+	if trun.Header.Flag & Trun_first_sample_flags_present != 0 {
+		fields = append(fields, Box_field{"first_sample_flags", fmt.Sprintf("0x%08x", trun.First_sample_flags)})
+	}
+
+	if trun.Header.Flag & Trun_sample_duration_present != 0 {
+		total := uint64(0)
+		for _, s := range trun.Samples {
+			total += uint64(s.Duration)
+		}
+
+		fields = append(fields, Box_field{"total_duration", total})
+	}
+
+	if trun.Header.Flag & Trun_sample_size_present != 0 {
+		total := uint64(0)
+		for _, s := range trun.Samples {
+			total += uint64(s.Size)
+		}
+
+		fields = append(fields, Box_field{"total_size", total})
+	}
+
+	return fields, nil
+}
+
+func decode_sidx(box *Mp4_box) (Box_fields, error) {
+	sidx, err := parse_sidx(box.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return Box_fields{{"version", sidx.Header.Version}, {"reference_id", sidx.Reference_id}, {"timescale", sidx.Timescale},
+		{"earliest_presentation_time", sidx.Earliest_presentation_time}, {"first_offset", sidx.First_offset}, {"reference_count", len(sidx.References)}}, nil
+}
+
+func decode_entry_count(box *Mp4_box) (Box_fields, error) {
+	if len(box.Payload) < 8 {
+		return nil, incomplete_box(box)
+	}
+
+	offset := uint32(4)
+	if box.Type == mp4_fourcc('s', 'a', 'i', 'o') && box.Flags() & 0x01 != 0 {
+		// aux_info_type and aux_info_type_parameter
+		offset = 12
+		if len(box.Payload) < 16 {
+			return nil, incomplete_box(box)
+		}
+	}
+
+	return Box_fields{{"entry_count", get_uint32(offset, box.Payload)}}, nil
+}
+
+func decode_stsz(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if len(d) < 12 {
+		return nil, incomplete_box(box)
+	}
+
+	if box.Type == mp4_fourcc('s', 't', 'z', '2') {
+		return Box_fields{{"field_size", d[7]}, {"sample_count", get_uint32(8, d)}}, nil
+	}
+
+	return Box_fields{{"sample_size", get_uint32(4, d)}, {"sample_count", get_uint32(8, d)}}, nil
+}
+
+func decode_sdtp(box *Mp4_box) (Box_fields, error) {
+	if len(box.Payload) < 4 {
+		return nil, incomplete_box(box)
+	}
+
+	return Box_fields{{"sample_count", len(box.Payload) - 4}}, nil
+}
+
+func decode_elst(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if len(d) < 8 {
+		return nil, incomplete_box(box)
+	}
+
+	entry_count := get_uint32(4, d)
+	fields := Box_fields{{"version", box.Version()}, {"entry_count", entry_count}}
+	entry_size := uint32(12)
+	if box.Version() == 1 {
+		entry_size = 20
+	}
+
+	if (uint32(len(d)) - 8) / entry_size < entry_count {
+		return fields, incomplete_box(box)
+	}
+
+	var durations []string
+	var media_times []string
+	for i := uint32(0); i < entry_count; i++ {
+		p := 8 + i * entry_size
+		if box.Version() == 1 {
+			durations = append(durations, strconv.FormatUint(get_uint64(uint64(p), d), 10))
+			media_times = append(media_times, strconv.FormatInt(int64(get_uint64(uint64(p + 8), d)), 10))
+		} else {
+			durations = append(durations, strconv.FormatUint(uint64(get_uint32(p, d)), 10))
+			media_times = append(media_times, strconv.FormatInt(int64(int32(get_uint32(p + 4, d))), 10))
+		}
+	}
+
+	return append(fields, Box_field{"segment_durations", durations}, Box_field{"media_times", media_times}), nil
+}
+
+func decode_visual_sample_entry(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if len(d) < 78 {
+		return nil, incomplete_box(box)
+	}
+
+	// compressorname: a length byte and up to 31 characters
+	name_size := int(d[42])
+	if name_size > 31 {
+		name_size = 31
+	}
+
+	return Box_fields{{"data_reference_index", get_uint16(6, d)}, {"width", get_uint16(24, d)}, {"height", get_uint16(26, d)},
+		{"compressorname", string(d[43 : 43+name_size])}, {"depth", get_uint16(74, d)}}, nil
+}
+
+func decode_audio_sample_entry(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if len(d) < 28 {
+		return nil, incomplete_box(box)
+	}
+
+	return Box_fields{{"data_reference_index", get_uint16(6, d)}, {"channel_count", get_uint16(16, d)}, {"sample_size", get_uint16(18, d)},
+		{"sample_rate", get_uint32(24, d) >> 16}}, nil
+}
+
+func decode_avcc(box *Mp4_box) (Box_fields, error) {
+	avcc, err := ParseAvcc(box.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return Box_fields{{"profile", avcc.Profile}, {"profile_compatibility", avcc.Profile_compatibility}, {"level", avcc.Level},
+		{"nal_length_size", avcc.Nal_length_size}, {"sps_count", len(avcc.Sps)}, {"pps_count", len(avcc.Pps)}}, nil
+}
+
+func decode_hvcc(box *Mp4_box) (Box_fields, error) {
+	hvcc, err := ParseHvcc(box.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return Box_fields{{"general_profile_space", hvcc.General_profile_space}, {"general_tier_flag", hvcc.General_tier_flag},
+		{"general_profile_idc", hvcc.General_profile_idc}, {"general_level_idc", hvcc.General_level_idc}, {"chroma_format_idc", hvcc.Chroma_format_idc},
+		{"bit_depth_luma", hvcc.Bit_depth_luma}, {"bit_depth_chroma", hvcc.Bit_depth_chroma}, {"nal_length_size", hvcc.Nal_length_size}, {"array_count", len(hvcc.Arrays)}}, nil
+}
+
+func decode_esds(box *Mp4_box) (Box_fields, error) {
+	esds, err := ParseEsds(box.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := Box_fields{{"es_id", esds.Es_id}, {"object_type_indication", fmt.Sprintf("0x%02x", esds.Object_type_indication)},
+		{"max_bitrate", esds.Max_bitrate}, {"avg_bitrate", esds.Avg_bitrate}}
+	if esds.Object_type_indication == 0x40 && len(esds.Decoder_specific_info) > 0 {
+		asc, err := ParseAudioSpecificConfig(esds.Decoder_specific_info)
+		if err != nil {
+			return fields, at_box(err, box)
+		}
+
+		fields = append(fields, Box_field{"audio_object_type", asc.Audio_object_type}, Box_field{"sampling_frequency", asc.Sampling_frequency},
+			Box_field{"channel_configuration", asc.Channel_configuration})
+	}
+
+	return fields, nil
+}
+
+func decode_btrt(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if len(d) < 12 {
+		return nil, incomplete_box(box)
+	}
+
+	return Box_fields{{"buffer_size_db", get_uint32(0, d)}, {"max_bitrate", get_uint32(4, d)}, {"avg_bitrate", get_uint32(8, d)}}, nil
+}
+
+func decode_pasp(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if len(d) < 8 {
+		return nil, incomplete_box(box)
+	}
+
+	return Box_fields{{"h_spacing", get_uint32(0, d)}, {"v_spacing", get_uint32(4, d)}}, nil
+}
+
+func decode_colr(box *Mp4_box) (Box_fields, error) {
+	colr, err := ParseColr(box.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if colr.Icc_profile != nil {
+		return Box_fields{{"colour_type", colr.Colour_type}, {"icc_profile_size", len(colr.Icc_profile)}}, nil
+	}
+
+	return Box_fields{{"colour_type", colr.Colour_type}, {"colour_primaries", colr.Colour_primaries}, {"transfer_characteristics", colr.Transfer_characteristics},
+		{"matrix_coefficients", colr.Matrix_coefficients}, {"full_range", colr.Full_range}}, nil
+}
+
+func decode_mdcv(box *Mp4_box) (Box_fields, error) {
+	mdcv, err := ParseMdcv(box.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return Box_fields{{"max_luminance", mdcv.MaxLuminance()}, {"min_luminance", mdcv.MinLuminance()}}, nil
+}
+
+func decode_clli(box *Mp4_box) (Box_fields, error) {
+	clli, err := ParseClli(box.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return Box_fields{{"max_content_light_level", clli.Max_content_light_level}, {"max_pic_average_light_level", clli.Max_pic_average_light_level}}, nil
+}
+
+func decode_dolby_vision(box *Mp4_box) (Box_fields, error) {
+	dv, err := ParseDolbyVisionConfig(box.TypeString(), box.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return Box_fields{{"profile", dv.Profile}, {"level", dv.Level}, {"rpu_present", dv.Rpu_present}, {"el_present", dv.El_present},
+		{"bl_present", dv.Bl_present}, {"bl_signal_compatibility_id", dv.Bl_signal_compatibility_id}}, nil
+}
+
+func decode_emsg(box *Mp4_box) (Box_fields, error) {
+	emsg, err := ParseEmsg(box.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	fields := Box_fields{{"version", emsg.Header.Version}, {"scheme_id_uri", emsg.Scheme_id_uri}, {"value", emsg.Value}, {"timescale", emsg.Timescale}}
+	if emsg.Header.Version == 1 {
+		fields = append(fields, Box_field{"presentation_time", emsg.Presentation_time})
+	} else {
+		fields = append(fields, Box_field{"presentation_time_delta", emsg.Presentation_time_delta})
+	}
+
+	return append(fields, Box_field{"event_duration", emsg.Event_duration}, Box_field{"id", emsg.Id}, Box_field{"message_data_size", len(emsg.Message_data)}), nil
+}
+
+func decode_prft(box *Mp4_box) (Box_fields, error) {
+	d := box.Bytes()
+	prft, err := parse_prft(d, 0, uint32(len(d)))
+	if err != nil {
+		return nil, err
+	}
+
+	return Box_fields{{"version", prft.Header.Version}, {"reference_track_id", prft.Reference_track_id}, {"ntp_timestamp", prft.Ntp_timestamp}, {"media_time", prft.Media_time}}, nil
+}
+
+func decode_frma(box *Mp4_box) (Box_fields, error) {
+	if len(box.Payload) < 4 {
+		return nil, incomplete_box(box)
+	}
+
+	return Box_fields{{"data_format", fourcc_string(get_uint32(0, box.Payload))}}, nil
+}
+
+func decode_schm(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if len(d) < 12 {
+		return nil, incomplete_box(box)
+	}
+
+	return Box_fields{{"scheme_type", fourcc_string(get_uint32(4, d))}, {"scheme_version", fmt.Sprintf("0x%08x", get_uint32(8, d))}}, nil
+}
+
+func decode_tenc(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if len(d) < 24 {
+		return nil, incomplete_box(box)
+	}
+
+	fields := Box_fields{{"version", box.Version()}}
+	if box.Version() > 0 {
+		fields = append(fields, Box_field{"default_crypt_byte_block", d[5] >> 4}, Box_field{"default_skip_byte_block", d[5] & 0x0F})
+	}
+
+	fields = append(fields, Box_field{"default_is_protected", d[6]}, Box_field{"default_per_sample_iv_size", d[7]}, Box_field{"default_kid", uuid_string(d[8:24])})
+	if d[6] == 1 && d[7] == 0 && len(d) >= 25 {
+		iv_size := int(d[24])
+		if len(d) < 25 + iv_size {
+			return fields, incomplete_box(box)
+		}
+
+		fields = append(fields, Box_field{"default_constant_iv", hex.EncodeToString(d[25 : 25+iv_size])})
+	}
+
+	return fields, nil
+}
+
+func decode_pssh(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	if len(d) < 20 {
+		return nil, incomplete_box(box)
+	}
+
+	fields := Box_fields{{"version", box.Version()}, {"system_id", uuid_string(d[4:20])}}
+	p := 20
+	if box.Version() > 0 {
+		if len(d) < 24 {
+			return fields, incomplete_box(box)
+		}
+
+		kid_count := int(get_uint32(20, d))
+		p = 24
+		if (len(d) - p) / 16 < kid_count {
+			return fields, incomplete_box(box)
+		}
+
+		var kids []string
+		for i := 0; i < kid_count; i++ {
+			kids = append(kids, uuid_string(d[p : p+16]))
+			p += 16
+		}
+
+		fields = append(fields, Box_field{"kids", kids})
+	}
+
+	if len(d) - p < 4 {
+		return fields, incomplete_box(box)
+	}
+
+	return append(fields, Box_field{"data_size", get_uint32(uint32(p), d)}), nil
+}
+
+func decode_senc(box *Mp4_box) (Box_fields, error) {
+	if len(box.Payload) < 8 {
+		return nil, incomplete_box(box)
+	}
+
+	return Box_fields{{"flags", fmt.Sprintf("0x%06x", box.Flags())}, {"sample_count", get_uint32(4, box.Payload)}}, nil
+}
+
+func decode_saiz(box *Mp4_box) (Box_fields, error) {
+	d := box.Payload
+	p := uint32(4)
+	if box.Flags() & 0x01 != 0 {
+		// aux_info_type and aux_info_type_parameter
+		p += 8
+	}
+
+	if uint32(len(d)) < p + 5 {
+		return nil, incomplete_box(box)
+	}
+
+	return Box_fields{{"default_sample_info_size", d[p]}, {"sample_count", get_uint32(p + 1, d)}}, nil
+}
+
+func decode_mdat(box *Mp4_box) (Box_fields, error) {
+	return Box_fields{{"data_size", len(box.Payload)}}, nil
+}
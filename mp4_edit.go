@@ -0,0 +1,139 @@
+package media_utils
+
+// insert_top_level_box returns a copy of seg_data with box_data inserted at
+// file offset pos, which must be a top-level box boundary ahead of the moof
+// boxes. A preceding sidx has the referenced_size of the subsegment that
+// receives the box grown accordingly, and explicit tfhd base_data_offsets
+// are shifted.
+func insert_top_level_box(seg_data []byte, pos uint32, box_data []byte) ([]byte, error) {
+	if uint64(len(seg_data)) + uint64(len(box_data)) > 0xFFFFFFFF {
+		return nil, parse_error(ErrInvalidData, "invalid_segment_size", uint64(pos), "")
+	}
+
+	out := make([]byte, 0, len(seg_data) + len(box_data))
+	out = append(out, seg_data[:pos]...)
+	out = append(out, box_data...)
+	out = append(out, seg_data[pos:]...)
+
+	delta := uint32(len(box_data))
+	sidx_start_offset, sidx_box_size, err := find_box(out, 0, pos, "", mp4_fourcc('s', 'i', 'd', 'x'))
+	if err == nil {
+		err = grow_sidx_reference(out, sidx_start_offset, sidx_box_size, pos, delta)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = shift_tfhd_base_data_offsets(out, pos + delta, int64(delta))
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// grow_sidx_reference adds delta bytes to the sidx reference whose subsegment
+// contains file offset pos (or to first_offset if pos precedes the first subsegment).
+func grow_sidx_reference(d []byte, sidx_start_offset uint32, sidx_box_size uint32, pos uint32, delta uint32) error {
+	p := sidx_start_offset + 8
+	end := sidx_start_offset + sidx_box_size
+	if end - p < 4 {
+		return parse_error(ErrTruncated, "incomplete_sidx", uint64(sidx_start_offset), "sidx")
+	}
+
+	version := get_uint8(p, d)
+	p += 12 // version, flags, reference_ID, timescale
+
+	var first_offset uint64
+	first_offset_pos := p
+	if version == 0 {
+		if end - p < 12 {
+			return parse_error(ErrTruncated, "incomplete_sidx", uint64(sidx_start_offset), "sidx")
+		}
+
+		first_offset_pos += 4
+		first_offset = uint64(get_uint32(first_offset_pos, d))
+		p += 8
+	} else {
+		if end - p < 20 {
+			return parse_error(ErrTruncated, "incomplete_sidx", uint64(sidx_start_offset), "sidx")
+		}
+
+		first_offset_pos += 8
+		first_offset = get_uint64(uint64(first_offset_pos), d)
+		p += 16
+	}
+
+	reference_count := uint32(get_uint16(p + 2, d))
+	p += 4
+	if (end - p) / 12 < reference_count {
+		return parse_error(ErrTruncated, "incomplete_sidx", uint64(sidx_start_offset), "sidx")
+	}
+
+	ref_start := uint64(end) + first_offset
+	if uint64(pos) < ref_start {
+		if version == 0 {
+			set_uint32(first_offset_pos, d, uint32(first_offset) + delta)
+		} else {
+			set_uint64(first_offset_pos, d, first_offset + uint64(delta))
+		}
+
+		return nil
+	}
+
+	for i := uint32(0); i < reference_count; i++ {
+		ref := get_uint32(p, d)
+		referenced_size := uint64(ref & 0x7FFFFFFF)
+		if uint64(pos) < ref_start + referenced_size {
+			set_uint32(p, d, ref & 0x80000000 | (uint32(referenced_size) + delta) & 0x7FFFFFFF)
+			return nil
+		}
+
+		ref_start += referenced_size
+		p += 12
+	}
+
+	return nil
+}
+
+// shift_tfhd_base_data_offsets adds delta to the explicit base_data_offset of
+// every tfhd in the top-level moof boxes at or after file offset start.
+func shift_tfhd_base_data_offsets(d []byte, start uint32, delta int64) error {
+	bytes_total := uint32(len(d))
+	p := start
+	for p < bytes_total {
+		moof_start_offset, moof_box_size, err := find_box(d, p, bytes_total, "", mp4_fourcc('m', 'o', 'o', 'f'))
+		if err != nil {
+			break
+		}
+
+		moof_end := moof_start_offset + moof_box_size
+		q := moof_start_offset + 8
+		for q < moof_end {
+			traf_start_offset, traf_box_size, err := find_box(d, q, moof_end, "moof", mp4_fourcc('t', 'r', 'a', 'f'))
+			if err != nil {
+				break
+			}
+
+			traf_end := traf_start_offset + traf_box_size
+			tfhd_start_offset, tfhd_box_size, err := find_box(d, traf_start_offset + 8, traf_end, "moof/traf", mp4_fourcc('t', 'f', 'h', 'd'))
+			if err == nil && tfhd_box_size >= 16 {
+				tfhd_flags := get_uint32(tfhd_start_offset + 8, d) & 0x00FFFFFF
+				if tfhd_flags & 0x000001 != 0 {
+					if tfhd_box_size < 24 {
+						return parse_error(ErrTruncated, "incomplete_tfhd", uint64(tfhd_start_offset), "moof/traf/tfhd")
+					}
+
+					base_data_offset := get_uint64(uint64(tfhd_start_offset + 16), d)
+					set_uint64(tfhd_start_offset + 16, d, uint64(int64(base_data_offset) + delta))
+				}
+			}
+
+			q = traf_end
+		}
+
+		p = moof_end
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package media_utils
+
+const Emsg_scheme_scte35 = "urn:scte:scte35:2013:bin"
+const Emsg_scheme_id3 = "https://aomedia.org/emsg/ID3"
+
+type Emsg_box struct {
+	Header Box_header
+	Scheme_id_uri string
+	Value string
+	Timescale uint32
+	Presentation_time_delta uint32 // version 0
+	Presentation_time uint64 // version 1
+	Event_duration uint32
+	Id uint32
+	Message_data []byte
+
+	// Decoded Message_data of the known schemes
+	Scte35 *Splice_info_section
+	Id3 *Id3_tag
+}
+
+// read_cstring reads a null-terminated string from d[p:end]
+// and returns it with the offset following the terminator.
+func read_cstring(p uint32, end uint32, d []byte) (string, uint32, error) {
+	for i := p; i < end; i++ {
+		if d[i] == 0 {
+			return string(d[p:i]), i + 1, nil
+		}
+	}
+
+	return "", end, parse_error(ErrTruncated, "unterminated_string", uint64(end), "")
+}
+
+// ParseEmsg decodes a single emsg box (version 0 or 1) starting at box_data[0].
+func ParseEmsg(box_data []byte) (Emsg_box, error) {
+	var emsg Emsg_box
+	var err error
+	if uint64(len(box_data)) > 0xFFFFFFFF {
+		return emsg, parse_error(ErrInvalidData, "invalid_box_size", 0, "emsg")
+	}
+
+	box_size, err := read_box_size(box_data, 0, uint32(len(box_data)))
+	if err != nil {
+		return emsg, err
+	}
+
+	if get_uint32(4, box_data) != mp4_fourcc('e', 'm', 's', 'g') {
+		return emsg, parse_error(ErrBoxNotFound, "Failed_to_find_emsg", 0, "emsg")
+	}
+
+	if box_size < 12 {
+		return emsg, parse_error(ErrTruncated, "incomplete_emsg", 0, "emsg")
+	}
+
+	emsg.Header.Box_size = box_size
+	emsg.Header.Version = get_uint8(8, box_data)
+	emsg.Header.Flag = get_uint32(8, box_data) & 0x00FFFFFF
+
+	p := uint32(12)
+	if emsg.Header.Version == 0 {
+		emsg.Scheme_id_uri, p, err = read_cstring(p, box_size, box_data)
+		if err != nil {
+			return emsg, parse_error(ErrTruncated, "incomplete_emsg", 0, "emsg")
+		}
+
+		emsg.Value, p, err = read_cstring(p, box_size, box_data)
+		if err != nil {
+			return emsg, parse_error(ErrTruncated, "incomplete_emsg", 0, "emsg")
+		}
+
+		if box_size - p < 16 {
+			return emsg, parse_error(ErrTruncated, "incomplete_emsg", 0, "emsg")
+		}
+
+		emsg.Timescale = get_uint32(p, box_data)
+		emsg.Presentation_time_delta = get_uint32(p + 4, box_data)
+		emsg.Event_duration = get_uint32(p + 8, box_data)
+		emsg.Id = get_uint32(p + 12, box_data)
+		p += 16
+	} else if emsg.Header.Version == 1 {
+		if box_size - p < 20 {
+			return emsg, parse_error(ErrTruncated, "incomplete_emsg", 0, "emsg")
+		}
+
+		emsg.Timescale = get_uint32(p, box_data)
+		emsg.Presentation_time = get_uint64(uint64(p + 4), box_data)
+		emsg.Event_duration = get_uint32(p + 12, box_data)
+		emsg.Id = get_uint32(p + 16, box_data)
+		p += 20
+
+		emsg.Scheme_id_uri, p, err = read_cstring(p, box_size, box_data)
+		if err != nil {
+			return emsg, parse_error(ErrTruncated, "incomplete_emsg", 0, "emsg")
+		}
+
+		emsg.Value, p, err = read_cstring(p, box_size, box_data)
+		if err != nil {
+			return emsg, parse_error(ErrTruncated, "incomplete_emsg", 0, "emsg")
+		}
+	} else {
+		return emsg, parse_error(ErrUnsupportedVersion, "unsupported_emsg_version", 8, "emsg")
+	}
+
+	emsg.Message_data = append([]byte{}, box_data[p:box_size]...)
+	decode_emsg_message(&emsg)
+	return emsg, nil
+}
+
+// decode_emsg_message decodes Message_data of the known schemes. Payloads that
+// fail to decode are left as raw Message_data only.
+func decode_emsg_message(emsg *Emsg_box) {
+	if emsg.Scheme_id_uri == Emsg_scheme_scte35 {
+		sis, err := ParseSpliceInfoSection(emsg.Message_data)
+		if err == nil {
+			emsg.Scte35 = &sis
+		}
+	} else if emsg.Scheme_id_uri == Emsg_scheme_id3 {
+		tag, err := ParseId3(emsg.Message_data)
+		if err == nil {
+			emsg.Id3 = &tag
+		}
+	}
+}
+
+// GetEmsgs returns all top-level emsg boxes in the segment, in file order.
+func GetEmsgs(seg_data []byte) ([]Emsg_box, error) {
+	var emsgs []Emsg_box
+	err := check_segment_size(seg_data)
+	if err != nil {
+		return emsgs, err
+	}
+
+	bytes_total := uint32(len(seg_data))
+	p := uint32(0)
+	for p < bytes_total {
+		emsg_start_offset, emsg_box_size, err := find_box(seg_data, p, bytes_total, "", mp4_fourcc('e', 'm', 's', 'g'))
+		if err != nil {
+			if len(emsgs) == 0 {
+				return emsgs, err
+			}
+
+			break
+		}
+
+		emsg, err := ParseEmsg(seg_data[emsg_start_offset : emsg_start_offset+emsg_box_size])
+		if err != nil {
+			return emsgs, shift_error(err, uint64(emsg_start_offset))
+		}
+
+		emsgs = append(emsgs, emsg)
+		p = emsg_start_offset + emsg_box_size
+	}
+
+	return emsgs, nil
+}
+
+// BuildEmsg serializes an emsg box. Header.Version selects the layout; the
+// box size is computed from the fields.
+func BuildEmsg(emsg Emsg_box) ([]byte, error) {
+	var payload []byte
+	if emsg.Header.Version == 0 {
+		payload = append(payload, emsg.Scheme_id_uri...)
+		payload = append(payload, 0)
+		payload = append(payload, emsg.Value...)
+		payload = append(payload, 0)
+		payload = append_uint32(payload, emsg.Timescale)
+		payload = append_uint32(payload, emsg.Presentation_time_delta)
+		payload = append_uint32(payload, emsg.Event_duration)
+		payload = append_uint32(payload, emsg.Id)
+	} else if emsg.Header.Version == 1 {
+		payload = append_uint32(payload, emsg.Timescale)
+		payload = append_uint64(payload, emsg.Presentation_time)
+		payload = append_uint32(payload, emsg.Event_duration)
+		payload = append_uint32(payload, emsg.Id)
+		payload = append(payload, emsg.Scheme_id_uri...)
+		payload = append(payload, 0)
+		payload = append(payload, emsg.Value...)
+		payload = append(payload, 0)
+	} else {
+		return nil, parse_error(ErrUnsupportedVersion, "unsupported_emsg_version", 0, "")
+	}
+
+	payload = append(payload, emsg.Message_data...)
+
+	box := make([]byte, 0, 12 + len(payload))
+	box = append_uint32(box, uint32(12 + len(payload)))
+	box = append_uint32(box, mp4_fourcc('e', 'm', 's', 'g'))
+	box = append_uint32(box, uint32(emsg.Header.Version) << 24 | emsg.Header.Flag & 0x00FFFFFF)
+	box = append(box, payload...)
+	return box, nil
+}
+
+// InsertEmsg returns a copy of the media segment with the emsg box inserted
+// immediately before the first moof, after any styp, sidx, prft or emsg boxes
+// already present.
+func InsertEmsg(seg_data []byte, emsg Emsg_box) ([]byte, error) {
+	err := check_segment_size(seg_data)
+	if err != nil {
+		return nil, err
+	}
+
+	emsg_data, err := BuildEmsg(emsg)
+	if err != nil {
+		return nil, err
+	}
+
+	moof_start_offset, _, err := find_box(seg_data, 0, uint32(len(seg_data)), "", mp4_fourcc('m', 'o', 'o', 'f'))
+	if err != nil {
+		return nil, err
+	}
+
+	return insert_top_level_box(seg_data, moof_start_offset, emsg_data)
+}
@@ -0,0 +1,195 @@
+package media_utils
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEmsgVersions(t *testing.T) {
+	sis := Splice_info_section{Sap_type: 3, Tier: 0xFFF, Time_signal: &Time_signal{Splice_time{true, 90000}}}
+	section, err := BuildSpliceInfoSection(sis)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v0 := Emsg_box{Header: Box_header{Version: 0}, Scheme_id_uri: Emsg_scheme_scte35, Value: "1", Timescale: 90000, Presentation_time_delta: 3000, Event_duration: 0xFFFFFFFF, Id: 1, Message_data: section}
+	v1 := Emsg_box{Header: Box_header{Version: 1}, Scheme_id_uri: "urn:example", Timescale: 1000, Presentation_time: 1 << 40, Event_duration: 2000, Id: 2, Message_data: []byte("data")}
+	for _, emsg := range []Emsg_box{v0, v1} {
+		box, err := BuildEmsg(emsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ParseEmsg(box)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if parsed.Header.Box_size != uint32(len(box)) {
+			t.Errorf("version %d box size %d, want %d", emsg.Header.Version, parsed.Header.Box_size, len(box))
+		}
+
+		emsg.Header.Box_size = parsed.Header.Box_size
+		if emsg.Scheme_id_uri == Emsg_scheme_scte35 {
+			emsg.Scte35 = parsed.Scte35
+			if parsed.Scte35 == nil || !reflect.DeepEqual(parsed.Scte35.Time_signal, sis.Time_signal) {
+				t.Errorf("SCTE-35 message %+v", parsed.Scte35)
+			}
+		}
+
+		if !reflect.DeepEqual(parsed, emsg) {
+			t.Errorf("emsg %+v parsed back as %+v", emsg, parsed)
+		}
+	}
+
+	// The strings come first in version 0, after the times in version 1
+	box, _ := BuildEmsg(v1)
+	if get_uint32(12, box) != 1000 || get_uint64(16, box) != 1 << 40 || string(box[32:45]) != "urn:example\x00\x00" {
+		t.Errorf("version 1 layout % X", box)
+	}
+
+	box, _ = BuildEmsg(v0)
+	if string(box[12:39]) != Emsg_scheme_scte35 + "\x001\x00" {
+		t.Errorf("version 0 layout % X", box)
+	}
+
+	// An unterminated Value
+	unterminated := append_uint32(nil, 38)
+	unterminated = append(unterminated, box[4:38]...)
+	_, err = ParseEmsg(unterminated)
+	var e *Parse_error
+	if !errors.Is(err, ErrTruncated) || !errors.As(err, &e) || e.Reason != "incomplete_emsg" {
+		t.Errorf("truncated emsg: %v", err)
+	}
+
+	box[8] = 2
+	_, err = ParseEmsg(box)
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("emsg version 2: %v", err)
+	}
+}
+
+// emsg_test_segment returns a segment of styp, sidx, emsg, moof and mdat
+// whose tfhd has an explicit base_data_offset.
+func emsg_test_segment() []byte {
+	styp := NewBox(mp4_fourcc('s', 't', 'y', 'p'), []byte("msdh\x00\x00\x00\x00msdhmsix"))
+	emsg, _ := BuildEmsg(Emsg_box{Scheme_id_uri: "urn:first", Timescale: 1000, Id: 1})
+	trun := NewBox(mp4_fourcc('t', 'r', 'u', 'n'), trun_payload(Trun_box{Header: Box_header{Flag: Trun_data_offset_present | Trun_sample_size_present}, Samples: []Trun_sample{{Size: 2}, {Size: 4}}}))
+	tfhd := Tfhd_box{Header: Box_header{Flag: Tfhd_base_data_offset_present | Tfhd_default_sample_duration_present}, Track_id: 1, Default_sample_duration: 3000}
+	traf := NewContainerBox(mp4_fourcc('t', 'r', 'a', 'f'), NewBox(mp4_fourcc('t', 'f', 'h', 'd'), tfhd_payload(tfhd)), trun)
+	moof := NewContainerBox(mp4_fourcc('m', 'o', 'o', 'f'), NewFullBox(mp4_fourcc('m', 'f', 'h', 'd'), 0, 0, append_uint32(nil, 1)), traf)
+	mdat := NewBox(mp4_fourcc('m', 'd', 'a', 't'), []byte("abcdef"))
+	subsegment_size := uint64(len(emsg)) + moof.EncodedSize() + mdat.EncodedSize()
+	sidx := NewBox(mp4_fourcc('s', 'i', 'd', 'x'), sidx_payload(Sidx_box{Reference_id: 1, Timescale: 90000, References: []Sidx_reference{{Referenced_size: uint32(subsegment_size), Subsegment_duration: 6000, Starts_with_sap: true, Sap_type: 1}}}))
+
+	// The mdat data follows the moof
+	tfhd.Base_data_offset = styp.EncodedSize() + sidx.EncodedSize() + subsegment_size - mdat.EncodedSize() + 8
+	traf.Child(mp4_fourcc('t', 'f', 'h', 'd')).Payload = tfhd_payload(tfhd)
+	return append(append(SerializeBoxes([]*Mp4_box{styp, sidx}), emsg...), SerializeBoxes([]*Mp4_box{moof, mdat})...)
+}
+
+func TestInsertEmsg(t *testing.T) {
+	seg := emsg_test_segment()
+	tracks := []Track_info{{Track_id: 1, Timescale: 90000}}
+	samples, err := GetFragmentSamples(seg, tracks)
+	if err != nil || len(samples) != 2 || string(samples[1].Data) != "cdef" {
+		t.Fatalf("samples %+v: %v", samples, err)
+	}
+
+	sidx, _ := GetSidx(seg)
+	emsg := Emsg_box{Header: Box_header{Version: 1}, Scheme_id_uri: "urn:second", Timescale: 1000, Id: 2, Message_data: []byte("message")}
+	out, err := InsertEmsg(seg, emsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boxes, err := ParseBoxes(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	for _, box := range boxes {
+		types = append(types, box.TypeString())
+	}
+
+	if !reflect.DeepEqual(types, []string{"styp", "sidx", "emsg", "emsg", "moof", "mdat"}) {
+		t.Errorf("top level boxes %v", types)
+	}
+
+	emsgs, err := GetEmsgs(out)
+	if err != nil || len(emsgs) != 2 || emsgs[0].Scheme_id_uri != "urn:first" || emsgs[1].Scheme_id_uri != "urn:second" || !bytes.Equal(emsgs[1].Message_data, emsg.Message_data) {
+		t.Errorf("emsgs %+v: %v", emsgs, err)
+	}
+
+	// The subsegment holding the new emsg grows, and the samples stay in place
+	emsg_size := uint32(len(out) - len(seg))
+	out_sidx, err := GetSidx(out)
+	if err != nil || out_sidx.First_offset != 0 || out_sidx.References[0].Referenced_size != sidx.References[0].Referenced_size + emsg_size {
+		t.Errorf("sidx %+v: %v", out_sidx, err)
+	}
+
+	out_samples, err := GetFragmentSamples(out, tracks)
+	if err != nil || len(out_samples) != 2 || string(out_samples[0].Data) != "ab" || string(out_samples[1].Data) != "cdef" || out_samples[0].Offset != samples[0].Offset + uint64(emsg_size) {
+		t.Errorf("samples after the insertion %+v: %v", out_samples, err)
+	}
+
+	// No moof to insert before
+	_, err = InsertEmsg(out[:len(out) - int(boxes[4].EncodedSize() + boxes[5].EncodedSize())], emsg)
+	if !errors.Is(err, ErrBoxNotFound) {
+		t.Errorf("segment without moof: %v", err)
+	}
+}
+
+// FuzzEmsg checks that a parsed emsg builds back to the same fields and that
+// an inserted emsg is read back.
+func FuzzEmsg(f *testing.F) {
+	v1, _ := BuildEmsg(Emsg_box{Header: Box_header{Version: 1}, Scheme_id_uri: "urn:test", Value: "1", Timescale: 90000, Presentation_time: 1 << 40, Message_data: []byte("hi")})
+	f.Add(v1)
+	f.Add(fuzz_segment())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if emsg, err := ParseEmsg(data); err == nil {
+			box, err := BuildEmsg(emsg)
+			if err != nil {
+				t.Fatalf("parsed emsg does not build: %v", err)
+			}
+
+			again, err := ParseEmsg(box)
+			if err != nil {
+				t.Fatalf("built emsg does not parse: %v", err)
+			}
+
+			again.Header.Box_size = emsg.Header.Box_size
+			if !reflect.DeepEqual(again, emsg) {
+				t.Fatalf("emsg %+v built and parsed back as %+v", emsg, again)
+			}
+		}
+
+		// The emsgs already present must be valid
+		if _, err := GetEmsgs(data); err != nil && !errors.Is(err, ErrBoxNotFound) {
+			return
+		}
+
+		inserted := Emsg_box{Scheme_id_uri: "urn:fuzz", Value: "v", Timescale: 1000, Id: 7, Message_data: []byte("message")}
+		out, err := InsertEmsg(data, inserted)
+		if err != nil {
+			return
+		}
+
+		emsgs, err := GetEmsgs(out)
+		if err != nil {
+			t.Fatalf("emsgs of the output: %v", err)
+		}
+
+		found := false
+		for _, emsg := range emsgs {
+			found = found || (emsg.Scheme_id_uri == inserted.Scheme_id_uri && emsg.Id == inserted.Id && string(emsg.Message_data) == "message")
+		}
+
+		if !found {
+			t.Fatalf("inserted emsg not read back: %+v", emsgs)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package media_utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Error categories of Parse_error, for use with errors.Is:
+//
+//	if errors.Is(err, ErrTruncated) { /* wait for more data */ }
+//
+// errors.As(err, &parse_err) gives the box path and offset.
+var (
+	ErrBoxNotFound = errors.New("box_not_found")
+	ErrTruncated = errors.New("truncated")
+	ErrUnsupportedVersion = errors.New("unsupported_version")
+	ErrInvalidData = errors.New("invalid_data")
+	ErrUnsupported = errors.New("unsupported")
+)
+
+// Parse_error reports missing, truncated, malformed or unsupported data: its
+// category (Kind, one of the Err* sentinels above, which errors.Is matches),
+// what is wrong (Reason, e.g. "Failed_to_find_tfdt" or "incomplete_tfdt"), in
+// which box (Path, e.g. "moof/traf/tfdt") and at which offset of the parsed
+// data. Parsers of a single payload, which know no box, leave Path empty and
+// give the offset in that payload.
+type Parse_error struct {
+	Kind error
+	Reason string
+	Offset uint64
+	Path string
+}
+
+func (e *Parse_error) Error() string {
+	if e.Path == "" {
+		return e.Reason
+	}
+
+	return fmt.Sprintf("%s at offset %d in %s", e.Reason, e.Offset, e.Path)
+}
+
+func (e *Parse_error) Unwrap() error {
+	return e.Kind
+}
+
+func parse_error(kind error, reason string, offset uint64, path string) error {
+	return &Parse_error{Kind: kind, Reason: reason, Offset: offset, Path: path}
+}
+
+// box_error reports an error of the given kind in box.
+func box_error(kind error, reason string, box *Mp4_box) error {
+	return parse_error(kind, reason, box.Offset, box.Path())
+}
+
+// incomplete_box reports a box whose payload is too short for its fields.
+func incomplete_box(box *Mp4_box) error {
+	return box_error(ErrTruncated, "incomplete_" + box.TypeString(), box)
+}
+
+// in_box places an error of a parser given box alone in the parsed data: the
+// offset in its payload (Path empty) or in the box (Path the box type, for
+// parsers of the whole box) becomes an offset in the data, with the path of box.
+func in_box(err error, box *Mp4_box) error {
+	var e *Parse_error
+	if box == nil || !errors.As(err, &e) {
+		return err
+	}
+
+	switch e.Path {
+	case "":
+		return parse_error(e.Kind, e.Reason, box.Offset + uint64(box.Header_size) + e.Offset, box.Path())
+	case box.TypeString():
+		return parse_error(e.Kind, e.Reason, box.Offset + e.Offset, box.Path())
+	}
+
+	return err
+}
+
+// at_box places an error of a parser of data nested in the payload of box,
+// at an unknown position, at box.
+func at_box(err error, box *Mp4_box) error {
+	var e *Parse_error
+	if box == nil || !errors.As(err, &e) || e.Path != "" {
+		return err
+	}
+
+	return parse_error(e.Kind, e.Reason, box.Offset, box.Path())
+}
+
+// box_path appends a box type to the path of its parent box.
+func box_path(parent_path string, box_type uint32) string {
+	if parent_path == "" {
+		return fourcc_string(box_type)
+	}
+
+	return parent_path + "/" + fourcc_string(box_type)
+}
+
+// box_not_found reports a missing box at path, e.g. "mdia/mdhd", below
+// parent, or a missing top-level box if parent is nil.
+func box_not_found(parent *Mp4_box, path string) error {
+	reason := "Failed_to_find_" + path[strings.LastIndex(path, "/") + 1:]
+	if parent == nil {
+		return parse_error(ErrBoxNotFound, reason, 0, path)
+	}
+
+	return parse_error(ErrBoxNotFound, reason, parent.Offset, parent.Path() + "/" + path)
+}
+
+// shift_error moves the offset of a Parse_error reported within a sub-slice
+// of the data by base, the position of that slice.
+func shift_error(err error, base uint64) error {
+	if e, ok := err.(*Parse_error); ok {
+		e.Offset += base
+	}
+
+	return err
+}
@@ -0,0 +1,72 @@
+package media_utils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func mux_test_init(t *testing.T) []byte {
+	var out bytes.Buffer
+	m, err := NewFmp4Muxer(&out, mux_test_tracks(48000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.WriteInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Bytes()
+}
+
+func TestParseErrorKinds(t *testing.T) {
+	init := mux_test_init(t)
+	_, err := GetTracks(init[:len(init) - 3])
+	if !errors.Is(err, ErrTruncated) || errors.Is(err, ErrBoxNotFound) {
+		t.Errorf("truncated init: %v", err)
+	}
+
+	_, seg := mux_test_segment(t)
+	_, err = GetTrackTfdt(seg, 9)
+	var e *Parse_error
+	if !errors.Is(err, ErrBoxNotFound) || !errors.As(err, &e) || e.Path != "moof/traf/tfhd" {
+		t.Errorf("unknown track: %v", err)
+	}
+
+	_, err = GetEmsgs(seg)
+	if !errors.Is(err, ErrBoxNotFound) {
+		t.Errorf("no emsg: %v", err)
+	}
+}
+
+func TestParseErrorLocation(t *testing.T) {
+	init := mux_test_init(t)
+	boxes, err := ParseBoxes(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 31 SPS announced, one present
+	avcc := FindBox(boxes, "moov/trak/mdia/minf/stbl/stsd/avc1/avcC")
+	if avcc == nil {
+		t.Fatal("no avcC")
+	}
+
+	init = append([]byte(nil), init...)
+	init[avcc.Offset + uint64(avcc.Header_size) + 5] = 0xFF
+	_, err = GetTracks(init)
+	var e *Parse_error
+	if !errors.As(err, &e) || !errors.Is(err, ErrTruncated) {
+		t.Fatalf("corrupt avcC: %v", err)
+	}
+
+	if e.Reason != "incomplete_avcC" || e.Path != avcc.Path() {
+		t.Errorf("corrupt avcC: %v", err)
+	}
+
+	if e.Offset <= avcc.Offset + uint64(avcc.Header_size) || e.Offset >= avcc.Offset + avcc.Size {
+		t.Errorf("offset %d outside avcC at %d, size %d", e.Offset, avcc.Offset, avcc.Size)
+	}
+}
@@ -0,0 +1,279 @@
+package media_utils
+
+import (
+	"io"
+)
+
+const (
+	es_codec_avc = iota
+	es_codec_hevc
+	es_codec_aac
+)
+
+var annexb_start_code = []byte{0x00, 0x00, 0x00, 0x01}
+
+// Es_writer writes the samples of a track as a raw elementary stream:
+// Annex-B byte stream for H.264/HEVC, ADTS for AAC.
+type Es_writer struct {
+	w io.Writer
+	codec int
+	nal_length_size int
+	parameter_sets [][]byte
+	adts_profile uint8
+	adts_sampling_frequency_index uint8
+	adts_channel_configuration uint8
+	samples_written int
+}
+
+// NewEsWriter returns an Es_writer for the codec configuration of track.
+func NewEsWriter(track Track_info, w io.Writer) (*Es_writer, error) {
+	es := &Es_writer{w: w}
+	switch {
+	case track.Codec == "encv" || track.Codec == "enca":
+		return nil, parse_error(ErrUnsupported, "encrypted_track_not_supported", 0, "")
+	case track.Avcc != nil:
+		es.codec = es_codec_avc
+		es.nal_length_size = int(track.Avcc.Nal_length_size)
+		es.parameter_sets = append(es.parameter_sets, track.Avcc.Sps...)
+		es.parameter_sets = append(es.parameter_sets, track.Avcc.Pps...)
+	case track.Hvcc != nil:
+		es.codec = es_codec_hevc
+		es.nal_length_size = int(track.Hvcc.Nal_length_size)
+		es.parameter_sets = track.Hvcc.ParameterSets()
+	case track.Audio_config != nil:
+		asc := track.Audio_config
+		// ADTS carries the AAC core; SBR/PS are implicitly signaled.
+		if asc.Core_audio_object_type < 1 || asc.Core_audio_object_type > 4 {
+			return nil, parse_error(ErrUnsupported, "adts_unsupported_audio_object_type", 0, "")
+		}
+
+		if asc.Sampling_frequency_index >= 0x0F || asc.Channel_configuration == 0 || asc.Channel_configuration > 7 {
+			return nil, parse_error(ErrUnsupported, "adts_unsupported_audio_specific_config", 0, "")
+		}
+
+		es.codec = es_codec_aac
+		es.adts_profile = asc.Core_audio_object_type - 1
+		es.adts_sampling_frequency_index = asc.Sampling_frequency_index
+		es.adts_channel_configuration = asc.Channel_configuration
+	default:
+		return nil, parse_error(ErrUnsupported, "unsupported_codec_" + track.Codec, 0, "")
+	}
+
+	return es, nil
+}
+
+// EsFileExtension returns the file extension of the elementary stream of track.
+func EsFileExtension(track Track_info) string {
+	switch {
+	case track.Avcc != nil:
+		return ".h264"
+	case track.Hvcc != nil:
+		return ".h265"
+	case track.Audio_config != nil:
+		return ".aac"
+	}
+
+	return ".es"
+}
+
+// SplitNalUnits splits a length-prefixed sample into NAL units.
+func SplitNalUnits(data []byte, nal_length_size int) ([][]byte, error) {
+	var nalus [][]byte
+	p := 0
+	for p < len(data) {
+		if len(data) - p < nal_length_size {
+			return nalus, parse_error(ErrTruncated, "incomplete_nal_length", uint64(p), "")
+		}
+
+		n := 0
+		for i := 0; i < nal_length_size; i++ {
+			n = n << 8 | int(data[p+i])
+		}
+
+		p += nal_length_size
+		if len(data) - p < n {
+			return nalus, parse_error(ErrTruncated, "incomplete_nal_unit", uint64(p - nal_length_size), "")
+		}
+
+		nalus = append(nalus, data[p : p+n])
+		p += n
+	}
+
+	return nalus, nil
+}
+
+// SplitAnnexB splits an Annex-B byte stream into NAL units, without their
+// start codes and trailing zero bytes.
+func SplitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for p := 0; p + 2 < len(data); p++ {
+		if data[p] != 0 || data[p + 1] != 0 || data[p + 2] != 1 {
+			continue
+		}
+
+		if start >= 0 {
+			nalus = append(nalus, trim_trailing_zeros(data[start:p]))
+		}
+
+		start = p + 3
+		p += 2
+	}
+
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, trim_trailing_zeros(data[start:]))
+	}
+
+	return nalus
+}
+
+func trim_trailing_zeros(nalu []byte) []byte {
+	n := len(nalu)
+	for n > 0 && nalu[n - 1] == 0 {
+		n--
+	}
+
+	return nalu[:n]
+}
+
+// nal_unit_type returns the NAL unit type of an H.264 or HEVC NAL unit.
+func nal_unit_type(codec int, nalu []byte) uint8 {
+	if len(nalu) == 0 {
+		return 0xFF
+	}
+
+	if codec == es_codec_hevc {
+		return nalu[0] >> 1 & 0x3F
+	}
+
+	return nalu[0] & 0x1F
+}
+
+func (es *Es_writer) is_irap(nal_type uint8) bool {
+	if es.codec == es_codec_hevc {
+		return nal_type >= 16 && nal_type <= 23
+	}
+
+	return nal_type == 5
+}
+
+func (es *Es_writer) is_parameter_set(nal_type uint8) bool {
+	if es.codec == es_codec_hevc {
+		return nal_type >= 32 && nal_type <= 34
+	}
+
+	return nal_type == 7 || nal_type == 8
+}
+
+func (es *Es_writer) is_aud(nal_type uint8) bool {
+	if es.codec == es_codec_hevc {
+		return nal_type == 35
+	}
+
+	return nal_type == 9
+}
+
+func (es *Es_writer) write_nal_unit(nalu []byte) error {
+	_, err := es.w.Write(annexb_start_code)
+	if err == nil {
+		_, err = es.w.Write(nalu)
+	}
+
+	return err
+}
+
+// write_access_unit converts a length-prefixed video sample to Annex-B. The
+// decoder configuration parameter sets go ahead of the first sample and of
+// every IRAP/sync sample not carrying its own, after any access unit delimiter.
+func (es *Es_writer) write_access_unit(sample Mp4_sample) error {
+	nalus, err := SplitNalUnits(sample.Data, es.nal_length_size)
+	if err != nil {
+		return err
+	}
+
+	needs_parameter_sets := es.samples_written == 0 || sample.Is_sync
+	for _, nalu := range nalus {
+		nal_type := nal_unit_type(es.codec, nalu)
+		if es.is_irap(nal_type) {
+			needs_parameter_sets = true
+		}
+	}
+
+	for _, nalu := range nalus {
+		if es.is_parameter_set(nal_unit_type(es.codec, nalu)) {
+			needs_parameter_sets = false
+		}
+	}
+
+	for _, nalu := range nalus {
+		if needs_parameter_sets && !es.is_aud(nal_unit_type(es.codec, nalu)) {
+			for _, ps := range es.parameter_sets {
+				err = es.write_nal_unit(ps)
+				if err != nil {
+					return err
+				}
+			}
+
+			needs_parameter_sets = false
+		}
+
+		err = es.write_nal_unit(nalu)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// adts_header builds a 7-byte ADTS header (no CRC) for a raw AAC frame.
+func (es *Es_writer) adts_header(frame_size int) ([]byte, error) {
+	frame_length := frame_size + 7
+	if frame_length > 0x1FFF {
+		return nil, parse_error(ErrUnsupported, "adts_frame_too_large", 0, "")
+	}
+
+	var w bit_writer
+	w.write_bits(12, 0xFFF) // syncword
+	w.write_bits(1, 0) // MPEG-4
+	w.write_bits(2, 0) // layer
+	w.write_bits(1, 1) // protection_absent
+	w.write_bits(2, uint64(es.adts_profile))
+	w.write_bits(4, uint64(es.adts_sampling_frequency_index))
+	w.write_bits(1, 0) // private_bit
+	w.write_bits(3, uint64(es.adts_channel_configuration))
+	w.write_bits(4, 0) // original_copy, home, copyright id bit and start
+	w.write_bits(13, uint64(frame_length))
+	w.write_bits(11, 0x7FF) // buffer fullness: VBR
+	w.write_bits(2, 0) // one raw data block
+	return w.bytes(), nil
+}
+
+// WriteSample appends one sample to the elementary stream.
+func (es *Es_writer) WriteSample(sample Mp4_sample) error {
+	if sample.Data == nil {
+		return parse_error(ErrTruncated, "sample_outside_data", sample.Offset, "")
+	}
+
+	var err error
+	if es.codec == es_codec_aac {
+		var header []byte
+		header, err = es.adts_header(len(sample.Data))
+		if err == nil {
+			_, err = es.w.Write(header)
+		}
+
+		if err == nil {
+			_, err = es.w.Write(sample.Data)
+		}
+	} else {
+		err = es.write_access_unit(sample)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	es.samples_written++
+	return nil
+}
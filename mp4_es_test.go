@@ -0,0 +1,156 @@
+package media_utils
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSplitAnnexB(t *testing.T) {
+	nalus := SplitAnnexB([]byte{0, 0, 1, 0x09, 0xF0, 0, 0, 0, 1, 0x65, 0x88, 0, 0, 0, 0, 1, 0x41, 0, 0})
+	if !reflect.DeepEqual(nalus, [][]byte{{0x09, 0xF0}, {0x65, 0x88}, {0x41}}) {
+		t.Errorf("NAL units % X", nalus)
+	}
+
+	if nalus := SplitAnnexB([]byte{0x65, 0x88}); nalus != nil {
+		t.Errorf("NAL units without start code % X", nalus)
+	}
+
+	nalus, err := SplitNalUnits([]byte{0, 2, 0x65, 0x88, 0, 3, 0x41}, 2)
+	var e *Parse_error
+	if !errors.Is(err, ErrTruncated) || !errors.As(err, &e) || e.Reason != "incomplete_nal_unit" || e.Offset != 4 || len(nalus) != 1 {
+		t.Errorf("truncated NAL unit: % X %v", nalus, err)
+	}
+}
+
+// es_test_sample returns a sample of the NAL units, with 4-byte lengths.
+func es_test_sample(is_sync bool, nalus ...[]byte) Mp4_sample {
+	var data []byte
+	for _, nalu := range nalus {
+		data = append(append_uint32(data, uint32(len(nalu))), nalu...)
+	}
+
+	return Mp4_sample{Track_id: 1, Size: uint32(len(data)), Is_sync: is_sync, Data: data}
+}
+
+func TestEsWriterParameterSets(t *testing.T) {
+	var out bytes.Buffer
+	es, err := NewEsWriter(mux_test_tracks(48000)[0], &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aud := []byte{0x09, 0xF0}
+	idr := []byte{0x65, 0x88}
+	p := []byte{0x41, 0x9A}
+	sps := []byte{0x67, 0x42, 0xC0, 0x1F}
+	pps := []byte{0x68, 0xCE}
+	annexb := func(nalus ...[]byte) []byte {
+		var d []byte
+		for _, nalu := range nalus {
+			d = append(append(d, 0, 0, 0, 1), nalu...)
+		}
+
+		return d
+	}
+
+	for _, tc := range []struct {
+		name string
+		sample Mp4_sample
+		want []byte
+	}{
+		// The parameter sets of the avcC go after the access unit delimiter
+		{"first sample", es_test_sample(false, aud, p), annexb(aud, mux_test_sps, mux_test_pps, p)},
+		{"P picture", es_test_sample(false, p), annexb(p)},
+		// An IDR not flagged as sync
+		{"IDR", es_test_sample(false, idr), annexb(mux_test_sps, mux_test_pps, idr)},
+		{"sync sample", es_test_sample(true, p), annexb(mux_test_sps, mux_test_pps, p)},
+		{"IDR with parameter sets", es_test_sample(true, sps, pps, idr), annexb(sps, pps, idr)},
+	} {
+		out.Reset()
+		err = es.WriteSample(tc.sample)
+		if err != nil || !bytes.Equal(out.Bytes(), tc.want) {
+			t.Errorf("%s written as % X, want % X: %v", tc.name, out.Bytes(), tc.want, err)
+		}
+	}
+
+	err = es.WriteSample(Mp4_sample{Track_id: 1, Size: 4})
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("sample outside the data: %v", err)
+	}
+}
+
+func TestEsWriterAdts(t *testing.T) {
+	track := ts_test_tracks(t)[1]
+	if EsFileExtension(track) != ".aac" {
+		t.Errorf("extension %s", EsFileExtension(track))
+	}
+
+	var out bytes.Buffer
+	es, err := NewEsWriter(track, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := []byte("0123456789")
+	err = es.WriteSample(Mp4_sample{Track_id: 2, Size: uint32(len(frame)), Data: frame})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// AAC-LC, 48 kHz, stereo, 17 bytes, VBR
+	want := append([]byte{0xFF, 0xF1, 0x4C, 0x80, 0x02, 0x3F, 0xFC}, frame...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("ADTS frame % X, want % X", out.Bytes(), want)
+	}
+
+	h, err := ParseAdtsHeader(out.Bytes())
+	if err != nil || h.Audio_object_type != 2 || h.Sampling_frequency != 48000 || h.Channel_configuration != 2 || h.Frame_length != len(want) {
+		t.Errorf("ADTS header %+v: %v", h, err)
+	}
+
+	err = es.WriteSample(Mp4_sample{Track_id: 2, Size: 0x2000, Data: make([]byte, 0x2000)})
+	var e *Parse_error
+	if !errors.Is(err, ErrUnsupported) || !errors.As(err, &e) || e.Reason != "adts_frame_too_large" {
+		t.Errorf("8 KB frame: %v", err)
+	}
+
+	track.Codec = "enca"
+	_, err = NewEsWriter(track, &out)
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("encrypted track: %v", err)
+	}
+}
+
+// FuzzEsWriter checks that an ADTS frame wraps each AAC sample and that the
+// video samples are written as Annex-B.
+func FuzzEsWriter(f *testing.F) {
+	f.Add(fuzz_init(), fuzz_segment())
+	f.Fuzz(func(t *testing.T, init_data []byte, seg_data []byte) {
+		tracks, samples := fuzz_samples(init_data, seg_data)
+		for _, track := range tracks {
+			var out bytes.Buffer
+			es, err := NewEsWriter(track, &out)
+			if err != nil {
+				continue
+			}
+
+			for _, sample := range samples {
+				out.Reset()
+				if sample.Track_id != track.Track_id || es.WriteSample(sample) != nil {
+					continue
+				}
+
+				if es.codec == es_codec_aac {
+					h, err := ParseAdtsHeader(out.Bytes())
+					if err != nil || h.Frame_length != out.Len() || out.Len() != len(sample.Data) + 7 {
+						t.Fatalf("ADTS frame of %d bytes for %d bytes: %+v %v", out.Len(), len(sample.Data), h, err)
+					}
+				} else if out.Len() > 0 && !bytes.HasPrefix(out.Bytes(), annexb_start_code) {
+					t.Fatalf("access unit % x", out.Bytes())
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,287 @@
+package media_utils
+
+import (
+	"io"
+)
+
+// ScanBoxes reads the top-level box headers of a file of the given size
+// without loading box payloads. The returned boxes have no Payload or Children.
+func ScanBoxes(r io.ReaderAt, size int64) ([]*Mp4_box, error) {
+	var boxes []*Mp4_box
+	header := make([]byte, 16)
+	end := uint64(size)
+	p := uint64(0)
+	for p < end {
+		if end - p < 8 {
+			return boxes, parse_error(ErrTruncated, "incomplete_box_header", p, "")
+		}
+
+		_, err := r.ReadAt(header[:8], int64(p))
+		if err != nil {
+			return boxes, err
+		}
+
+		box := &Mp4_box{Offset: p, Type: get_uint32(4, header), Header_size: 8}
+		box_size := uint64(get_uint32(0, header))
+		if box_size == 1 {
+			if end - p < 16 {
+				return boxes, parse_error(ErrTruncated, "incomplete_box_header", p, box.TypeString())
+			}
+
+			_, err = r.ReadAt(header[8:16], int64(p + 8))
+			if err != nil {
+				return boxes, err
+			}
+
+			box_size = get_uint64(8, header)
+			box.Header_size = 16
+		} else if box_size == 0 {
+			box_size = end - p
+		}
+
+		if box_size < uint64(box.Header_size) {
+			return boxes, parse_error(ErrInvalidData, "invalid_box_size", p, box.TypeString())
+		}
+
+		if box_size > end - p {
+			return boxes, parse_error(ErrTruncated, "incomplete_" + box.TypeString(), p, box.TypeString())
+		}
+
+		box.Size = box_size
+		boxes = append(boxes, box)
+		p += box_size
+	}
+
+	return boxes, nil
+}
+
+// box_relocation records where a top-level box moves to.
+type box_relocation struct {
+	old_offset uint64
+	size uint64
+	new_offset uint64
+}
+
+func relocate_offset(relocations []box_relocation, old uint64) (uint64, bool) {
+	for _, r := range relocations {
+		if old >= r.old_offset && old < r.old_offset + r.size {
+			return r.new_offset + old - r.old_offset, true
+		}
+	}
+
+	return 0, false
+}
+
+type chunk_offset_table struct {
+	box *Mp4_box
+	offsets []uint64
+}
+
+func parse_chunk_offsets(box *Mp4_box) ([]uint64, error) {
+	if len(box.Payload) < 8 {
+		return nil, incomplete_box(box)
+	}
+
+	entry_count := get_uint32(4, box.Payload)
+	is_co64 := box.Type == mp4_fourcc('c', 'o', '6', '4')
+	entry_size := uint32(4)
+	if is_co64 {
+		entry_size = 8
+	}
+
+	if (uint32(len(box.Payload)) - 8) / entry_size < entry_count {
+		return nil, incomplete_box(box)
+	}
+
+	offsets := make([]uint64, entry_count)
+	for i := range offsets {
+		p := 8 + uint32(i) * entry_size
+		if is_co64 {
+			offsets[i] = get_uint64(uint64(p), box.Payload)
+		} else {
+			offsets[i] = uint64(get_uint32(p, box.Payload))
+		}
+	}
+
+	return offsets, nil
+}
+
+// set_chunk_offsets rewrites a stco/co64 box with the given offsets, turning
+// a stco into a co64 if an offset needs more than 32 bits.
+func set_chunk_offsets(box *Mp4_box, offsets []uint64) {
+	if box.Type == mp4_fourcc('s', 't', 'c', 'o') {
+		for _, o := range offsets {
+			if o > 0xFFFFFFFF {
+				box.Type = mp4_fourcc('c', 'o', '6', '4')
+				break
+			}
+		}
+	}
+
+	payload := make([]byte, 0, 8 + 8 * len(offsets))
+	payload = append_uint32(payload, 0)
+	payload = append_uint32(payload, uint32(len(offsets)))
+	for _, o := range offsets {
+		if box.Type == mp4_fourcc('c', 'o', '6', '4') {
+			payload = append_uint64(payload, o)
+		} else {
+			payload = append_uint32(payload, uint32(o))
+		}
+	}
+
+	box.Payload = payload
+}
+
+// find_chunk_offsets returns the stco or co64 of a trak. A box on the way
+// whose children do not parse, e.g. a malformed stbl, is an error rather
+// than a track without chunk offsets.
+func find_chunk_offsets(trak *Mp4_box) (*Mp4_box, error) {
+	box := trak
+	for _, path := range []string{"mdia", "mdia/minf", "mdia/minf/stbl"} {
+		if box.children_err != nil {
+			return nil, box.children_err
+		}
+
+		box = trak.Find(path)
+		if box == nil {
+			return nil, box_not_found(trak, path)
+		}
+	}
+
+	if box.children_err != nil {
+		return nil, box.children_err
+	}
+
+	for _, box_type := range []uint32{mp4_fourcc('s', 't', 'c', 'o'), mp4_fourcc('c', 'o', '6', '4')} {
+		if table := box.Child(box_type); table != nil {
+			return table, nil
+		}
+	}
+
+	return nil, box_not_found(trak, "mdia/minf/stbl/stco")
+}
+
+// Faststart copies a progressive MP4 of the given size from r to w with the
+// moov box moved ahead of the first mdat, and every stco/co64 chunk offset
+// shifted accordingly. A stco becomes a co64 when shifted offsets overflow 32
+// bits. Only the moov is held in memory; all other boxes are streamed. Files
+// whose moov already precedes the media data are copied unchanged. Every
+// trak must have a chunk offset table: one that could not be found would
+// keep offsets into the old layout.
+func Faststart(r io.ReaderAt, size int64, w io.Writer) error {
+	boxes, err := ScanBoxes(r, size)
+	if err != nil {
+		return err
+	}
+
+	moov_index := -1
+	mdat_index := -1
+	for i, box := range boxes {
+		if box.Type == mp4_fourcc('m', 'o', 'o', 'v') && moov_index < 0 {
+			moov_index = i
+		} else if box.Type == mp4_fourcc('m', 'd', 'a', 't') && mdat_index < 0 {
+			mdat_index = i
+		}
+	}
+
+	if moov_index < 0 {
+		return box_not_found(nil, "moov")
+	}
+
+	if mdat_index < 0 || moov_index < mdat_index {
+		_, err = io.Copy(w, io.NewSectionReader(r, 0, size))
+		return err
+	}
+
+	moov_data := make([]byte, boxes[moov_index].Size)
+	_, err = r.ReadAt(moov_data, int64(boxes[moov_index].Offset))
+	if err != nil {
+		return err
+	}
+
+	// Offsets in moov_data are relative to the moov
+	moov_offset := boxes[moov_index].Offset
+	moov_boxes, err := ParseBoxes(moov_data)
+	if err != nil {
+		return shift_error(err, moov_offset)
+	}
+
+	moov := moov_boxes[0]
+	if moov.children_err != nil {
+		return shift_error(moov.children_err, moov_offset)
+	}
+
+	var tables []chunk_offset_table
+	for _, trak := range moov.ChildrenOfType(mp4_fourcc('t', 'r', 'a', 'k')) {
+		box, err := find_chunk_offsets(trak)
+		if err != nil {
+			return shift_error(err, moov_offset)
+		}
+
+		offsets, err := parse_chunk_offsets(box)
+		if err != nil {
+			return shift_error(err, moov_offset)
+		}
+
+		tables = append(tables, chunk_offset_table{box: box, offsets: offsets})
+	}
+
+	// New order: the boxes ahead of the first mdat, moov, then the rest
+	var order []*Mp4_box
+	order = append(order, boxes[:mdat_index]...)
+	order = append(order, moov)
+	for i := mdat_index; i < len(boxes); i++ {
+		if i != moov_index {
+			order = append(order, boxes[i])
+		}
+	}
+
+	// Converting stco to co64 grows moov and moves the media again, so
+	// repeat until the layout is stable.
+	for {
+		moov_size := moov.EncodedSize()
+		var relocations []box_relocation
+		var new_offset uint64
+		for _, box := range order {
+			if box == moov {
+				new_offset += moov_size
+				continue
+			}
+
+			relocations = append(relocations, box_relocation{old_offset: box.Offset, size: box.Size, new_offset: new_offset})
+			new_offset += box.Size
+		}
+
+		for _, t := range tables {
+			new_offsets := make([]uint64, len(t.offsets))
+			for i, o := range t.offsets {
+				new_o, ok := relocate_offset(relocations, o)
+				if !ok {
+					return parse_error(ErrInvalidData, "chunk_offset_outside_media_data", moov_offset + t.box.Offset, t.box.Path())
+				}
+
+				new_offsets[i] = new_o
+			}
+
+			set_chunk_offsets(t.box, new_offsets)
+		}
+
+		if moov.EncodedSize() == moov_size {
+			break
+		}
+	}
+
+	for _, box := range order {
+		if box == moov {
+			_, err = w.Write(moov.Bytes())
+		} else {
+			_, err = io.Copy(w, io.NewSectionReader(r, int64(box.Offset), int64(box.Size)))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
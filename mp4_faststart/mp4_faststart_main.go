@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"github.com/maxutility2011/media_utils"
+)
+
+func main() {
+	inputPtr := flag.String("input", "", "Input MP4 file path")
+	outputPtr := flag.String("output", "", "Output MP4 file path")
+	flag.Parse()
+
+	if *inputPtr == "" || *outputPtr == "" {
+		fmt.Printf("Input and output file paths are required.\n")
+		os.Exit(1)
+	}
+
+	in, err := os.Open(*inputPtr)
+	if err != nil {
+		fmt.Printf("Error: Failed to open input file: %s. Error: %v\n", *inputPtr, err)
+		os.Exit(1)
+	}
+
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		fmt.Printf("Error: Failed to stat input file: %s. Error: %v\n", *inputPtr, err)
+		os.Exit(1)
+	}
+
+	out, err := os.Create(*outputPtr)
+	if err != nil {
+		fmt.Printf("Error: Failed to create output file: %s. Error: %v\n", *outputPtr, err)
+		os.Exit(1)
+	}
+
+	defer out.Close()
+
+	w := bufio.NewWriterSize(out, 1 << 20)
+	err = media_utils.Faststart(in, info.Size(), w)
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err != nil {
+		fmt.Printf("Error: Faststart failed. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Written %s with moov ahead of mdat\n", *outputPtr)
+}
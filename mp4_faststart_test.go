@@ -0,0 +1,223 @@
+package media_utils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// faststart_test_moov returns a moov with a trak per stbl.
+func faststart_test_moov(stbls ...*Mp4_box) *Mp4_box {
+	moov := NewContainerBox(mp4_fourcc('m', 'o', 'o', 'v'))
+	for _, stbl := range stbls {
+		minf := NewContainerBox(mp4_fourcc('m', 'i', 'n', 'f'), stbl)
+		moov.AddChild(NewContainerBox(mp4_fourcc('t', 'r', 'a', 'k'), NewContainerBox(mp4_fourcc('m', 'd', 'i', 'a'), minf)))
+	}
+
+	return moov
+}
+
+func faststart_test_stco(offsets ...uint64) *Mp4_box {
+	stco := NewBox(mp4_fourcc('s', 't', 'c', 'o'), nil)
+	set_chunk_offsets(stco, offsets)
+	return NewContainerBox(mp4_fourcc('s', 't', 'b', 'l'), stco)
+}
+
+var faststart_test_ftyp = NewBox(mp4_fourcc('f', 't', 'y', 'p'), []byte("isom\x00\x00\x00\x00isom"))
+
+func TestFaststart(t *testing.T) {
+	// Two tracks with chunks in both mdats
+	media := []byte("0123456789abcdefghij")
+	mdat1 := NewBox(mp4_fourcc('m', 'd', 'a', 't'), media[:12])
+	free := NewBox(mp4_fourcc('f', 'r', 'e', 'e'), []byte{0, 0})
+	mdat2 := NewBox(mp4_fourcc('m', 'd', 'a', 't'), media[12:])
+	ftyp_size := faststart_test_ftyp.EncodedSize()
+	mdat2_data := ftyp_size + mdat1.EncodedSize() + free.EncodedSize() + 8
+	moov := faststart_test_moov(faststart_test_stco(ftyp_size + 8, ftyp_size + 14), faststart_test_stco(mdat2_data, mdat2_data + 4))
+	data := SerializeBoxes([]*Mp4_box{faststart_test_ftyp, mdat1, free, mdat2, moov})
+
+	var out bytes.Buffer
+	err := Faststart(bytes.NewReader(data), int64(len(data)), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boxes, err := ParseBoxes(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	for _, box := range boxes {
+		types = append(types, box.TypeString())
+	}
+
+	if len(out.Bytes()) != len(data) || len(types) != 5 || types[1] != "moov" || types[2] != "mdat" {
+		t.Fatalf("faststart layout %v, %d bytes", types, len(out.Bytes()))
+	}
+
+	var got []string
+	for _, stco := range boxes[1].FindAll("trak/mdia/minf/stbl/stco") {
+		offsets, err := parse_chunk_offsets(stco)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, o := range offsets {
+			got = append(got, string(out.Bytes()[o:o + 2]))
+		}
+	}
+
+	if len(got) != 4 || got[0] != "01" || got[1] != "67" || got[2] != "cd" || got[3] != "gh" {
+		t.Errorf("chunks at the shifted offsets: %q", got)
+	}
+
+	// Already fast-started: copied unchanged
+	var again bytes.Buffer
+	err = Faststart(bytes.NewReader(out.Bytes()), int64(out.Len()), &again)
+	if err != nil || !bytes.Equal(again.Bytes(), out.Bytes()) {
+		t.Errorf("second faststart changed the file: %v", err)
+	}
+}
+
+// faststart_test_file is a file with an mdat of zeros between a head and a tail,
+// without holding the mdat in memory.
+type faststart_test_file struct {
+	head []byte
+	mdat_size int64
+	tail []byte
+}
+
+func (f *faststart_test_file) size() int64 {
+	return int64(len(f.head)) + f.mdat_size + int64(len(f.tail))
+}
+
+func (f *faststart_test_file) ReadAt(p []byte, off int64) (int, error) {
+	tail_offset := int64(len(f.head)) + f.mdat_size
+	for i := range p {
+		pos := off + int64(i)
+		switch {
+		case pos < int64(len(f.head)):
+			p[i] = f.head[pos]
+		case pos >= tail_offset:
+			p[i] = f.tail[pos - tail_offset]
+		default:
+			// The rest of p, up to the tail, is mdat payload
+			n := int(min(int64(len(p) - i), tail_offset - pos))
+			clear(p[i:i + n])
+			if i + n < len(p) {
+				copy(p[i + n:], f.tail)
+			}
+
+			return len(p), nil
+		}
+	}
+
+	return len(p), nil
+}
+
+// faststart_test_writer keeps the first bytes written and counts the rest.
+type faststart_test_writer struct {
+	head []byte
+	size int64
+}
+
+func (w *faststart_test_writer) Write(p []byte) (int, error) {
+	if n := min(len(p), 4096 - len(w.head)); n > 0 {
+		w.head = append(w.head, p[:n]...)
+	}
+
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+// TestFaststartCo64 shifts a chunk near the end of a 4 GB mdat past 32 bits:
+// the stco becomes a co64, which grows the moov and shifts the media again.
+func TestFaststartCo64(t *testing.T) {
+	const mdat_size = 0xFFFFFFF0
+	head := append(faststart_test_ftyp.Bytes(), append_uint32(append_uint32(nil, mdat_size), mp4_fourcc('m', 'd', 'a', 't'))...)
+	first := uint64(len(head))
+	last := uint64(len(head)) + mdat_size - 8 - 16
+	moov := faststart_test_moov(faststart_test_stco(first, last))
+	file := &faststart_test_file{head: head, mdat_size: mdat_size - 8, tail: moov.Bytes()}
+
+	var out faststart_test_writer
+	err := Faststart(file, file.size(), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boxes, err := ParseBoxes(out.head[:faststart_test_ftyp.EncodedSize()])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := boxes[0].EncodedSize()
+	moov_size := uint64(get_uint32(0, out.head[p:]))
+	moved, err := ParseBoxes(out.head[p:p + moov_size])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	co64 := moved[0].Find("trak/mdia/minf/stbl/co64")
+	if co64 == nil || moved[0].Find("trak/mdia/minf/stbl/stco") != nil {
+		t.Fatalf("stco not converted to co64")
+	}
+
+	offsets, err := parse_chunk_offsets(co64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The media moves by the size of the moov after the conversion
+	if out.size != file.size() + 8 || moov_size != uint64(len(file.tail)) + 8 || len(offsets) != 2 || offsets[0] != first + moov_size || offsets[1] != last + moov_size || offsets[1] <= 0xFFFFFFFF {
+		t.Errorf("co64 offsets %v, moov %d bytes, output %d bytes", offsets, moov_size, out.size)
+	}
+
+	if mdat := out.head[p + moov_size:]; get_uint32(4, mdat) != mp4_fourcc('m', 'd', 'a', 't') {
+		t.Errorf("no mdat after the moov")
+	}
+}
+
+func TestFaststartChunkOffsetErrors(t *testing.T) {
+	mdat := NewBox(mp4_fourcc('m', 'd', 'a', 't'), []byte{1, 2, 3, 4})
+	offset := faststart_test_ftyp.EncodedSize() + 8
+
+	// An stbl whose children do not parse hides its stco
+	malformed := faststart_test_stco(offset)
+	malformed.AddChild(NewBox(mp4_fourcc('s', 't', 's', 'z'), nil))
+	data := SerializeBoxes([]*Mp4_box{faststart_test_ftyp, mdat, faststart_test_moov(malformed)})
+	set_uint32(uint32(len(data) - 8), data, 4)
+	var e *Parse_error
+	err := Faststart(bytes.NewReader(data), int64(len(data)), &bytes.Buffer{})
+	if !errors.Is(err, ErrInvalidData) || !errors.As(err, &e) || e.Path != "moov/trak/mdia/minf/stbl/stsz" || e.Offset != uint64(len(data) - 8) {
+		t.Errorf("malformed stbl: %v", err)
+	}
+
+	// A trak without chunk offsets
+	data = SerializeBoxes([]*Mp4_box{faststart_test_ftyp, mdat, faststart_test_moov(faststart_test_stco(offset), NewContainerBox(mp4_fourcc('s', 't', 'b', 'l')))})
+	err = Faststart(bytes.NewReader(data), int64(len(data)), &bytes.Buffer{})
+	if !errors.Is(err, ErrBoxNotFound) || !errors.As(err, &e) || e.Path != "moov/trak/mdia/minf/stbl/stco" {
+		t.Errorf("trak without stco: %v", err)
+	}
+}
+
+// FuzzFaststart checks that a second pass leaves a fast-started file unchanged.
+func FuzzFaststart(f *testing.F) {
+	mdat := NewBox(mp4_fourcc('m', 'd', 'a', 't'), []byte{1, 2, 3, 4})
+	offset := faststart_test_ftyp.EncodedSize() + 8
+	f.Add(SerializeBoxes([]*Mp4_box{faststart_test_ftyp, mdat, faststart_test_moov(faststart_test_stco(offset, offset + 2))}))
+	f.Add(largesize_progressive_file())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var out bytes.Buffer
+		if Faststart(bytes.NewReader(data), int64(len(data)), &out) != nil {
+			return
+		}
+
+		var again bytes.Buffer
+		err := Faststart(bytes.NewReader(out.Bytes()), int64(out.Len()), &again)
+		if err != nil || !bytes.Equal(again.Bytes(), out.Bytes()) {
+			t.Fatalf("second faststart changed the file: %v", err)
+		}
+	})
+}
@@ -0,0 +1,409 @@
+package media_utils
+
+// tfhd flags
+const (
+	Tfhd_base_data_offset_present = 0x000001
+	Tfhd_sample_description_index_present = 0x000002
+	Tfhd_default_sample_duration_present = 0x000008
+	Tfhd_default_sample_size_present = 0x000010
+	Tfhd_default_sample_flags_present = 0x000020
+	Tfhd_duration_is_empty = 0x010000
+	Tfhd_default_base_is_moof = 0x020000
+)
+
+// trun flags
+const (
+	Trun_data_offset_present = 0x000001
+	Trun_first_sample_flags_present = 0x000004
+	Trun_sample_duration_present = 0x000100
+	Trun_sample_size_present = 0x000200
+	Trun_sample_flags_present = 0x000400
+	Trun_sample_composition_time_offsets_present = 0x000800
+)
+
+// Upper bound of trun sample_count when the samples have no per-sample fields,
+// so that a few bytes cannot make the parser allocate hundreds of megabytes
+const max_trun_sample_count = 1 << 20
+
+type Tfhd_box struct {
+	Header Box_header
+	Track_id uint32
+	Base_data_offset uint64
+	Sample_description_index uint32
+	Default_sample_duration uint32
+	Default_sample_size uint32
+	Default_sample_flags uint32
+}
+
+type Trun_sample struct {
+	Duration uint32
+	Size uint32
+	Flags uint32
+	Composition_time_offset int64 // unsigned in trun version 0, signed in version 1
+}
+
+// Trun_box holds the per-sample fields present in the trun; which ones are
+// present is given by Header.Flag.
+type Trun_box struct {
+	Header Box_header
+	Data_offset int32
+	First_sample_flags uint32
+	Samples []Trun_sample
+}
+
+// parse_tfhd decodes a tfhd box payload (the bytes following the box header).
+func parse_tfhd(payload []byte) (Tfhd_box, error) {
+	var tfhd Tfhd_box
+	if len(payload) < 8 {
+		return tfhd, parse_error(ErrTruncated, "incomplete_tfhd", 0, "")
+	}
+
+	tfhd.Header.Box_size = uint32(len(payload) + 8)
+	tfhd.Header.Version = payload[0]
+	tfhd.Header.Flag = get_uint32(0, payload) & 0x00FFFFFF
+	tfhd.Track_id = get_uint32(4, payload)
+
+	p := uint32(8)
+	end := uint32(len(payload))
+	if tfhd.Header.Flag & Tfhd_base_data_offset_present != 0 {
+		if end - p < 8 {
+			return tfhd, parse_error(ErrTruncated, "incomplete_tfhd", uint64(p), "")
+		}
+
+		tfhd.Base_data_offset = get_uint64(uint64(p), payload)
+		p += 8
+	}
+
+	for _, field := range []struct{ flag uint32; v *uint32 }{
+		{Tfhd_sample_description_index_present, &tfhd.Sample_description_index},
+		{Tfhd_default_sample_duration_present, &tfhd.Default_sample_duration},
+		{Tfhd_default_sample_size_present, &tfhd.Default_sample_size},
+		{Tfhd_default_sample_flags_present, &tfhd.Default_sample_flags},
+	} {
+		if tfhd.Header.Flag & field.flag != 0 {
+			if end - p < 4 {
+				return tfhd, parse_error(ErrTruncated, "incomplete_tfhd", uint64(p), "")
+			}
+
+			*field.v = get_uint32(p, payload)
+			p += 4
+		}
+	}
+
+	return tfhd, nil
+}
+
+// tfhd_payload serializes the tfhd fields selected by Header.Flag.
+func tfhd_payload(tfhd Tfhd_box) []byte {
+	payload := make([]byte, 0, 32)
+	payload = append_uint32(payload, tfhd.Header.Flag & 0x00FFFFFF)
+	payload = append_uint32(payload, tfhd.Track_id)
+	if tfhd.Header.Flag & Tfhd_base_data_offset_present != 0 {
+		payload = append_uint64(payload, tfhd.Base_data_offset)
+	}
+
+	if tfhd.Header.Flag & Tfhd_sample_description_index_present != 0 {
+		payload = append_uint32(payload, tfhd.Sample_description_index)
+	}
+
+	if tfhd.Header.Flag & Tfhd_default_sample_duration_present != 0 {
+		payload = append_uint32(payload, tfhd.Default_sample_duration)
+	}
+
+	if tfhd.Header.Flag & Tfhd_default_sample_size_present != 0 {
+		payload = append_uint32(payload, tfhd.Default_sample_size)
+	}
+
+	if tfhd.Header.Flag & Tfhd_default_sample_flags_present != 0 {
+		payload = append_uint32(payload, tfhd.Default_sample_flags)
+	}
+
+	return payload
+}
+
+func trun_sample_record_size(flags uint32) uint32 {
+	size := uint32(0)
+	for _, f := range []uint32{Trun_sample_duration_present, Trun_sample_size_present, Trun_sample_flags_present, Trun_sample_composition_time_offsets_present} {
+		if flags & f != 0 {
+			size += 4
+		}
+	}
+
+	return size
+}
+
+// parse_trun decodes a trun box payload (the bytes following the box header).
+func parse_trun(payload []byte) (Trun_box, error) {
+	var trun Trun_box
+	if len(payload) < 8 {
+		return trun, parse_error(ErrTruncated, "incomplete_trun", 0, "")
+	}
+
+	trun.Header.Box_size = uint32(len(payload) + 8)
+	trun.Header.Version = payload[0]
+	trun.Header.Flag = get_uint32(0, payload) & 0x00FFFFFF
+	sample_count := get_uint32(4, payload)
+
+	p := uint32(8)
+	end := uint32(len(payload))
+	if trun.Header.Flag & Trun_data_offset_present != 0 {
+		if end - p < 4 {
+			return trun, parse_error(ErrTruncated, "incomplete_trun", uint64(p), "")
+		}
+
+		trun.Data_offset = int32(get_uint32(p, payload))
+		p += 4
+	}
+
+	if trun.Header.Flag & Trun_first_sample_flags_present != 0 {
+		if end - p < 4 {
+			return trun, parse_error(ErrTruncated, "incomplete_trun", uint64(p), "")
+		}
+
+		trun.First_sample_flags = get_uint32(p, payload)
+		p += 4
+	}
+
+	record_size := trun_sample_record_size(trun.Header.Flag)
+	if record_size == 0 && sample_count > max_trun_sample_count {
+		return trun, parse_error(ErrInvalidData, "invalid_trun_sample_count", 4, "")
+	}
+
+	if record_size != 0 && (end - p) / record_size < sample_count {
+		return trun, parse_error(ErrTruncated, "incomplete_trun", uint64(p), "")
+	}
+
+	trun.Samples = make([]Trun_sample, sample_count)
+	for i := range trun.Samples {
+		s := &trun.Samples[i]
+		if trun.Header.Flag & Trun_sample_duration_present != 0 {
+			s.Duration = get_uint32(p, payload)
+			p += 4
+		}
+
+		if trun.Header.Flag & Trun_sample_size_present != 0 {
+			s.Size = get_uint32(p, payload)
+			p += 4
+		}
+
+		if trun.Header.Flag & Trun_sample_flags_present != 0 {
+			s.Flags = get_uint32(p, payload)
+			p += 4
+		}
+
+		if trun.Header.Flag & Trun_sample_composition_time_offsets_present != 0 {
+			if trun.Header.Version == 0 {
+				s.Composition_time_offset = int64(get_uint32(p, payload))
+			} else {
+				s.Composition_time_offset = int64(int32(get_uint32(p, payload)))
+			}
+
+			p += 4
+		}
+	}
+
+	return trun, nil
+}
+
+// trun_payload serializes the trun fields selected by Header.Flag.
+func trun_payload(trun Trun_box) []byte {
+	payload := make([]byte, 0, 16 + len(trun.Samples) * int(trun_sample_record_size(trun.Header.Flag)))
+	payload = append_uint32(payload, uint32(trun.Header.Version) << 24 | trun.Header.Flag & 0x00FFFFFF)
+	payload = append_uint32(payload, uint32(len(trun.Samples)))
+	if trun.Header.Flag & Trun_data_offset_present != 0 {
+		payload = append_uint32(payload, uint32(trun.Data_offset))
+	}
+
+	if trun.Header.Flag & Trun_first_sample_flags_present != 0 {
+		payload = append_uint32(payload, trun.First_sample_flags)
+	}
+
+	for _, s := range trun.Samples {
+		if trun.Header.Flag & Trun_sample_duration_present != 0 {
+			payload = append_uint32(payload, s.Duration)
+		}
+
+		if trun.Header.Flag & Trun_sample_size_present != 0 {
+			payload = append_uint32(payload, s.Size)
+		}
+
+		if trun.Header.Flag & Trun_sample_flags_present != 0 {
+			payload = append_uint32(payload, s.Flags)
+		}
+
+		if trun.Header.Flag & Trun_sample_composition_time_offsets_present != 0 {
+			payload = append_uint32(payload, uint32(s.Composition_time_offset))
+		}
+	}
+
+	return payload
+}
+
+// parse_tfdt decodes a tfdt box payload into baseMediaDecodeTime.
+func parse_tfdt(payload []byte) (uint64, error) {
+	if len(payload) >= 8 && payload[0] == 0 {
+		return uint64(get_uint32(4, payload)), nil
+	} else if len(payload) >= 12 && payload[0] == 1 {
+		return get_uint64(4, payload), nil
+	}
+
+	return 0, parse_error(ErrTruncated, "incomplete_tfdt_baseMediaDecodeTime", 4, "")
+}
+
+// GetTrackTfdt returns the tfdt of the traf of track_id in the first moof.
+func GetTrackTfdt(seg_data []byte, track_id uint32) (Tfdt_box, error) {
+	var tfdt Tfdt_box
+	boxes, err := ParseBoxes(seg_data)
+	if err != nil {
+		return tfdt, err
+	}
+
+	moof := FindBox(boxes, "moof")
+	if moof == nil {
+		return tfdt, box_not_found(nil, "moof")
+	}
+
+	for _, traf := range moof.ChildrenOfType(mp4_fourcc('t', 'r', 'a', 'f')) {
+		tfhd_box := traf.Child(mp4_fourcc('t', 'f', 'h', 'd'))
+		if tfhd_box == nil || len(tfhd_box.Payload) < 8 || get_uint32(4, tfhd_box.Payload) != track_id {
+			continue
+		}
+
+		tfdt_box := traf.Child(mp4_fourcc('t', 'f', 'd', 't'))
+		if tfdt_box == nil {
+			return tfdt, box_not_found(traf, "tfdt")
+		}
+
+		base_media_decode_time, err := parse_tfdt(tfdt_box.Payload)
+		if err != nil {
+			return tfdt, in_box(err, tfdt_box)
+		}
+
+		tfdt.Header.Box_size = uint32(tfdt_box.Size)
+		tfdt.Header.Version = tfdt_box.Version()
+		tfdt.Header.Flag = tfdt_box.Flags()
+		if tfdt.Header.Version == 0 {
+			tfdt.BaseMediaDecodeTime_v0 = uint32(base_media_decode_time)
+		} else {
+			tfdt.BaseMediaDecodeTime_v1 = base_media_decode_time
+		}
+
+		return tfdt, nil
+	}
+
+	return tfdt, parse_error(ErrBoxNotFound, "Failed_to_find_track", moof.Offset, moof.Path() + "/traf/tfhd")
+}
+
+// tfdt_payload serializes baseMediaDecodeTime, as version 1 if it does not fit in 32 bits.
+func tfdt_payload(version uint8, base_media_decode_time uint64) []byte {
+	if base_media_decode_time > 0xFFFFFFFF {
+		version = 1
+	}
+
+	if version == 1 {
+		return append_uint64([]byte{1, 0, 0, 0}, base_media_decode_time)
+	}
+
+	return append_uint32([]byte{0, 0, 0, 0}, uint32(base_media_decode_time))
+}
+
+type Sidx_reference struct {
+	Reference_type uint8 // 1: the reference points to a sidx, 0: to media
+	Referenced_size uint32
+	Subsegment_duration uint32
+	Starts_with_sap bool
+	Sap_type uint8
+	Sap_delta_time uint32
+}
+
+// parse_sidx decodes a sidx box payload (the bytes following the box header).
+func parse_sidx(payload []byte) (Sidx_box, error) {
+	var sidx Sidx_box
+	if len(payload) < 12 {
+		return sidx, parse_error(ErrTruncated, "incomplete_sidx", 0, "")
+	}
+
+	sidx.Header.Box_size = uint32(len(payload) + 8)
+	sidx.Header.Version = payload[0]
+	sidx.Header.Flag = get_uint32(0, payload) & 0x00FFFFFF
+	sidx.Reference_id = get_uint32(4, payload)
+	sidx.Timescale = get_uint32(8, payload)
+
+	p := uint32(12)
+	end := uint32(len(payload))
+	if sidx.Header.Version == 0 {
+		if end - p < 12 {
+			return sidx, parse_error(ErrTruncated, "incomplete_sidx", uint64(p), "")
+		}
+
+		sidx.Earliest_presentation_time = uint64(get_uint32(p, payload))
+		sidx.First_offset = uint64(get_uint32(p + 4, payload))
+		p += 8
+	} else {
+		if end - p < 20 {
+			return sidx, parse_error(ErrTruncated, "incomplete_sidx", uint64(p), "")
+		}
+
+		sidx.Earliest_presentation_time = get_uint64(uint64(p), payload)
+		sidx.First_offset = get_uint64(uint64(p + 8), payload)
+		p += 16
+	}
+
+	// reserved, reference_count
+	reference_count := uint32(get_uint16(p + 2, payload))
+	p += 4
+	if (end - p) / 12 < reference_count {
+		return sidx, parse_error(ErrTruncated, "incomplete_sidx", uint64(p), "")
+	}
+
+	sidx.References = make([]Sidx_reference, reference_count)
+	for i := range sidx.References {
+		ref := &sidx.References[i]
+		v := get_uint32(p, payload)
+		ref.Reference_type = uint8(v >> 31)
+		ref.Referenced_size = v & 0x7FFFFFFF
+		ref.Subsegment_duration = get_uint32(p + 4, payload)
+		v = get_uint32(p + 8, payload)
+		ref.Starts_with_sap = v >> 31 == 1
+		ref.Sap_type = uint8(v >> 28 & 0x7)
+		ref.Sap_delta_time = v & 0x0FFFFFFF
+		p += 12
+	}
+
+	return sidx, nil
+}
+
+// sidx_payload serializes a sidx, as version 1 if the 64-bit fields do not fit in 32 bits.
+func sidx_payload(sidx Sidx_box) []byte {
+	version := sidx.Header.Version
+	if sidx.Earliest_presentation_time > 0xFFFFFFFF || sidx.First_offset > 0xFFFFFFFF {
+		version = 1
+	}
+
+	payload := make([]byte, 0, 32 + 12 * len(sidx.References))
+	payload = append_uint32(payload, uint32(version) << 24 | sidx.Header.Flag & 0x00FFFFFF)
+	payload = append_uint32(payload, sidx.Reference_id)
+	payload = append_uint32(payload, sidx.Timescale)
+	if version == 0 {
+		payload = append_uint32(payload, uint32(sidx.Earliest_presentation_time))
+		payload = append_uint32(payload, uint32(sidx.First_offset))
+	} else {
+		payload = append_uint64(payload, sidx.Earliest_presentation_time)
+		payload = append_uint64(payload, sidx.First_offset)
+	}
+
+	payload = append_uint16(payload, 0)
+	payload = append_uint16(payload, uint16(len(sidx.References)))
+	for _, ref := range sidx.References {
+		payload = append_uint32(payload, uint32(ref.Reference_type) << 31 | ref.Referenced_size & 0x7FFFFFFF)
+		payload = append_uint32(payload, ref.Subsegment_duration)
+		sap := uint32(ref.Sap_type & 0x7) << 28 | ref.Sap_delta_time & 0x0FFFFFFF
+		if ref.Starts_with_sap {
+			sap |= 0x80000000
+		}
+
+		payload = append_uint32(payload, sap)
+	}
+
+	return payload
+}
@@ -0,0 +1,36 @@
+package media_utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzFragmentBoxes checks that the tfhd, trun and sidx payloads serialize
+// back to payloads parsing to the same fields.
+func FuzzFragmentBoxes(f *testing.F) {
+	f.Add(tfhd_payload(Tfhd_box{Header: Box_header{Flag: 0x02003A}, Track_id: 1, Sample_description_index: 1, Default_sample_duration: 3000, Default_sample_size: 100, Default_sample_flags: 0x10000}))
+	f.Add(sidx_payload(Sidx_box{Reference_id: 1, Timescale: 90000, Earliest_presentation_time: 1 << 33, References: []Sidx_reference{{Referenced_size: 1000, Subsegment_duration: 180000, Starts_with_sap: true, Sap_type: 1}}}))
+	f.Add([]byte{0, 0, 0x0F, 0x01, 0, 0, 0, 1, 0, 0, 0, 8, 0, 0, 0x0B, 0xB8, 0, 0, 0, 100, 0x02, 0, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		if tfhd, err := parse_tfhd(payload); err == nil {
+			again, err := parse_tfhd(tfhd_payload(tfhd))
+			if err != nil || !bytes.Equal(tfhd_payload(again), tfhd_payload(tfhd)) {
+				t.Fatalf("tfhd %+v read back as %+v: %v", tfhd, again, err)
+			}
+		}
+
+		if trun, err := parse_trun(payload); err == nil {
+			again, err := parse_trun(trun_payload(trun))
+			if err != nil || !bytes.Equal(trun_payload(again), trun_payload(trun)) {
+				t.Fatalf("trun %+v read back as %+v: %v", trun, again, err)
+			}
+		}
+
+		if sidx, err := parse_sidx(payload); err == nil {
+			again, err := parse_sidx(sidx_payload(sidx))
+			if err != nil || !bytes.Equal(sidx_payload(again), sidx_payload(sidx)) {
+				t.Fatalf("sidx %+v read back as %+v: %v", sidx, again, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package media_utils
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Frame_hash is the hash of the data of one sample.
+type Frame_hash struct {
+	Track_index int // index of the track in the moov, the stream number of the output
+	Track_id uint32
+	Dts int64
+	Pts int64
+	Duration uint32
+	Size uint32
+	Hash string
+}
+
+// Frame_hasher hashes the samples of a set of tracks and writes them in the
+// line format of ffmpeg framemd5/framehash:
+//
+//	#stream#, dts,        pts, duration,     size, hash
+//	0,          0,       3000,     3000,    18326, 4d0a2e5a6b5c0e5c8a7f0d1e2b3c4d5e
+//
+// Samples are written grouped by track in decode order, so that the output
+// does not depend on how a packager interleaves the tracks. Times are media
+// times in the track timescale, before edit lists.
+type Frame_hasher struct {
+	tracks []Track_info
+	hash_name string
+	new_hash func() hash.Hash
+	hashes []Frame_hash
+}
+
+var frame_hash_functions = map[string]func() hash.Hash{
+	"md5": md5.New,
+	"sha1": sha1.New,
+	"sha256": sha256.New,
+}
+
+// NewFrameHasher returns a hasher of the samples of tracks using the hash
+// function hash_name: md5, sha1 or sha256.
+func NewFrameHasher(tracks []Track_info, hash_name string) (*Frame_hasher, error) {
+	new_hash, ok := frame_hash_functions[strings.ToLower(hash_name)]
+	if !ok {
+		return nil, errors.New("unsupported_hash_" + hash_name)
+	}
+
+	return &Frame_hasher{tracks: tracks, hash_name: strings.ToLower(hash_name), new_hash: new_hash}, nil
+}
+
+// AddSamples hashes samples, e.g. those of GetTrackSamples or of the
+// GetFragmentSamples of one media segment. The sample data is not kept.
+func (h *Frame_hasher) AddSamples(samples []Mp4_sample) error {
+	for _, s := range samples {
+		index := -1
+		for i, track := range h.tracks {
+			if track.Track_id == s.Track_id {
+				index = i
+				break
+			}
+		}
+
+		if index < 0 {
+			return errors.New("unknown_track_id")
+		}
+
+		if s.Data == nil && s.Size > 0 {
+			return parse_error(ErrTruncated, "sample_outside_data", s.Offset, "")
+		}
+
+		hash := h.new_hash()
+		hash.Write(s.Data)
+		h.hashes = append(h.hashes, Frame_hash{Track_index: index, Track_id: s.Track_id, Dts: s.Dts, Pts: s.Pts, Duration: s.Duration, Size: s.Size, Hash: hex.EncodeToString(hash.Sum(nil))})
+	}
+
+	return nil
+}
+
+// Hashes returns the sample hashes grouped by track, in decode order.
+func (h *Frame_hasher) Hashes() []Frame_hash {
+	sort.SliceStable(h.hashes, func(i, j int) bool {
+		if h.hashes[i].Track_index != h.hashes[j].Track_index {
+			return h.hashes[i].Track_index < h.hashes[j].Track_index
+		}
+
+		return h.hashes[i].Dts < h.hashes[j].Dts
+	})
+
+	return h.hashes
+}
+
+// frame_hash_media_type maps a handler type to the ffmpeg media type name.
+func frame_hash_media_type(handler_type string) string {
+	switch handler_type {
+	case "vide":
+		return "video"
+	case "soun":
+		return "audio"
+	case "subt", "text", "sbtl":
+		return "subtitle"
+	}
+
+	return "data"
+}
+
+// Write writes the header describing the tracks and one line per sample.
+func (h *Frame_hasher) Write(w io.Writer) error {
+	header := fmt.Sprintf("#format: frame checksums\n#version: 2\n#hash: %s\n", strings.ToUpper(h.hash_name))
+	for i, track := range h.tracks {
+		header += fmt.Sprintf("#tb %d: 1/%d\n#media_type %d: %s\n#codec_id %d: %s\n", i, track.Timescale, i, frame_hash_media_type(track.Handler_type), i, track.CodecString())
+		if track.Width != 0 {
+			header += fmt.Sprintf("#dimensions %d: %dx%d\n", i, track.Width, track.Height)
+		}
+
+		if track.Sample_rate != 0 {
+			header += fmt.Sprintf("#sample_rate %d: %d\n#channels %d: %d\n", i, track.Sample_rate, i, track.Channel_count)
+		}
+	}
+
+	header += "#stream#, dts,        pts, duration,     size, hash\n"
+	_, err := io.WriteString(w, header)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range h.Hashes() {
+		_, err = fmt.Fprintf(w, "%d, %10d, %10d, %8d, %8d, %s\n", f.Track_index, f.Dts, f.Pts, f.Duration, f.Size, f.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
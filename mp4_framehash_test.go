@@ -0,0 +1,33 @@
+package media_utils
+
+import (
+	"io"
+	"testing"
+)
+
+// FuzzFrameHasher checks that every sample is hashed once, in track then
+// decode order.
+func FuzzFrameHasher(f *testing.F) {
+	f.Add(fuzz_init(), fuzz_segment())
+	f.Fuzz(func(t *testing.T, init_data []byte, seg_data []byte) {
+		tracks, samples := fuzz_samples(init_data, seg_data)
+		h, err := NewFrameHasher(tracks, "md5")
+		if err != nil || h.AddSamples(samples) != nil {
+			return
+		}
+
+		hashes := h.Hashes()
+		if len(hashes) != len(samples) {
+			t.Fatalf("%d hashes of %d samples", len(hashes), len(samples))
+		}
+
+		for i := 1; i < len(hashes); i++ {
+			a, b := hashes[i - 1], hashes[i]
+			if a.Track_index > b.Track_index || (a.Track_index == b.Track_index && a.Dts > b.Dts) {
+				t.Fatalf("hash %d %+v after %+v", i, b, a)
+			}
+		}
+
+		h.Write(io.Discard)
+	})
+}
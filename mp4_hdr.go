@@ -0,0 +1,526 @@
+package media_utils
+
+import (
+	"fmt"
+)
+
+// Transfer characteristics (ISO/IEC 23091-2)
+const (
+	Transfer_bt709 = 1
+	Transfer_bt2020_10 = 14
+	Transfer_bt2020_12 = 15
+	Transfer_smpte2084 = 16 // PQ
+	Transfer_arib_std_b67 = 18 // HLG
+)
+
+// Colr_box is a colour information box: nclx/nclc colour parameters or an
+// ICC profile (rICC, prof).
+type Colr_box struct {
+	Colour_type string
+	Colour_primaries uint16
+	Transfer_characteristics uint16
+	Matrix_coefficients uint16
+	Full_range bool // nclx only
+	Icc_profile []byte
+}
+
+// Mdcv_box is the SMPTE ST 2086 mastering display colour volume. Chromaticity
+// coordinates are in units of 0.00002, luminance in units of 0.0001 cd/m2.
+type Mdcv_box struct {
+	Display_primaries [3][2]uint16 // x, y of the G, B, R primaries
+	White_point [2]uint16
+	Max_display_mastering_luminance uint32
+	Min_display_mastering_luminance uint32
+}
+
+// Clli_box is the content light level information, in cd/m2.
+type Clli_box struct {
+	Max_content_light_level uint16
+	Max_pic_average_light_level uint16
+}
+
+// Dolby_vision_config is a DOVIDecoderConfigurationRecord (dvcC, dvvC or dvwC).
+type Dolby_vision_config struct {
+	Box_type string
+	Version_major uint8
+	Version_minor uint8
+	Profile uint8
+	Level uint8
+	Rpu_present bool
+	El_present bool
+	Bl_present bool
+	Bl_signal_compatibility_id uint8
+}
+
+// Hdr_info gathers the colour metadata of a video sample entry.
+type Hdr_info struct {
+	Colr *Colr_box
+	Mdcv *Mdcv_box
+	Clli *Clli_box
+	Dolby_vision *Dolby_vision_config
+	Sps_colour *Colr_box // colour description of the VUI of the SPS, if any
+	Alternative_transfer uint16 // preferred_transfer_characteristics of the SEI, 0 without
+	Video_range string // HLS VIDEO-RANGE: SDR, PQ or HLG
+	Dolby_vision_codec string // e.g. dvh1.08.06, empty without Dolby Vision
+	Supplemental_brand string // db1p, db2g or db4h for cross-compatible Dolby Vision
+}
+
+func ParseColr(payload []byte) (Colr_box, error) {
+	var colr Colr_box
+	if len(payload) < 4 {
+		return colr, parse_error(ErrTruncated, "incomplete_colr", 0, "")
+	}
+
+	colr.Colour_type = fourcc_string(get_uint32(0, payload))
+	switch colr.Colour_type {
+	case "nclx", "nclc":
+		if len(payload) < 10 {
+			return colr, parse_error(ErrTruncated, "incomplete_colr", 4, "")
+		}
+
+		colr.Colour_primaries = get_uint16(4, payload)
+		colr.Transfer_characteristics = get_uint16(6, payload)
+		colr.Matrix_coefficients = get_uint16(8, payload)
+		if colr.Colour_type == "nclx" && len(payload) >= 11 {
+			colr.Full_range = payload[10] & 0x80 != 0
+		}
+	case "rICC", "prof":
+		colr.Icc_profile = payload[4:]
+	}
+
+	return colr, nil
+}
+
+func ParseMdcv(payload []byte) (Mdcv_box, error) {
+	var mdcv Mdcv_box
+	if len(payload) < 24 {
+		return mdcv, parse_error(ErrTruncated, "incomplete_mdcv", 0, "")
+	}
+
+	for i := 0; i < 3; i++ {
+		mdcv.Display_primaries[i][0] = get_uint16(uint32(i * 4), payload)
+		mdcv.Display_primaries[i][1] = get_uint16(uint32(i * 4 + 2), payload)
+	}
+
+	mdcv.White_point[0] = get_uint16(12, payload)
+	mdcv.White_point[1] = get_uint16(14, payload)
+	mdcv.Max_display_mastering_luminance = get_uint32(16, payload)
+	mdcv.Min_display_mastering_luminance = get_uint32(20, payload)
+	return mdcv, nil
+}
+
+// MaxLuminance returns the maximum mastering display luminance in cd/m2.
+func (mdcv Mdcv_box) MaxLuminance() float64 {
+	return float64(mdcv.Max_display_mastering_luminance) / 10000
+}
+
+// MinLuminance returns the minimum mastering display luminance in cd/m2.
+func (mdcv Mdcv_box) MinLuminance() float64 {
+	return float64(mdcv.Min_display_mastering_luminance) / 10000
+}
+
+func ParseClli(payload []byte) (Clli_box, error) {
+	var clli Clli_box
+	if len(payload) < 4 {
+		return clli, parse_error(ErrTruncated, "incomplete_clli", 0, "")
+	}
+
+	clli.Max_content_light_level = get_uint16(0, payload)
+	clli.Max_pic_average_light_level = get_uint16(2, payload)
+	return clli, nil
+}
+
+func ParseDolbyVisionConfig(box_type string, payload []byte) (Dolby_vision_config, error) {
+	dv := Dolby_vision_config{Box_type: box_type}
+	if len(payload) < 5 {
+		return dv, parse_error(ErrTruncated, "incomplete_" + box_type, 0, "")
+	}
+
+	dv.Version_major = payload[0]
+	dv.Version_minor = payload[1]
+	dv.Profile = payload[2] >> 1
+	dv.Level = (payload[2] & 0x01) << 5 | payload[3] >> 3
+	dv.Rpu_present = payload[3] & 0x04 != 0
+	dv.El_present = payload[3] & 0x02 != 0
+	dv.Bl_present = payload[3] & 0x01 != 0
+	dv.Bl_signal_compatibility_id = payload[4] >> 4
+	return dv, nil
+}
+
+// VideoRange returns the HLS VIDEO-RANGE of a Dolby Vision stream, from its
+// profile and base layer compatibility.
+func (dv Dolby_vision_config) VideoRange() string {
+	switch dv.Profile {
+	case 5, 7:
+		return "PQ"
+	case 8, 10:
+		switch dv.Bl_signal_compatibility_id {
+		case 2:
+			return "SDR"
+		case 4:
+			return "HLG"
+		}
+
+		return "PQ"
+	}
+
+	return "SDR"
+}
+
+// SupplementalBrand returns the HLS SUPPLEMENTAL-CODECS brand of a
+// cross-compatible Dolby Vision stream, or "" if there is none.
+func (dv Dolby_vision_config) SupplementalBrand() string {
+	switch dv.Bl_signal_compatibility_id {
+	case 1:
+		return "db1p"
+	case 2:
+		return "db2g"
+	case 4:
+		return "db4h"
+	}
+
+	return ""
+}
+
+// CodecString returns the Dolby Vision codec string, e.g. dvh1.08.06, for a
+// stream carried in a sample entry of the given type. A Dolby Vision
+// configuration in a plain hvc1/avc1/av01 entry maps to the matching
+// Dolby Vision sample entry type.
+func (dv Dolby_vision_config) CodecString(sample_entry_type string) string {
+	fourcc := sample_entry_type
+	switch sample_entry_type {
+	case "hvc1":
+		fourcc = "dvh1"
+	case "hev1":
+		fourcc = "dvhe"
+	case "avc1":
+		fourcc = "dva1"
+	case "avc3":
+		fourcc = "dvav"
+	case "av01":
+		fourcc = "dav1"
+	}
+
+	return fmt.Sprintf("%s.%02d.%02d", fourcc, dv.Profile, dv.Level)
+}
+
+// VideoRange returns the HLS VIDEO-RANGE of a colour description.
+func (colr Colr_box) VideoRange() string {
+	switch colr.Transfer_characteristics {
+	case Transfer_smpte2084:
+		return "PQ"
+	case Transfer_arib_std_b67:
+		return "HLG"
+	}
+
+	return "SDR"
+}
+
+// read_vui_colour reads the colour description of H.264 or HEVC
+// vui_parameters at r, returning false if there is none.
+func read_vui_colour(r *bit_reader) (Colr_box, bool) {
+	colr := Colr_box{Colour_type: "nclx"}
+	if r.read_flag() { // aspect_ratio_info_present_flag
+		if r.read_bits(8) == 255 { // aspect_ratio_idc: Extended_SAR
+			r.skip_bits(32) // sar_width, sar_height
+		}
+	}
+
+	if r.read_flag() { // overscan_info_present_flag
+		r.read_flag() // overscan_appropriate_flag
+	}
+
+	if !r.read_flag() { // video_signal_type_present_flag
+		return colr, false
+	}
+
+	r.read_bits(3) // video_format
+	colr.Full_range = r.read_flag()
+	if !r.read_flag() { // colour_description_present_flag
+		return colr, false
+	}
+
+	colr.Colour_primaries = uint16(r.read_bits(8))
+	colr.Transfer_characteristics = uint16(r.read_bits(8))
+	colr.Matrix_coefficients = uint16(r.read_bits(8))
+	return colr, r.err == nil
+}
+
+// avc_sps_colour returns the colour description of the VUI of an H.264 SPS.
+func avc_sps_colour(sps []byte) (Colr_box, bool) {
+	r, _, _, err := read_avc_sps(sps)
+	if err != nil || !r.read_flag() { // vui_parameters_present_flag
+		return Colr_box{}, false
+	}
+
+	return read_vui_colour(r)
+}
+
+// skip_hevc_scaling_list_data skips the scaling_list_data of an HEVC SPS.
+func skip_hevc_scaling_list_data(r *bit_reader) {
+	for size_id := 0; size_id < 4; size_id++ {
+		step := 1
+		if size_id == 3 {
+			step = 3
+		}
+
+		for matrix_id := 0; matrix_id < 6 && r.err == nil; matrix_id += step {
+			if !r.read_flag() { // scaling_list_pred_mode_flag
+				r.read_ue() // scaling_list_pred_matrix_id_delta
+				continue
+			}
+
+			if size_id > 1 {
+				r.read_se() // scaling_list_dc_coef_minus8
+			}
+
+			for i := 0; i < min(64, 1 << (4 + size_id << 1)) && r.err == nil; i++ {
+				r.read_se() // scaling_list_delta_coef
+			}
+		}
+	}
+}
+
+// skip_hevc_st_ref_pic_sets skips the short-term reference picture sets of
+// an HEVC SPS.
+func skip_hevc_st_ref_pic_sets(r *bit_reader, count uint64) {
+	var num_delta_pocs []uint64
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		inter_ref_pic_set_prediction := i != 0 && r.read_flag()
+		if inter_ref_pic_set_prediction {
+			r.read_flag() // delta_rps_sign
+			r.read_ue() // abs_delta_rps_minus1
+			n := uint64(0)
+			for j := uint64(0); j <= num_delta_pocs[i - 1] && r.err == nil; j++ {
+				used_by_curr_pic := r.read_flag()
+				if used_by_curr_pic || r.read_flag() { // use_delta_flag
+					n++
+				}
+			}
+
+			num_delta_pocs = append(num_delta_pocs, n)
+			continue
+		}
+
+		num_negative_pics := r.read_ue()
+		num_positive_pics := r.read_ue()
+		for j := uint64(0); j < num_negative_pics + num_positive_pics && r.err == nil; j++ {
+			r.read_ue() // delta_poc_minus1
+			r.read_flag() // used_by_curr_pic_flag
+		}
+
+		num_delta_pocs = append(num_delta_pocs, num_negative_pics + num_positive_pics)
+	}
+}
+
+// hevc_sps_colour returns the colour description of the VUI of an HEVC SPS.
+func hevc_sps_colour(sps []byte) (Colr_box, bool) {
+	r, _, max_sub_layers_minus1, _, _, err := read_hevc_sps(sps)
+	if err != nil {
+		return Colr_box{}, false
+	}
+
+	log2_max_pic_order_cnt_lsb := uint(r.read_ue()) + 4
+	first_sub_layer := max_sub_layers_minus1
+	if r.read_flag() { // sps_sub_layer_ordering_info_present_flag
+		first_sub_layer = 0
+	}
+
+	for i := first_sub_layer; i <= max_sub_layers_minus1; i++ {
+		r.read_ue() // sps_max_dec_pic_buffering_minus1
+		r.read_ue() // sps_max_num_reorder_pics
+		r.read_ue() // sps_max_latency_increase_plus1
+	}
+
+	for i := 0; i < 6; i++ {
+		r.read_ue() // coding and transform block sizes, transform hierarchy depths
+	}
+
+	if r.read_flag() && r.read_flag() { // scaling_list_enabled_flag, sps_scaling_list_data_present_flag
+		skip_hevc_scaling_list_data(r)
+	}
+
+	r.read_flag() // amp_enabled_flag
+	r.read_flag() // sample_adaptive_offset_enabled_flag
+	if r.read_flag() { // pcm_enabled_flag
+		r.read_bits(8) // pcm_sample_bit_depth_luma_minus1, pcm_sample_bit_depth_chroma_minus1
+		r.read_ue() // log2_min_pcm_luma_coding_block_size_minus3
+		r.read_ue() // log2_diff_max_min_pcm_luma_coding_block_size
+		r.read_flag() // pcm_loop_filter_disabled_flag
+	}
+
+	skip_hevc_st_ref_pic_sets(r, r.read_ue())
+	if r.read_flag() { // long_term_ref_pics_present_flag
+		count := r.read_ue()
+		for i := uint64(0); i < count && r.err == nil; i++ {
+			r.read_bits(log2_max_pic_order_cnt_lsb + 1) // lt_ref_pic_poc_lsb_sps, used_by_curr_pic_lt_sps_flag
+		}
+	}
+
+	r.read_flag() // sps_temporal_mvp_enabled_flag
+	r.read_flag() // strong_intra_smoothing_enabled_flag
+	if !r.read_flag() { // vui_parameters_present_flag
+		return Colr_box{}, false
+	}
+
+	return read_vui_colour(r)
+}
+
+// sps_colour returns the colour description of the VUI of the first SPS of
+// the avcC or hvcC of a track.
+func sps_colour(track Track_info) (Colr_box, bool) {
+	if track.Avcc != nil && len(track.Avcc.Sps) > 0 {
+		return avc_sps_colour(track.Avcc.Sps[0])
+	}
+
+	if track.Hvcc != nil {
+		for _, array := range track.Hvcc.Arrays {
+			if array.Nal_unit_type == 33 && len(array.Nalus) > 0 {
+				return hevc_sps_colour(array.Nalus[0])
+			}
+		}
+	}
+
+	return Colr_box{}, false
+}
+
+// alternative_transfer returns the preferred_transfer_characteristics of
+// the first alternative transfer characteristics SEI message in the SEI
+// NAL units of the hvcC or in samples, or 0 if there is none.
+func alternative_transfer(track Track_info, samples []Mp4_sample) uint16 {
+	find := func(messages []Sei_message) uint16 {
+		for _, m := range messages {
+			if m.Payload_type == Sei_alternative_transfer_characteristics && len(m.Payload) > 0 {
+				return uint16(m.Payload[0])
+			}
+		}
+
+		return 0
+	}
+
+	if track.Hvcc != nil {
+		for _, array := range track.Hvcc.Arrays {
+			if array.Nal_unit_type != 39 {
+				continue
+			}
+
+			for _, nalu := range array.Nalus {
+				if len(nalu) > 2 {
+					if v := find(ParseSeiMessages(NalToRbsp(nalu[2:]))); v != 0 {
+						return v
+					}
+				}
+			}
+		}
+	}
+
+	a, err := NewNalAnalyzer(track)
+	if err != nil {
+		return 0
+	}
+
+	for _, sample := range samples {
+		if sample.Track_id != track.Track_id || sample.Data == nil {
+			continue
+		}
+
+		pic, err := a.AnalyzeSample(sample)
+		if err != nil {
+			continue
+		}
+
+		for _, nal := range pic.Nal_units {
+			if v := find(nal.Sei_messages); v != 0 {
+				return v
+			}
+		}
+	}
+
+	return 0
+}
+
+// GetHdrInfo parses the colour boxes of the first sample entry of a video
+// track and derives the expected VIDEO-RANGE and Dolby Vision codec string.
+// Without colr or Dolby Vision configuration the transfer characteristics
+// are those of the VUI of the SPS, and without either the range is SDR. A
+// BT.709 or BT.2020 transfer with an alternative transfer characteristics
+// SEI message, in the hvcC or in samples of the track (e.g. the first ones),
+// takes the preferred transfer: HLG streams compatible with SDR displays are
+// signaled that way.
+func GetHdrInfo(track Track_info, samples ...Mp4_sample) (Hdr_info, error) {
+	info := Hdr_info{Video_range: "SDR"}
+	if track.Sample_entry == nil {
+		if track.Trak == nil {
+			return info, parse_error(ErrBoxNotFound, "Failed_to_find_sample_entry", 0, "")
+		}
+
+		return info, parse_error(ErrBoxNotFound, "Failed_to_find_sample_entry", track.Trak.Offset, track.Trak.Path() + "/mdia/minf/stbl/stsd")
+	}
+
+	for _, box := range track.Sample_entry.Children {
+		switch box.TypeString() {
+		case "colr":
+			colr, err := ParseColr(box.Payload)
+			if err != nil {
+				return info, in_box(err, box)
+			}
+
+			// nclx is authoritative when an ICC profile is also present
+			if info.Colr == nil || colr.Icc_profile == nil {
+				info.Colr = &colr
+			}
+		case "mdcv":
+			mdcv, err := ParseMdcv(box.Payload)
+			if err != nil {
+				return info, in_box(err, box)
+			}
+
+			info.Mdcv = &mdcv
+		case "clli":
+			clli, err := ParseClli(box.Payload)
+			if err != nil {
+				return info, in_box(err, box)
+			}
+
+			info.Clli = &clli
+		case "dvcC", "dvvC", "dvwC":
+			dv, err := ParseDolbyVisionConfig(box.TypeString(), box.Payload)
+			if err != nil {
+				return info, err
+			}
+
+			info.Dolby_vision = &dv
+		}
+	}
+
+	if info.Dolby_vision != nil {
+		info.Video_range = info.Dolby_vision.VideoRange()
+		info.Dolby_vision_codec = info.Dolby_vision.CodecString(track.Codec)
+		info.Supplemental_brand = info.Dolby_vision.SupplementalBrand()
+		return info, nil
+	}
+
+	if colr, ok := sps_colour(track); ok {
+		info.Sps_colour = &colr
+	}
+
+	colour := info.Colr
+	if colour == nil || colour.Icc_profile != nil {
+		colour = info.Sps_colour
+	}
+
+	if colour == nil {
+		return info, nil
+	}
+
+	info.Video_range = colour.VideoRange()
+	switch colour.Transfer_characteristics {
+	case Transfer_bt709, Transfer_bt2020_10, Transfer_bt2020_12:
+		info.Alternative_transfer = alternative_transfer(track, samples)
+		if info.Alternative_transfer != 0 {
+			info.Video_range = Colr_box{Transfer_characteristics: info.Alternative_transfer}.VideoRange()
+		}
+	}
+
+	return info, nil
+}
@@ -0,0 +1,191 @@
+package media_utils
+
+import (
+	"testing"
+)
+
+// hdr_test_vui writes vui_parameters with the given transfer
+// characteristics, or without colour description if transfer is 0.
+func hdr_test_vui(w *bit_writer, transfer uint64) {
+	w.write_flag(false) // aspect_ratio_info_present_flag
+	w.write_flag(false) // overscan_info_present_flag
+	w.write_flag(true) // video_signal_type_present_flag
+	w.write_bits(3, 5) // video_format
+	w.write_flag(false) // video_full_range_flag
+	w.write_flag(transfer != 0) // colour_description_present_flag
+	if transfer != 0 {
+		w.write_bits(8, 9) // BT.2020 primaries
+		w.write_bits(8, transfer)
+		w.write_bits(8, 9) // BT.2020 non-constant luminance matrix
+	}
+
+	w.write_bits(5, 0) // chroma_loc_info, timing_info, HRD, pic_struct, bitstream_restriction flags
+	w.write_bits(1, 1) // rbsp_stop_one_bit
+	for len(w.bytes()) == 0 || w.nbits & 7 != 0 {
+		w.write_bits(1, 0)
+	}
+}
+
+// hdr_test_avc_sps returns a 320x240 Baseline SPS.
+func hdr_test_avc_sps(transfer uint64) []byte {
+	var w bit_writer
+	w.write_bytes([]byte{0x67, 66, 0, 30})
+	w.write_ue(0) // seq_parameter_set_id
+	w.write_ue(0) // log2_max_frame_num_minus4
+	w.write_ue(2) // pic_order_cnt_type
+	w.write_ue(1) // max_num_ref_frames
+	w.write_flag(false) // gaps_in_frame_num_value_allowed_flag
+	w.write_ue(19) // pic_width_in_mbs_minus1
+	w.write_ue(14) // pic_height_in_map_units_minus1
+	w.write_flag(true) // frame_mbs_only_flag
+	w.write_flag(true) // direct_8x8_inference_flag
+	w.write_flag(false) // frame_cropping_flag
+	w.write_flag(true) // vui_parameters_present_flag
+	hdr_test_vui(&w, transfer)
+	return w.bytes()
+}
+
+// hdr_test_hevc_sps returns a 1920x1080 Main 10 SPS with two short-term
+// reference picture sets, the second predicted from the first.
+func hdr_test_hevc_sps(transfer uint64) []byte {
+	var w bit_writer
+	w.write_bytes([]byte{0x42, 0x01})
+	w.write_bits(4, 0) // sps_video_parameter_set_id
+	w.write_bits(3, 0) // sps_max_sub_layers_minus1
+	w.write_flag(true) // sps_temporal_id_nesting_flag
+	w.write_bits(8, 2) // general_profile_space, tier, profile_idc
+	w.write_bits(32, 0x20000000)
+	w.write_bits(48, 0)
+	w.write_bits(8, 120) // general_level_idc
+	w.write_ue(0) // sps_seq_parameter_set_id
+	w.write_ue(1) // chroma_format_idc
+	w.write_ue(1920)
+	w.write_ue(1080)
+	w.write_flag(false) // conformance_window_flag
+	w.write_ue(2) // bit_depth_luma_minus8
+	w.write_ue(2) // bit_depth_chroma_minus8
+	w.write_ue(4) // log2_max_pic_order_cnt_lsb_minus4
+	w.write_flag(true) // sps_sub_layer_ordering_info_present_flag
+	w.write_ue(4)
+	w.write_ue(2)
+	w.write_ue(0)
+	for _, v := range []uint64{0, 3, 0, 3, 2, 2} {
+		w.write_ue(v)
+	}
+
+	w.write_flag(false) // scaling_list_enabled_flag
+	w.write_flag(true) // amp_enabled_flag
+	w.write_flag(true) // sample_adaptive_offset_enabled_flag
+	w.write_flag(false) // pcm_enabled_flag
+	w.write_ue(2) // num_short_term_ref_pic_sets
+	w.write_ue(1) // num_negative_pics
+	w.write_ue(0) // num_positive_pics
+	w.write_ue(0) // delta_poc_s0_minus1
+	w.write_flag(true) // used_by_curr_pic_s0_flag
+	w.write_flag(true) // inter_ref_pic_set_prediction_flag
+	w.write_flag(false) // delta_rps_sign
+	w.write_ue(0) // abs_delta_rps_minus1
+	w.write_flag(true) // used_by_curr_pic_flag
+	w.write_flag(false) // used_by_curr_pic_flag
+	w.write_flag(false) // use_delta_flag
+	w.write_flag(false) // long_term_ref_pics_present_flag
+	w.write_flag(true) // sps_temporal_mvp_enabled_flag
+	w.write_flag(true) // strong_intra_smoothing_enabled_flag
+	w.write_flag(true) // vui_parameters_present_flag
+	hdr_test_vui(&w, transfer)
+	return w.bytes()
+}
+
+// hdr_test_sample returns an H.264 IDR sample with an alternative transfer
+// characteristics SEI message if preferred_transfer is not 0.
+func hdr_test_sample(preferred_transfer uint8) Mp4_sample {
+	var data []byte
+	if preferred_transfer != 0 {
+		sei := []byte{0x06, Sei_alternative_transfer_characteristics, 1, preferred_transfer, 0x80}
+		data = append(append_uint32(data, uint32(len(sei))), sei...)
+	}
+
+	idr := []byte{0x65, 0x88, 0x84, 0x00}
+	data = append(append_uint32(data, uint32(len(idr))), idr...)
+	return Mp4_sample{Track_id: 1, Size: uint32(len(data)), Is_sync: true, Data: data}
+}
+
+func hdr_test_avc_track(transfer uint64) Track_info {
+	return Track_info{Track_id: 1, Codec: "avc1", Sample_entry: NewBox(mp4_fourcc('a', 'v', 'c', '1'), nil), Avcc: &Avcc_config{Nal_length_size: 4, Sps: [][]byte{hdr_test_avc_sps(transfer)}}}
+}
+
+func TestHdrInfoPq(t *testing.T) {
+	// colr PQ over an SDR VUI
+	track := hdr_test_avc_track(Transfer_bt709)
+	colr := append([]byte("nclx"), 0, 9, 0, Transfer_smpte2084, 0, 9, 0)
+	track.Sample_entry.AddChild(NewBox(mp4_fourcc('c', 'o', 'l', 'r'), colr))
+	info, err := GetHdrInfo(track)
+	if err != nil || info.Video_range != "PQ" || info.Colr == nil {
+		t.Errorf("colr PQ: %+v %v", info, err)
+	}
+
+	// VUI PQ without colr
+	info, err = GetHdrInfo(hdr_test_avc_track(Transfer_smpte2084))
+	if err != nil || info.Video_range != "PQ" || info.Sps_colour == nil || info.Sps_colour.Colour_primaries != 9 {
+		t.Errorf("VUI PQ: %+v %v", info, err)
+	}
+}
+
+func TestHdrInfoHlg(t *testing.T) {
+	// BT.2020 VUI with an alternative transfer characteristics SEI
+	track := hdr_test_avc_track(Transfer_bt2020_10)
+	info, err := GetHdrInfo(track, hdr_test_sample(Transfer_arib_std_b67))
+	if err != nil || info.Video_range != "HLG" || info.Alternative_transfer != Transfer_arib_std_b67 {
+		t.Errorf("SEI HLG: %+v %v", info, err)
+	}
+
+	// HEVC VUI HLG
+	hevc := Track_info{Track_id: 1, Codec: "hvc1", Sample_entry: NewBox(mp4_fourcc('h', 'v', 'c', '1'), nil)}
+	hevc.Hvcc = &Hvcc_config{Nal_length_size: 4, Arrays: []Hvcc_nal_array{{true, 33, [][]byte{hdr_test_hevc_sps(Transfer_arib_std_b67)}}}}
+	info, err = GetHdrInfo(hevc)
+	if err != nil || info.Video_range != "HLG" || info.Sps_colour == nil {
+		t.Errorf("HEVC VUI HLG: %+v %v", info, err)
+	}
+
+	// The SEI in the hvcC
+	hevc.Hvcc.Arrays[0].Nalus[0] = hdr_test_hevc_sps(Transfer_bt2020_10)
+	hevc.Hvcc.Arrays = append(hevc.Hvcc.Arrays, Hvcc_nal_array{true, 39, [][]byte{{0x4E, 0x01, Sei_alternative_transfer_characteristics, 1, Transfer_arib_std_b67, 0x80}}})
+	info, err = GetHdrInfo(hevc)
+	if err != nil || info.Video_range != "HLG" {
+		t.Errorf("hvcC SEI HLG: %+v %v", info, err)
+	}
+}
+
+func TestHdrInfoSdr(t *testing.T) {
+	for _, transfer := range []uint64{0, Transfer_bt709, Transfer_bt2020_10} {
+		info, err := GetHdrInfo(hdr_test_avc_track(transfer), hdr_test_sample(0))
+		if err != nil || info.Video_range != "SDR" || (info.Sps_colour != nil) != (transfer != 0) {
+			t.Errorf("transfer %d: %+v %v", transfer, info, err)
+		}
+	}
+
+	// The SEI only applies to BT.709 and BT.2020 transfers
+	info, err := GetHdrInfo(hdr_test_avc_track(Transfer_smpte2084), hdr_test_sample(Transfer_arib_std_b67))
+	if err != nil || info.Video_range != "PQ" || info.Alternative_transfer != 0 {
+		t.Errorf("PQ with SEI: %+v %v", info, err)
+	}
+}
+
+// FuzzHdrInfo checks the colour box parsers and that GetHdrInfo gives one of
+// the VIDEO-RANGE values.
+func FuzzHdrInfo(f *testing.F) {
+	f.Add(fuzz_init(), []byte{0x80, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, init_data []byte, payload []byte) {
+		ParseColr(payload)
+		ParseMdcv(payload)
+		ParseClli(payload)
+		ParseDolbyVisionConfig("dvcC", payload)
+		tracks, samples := fuzz_samples(init_data, nil)
+		for _, track := range tracks {
+			info, err := GetHdrInfo(track, append(samples, Mp4_sample{Track_id: track.Track_id, Data: payload})...)
+			if err == nil && info.Video_range != "SDR" && info.Video_range != "PQ" && info.Video_range != "HLG" {
+				t.Fatalf("VIDEO-RANGE %q", info.Video_range)
+			}
+		}
+	})
+}
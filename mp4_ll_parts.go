@@ -0,0 +1,195 @@
+package media_utils
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sort"
+)
+
+// Ll_part is an LL-HLS partial segment (EXT-X-PART): one CMAF chunk of a
+// media segment split by SplitSegment.
+type Ll_part struct {
+	Index int
+	Start float64 // seconds, decode time of the first sample of the reference track
+	Duration float64 // seconds, of the reference track
+	Independent bool // starts with a sync sample of the reference track (INDEPENDENT=YES)
+	Data []byte // moof and mdat; the first part starts with the styp
+}
+
+// SplitSegment splits the media segment seg_data into CMAF chunks of
+// part_duration ms of the reference track (the first video track of the
+// segment), for LL-HLS parts. The samples keep their times, flags, sample
+// description index and sdtp entry; each chunk has its own tfdt and trun. The
+// boxes ahead of a moof other than styp and sidx (emsg, prft) go ahead of the
+// first chunk holding samples of that fragment, after the styp in the first
+// part, and those after the last moof go at the end. The concatenation of the Data of the parts is the chunked segment.
+// The CMAF brands are written for a single track only. Encrypted tracks,
+// sample groups (sbgp, sgpd) and sub-sample information (subs) are not
+// supported: these per-sample tables would not follow the samples to the chunks.
+func SplitSegment(seg_data []byte, tracks []Track_info, part_duration uint32) ([]Ll_part, error) {
+	if part_duration == 0 {
+		return nil, errors.New("invalid_part_duration")
+	}
+
+	boxes, err := ParseBoxes(seg_data)
+	if err != nil {
+		return nil, err
+	}
+
+	// The boxes ahead of each moof, by moof offset
+	var moof_offsets []uint64
+	var prefixes [][]byte
+	var prefix []byte
+	sequence_number := uint32(0)
+	for _, box := range boxes {
+		switch box.Type {
+		case mp4_fourcc('s', 't', 'y', 'p'), mp4_fourcc('s', 'i', 'd', 'x'), mp4_fourcc('m', 'd', 'a', 't'):
+		case mp4_fourcc('m', 'o', 'o', 'f'):
+			for _, path := range []string{"traf/senc", "traf/saiz", "traf/saio"} {
+				if aux := box.Find(path); aux != nil {
+					return nil, box_error(ErrUnsupported, "encrypted_track_not_supported", aux)
+				}
+			}
+
+			for _, path := range []string{"traf/sbgp", "traf/sgpd", "traf/subs"} {
+				if table := box.Find(path); table != nil {
+					return nil, box_error(ErrUnsupported, table.TypeString() + "_not_supported", table)
+				}
+			}
+
+			if mfhd := box.Child(mp4_fourcc('m', 'f', 'h', 'd')); len(moof_offsets) == 0 && mfhd != nil && len(mfhd.Payload) >= 8 {
+				sequence_number = get_uint32(4, mfhd.Payload)
+			}
+
+			moof_offsets = append(moof_offsets, box.Offset)
+			prefixes = append(prefixes, prefix)
+			prefix = nil
+		default:
+			prefix = append(prefix, box.Bytes()...)
+		}
+	}
+
+	// The fragment of the sample data at offset
+	fragment_of := func(offset uint64) int {
+		return sort.Search(len(moof_offsets), func(i int) bool { return moof_offsets[i] > offset }) - 1
+	}
+
+	samples, err := GetFragmentSamples(seg_data, tracks)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(samples) == 0 {
+		return nil, errors.New("no_samples")
+	}
+
+	// Only the tracks of the segment: the reference track must have samples
+	present := make(map[uint32]bool)
+	for _, s := range samples {
+		if s.Data == nil && s.Size > 0 {
+			return nil, parse_error(ErrTruncated, "sample_outside_data", s.Offset, "")
+		}
+
+		present[s.Track_id] = true
+	}
+
+	var segment_tracks []Track_info
+	timescales := make(map[uint32]int64)
+	for _, track := range tracks {
+		if present[track.Track_id] {
+			if track.Codec == "encv" || track.Codec == "enca" {
+				return nil, parse_error(ErrUnsupported, "encrypted_track_not_supported", 0, "")
+			}
+
+			segment_tracks = append(segment_tracks, track)
+			timescales[track.Track_id] = int64(track.Timescale)
+		}
+	}
+
+	// Interleave the tracks by decode time, so that the muxer cuts all of
+	// them at the chunk boundaries of the reference track
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Dts * timescales[samples[j].Track_id] < samples[j].Dts * timescales[samples[i].Track_id]
+	})
+
+	var buffer bytes.Buffer
+	m, err := NewFmp4Muxer(&buffer, segment_tracks)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Segment_duration = math.MaxUint32 // a single segment
+	m.Chunk_duration = part_duration
+	m.Cmaf = len(segment_tracks) == 1
+	if sequence_number > 0 {
+		m.sequence_number = sequence_number - 1
+	}
+
+	var parts []Ll_part
+	next_prefix := 0
+	m.chunk_written = func(chunk [][]mux_sample) {
+		// The boxes ahead of the fragments up to the last one with
+		// samples in the chunk, not written yet
+		last := -1
+		for _, track_samples := range chunk {
+			for _, s := range track_samples {
+				last = max(last, fragment_of(s.Offset))
+			}
+		}
+
+		var boxes_ahead []byte
+		for ; next_prefix <= last; next_prefix++ {
+			boxes_ahead = append(boxes_ahead, prefixes[next_prefix]...)
+		}
+
+		data := buffer.Bytes()
+		if len(parts) == 0 {
+			// After the styp
+			styp_size := get_uint32(0, data)
+			boxes_ahead = append(append([]byte(nil), data[:styp_size]...), boxes_ahead...)
+			data = data[styp_size:]
+		}
+
+		part := Ll_part{Index: len(parts), Data: append(boxes_ahead, data...)}
+		buffer.Reset()
+		// A chunk without samples of the reference track is described by
+		// its first track with samples
+		t := m.reference
+		for i := 0; len(chunk[t]) == 0 && i < len(chunk); i++ {
+			t = i
+		}
+
+		track := m.tracks[t]
+		duration := uint64(0)
+		for _, s := range chunk[t] {
+			duration += uint64(s.Duration)
+		}
+
+		part.Start = float64(chunk[t][0].Dts) / float64(track.info.Timescale)
+		part.Duration = float64(duration) / float64(track.info.Timescale)
+		part.Independent = track.is_sync(chunk[t][0].Mp4_sample)
+		parts = append(parts, part)
+	}
+
+	for _, s := range samples {
+		err = m.WriteSample(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = m.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	// The boxes after the last moof stay at the end
+	last := &parts[len(parts) - 1]
+	for ; next_prefix < len(prefixes); next_prefix++ {
+		last.Data = append(last.Data, prefixes[next_prefix]...)
+	}
+
+	last.Data = append(last.Data, prefix...)
+	return parts, nil
+}
@@ -0,0 +1,278 @@
+package media_utils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// mux_test_segment returns the init segment and a 2 s media segment of the
+// mux_test_tracks.
+func mux_test_segment(t *testing.T) ([]Track_info, []byte) {
+	var out bytes.Buffer
+	m, err := NewFmp4Muxer(&out, mux_test_tracks(48000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Segment_duration = 10000
+	err = m.WriteInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	init_size := out.Len()
+	for i := 0; i < 60; i++ {
+		m.WriteSample(mux_test_video_sample(i, 0))
+		for j := i * 94 / 60; j < (i + 1) * 94 / 60; j++ {
+			m.WriteSample(mux_test_audio_sample(j, 0))
+		}
+	}
+
+	err = m.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, err := GetTracks(out.Bytes()[:init_size])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tracks, out.Bytes()[init_size:]
+}
+
+func TestSplitSegment(t *testing.T) {
+	tracks, seg := mux_test_segment(t)
+	parts, err := SplitSegment(seg, tracks, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parts) != 4 || !parts[0].Independent || parts[1].Independent {
+		t.Fatalf("%d parts: %+v", len(parts), parts)
+	}
+
+	var chunked []byte
+	for _, part := range parts {
+		chunked = append(chunked, part.Data...)
+	}
+
+	want, _ := GetFragmentSamples(seg, tracks)
+	got, err := GetFragmentSamples(chunked, tracks)
+	if err != nil || len(got) != len(want) {
+		t.Fatalf("%d samples in the parts, want %d: %v", len(got), len(want), err)
+	}
+
+	count := make(map[uint32]int)
+	for _, s := range got {
+		count[s.Track_id]++
+	}
+
+	if count[1] != 60 || count[2] != 94 {
+		t.Errorf("samples per track: %v", count)
+	}
+}
+
+func TestSplitSegmentEncrypted(t *testing.T) {
+	tracks, seg := mux_test_segment(t)
+	tracks[0].Codec = "encv"
+	_, err := SplitSegment(seg, tracks, 500)
+	if !errors.Is(err, ErrUnsupported) || !strings.HasPrefix(err.Error(), "encrypted_track_not_supported") {
+		t.Errorf("encrypted track: %v", err)
+	}
+}
+
+// mux_test_video_segment returns the video track and a 2 s media segment of
+// it, with the samples changed by modify.
+func mux_test_video_segment(t *testing.T, modify func(i int, s *Mp4_sample)) ([]Track_info, []byte) {
+	var out bytes.Buffer
+	m, err := NewFmp4Muxer(&out, mux_test_tracks(48000)[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Segment_duration = 10000
+	err = m.WriteInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	init_size := out.Len()
+	for i := 0; i < 60; i++ {
+		s := mux_test_video_sample(i, 0)
+		modify(i, &s)
+		m.WriteSample(s)
+	}
+
+	err = m.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, err := GetTracks(out.Bytes()[:init_size])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tracks, out.Bytes()[init_size:]
+}
+
+func styp_has_brand(t *testing.T, data []byte, brand string) bool {
+	boxes, err := ParseBoxes(data)
+	if err != nil || len(boxes) == 0 || boxes[0].TypeString() != "styp" {
+		t.Fatalf("no styp: %v", err)
+	}
+
+	return bytes.Contains(boxes[0].Payload[8:], []byte(brand))
+}
+
+func TestSplitSegmentCmafBrands(t *testing.T) {
+	tracks, seg := mux_test_segment(t)
+	parts, err := SplitSegment(seg, tracks, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if styp_has_brand(t, parts[0].Data, "cmfs") {
+		t.Error("CMAF brands for two tracks")
+	}
+
+	tracks, seg = mux_test_video_segment(t, func(int, *Mp4_sample) {})
+	parts, err = SplitSegment(seg, tracks, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !styp_has_brand(t, parts[0].Data, "cmfs") || !styp_has_brand(t, parts[0].Data, "cmfl") {
+		t.Error("no CMAF brands for one track")
+	}
+}
+
+func TestSplitSegmentSampleFields(t *testing.T) {
+	tracks, seg := mux_test_video_segment(t, func(i int, s *Mp4_sample) {
+		s.Sample_dependency = 0x10
+		if s.Is_sync {
+			s.Sample_dependency = 0x20
+		}
+
+		if i >= 40 {
+			s.Sample_description_index = 2
+		}
+	})
+
+	parts, err := SplitSegment(seg, tracks, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chunked []byte
+	for _, part := range parts {
+		chunked = append(chunked, part.Data...)
+	}
+
+	want, _ := GetFragmentSamples(seg, tracks)
+	got, err := GetFragmentSamples(chunked, tracks)
+	if err != nil || len(got) != len(want) {
+		t.Fatalf("%d samples in the parts, want %d: %v", len(got), len(want), err)
+	}
+
+	for i := range got {
+		if got[i].Sample_dependency != want[i].Sample_dependency || got[i].Sample_description_index != want[i].Sample_description_index {
+			t.Fatalf("sample %d: dependency %#x index %d, want %#x %d", i, got[i].Sample_dependency, got[i].Sample_description_index, want[i].Sample_dependency, want[i].Sample_description_index)
+		}
+	}
+
+	if want[45].Sample_description_index != 2 || want[0].Sample_dependency != 0x20 {
+		t.Errorf("segment samples: %+v %+v", want[0], want[45])
+	}
+}
+
+func TestSplitSegmentBoxesAheadOfFragments(t *testing.T) {
+	tracks, seg := mux_test_chunked_segment(t)
+	boxes, err := ParseBoxes(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A prft ahead of the fifth moof, an emsg at the end
+	prft := BuildPrft(Prft_box{Reference_track_id: 1, Ntp_timestamp: 1 << 40, Media_time: 90000})
+	emsg, _ := BuildEmsg(Emsg_box{Scheme_id_uri: "urn:test", Value: "1", Message_data: []byte("end")})
+	var rebuilt []byte
+	moof_count := 0
+	for _, box := range boxes {
+		if box.TypeString() == "moof" {
+			moof_count++
+			if moof_count == 5 {
+				rebuilt = append(rebuilt, prft...)
+			}
+		}
+
+		rebuilt = append(rebuilt, box.Bytes()...)
+	}
+
+	rebuilt = append(rebuilt, emsg...)
+	parts, err := SplitSegment(rebuilt, tracks, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chunked []byte
+	for _, part := range parts {
+		chunked = append(chunked, part.Data...)
+	}
+
+	if bytes.Count(chunked, prft) != 1 || !bytes.HasSuffix(chunked, emsg) {
+		t.Fatal("prft or emsg lost")
+	}
+
+	for i, part := range parts {
+		if !bytes.Contains(part.Data, prft) {
+			continue
+		}
+
+		part_boxes, _ := ParseBoxes(part.Data)
+		if i == 0 || part_boxes[0].TypeString() != "prft" || part_boxes[1].TypeString() != "moof" {
+			t.Errorf("prft in part %d: %v", i, part_boxes)
+		}
+	}
+}
+
+func TestSplitSegmentSampleGroups(t *testing.T) {
+	tracks, seg := mux_test_segment(t)
+	boxes, _ := ParseBoxes(seg)
+	traf := FindBox(boxes, "moof/traf")
+	traf.AddChild(NewFullBox(mp4_fourcc('s', 'b', 'g', 'p'), 0, 0, append_uint32(append_uint32(nil, mp4_fourcc('r', 'o', 'l', 'l')), 0)))
+	_, err := SplitSegment(SerializeBoxes(boxes), tracks, 500)
+	if !errors.Is(err, ErrUnsupported) || !strings.HasPrefix(err.Error(), "sbgp_not_supported") {
+		t.Errorf("sample groups: %v", err)
+	}
+}
+
+// FuzzSplitSegment checks that the parts hold the samples of the segment.
+func FuzzSplitSegment(f *testing.F) {
+	f.Add(fuzz_init(), fuzz_segment())
+	f.Fuzz(func(t *testing.T, init_data []byte, seg_data []byte) {
+		tracks, err := GetTracks(init_data)
+		if err != nil {
+			return
+		}
+
+		parts, err := SplitSegment(seg_data, tracks, 100)
+		if err != nil {
+			return
+		}
+
+		var chunked []byte
+		for _, part := range parts {
+			chunked = append(chunked, part.Data...)
+		}
+
+		samples, _ := GetFragmentSamples(seg_data, tracks)
+		chunked_samples, err := GetFragmentSamples(chunked, tracks)
+		if err != nil || len(chunked_samples) != len(samples) {
+			t.Fatalf("%d samples in the parts, want %d: %v", len(chunked_samples), len(samples), err)
+		}
+	})
+}
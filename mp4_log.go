@@ -0,0 +1,21 @@
+package media_utils
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+var logger atomic.Pointer[slog.Logger]
+
+// SetLogger routes the diagnostics of the library (box sizes, lookup
+// failures...) to l, at debug level. They are discarded while no logger is
+// set; SetLogger(nil) discards them again.
+func SetLogger(l *slog.Logger) {
+	logger.Store(l)
+}
+
+func log_debug(msg string, args ...any) {
+	if l := logger.Load(); l != nil {
+		l.Debug(msg, args...)
+	}
+}
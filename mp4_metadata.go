@@ -0,0 +1,467 @@
+package media_utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Well-known types of the data box of an ilst item
+const (
+	Metadata_type_binary = 0
+	Metadata_type_utf8 = 1
+	Metadata_type_jpeg = 13
+	Metadata_type_png = 14
+	Metadata_type_integer = 21
+)
+
+// Metadata_keys maps common names to ilst atom types.
+var Metadata_keys = map[string]string{
+	"title": "©nam",
+	"artist": "©ART",
+	"album_artist": "aART",
+	"album": "©alb",
+	"date": "©day",
+	"genre": "©gen",
+	"comment": "©cmt",
+	"description": "desc",
+	"encoder": "©too",
+	"cover": "covr",
+}
+
+// Metadata_item is an iTunes-style metadata item (moov/udta/meta/ilst) or a
+// classic QuickTime udta ©xxx atom. An ilst item with several data boxes,
+// e.g. several cover images, gives one Metadata_item per data box.
+type Metadata_item struct {
+	Key string // atom type, e.g. "©nam" or "covr", or "----:<mean>:<name>" for a freeform atom
+	Type uint32 // Metadata_type_*, for ilst items
+	Value []byte
+	Quicktime bool // a QuickTime udta ©xxx atom rather than an ilst item
+}
+
+func (item Metadata_item) String() string {
+	switch {
+	case item.Quicktime || item.Type == Metadata_type_utf8:
+		return string(item.Value)
+	case item.Type == Metadata_type_integer && len(item.Value) > 0 && len(item.Value) <= 8:
+		v := int64(int8(item.Value[0]))
+		for _, b := range item.Value[1:] {
+			v = v << 8 | int64(b)
+		}
+
+		return fmt.Sprint(v)
+	case item.Type == Metadata_type_jpeg:
+		return fmt.Sprintf("(%d bytes image/jpeg)", len(item.Value))
+	case item.Type == Metadata_type_png:
+		return fmt.Sprintf("(%d bytes image/png)", len(item.Value))
+	}
+
+	return fmt.Sprintf("(%d bytes)", len(item.Value))
+}
+
+// metadata_key returns the atom type as a key; the © of the ©xxx atoms is a
+// single 0xA9 byte in the file.
+func metadata_key(box_type uint32) string {
+	return strings.Replace(fourcc_string(box_type), "\xa9", "©", 1)
+}
+
+func metadata_box_type(key string) (uint32, error) {
+	t := strings.Replace(key, "©", "\xa9", 1)
+	if len(t) != 4 {
+		return 0, errors.New("invalid_metadata_key_" + key)
+	}
+
+	return mp4_fourcc(t[0], t[1], t[2], t[3]), nil
+}
+
+func is_quicktime_text_atom(box_type uint32) bool {
+	return box_type >> 24 == 0xA9
+}
+
+// ilst_item_key returns the key of an ilst item, reading mean and name of a
+// freeform (----) item.
+func ilst_item_key(item *Mp4_box) string {
+	if item.Type != mp4_fourcc('-', '-', '-', '-') {
+		return metadata_key(item.Type)
+	}
+
+	var mean, name string
+	if box := item.Child(mp4_fourcc('m', 'e', 'a', 'n')); box != nil && len(box.Payload) >= 4 {
+		mean = string(box.Payload[4:])
+	}
+
+	if box := item.Child(mp4_fourcc('n', 'a', 'm', 'e')); box != nil && len(box.Payload) >= 4 {
+		name = string(box.Payload[4:])
+	}
+
+	return "----:" + mean + ":" + name
+}
+
+// parse_quicktime_text returns the first string of a QuickTime ©xxx atom:
+// 16-bit size, 16-bit language code, text.
+func parse_quicktime_text(box *Mp4_box) ([]byte, error) {
+	if len(box.Payload) < 4 {
+		return nil, incomplete_box(box)
+	}
+
+	size := uint32(get_uint16(0, box.Payload))
+	if size > uint32(len(box.Payload)) - 4 {
+		return nil, incomplete_box(box)
+	}
+
+	return box.Payload[4 : 4 + size], nil
+}
+
+// metadata_ilsts returns the ilst boxes of moov/udta/meta and moov/meta.
+func metadata_ilsts(moov *Mp4_box) []*Mp4_box {
+	var ilsts []*Mp4_box
+	for _, udta := range moov.ChildrenOfType(mp4_fourcc('u', 'd', 't', 'a')) {
+		for _, meta := range udta_children(udta) {
+			if meta.Type == mp4_fourcc('m', 'e', 't', 'a') {
+				ilsts = append(ilsts, meta.ChildrenOfType(mp4_fourcc('i', 'l', 's', 't'))...)
+			}
+		}
+	}
+
+	for _, meta := range moov.ChildrenOfType(mp4_fourcc('m', 'e', 't', 'a')) {
+		ilsts = append(ilsts, meta.ChildrenOfType(mp4_fourcc('i', 'l', 's', 't'))...)
+	}
+
+	return ilsts
+}
+
+// GetMetadata returns the ilst items of moov/udta/meta (and moov/meta) and
+// the QuickTime ©xxx atoms of moov/udta.
+func GetMetadata(data []byte) ([]Metadata_item, error) {
+	boxes, err := ParseBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	moov := FindBox(boxes, "moov")
+	if moov == nil {
+		return nil, box_not_found(nil, "moov")
+	}
+
+	var items []Metadata_item
+	for _, ilst := range metadata_ilsts(moov) {
+		for _, item := range ilst.Children {
+			key := ilst_item_key(item)
+			for _, data_box := range item.ChildrenOfType(mp4_fourcc('d', 'a', 't', 'a')) {
+				if len(data_box.Payload) < 8 {
+					return nil, incomplete_box(data_box)
+				}
+
+				items = append(items, Metadata_item{Key: key, Type: get_uint32(0, data_box.Payload) & 0x00FFFFFF, Value: data_box.Payload[8:]})
+			}
+		}
+	}
+
+	for _, udta := range moov.ChildrenOfType(mp4_fourcc('u', 'd', 't', 'a')) {
+		for _, atom := range udta_children(udta) {
+			if !is_quicktime_text_atom(atom.Type) {
+				continue
+			}
+
+			text, err := parse_quicktime_text(atom)
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(items, Metadata_item{Key: metadata_key(atom.Type), Type: Metadata_type_utf8, Value: text, Quicktime: true})
+		}
+	}
+
+	return items, nil
+}
+
+// metadata_udta returns the udta of moov, adding one if needed. A QuickTime
+// udta kept as a leaf is turned into a container, dropping its terminator.
+func metadata_udta(moov *Mp4_box) *Mp4_box {
+	udta := moov.Child(mp4_fourcc('u', 'd', 't', 'a'))
+	if udta == nil {
+		udta = NewContainerBox(mp4_fourcc('u', 'd', 't', 'a'))
+		moov.AddChild(udta)
+	} else if len(udta.Children) == 0 && len(udta.Payload) > 0 {
+		children := udta_children(udta)
+		udta.Payload = nil
+		for _, c := range children {
+			udta.AddChild(c)
+		}
+	}
+
+	return udta
+}
+
+// metadata_ilst returns moov/udta/meta/ilst, adding the boxes that are missing.
+func metadata_ilst(moov *Mp4_box) (*Mp4_box, error) {
+	udta := metadata_udta(moov)
+	meta := udta.Child(mp4_fourcc('m', 'e', 't', 'a'))
+	if meta == nil {
+		meta = NewFullBox(mp4_fourcc('m', 'e', 't', 'a'), 0, 0, nil)
+		hdlr := append_uint32(nil, 0) // pre_defined
+		hdlr = append_uint32(hdlr, mp4_fourcc('m', 'd', 'i', 'r'))
+		hdlr = append_uint32(hdlr, mp4_fourcc('a', 'p', 'p', 'l'))
+		hdlr = append(hdlr, make([]byte, 9)...) // reserved, empty name
+		meta.AddChild(NewFullBox(mp4_fourcc('h', 'd', 'l', 'r'), 0, 0, hdlr))
+		udta.AddChild(meta)
+	}
+
+	if meta.children_err != nil {
+		return nil, meta.children_err
+	}
+
+	ilst := meta.Child(mp4_fourcc('i', 'l', 's', 't'))
+	if ilst == nil {
+		ilst = NewContainerBox(mp4_fourcc('i', 'l', 's', 't'))
+		meta.AddChild(ilst)
+	}
+
+	if ilst.children_err != nil {
+		return nil, ilst.children_err
+	}
+
+	return ilst, nil
+}
+
+// set_ilst_item replaces the data boxes of the ilst item of key with values,
+// or removes the item if values is empty.
+func set_ilst_item(ilst *Mp4_box, key string, values []Metadata_item) error {
+	var item *Mp4_box
+	for _, c := range ilst.Children {
+		if ilst_item_key(c) == key {
+			item = c
+			break
+		}
+	}
+
+	if item != nil && item.children_err != nil {
+		return item.children_err
+	}
+
+	if len(values) == 0 {
+		if item != nil {
+			ilst.RemoveChild(item)
+		}
+
+		return nil
+	}
+
+	if item == nil {
+		if strings.HasPrefix(key, "----:") {
+			parts := strings.SplitN(key, ":", 3)
+			if len(parts) != 3 {
+				return errors.New("invalid_metadata_key_" + key)
+			}
+
+			item = NewContainerBox(mp4_fourcc('-', '-', '-', '-'), NewFullBox(mp4_fourcc('m', 'e', 'a', 'n'), 0, 0, []byte(parts[1])), NewFullBox(mp4_fourcc('n', 'a', 'm', 'e'), 0, 0, []byte(parts[2])))
+		} else {
+			item_type, err := metadata_box_type(key)
+			if err != nil {
+				return err
+			}
+
+			item = NewContainerBox(item_type)
+		}
+
+		ilst.AddChild(item)
+	}
+
+	for _, data_box := range item.ChildrenOfType(mp4_fourcc('d', 'a', 't', 'a')) {
+		item.RemoveChild(data_box)
+	}
+
+	for _, v := range values {
+		payload := append_uint32(append_uint32(nil, v.Type), 0) // type, locale
+		item.AddChild(NewBox(mp4_fourcc('d', 'a', 't', 'a'), append(payload, v.Value...)))
+	}
+
+	return nil
+}
+
+// set_quicktime_atom replaces the QuickTime ©xxx atom of key in udta, or
+// removes it if value is nil.
+func set_quicktime_atom(udta *Mp4_box, key string, value []byte) error {
+	atom_type, err := metadata_box_type(key)
+	if err != nil {
+		return err
+	}
+
+	if !is_quicktime_text_atom(atom_type) {
+		return errors.New("invalid_quicktime_metadata_key_" + key)
+	}
+
+	if len(value) > 0xFFFF {
+		return errors.New("quicktime_metadata_value_too_long")
+	}
+
+	for _, atom := range udta.ChildrenOfType(atom_type) {
+		udta.RemoveChild(atom)
+	}
+
+	if value != nil {
+		payload := append_uint16(append_uint16(nil, uint16(len(value))), 0x55C4) // "und"
+		udta.AddChild(NewBox(atom_type, append(payload, value...)))
+	}
+
+	return nil
+}
+
+// SetMetadata returns a copy of the file in data with metadata items set:
+// the items of each key replace the existing ones, an item with a nil Value
+// removes the key. ilst items go to moov/udta/meta/ilst, which is added if
+// missing. When the moov changes size, a free box following it absorbs the
+// difference if it can; otherwise the chunk offsets (stco/co64) and explicit
+// tfhd base_data_offsets of the media data after the moov are shifted. A moov,
+// meta, ilst or ilst item whose children do not parse is an error, as the
+// items added to it would not be read back.
+func SetMetadata(data []byte, items []Metadata_item) ([]byte, error) {
+	boxes, err := ParseBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	moov_index := -1
+	for i, box := range boxes {
+		if box.Type == mp4_fourcc('m', 'o', 'o', 'v') {
+			moov_index = i
+			break
+		}
+	}
+
+	if moov_index < 0 {
+		return nil, box_not_found(nil, "moov")
+	}
+
+	moov := boxes[moov_index]
+	if moov.children_err != nil {
+		return nil, moov.children_err
+	}
+
+	// Group the items by key, keeping their order
+	type item_key struct {
+		key string
+		quicktime bool
+	}
+
+	var keys []item_key
+	values := make(map[item_key][]Metadata_item)
+	for _, item := range items {
+		k := item_key{item.Key, item.Quicktime}
+		if _, ok := values[k]; !ok {
+			keys = append(keys, k)
+			values[k] = nil
+		}
+
+		if item.Value != nil {
+			values[k] = append(values[k], item)
+		}
+	}
+
+	for _, k := range keys {
+		if k.quicktime {
+			var value []byte
+			if v := values[k]; len(v) > 0 {
+				value = v[len(v) - 1].Value
+			}
+
+			err = set_quicktime_atom(metadata_udta(moov), k.key, value)
+		} else {
+			var ilst *Mp4_box
+			ilst, err = metadata_ilst(moov)
+			if err == nil {
+				err = set_ilst_item(ilst, k.key, values[k])
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	delta, err := fit_moov(boxes, moov_index)
+	if err != nil {
+		return nil, err
+	}
+
+	out := SerializeBoxes(boxes)
+	if delta != 0 && moov.Offset + moov.EncodedSize() <= 0xFFFFFFFF {
+		err = shift_tfhd_base_data_offsets(out, uint32(moov.Offset + moov.EncodedSize()), delta)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// fit_moov accommodates a change of the size of the moov: a free or skip box
+// following it shrinks or grows by the difference if it can, otherwise the
+// chunk offsets of the data after the moov are shifted. It returns how far
+// the boxes after the moov move: by the moov size change alone, as they keep
+// their header sizes (e.g. a largesize mdat) when serialized.
+func fit_moov(boxes []*Mp4_box, moov_index int) (int64, error) {
+	moov := boxes[moov_index]
+	delta := int64(moov.EncodedSize()) - int64(moov.Size)
+	if delta == 0 {
+		return 0, nil
+	}
+
+	if moov_index + 1 < len(boxes) {
+		free := boxes[moov_index + 1]
+		if (free.Type == mp4_fourcc('f', 'r', 'e', 'e') || free.Type == mp4_fourcc('s', 'k', 'i', 'p')) && len(free.Children) == 0 && free.Header_size == 8 {
+			if delta < 0 {
+				free.Payload = append(free.Payload, make([]byte, -delta)...)
+				return 0, nil
+			}
+
+			if int64(len(free.Payload)) >= delta {
+				free.Payload = free.Payload[:int64(len(free.Payload)) - delta]
+				return 0, nil
+			}
+		}
+	}
+
+	moov_end := moov.Offset + moov.Size
+	var tables []chunk_offset_table
+	for _, trak := range moov.ChildrenOfType(mp4_fourcc('t', 'r', 'a', 'k')) {
+		stbl := trak.Find("mdia/minf/stbl")
+		if stbl == nil {
+			continue
+		}
+
+		for _, box := range stbl.Children {
+			if box.Type != mp4_fourcc('s', 't', 'c', 'o') && box.Type != mp4_fourcc('c', 'o', '6', '4') {
+				continue
+			}
+
+			offsets, err := parse_chunk_offsets(box)
+			if err != nil {
+				return 0, err
+			}
+
+			tables = append(tables, chunk_offset_table{box: box, offsets: offsets})
+		}
+	}
+
+	// A stco turning into a co64 grows the moov again
+	for {
+		size := moov.EncodedSize()
+		delta = int64(size) - int64(moov.Size)
+		for _, table := range tables {
+			shifted := make([]uint64, len(table.offsets))
+			for i, o := range table.offsets {
+				shifted[i] = o
+				if o >= moov_end {
+					shifted[i] = uint64(int64(o) + delta)
+				}
+			}
+
+			set_chunk_offsets(table.box, shifted)
+		}
+
+		if moov.EncodedSize() == size {
+			return delta, nil
+		}
+	}
+}
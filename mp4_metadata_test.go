@@ -0,0 +1,88 @@
+package media_utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// largesize_progressive_file returns a progressive file with one track of two
+// samples, "Hello" and "World", in an mdat with a 64-bit largesize header
+// after the moov.
+func largesize_progressive_file() []byte {
+	tkhd := NewFullBox(mp4_fourcc('t', 'k', 'h', 'd'), 0, 3, append(append_uint32(append_uint32(append_uint32(nil, 0), 0), 1), make([]byte, 68)...))
+	mdhd := NewFullBox(mp4_fourcc('m', 'd', 'h', 'd'), 0, 0, append(append_uint32(append_uint32(append_uint32(nil, 0), 0), 1000), 0, 0, 0x07, 0xD0, 0x55, 0xc4, 0, 0))
+	hdlr := NewFullBox(mp4_fourcc('h', 'd', 'l', 'r'), 0, 0, append(append_uint32(append_uint32(nil, 0), mp4_fourcc('s', 'o', 'u', 'n')), make([]byte, 13)...))
+	stsd := NewFullBox(mp4_fourcc('s', 't', 's', 'd'), 0, 0, append_uint32(nil, 1))
+	stsd.AddChild(NewBox(mp4_fourcc('m', 'p', '4', 'a'), make([]byte, 28)))
+	stts := NewFullBox(mp4_fourcc('s', 't', 't', 's'), 0, 0, append_uint32(append_uint32(append_uint32(nil, 1), 2), 1000))
+	stsc := NewFullBox(mp4_fourcc('s', 't', 's', 'c'), 0, 0, append_uint32(append_uint32(append_uint32(append_uint32(nil, 1), 1), 2), 1))
+	stsz := NewFullBox(mp4_fourcc('s', 't', 's', 'z'), 0, 0, append_uint32(append_uint32(append_uint32(append_uint32(nil, 0), 2), 5), 5))
+	build := func(chunk_offset uint32) []byte {
+		stco := NewFullBox(mp4_fourcc('s', 't', 'c', 'o'), 0, 0, append_uint32(append_uint32(nil, 1), chunk_offset))
+		stbl := NewContainerBox(mp4_fourcc('s', 't', 'b', 'l'), stsd, stts, stsc, stsz, stco)
+		mdia := NewContainerBox(mp4_fourcc('m', 'd', 'i', 'a'), mdhd, hdlr, NewContainerBox(mp4_fourcc('m', 'i', 'n', 'f'), stbl))
+		moov := NewContainerBox(mp4_fourcc('m', 'o', 'o', 'v'), NewContainerBox(mp4_fourcc('t', 'r', 'a', 'k'), tkhd, mdia))
+		return SerializeBoxes([]*Mp4_box{NewBox(mp4_fourcc('f', 't', 'y', 'p'), []byte("isom\x00\x00\x00\x00isom")), moov})
+	}
+
+	head := build(0)
+	head = build(uint32(len(head) + 16))
+	mdat := &Mp4_box{Type: mp4_fourcc('m', 'd', 'a', 't'), Header_size: 16, Payload: []byte("HelloWorld")}
+	return append(head, mdat.Bytes()...)
+}
+
+func TestSetMetadataLargesizeMdat(t *testing.T) {
+	data, err := SetMetadata(largesize_progressive_file(), []Metadata_item{{Key: "©nam", Type: Metadata_type_utf8, Value: []byte("A title long enough to grow the moov")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, err := GetTracks(data)
+	if err != nil || len(tracks) != 1 {
+		t.Fatalf("tracks: %v, %v", tracks, err)
+	}
+
+	samples, err := GetTrackSamples(data, tracks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(samples) != 2 || string(samples[0].Data) != "Hello" || string(samples[1].Data) != "World" {
+		t.Fatalf("samples after SetMetadata: %+v", samples)
+	}
+
+	items, err := GetMetadata(data)
+	if err != nil || len(items) != 1 || items[0].String() != "A title long enough to grow the moov" {
+		t.Fatalf("metadata: %v, %v", items, err)
+	}
+}
+
+// FuzzSetMetadata checks that the items set are read back.
+func FuzzSetMetadata(f *testing.F) {
+	f.Add(largesize_progressive_file())
+	f.Add(fuzz_init())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		GetMetadata(data)
+		items := []Metadata_item{{Key: "©nam", Type: Metadata_type_utf8, Value: []byte("title")}, {Key: "©cmt", Quicktime: true, Value: []byte("comment")}}
+		out, err := SetMetadata(data, items)
+		if err != nil {
+			return
+		}
+
+		got, err := GetMetadata(out)
+		if err != nil {
+			t.Fatalf("metadata of the output: %v", err)
+		}
+
+		for _, item := range items {
+			found := false
+			for _, g := range got {
+				found = found || (g.Key == item.Key && g.Quicktime == item.Quicktime && bytes.Equal(g.Value, item.Value))
+			}
+
+			if !found {
+				t.Fatalf("%s not read back: %+v", item.Key, got)
+			}
+		}
+	})
+}
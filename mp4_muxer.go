@@ -0,0 +1,610 @@
+package media_utils
+
+import (
+	"errors"
+	"io"
+)
+
+// Sample flags written by the muxer
+const (
+	mux_sync_sample_flags = 0x02000000 // sample_depends_on 2 (I-frame)
+	mux_non_sync_sample_flags = 0x01000000 | Sample_is_non_sync_sample
+)
+
+type mux_sample struct {
+	Mp4_sample
+	duration_known bool
+}
+
+// mux_boundary is the end of a chunk, in the reference timescale, waiting
+// for the samples of every track up to it.
+type mux_boundary struct {
+	dts int64
+	segment bool // the next chunk starts a new segment
+}
+
+type mux_track struct {
+	info Track_info
+	pending []mux_sample
+	last_duration uint32
+}
+
+// Fmp4_muxer writes fragmented MP4: an init segment, then media segments
+// (styp, moof, mdat) built from the samples of its tracks. Samples are added
+// in decode order per track; the tracks may be interleaved in any way, a
+// chunk being written once every track has a sample at or after its end
+// (or on Flush).
+//
+// Segments start at a sync sample of the reference track, the first video
+// track (or the first track): every sync sample with Segment_duration 0, else
+// the first sync sample Segment_duration ms after the segment start. With
+// Chunk_duration, a segment is made of several moof/mdat pairs (CMAF chunks)
+// starting every Chunk_duration ms of the reference track, at any sample;
+// with Chunk_sync_samples, a chunk also starts at every sync sample of a
+// video reference track. The CMAF brands need a single track, CMAF fragments
+// having one traf.
+type Fmp4_muxer struct {
+	Segment_duration uint32 // ms
+	Chunk_duration uint32 // ms, 0 for one moof/mdat per segment
+	Chunk_sync_samples bool // start a chunk at every sync sample
+	Cmaf bool // write the CMAF brands, single track only
+
+	// New_segment, if set, returns the writer of each media segment;
+	// otherwise the segments follow the init segment in the muxer's writer.
+	New_segment func(segment_index int) (io.Writer, error)
+
+	w io.Writer
+	segment_w io.Writer
+	tracks []*mux_track
+	reference int
+	sequence_number uint32
+	segment_index int
+	segment_open bool
+	started bool
+	segment_start int64 // in the reference timescale
+	chunk_start int64
+	boundaries []mux_boundary // chunks ended by the reference track, not written yet
+	chunk_written func(chunk [][]mux_sample) // called after each moof/mdat is written
+}
+
+// NewFmp4Muxer returns a muxer writing to w. Each track needs a Track_id,
+// Timescale and either a Sample_entry box, copied as is (e.g. a track of
+// GetTracks), or the codec configuration (Avcc, Hvcc or Esds) with Width and
+// Height or Channel_count and Sample_rate to build one.
+func NewFmp4Muxer(w io.Writer, tracks []Track_info) (*Fmp4_muxer, error) {
+	if len(tracks) == 0 {
+		return nil, errors.New("no_tracks")
+	}
+
+	m := &Fmp4_muxer{w: w, reference: -1}
+	ids := make(map[uint32]bool)
+	for i, track := range tracks {
+		if track.Track_id == 0 || ids[track.Track_id] {
+			return nil, errors.New("invalid_track_id")
+		}
+
+		if track.Timescale == 0 {
+			return nil, errors.New("invalid_timescale")
+		}
+
+		if track.Handler_type == "" {
+			switch {
+			case track.Avcc != nil || track.Hvcc != nil:
+				track.Handler_type = "vide"
+			case track.Esds != nil:
+				track.Handler_type = "soun"
+			}
+		}
+
+		if m.reference < 0 && track.Handler_type == "vide" {
+			m.reference = i
+		}
+
+		ids[track.Track_id] = true
+		m.tracks = append(m.tracks, &mux_track{info: track})
+	}
+
+	if m.reference < 0 {
+		m.reference = 0
+	}
+
+	return m, nil
+}
+
+func brands_payload(major string, compatible ...string) []byte {
+	d := append([]byte(major), 0, 0, 0, 0)
+	for _, brand := range compatible {
+		d = append(d, brand...)
+	}
+
+	return d
+}
+
+func fourcc_of(s string) uint32 {
+	return mp4_fourcc(s[0], s[1], s[2], s[3])
+}
+
+var mux_identity_matrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func append_matrix(d []byte) []byte {
+	for _, v := range mux_identity_matrix {
+		d = append_uint32(d, v)
+	}
+
+	return d
+}
+
+func mdhd_language_code(language string) uint16 {
+	if len(language) != 3 {
+		language = "und"
+	}
+
+	return uint16(language[0] - 0x60) << 10 | uint16(language[1] - 0x60) << 5 | uint16(language[2] - 0x60)
+}
+
+// mux_sample_entry returns the stsd entry of a track.
+func mux_sample_entry(track Track_info) ([]byte, error) {
+	if track.Sample_entry != nil {
+		return track.Sample_entry.Bytes(), nil
+	}
+
+	codec := track.Codec
+	var config *Mp4_box
+	switch {
+	case track.Avcc != nil:
+		if codec == "" {
+			codec = "avc1"
+		}
+
+		config = NewBox(mp4_fourcc('a', 'v', 'c', 'C'), BuildAvcc(*track.Avcc))
+	case track.Hvcc != nil:
+		if codec == "" {
+			codec = "hvc1"
+		}
+
+		config = NewBox(mp4_fourcc('h', 'v', 'c', 'C'), BuildHvcc(*track.Hvcc))
+	case track.Esds != nil:
+		if codec == "" {
+			codec = "mp4a"
+		}
+
+		config = NewBox(mp4_fourcc('e', 's', 'd', 's'), BuildEsds(*track.Esds))
+	default:
+		return nil, parse_error(ErrUnsupported, "unsupported_codec", 0, "")
+	}
+
+	if len(codec) != 4 {
+		return nil, parse_error(ErrUnsupported, "unsupported_codec_" + codec, 0, "")
+	}
+
+	entry := make([]byte, 6)
+	entry = append_uint16(entry, 1) // data_reference_index
+	if track.Esds != nil {
+		entry = append(entry, make([]byte, 8)...)
+		entry = append_uint16(entry, max(track.Channel_count, 1))
+		entry = append_uint16(entry, 16) // sample size
+		entry = append(entry, 0, 0, 0, 0)
+		// 16.16 fixed point; 0 for rates that do not fit, the timescale and
+		// the decoder configuration giving the rate then
+		sample_rate := track.Sample_rate << 16
+		if track.Sample_rate > 0xFFFF {
+			sample_rate = 0
+		}
+
+		entry = append_uint32(entry, sample_rate)
+	} else {
+		entry = append(entry, make([]byte, 16)...)
+		entry = append_uint16(append_uint16(entry, track.Width), track.Height)
+		entry = append_uint32(append_uint32(entry, 0x00480000), 0x00480000) // 72 dpi
+		entry = append_uint32(entry, 0)
+		entry = append_uint16(entry, 1) // frame_count
+		entry = append(entry, make([]byte, 32)...) // compressorname
+		entry = append_uint16(append_uint16(entry, 0x0018), 0xFFFF)
+	}
+
+	box := NewBox(fourcc_of(codec), entry)
+	box.AddChild(config)
+	return box.Bytes(), nil
+}
+
+var mux_handler_names = map[string]string{
+	"vide": "VideoHandler",
+	"soun": "SoundHandler",
+	"subt": "SubtitleHandler",
+	"text": "TextHandler",
+}
+
+func (m *Fmp4_muxer) build_trak(track Track_info) (*Mp4_box, error) {
+	tkhd := append_uint32(append_uint32(nil, 0), 0) // creation, modification time
+	tkhd = append_uint32(append_uint32(tkhd, track.Track_id), 0)
+	tkhd = append_uint32(tkhd, 0) // duration
+	tkhd = append(tkhd, make([]byte, 8)...)
+	tkhd = append_uint16(append_uint16(tkhd, 0), 0) // layer, alternate_group
+	volume := uint16(0)
+	if track.Handler_type == "soun" {
+		volume = 0x0100
+	}
+
+	tkhd = append_uint16(append_uint16(tkhd, volume), 0)
+	tkhd = append_matrix(tkhd)
+	tkhd = append_uint32(append_uint32(tkhd, uint32(track.Width) << 16), uint32(track.Height) << 16)
+
+	mdhd := append_uint32(append_uint32(nil, 0), 0)
+	mdhd = append_uint32(append_uint32(mdhd, track.Timescale), 0)
+	mdhd = append_uint16(append_uint16(mdhd, mdhd_language_code(track.Language)), 0)
+
+	hdlr := append_uint32(nil, 0)
+	hdlr = append(hdlr, (track.Handler_type + "    ")[:4]...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	hdlr = append(append(hdlr, mux_handler_names[track.Handler_type]...), 0)
+
+	var media_header *Mp4_box
+	switch track.Handler_type {
+	case "vide":
+		media_header = NewFullBox(mp4_fourcc('v', 'm', 'h', 'd'), 0, 1, make([]byte, 8))
+	case "soun":
+		media_header = NewFullBox(mp4_fourcc('s', 'm', 'h', 'd'), 0, 0, make([]byte, 4))
+	case "subt":
+		media_header = NewFullBox(mp4_fourcc('s', 't', 'h', 'd'), 0, 0, nil)
+	default:
+		media_header = NewFullBox(mp4_fourcc('n', 'm', 'h', 'd'), 0, 0, nil)
+	}
+
+	dref := NewFullBox(mp4_fourcc('d', 'r', 'e', 'f'), 0, 0, append_uint32(nil, 1))
+	dref.AddChild(NewFullBox(mp4_fourcc('u', 'r', 'l', ' '), 0, 1, nil)) // media data in the same file
+
+	entry, err := mux_sample_entry(track)
+	if err != nil {
+		return nil, err
+	}
+
+	empty_table := append_uint32(nil, 0)
+	stbl := NewContainerBox(mp4_fourcc('s', 't', 'b', 'l'),
+		NewFullBox(mp4_fourcc('s', 't', 's', 'd'), 0, 0, append(append_uint32(nil, 1), entry...)),
+		NewFullBox(mp4_fourcc('s', 't', 't', 's'), 0, 0, empty_table),
+		NewFullBox(mp4_fourcc('s', 't', 's', 'c'), 0, 0, empty_table),
+		NewFullBox(mp4_fourcc('s', 't', 's', 'z'), 0, 0, append_uint32(empty_table, 0)),
+		NewFullBox(mp4_fourcc('s', 't', 'c', 'o'), 0, 0, empty_table))
+
+	minf := NewContainerBox(mp4_fourcc('m', 'i', 'n', 'f'), media_header, NewContainerBox(mp4_fourcc('d', 'i', 'n', 'f'), dref), stbl)
+	mdia := NewContainerBox(mp4_fourcc('m', 'd', 'i', 'a'), NewFullBox(mp4_fourcc('m', 'd', 'h', 'd'), 0, 0, mdhd), NewFullBox(mp4_fourcc('h', 'd', 'l', 'r'), 0, 0, hdlr), minf)
+	return NewContainerBox(mp4_fourcc('t', 'r', 'a', 'k'), NewFullBox(mp4_fourcc('t', 'k', 'h', 'd'), 0, 3, tkhd), mdia), nil
+}
+
+// WriteInit writes the init segment: ftyp and a moov with the tracks, empty
+// sample tables and a trex per track.
+func (m *Fmp4_muxer) WriteInit() error {
+	if m.Cmaf && len(m.tracks) > 1 {
+		return errors.New("cmaf_requires_single_track")
+	}
+
+	brands := []string{"iso6", "mp41"}
+	if m.Cmaf {
+		brands = append(brands, "cmfc")
+	}
+
+	next_track_id := uint32(0)
+	for _, t := range m.tracks {
+		next_track_id = max(next_track_id, t.info.Track_id + 1)
+	}
+
+	mvhd := append_uint32(append_uint32(nil, 0), 0) // creation, modification time
+	mvhd = append_uint32(append_uint32(mvhd, 1000), 0) // timescale, duration
+	mvhd = append_uint32(mvhd, 0x00010000) // rate
+	mvhd = append_uint16(mvhd, 0x0100) // volume
+	mvhd = append(mvhd, make([]byte, 10)...)
+	mvhd = append_matrix(mvhd)
+	mvhd = append(mvhd, make([]byte, 24)...)
+	mvhd = append_uint32(mvhd, next_track_id)
+
+	moov := NewContainerBox(mp4_fourcc('m', 'o', 'o', 'v'), NewFullBox(mp4_fourcc('m', 'v', 'h', 'd'), 0, 0, mvhd))
+	mvex := NewContainerBox(mp4_fourcc('m', 'v', 'e', 'x'))
+	for _, t := range m.tracks {
+		trak, err := m.build_trak(t.info)
+		if err != nil {
+			return err
+		}
+
+		moov.AddChild(trak)
+		trex := append_uint32(append_uint32(nil, t.info.Track_id), 1)
+		trex = append_uint32(append_uint32(append_uint32(trex, 0), 0), 0)
+		mvex.AddChild(NewFullBox(mp4_fourcc('t', 'r', 'e', 'x'), 0, 0, trex))
+	}
+
+	moov.AddChild(mvex)
+	_, err := m.w.Write(SerializeBoxes([]*Mp4_box{NewBox(mp4_fourcc('f', 't', 'y', 'p'), brands_payload(brands[0], brands...)), moov}))
+	return err
+}
+
+func (m *Fmp4_muxer) find_track(track_id uint32) *mux_track {
+	for _, t := range m.tracks {
+		if t.info.Track_id == track_id {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func (t *mux_track) is_sync(s Mp4_sample) bool {
+	return s.Is_sync || t.info.Handler_type != "vide"
+}
+
+// WriteSample adds a sample of one of the tracks. Dts and Pts are in the
+// track timescale, Dts not negative. A zero Duration is taken from the Dts
+// of the next sample of the track. Is_sync marks video sync samples; a zero
+// Flags is derived from it. A Sample_description_index other than 1 and a
+// Sample_dependency are kept, in the tfhd and a sdtp. Complete chunks are
+// written as samples arrive.
+func (m *Fmp4_muxer) WriteSample(s Mp4_sample) error {
+	t := m.find_track(s.Track_id)
+	if t == nil {
+		return errors.New("unknown_track_id")
+	}
+
+	// tfdt holds an unsigned baseMediaDecodeTime
+	if s.Dts < 0 {
+		return errors.New("negative_decode_time")
+	}
+
+	if uint64(len(s.Data)) > 0xFFFFFFFF {
+		return errors.New("sample_too_large")
+	}
+
+	s.Size = uint32(len(s.Data))
+	if n := len(t.pending); n > 0 && !t.pending[n - 1].duration_known {
+		if s.Dts < t.pending[n - 1].Dts {
+			return errors.New("decode_time_regression")
+		}
+
+		t.pending[n - 1].Duration = uint32(s.Dts - t.pending[n - 1].Dts)
+		t.pending[n - 1].duration_known = true
+		t.last_duration = t.pending[n - 1].Duration
+	}
+
+	if t == m.tracks[m.reference] {
+		if !m.started {
+			m.started = true
+			m.segment_start = s.Dts
+			m.chunk_start = s.Dts
+		} else {
+			segment_boundary := t.is_sync(s) && (m.Segment_duration == 0 || s.Dts - m.segment_start >= int64(m.Segment_duration) * int64(t.info.Timescale) / 1000)
+			chunk_boundary := m.Chunk_duration != 0 && s.Dts - m.chunk_start >= int64(m.Chunk_duration) * int64(t.info.Timescale) / 1000
+			if m.Chunk_sync_samples && t.info.Handler_type == "vide" && s.Is_sync {
+				chunk_boundary = true
+			}
+
+			if segment_boundary || chunk_boundary {
+				m.boundaries = append(m.boundaries, mux_boundary{s.Dts, segment_boundary})
+				m.chunk_start = s.Dts
+				if segment_boundary {
+					m.segment_start = s.Dts
+				}
+			}
+		}
+	}
+
+	if s.Flags == 0 {
+		s.Flags = mux_non_sync_sample_flags
+		if t.is_sync(s) {
+			s.Flags = mux_sync_sample_flags
+		}
+	}
+
+	t.pending = append(t.pending, mux_sample{Mp4_sample: s, duration_known: s.Duration != 0})
+	if s.Duration != 0 {
+		t.last_duration = s.Duration
+	}
+
+	for len(m.boundaries) > 0 && m.tracks_reached(m.boundaries[0].dts) {
+		err := m.write_boundary()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tracks_reached tells whether every track has a pending sample decoding at
+// or after boundary, in the reference timescale, so that no sample before it
+// is still to come.
+func (m *Fmp4_muxer) tracks_reached(boundary int64) bool {
+	reference_timescale := int64(m.tracks[m.reference].info.Timescale)
+	for _, t := range m.tracks {
+		n := len(t.pending)
+		if n == 0 || t.pending[n - 1].Dts * reference_timescale < boundary * int64(t.info.Timescale) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// write_boundary writes the chunk ending at the first waiting boundary.
+func (m *Fmp4_muxer) write_boundary() error {
+	b := m.boundaries[0]
+	m.boundaries = m.boundaries[1:]
+	err := m.write_chunk(b.dts, false)
+	if err != nil {
+		return err
+	}
+
+	if b.segment {
+		m.segment_open = false
+	}
+
+	return nil
+}
+
+// Flush writes the samples not written yet as the last chunk of the last
+// segment. A last sample without Duration gets the duration of the one before.
+func (m *Fmp4_muxer) Flush() error {
+	for _, t := range m.tracks {
+		for i := range t.pending {
+			if !t.pending[i].duration_known {
+				t.pending[i].Duration = t.last_duration
+				t.pending[i].duration_known = true
+			}
+		}
+	}
+
+	for len(m.boundaries) > 0 {
+		err := m.write_boundary()
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.write_chunk(0, true)
+}
+
+// write_chunk writes one moof/mdat with the samples decoding before boundary,
+// in the reference timescale, or all samples if final. Samples whose duration
+// is not known yet wait for the next chunk.
+func (m *Fmp4_muxer) write_chunk(boundary int64, final bool) error {
+	reference_timescale := int64(m.tracks[m.reference].info.Timescale)
+	chunk := make([][]mux_sample, len(m.tracks))
+	sample_count := 0
+	for i, t := range m.tracks {
+		n := 0
+		for n < len(t.pending) && t.pending[n].duration_known && (final || t.pending[n].Dts * reference_timescale < boundary * int64(t.info.Timescale)) {
+			n++
+		}
+
+		chunk[i] = t.pending[:n]
+		t.pending = append([]mux_sample(nil), t.pending[n:]...)
+		sample_count += n
+	}
+
+	if sample_count == 0 {
+		return nil
+	}
+
+	if !m.segment_open {
+		if m.Cmaf && len(m.tracks) > 1 {
+			return errors.New("cmaf_requires_single_track")
+		}
+
+		m.segment_open = true
+		m.segment_w = m.w
+		if m.New_segment != nil {
+			w, err := m.New_segment(m.segment_index)
+			if err != nil {
+				return err
+			}
+
+			m.segment_w = w
+		}
+
+		m.segment_index++
+		brands := []string{"msdh", "msix"}
+		if m.Cmaf {
+			brands = append(brands, "cmfs", "cmff")
+			if m.Chunk_duration != 0 || m.Chunk_sync_samples {
+				brands = append(brands, "cmfl")
+			}
+		}
+
+		_, err := m.segment_w.Write(NewBox(mp4_fourcc('s', 't', 'y', 'p'), brands_payload(brands[0], brands...)).Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := m.segment_w.Write(m.build_fragment(chunk))
+	if err == nil && m.chunk_written != nil {
+		m.chunk_written(chunk)
+	}
+
+	return err
+}
+
+// mux_description_runs splits the samples of a track into runs sharing a
+// sample description index, 0 and 1 (the trex default) being the same.
+func mux_description_runs(samples []mux_sample) [][]mux_sample {
+	index := func(s mux_sample) uint32 {
+		return max(s.Sample_description_index, 1)
+	}
+
+	var runs [][]mux_sample
+	start := 0
+	for n := 1; n <= len(samples); n++ {
+		if n == len(samples) || index(samples[n]) != index(samples[start]) {
+			runs = append(runs, samples[start:n])
+			start = n
+		}
+	}
+
+	return runs
+}
+
+// build_fragment returns a moof with a traf per track that has samples, and
+// the mdat holding their data in the same order. A track whose samples
+// change sample description gets a traf per description, with the index in
+// its tfhd, and a track with sample dependencies gets a sdtp.
+func (m *Fmp4_muxer) build_fragment(chunk [][]mux_sample) []byte {
+	m.sequence_number++
+	moof := NewContainerBox(mp4_fourcc('m', 'o', 'o', 'f'), NewFullBox(mp4_fourcc('m', 'f', 'h', 'd'), 0, 0, append_uint32(nil, m.sequence_number)))
+	var truns []*Mp4_box
+	var data_sizes []uint64
+	var mdat []byte
+	for i, track_samples := range chunk {
+		for _, samples := range mux_description_runs(track_samples) {
+			trun_flags := uint32(Trun_data_offset_present | Trun_sample_duration_present | Trun_sample_size_present | Trun_sample_flags_present)
+			has_dependencies := false
+			for _, s := range samples {
+				if s.Pts != s.Dts {
+					trun_flags |= Trun_sample_composition_time_offsets_present
+				}
+
+				if s.Sample_dependency != 0 {
+					has_dependencies = true
+				}
+			}
+
+			trun := append_uint32(append_uint32(nil, uint32(len(samples))), 0) // data_offset, set below
+			var sdtp []byte
+			data_size := uint64(0)
+			for _, s := range samples {
+				trun = append_uint32(append_uint32(append_uint32(trun, s.Duration), s.Size), s.Flags)
+				if trun_flags & Trun_sample_composition_time_offsets_present != 0 {
+					trun = append_uint32(trun, uint32(int32(s.Pts - s.Dts)))
+				}
+
+				sdtp = append(sdtp, s.Sample_dependency)
+				mdat = append(mdat, s.Data...)
+				data_size += uint64(s.Size)
+			}
+
+			tfhd_flags := uint32(Tfhd_default_base_is_moof)
+			tfhd := append_uint32(nil, m.tracks[i].info.Track_id)
+			if samples[0].Sample_description_index > 1 {
+				tfhd_flags |= Tfhd_sample_description_index_present
+				tfhd = append_uint32(tfhd, samples[0].Sample_description_index)
+			}
+
+			trun_box := NewFullBox(mp4_fourcc('t', 'r', 'u', 'n'), 1, trun_flags, trun)
+			truns = append(truns, trun_box)
+			data_sizes = append(data_sizes, data_size)
+			traf := NewContainerBox(mp4_fourcc('t', 'r', 'a', 'f'),
+				NewFullBox(mp4_fourcc('t', 'f', 'h', 'd'), 0, tfhd_flags, tfhd),
+				NewFullBox(mp4_fourcc('t', 'f', 'd', 't'), 1, 0, append_uint64(nil, uint64(samples[0].Dts))),
+				trun_box)
+			if has_dependencies {
+				traf.AddChild(NewFullBox(mp4_fourcc('s', 'd', 't', 'p'), 0, 0, sdtp))
+			}
+
+			moof.AddChild(traf)
+		}
+	}
+
+	mdat_box := NewBox(mp4_fourcc('m', 'd', 'a', 't'), mdat)
+	data_offset := moof.EncodedSize() + mdat_box.EncodedSize() - uint64(len(mdat))
+	for i, trun := range truns {
+		set_uint32(8, trun.Payload, uint32(data_offset)) // after version/flags and sample_count
+		data_offset += data_sizes[i]
+	}
+
+	return SerializeBoxes([]*Mp4_box{moof, mdat_box})
+}
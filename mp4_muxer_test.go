@@ -0,0 +1,259 @@
+package media_utils
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// 1280x720 H.264 baseline parameter sets
+var mux_test_sps = []byte{0x67, 0x42, 0xC0, 0x1F, 0xDA, 0x01, 0x40, 0x16, 0xE4}
+var mux_test_pps = []byte{0x68, 0xCE, 0x38, 0x80}
+
+// mux_test_tracks returns an H.264 track 1 at 90 kHz and a stereo AAC-LC
+// track 2 at sample_rate, one of aac_sampling_frequencies.
+func mux_test_tracks(sample_rate uint32) []Track_info {
+	index := uint16(0)
+	for i, f := range aac_sampling_frequencies {
+		if f == sample_rate {
+			index = uint16(i)
+		}
+	}
+
+	asc := append_uint16(nil, 2 << 11 | index << 7 | 2 << 3)
+	return []Track_info{
+		{Track_id: 1, Handler_type: "vide", Timescale: 90000, Width: 1280, Height: 720, Avcc: &Avcc_config{Configuration_version: 1, Profile: 0x42, Profile_compatibility: 0xC0, Level: 0x1F, Nal_length_size: 4, Sps: [][]byte{mux_test_sps}, Pps: [][]byte{mux_test_pps}}},
+		{Track_id: 2, Handler_type: "soun", Timescale: sample_rate, Sample_rate: sample_rate, Channel_count: 2, Esds: &Esds_config{Es_id: 2, Object_type_indication: 0x40, Stream_type: 0x05, Decoder_specific_info: asc}},
+	}
+}
+
+// mux_test_video_sample returns frame i of a 30 fps stream starting at dts,
+// with a sync sample every 30 frames and a composition offset of one frame.
+func mux_test_video_sample(i int, dts int64) Mp4_sample {
+	nalu := []byte{0x41}
+	if i % 30 == 0 {
+		nalu[0] = 0x65
+	}
+
+	nalu = append(nalu, bytes.Repeat([]byte{byte(i) | 1}, 100 + i)...)
+	return Mp4_sample{Track_id: 1, Dts: dts + int64(i) * 3000, Pts: dts + int64(i + 1) * 3000, Duration: 3000, Is_sync: i % 30 == 0, Data: append(append_uint32(nil, uint32(len(nalu))), nalu...)}
+}
+
+// mux_test_audio_sample returns AAC frame i of a stream starting at dts.
+func mux_test_audio_sample(i int, dts int64) Mp4_sample {
+	return Mp4_sample{Track_id: 2, Dts: dts + int64(i) * 1024, Pts: dts + int64(i) * 1024, Duration: 1024, Is_sync: true, Data: bytes.Repeat([]byte{byte(i) | 0x80}, 20 + i % 7)}
+}
+
+// TestMuxerTrackOrder feeds all the video before the audio: every segment
+// must still get the audio of its time range.
+func TestMuxerTrackOrder(t *testing.T) {
+	tracks := mux_test_tracks(48000)
+	var init_data bytes.Buffer
+	var segments []*bytes.Buffer
+	m, err := NewFmp4Muxer(&init_data, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Segment_duration = 1000
+	m.New_segment = func(segment_index int) (io.Writer, error) {
+		segments = append(segments, &bytes.Buffer{})
+		return segments[segment_index], nil
+	}
+
+	err = m.WriteInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 90; i++ {
+		err = m.WriteSample(mux_test_video_sample(i, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 140; i++ {
+		err = m.WriteSample(mux_test_audio_sample(i, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = m.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(segments) != 3 {
+		t.Fatalf("%d segments, want 3", len(segments))
+	}
+
+	audio_count := 0
+	for k, segment := range segments {
+		samples, err := GetFragmentSamples(segment.Bytes(), tracks)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		video_count := 0
+		for _, s := range samples {
+			if s.Track_id == 1 {
+				video_count++
+				continue
+			}
+
+			audio_count++
+			// Segment k covers [k s, k + 1 s)
+			if s.Dts < int64(k) * 48000 || (k < 2 && s.Dts >= int64(k + 1) * 48000) {
+				t.Errorf("segment %d: audio sample at %d", k, s.Dts)
+			}
+		}
+
+		if video_count != 30 {
+			t.Errorf("segment %d: %d video samples, want 30", k, video_count)
+		}
+	}
+
+	if audio_count != 140 {
+		t.Errorf("%d audio samples, want 140", audio_count)
+	}
+}
+
+func TestMuxerHighSampleRate(t *testing.T) {
+	var init_data bytes.Buffer
+	m, err := NewFmp4Muxer(&init_data, mux_test_tracks(96000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.WriteInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, err := GetTracks(init_data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 96000 does not fit in the 16.16 samplerate of the sample entry
+	if tracks[1].Sample_rate != 0 || tracks[1].Timescale != 96000 {
+		t.Errorf("samplerate %d, timescale %d", tracks[1].Sample_rate, tracks[1].Timescale)
+	}
+}
+
+func TestMuxerCmafSingleTrack(t *testing.T) {
+	var out bytes.Buffer
+	m, err := NewFmp4Muxer(&out, mux_test_tracks(48000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Cmaf = true
+	if m.WriteInit() == nil {
+		t.Error("CMAF brands written for two tracks")
+	}
+
+	m, err = NewFmp4Muxer(&out, mux_test_tracks(48000)[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Cmaf = true
+	err = m.WriteInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boxes, _ := ParseBoxes(out.Bytes())
+	if !bytes.Contains(FindBox(boxes, "ftyp").Payload, []byte("cmfc")) {
+		t.Error("no cmfc brand")
+	}
+}
+
+func TestMuxerChunkSyncSamples(t *testing.T) {
+	var out bytes.Buffer
+	m, err := NewFmp4Muxer(&out, mux_test_tracks(48000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Segment_duration = 10000
+	m.Chunk_sync_samples = true
+	for i := 0; i < 90; i++ {
+		m.WriteSample(mux_test_video_sample(i, 0))
+		for j := i * 141 / 90; j < (i + 1) * 141 / 90; j++ {
+			m.WriteSample(mux_test_audio_sample(j, 0))
+		}
+	}
+
+	err = m.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boxes, err := ParseBoxes(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One segment of three chunks, each starting at a sync sample
+	if len(FindBoxes(boxes, "styp")) != 1 || len(FindBoxes(boxes, "moof")) != 3 {
+		t.Fatalf("%d segments, %d chunks", len(FindBoxes(boxes, "styp")), len(FindBoxes(boxes, "moof")))
+	}
+
+	for k, moof := range FindBoxes(boxes, "moof") {
+		tfdt, err := parse_tfdt(moof.Find("traf/tfdt").Payload)
+		if err != nil || tfdt != uint64(k) * 90000 {
+			t.Errorf("chunk %d at %d: %v", k, tfdt, err)
+		}
+	}
+}
+
+func TestMuxerNegativeDts(t *testing.T) {
+	var out bytes.Buffer
+	m, err := NewFmp4Muxer(&out, mux_test_tracks(48000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.WriteSample(mux_test_video_sample(0, -3000)) == nil {
+		t.Error("negative DTS accepted")
+	}
+}
+
+// FuzzFmp4Muxer checks that the muxed file reads back with the samples
+// written.
+func FuzzFmp4Muxer(f *testing.F) {
+	f.Add(fuzz_init(), fuzz_segment())
+	f.Fuzz(func(t *testing.T, init_data []byte, seg_data []byte) {
+		tracks, samples := fuzz_samples(init_data, seg_data)
+		var out bytes.Buffer
+		m, err := NewFmp4Muxer(&out, tracks)
+		if err != nil || m.WriteInit() != nil {
+			return
+		}
+
+		m.Chunk_duration = 100
+		for _, sample := range samples {
+			if m.WriteSample(sample) != nil {
+				return
+			}
+		}
+
+		if m.Flush() != nil {
+			return
+		}
+
+		muxed_tracks, err := GetTracks(out.Bytes())
+		if err != nil {
+			t.Fatalf("muxed init segment: %v", err)
+		}
+
+		muxed, err := GetFragmentSamples(out.Bytes(), muxed_tracks)
+		if err != nil || len(muxed) != len(samples) {
+			t.Fatalf("%d samples muxed, %d read back: %v", len(samples), len(muxed), err)
+		}
+	})
+}
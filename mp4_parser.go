@@ -1,10 +1,5 @@
 package media_utils
 
-import (
-	"fmt"
-	"errors"
-)
-
 type Box_header struct {
 	Box_size uint32
 	Version uint8
@@ -23,7 +18,19 @@ type Tfdt_box struct {
 }
 
 type Sidx_box struct {
+	Header Box_header
+	Reference_id uint32
 	Timescale uint32
+	Earliest_presentation_time uint64
+	First_offset uint64
+	References []Sidx_reference
+}
+
+type Mdhd_box struct {
+	Header Box_header
+	Timescale uint32
+	Duration uint64
+	Language string
 }
 
 func get_uint8(p uint32, d []byte) uint8 {
@@ -49,456 +56,457 @@ func set_uint32(p uint32, d []byte, v uint32) {
 	d[p+3] = byte(v - (uint32(d[p]) << 24) - (uint32(d[p+1]) << 16) - (uint32(d[p+2]) << 8))
 }
 
+func set_uint16(p uint32, d []byte, v uint16) {
+	d[p] = byte(v >> 8)
+	d[p+1] = byte(v)
+}
+
+func set_uint64(p uint32, d []byte, v uint64) {
+	set_uint32(p, d, uint32(v >> 32))
+	set_uint32(p + 4, d, uint32(v))
+}
+
 func mp4_fourcc(a byte, b byte, c byte, d byte) uint32 {
 	return uint32(a) << 24 + uint32(b) << 16 + uint32(c) << 8 + uint32(d)
 }
 
-func GetFtyp(seg_data []byte) error {
-	bytes_total := uint32(len(seg_data))
-	bytes_remaining := bytes_total
-	var box_size uint32
-	var box_type uint32
+func fourcc_string(box_type uint32) string {
+	return string([]byte{byte(box_type >> 24), byte(box_type >> 16), byte(box_type >> 8), byte(box_type)})
+}
 
-	if bytes_remaining > 8 {
-		box_size = get_uint32(0, seg_data)
-		box_type = get_uint32(4, seg_data)
-	} else {
-		fmt.Println("Error: invalid segment data")
-		return errors.New("Failed_to_find_ftyp")
-	}
+func append_uint16(d []byte, v uint16) []byte {
+	return append(d, byte(v >> 8), byte(v))
+}
 
-	for box_type != mp4_fourcc('f', 't', 'y', 'p') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			fmt.Println("FTYP box not found")
-			return errors.New("Failed_to_find_ftyp")
-		}
+func append_uint32(d []byte, v uint32) []byte {
+	return append(d, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v))
+}
+
+func append_uint64(d []byte, v uint64) []byte {
+	return append(d, byte(v >> 56), byte(v >> 48), byte(v >> 40), byte(v >> 32), byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v))
+}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+// check_segment_size rejects data whose offsets do not fit the 32-bit offsets of the parser.
+func check_segment_size(seg_data []byte) error {
+	if uint64(len(seg_data)) > 0xFFFFFFFF {
+		return parse_error(ErrInvalidData, "invalid_segment_size", 0, "")
 	}
 
-	//ftyp_start_offset := bytes_total - bytes_remaining
-	ftyp_box_size := box_size
-	fmt.Println("FTYP box size = ", ftyp_box_size)
 	return nil
 }
 
-func GetMoof(seg_data []byte) error {
-	bytes_total := uint32(len(seg_data))
-	bytes_remaining := bytes_total
-	var box_size uint32
-	var box_type uint32
-
-	if bytes_remaining > 8 {
-		box_size = get_uint32(0, seg_data)
-		box_type = get_uint32(4, seg_data)
-	} else {
-		fmt.Println("Error: invalid segment data")
-		return errors.New("Failed_to_find_moof")
+// read_box_size returns the size of the box starting at d[p], resolving the
+// 64-bit largesize and the "extends to end" (size 0) forms. The box must fit in d[p:end].
+func read_box_size(d []byte, p uint32, end uint32) (uint32, error) {
+	if end > uint32(len(d)) || p > end || end - p < 8 {
+		return 0, parse_error(ErrTruncated, "incomplete_box_header", uint64(p), "")
 	}
 
-	for box_type != mp4_fourcc('m', 'o', 'o', 'f') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			fmt.Println("MOOF box not found")
-			return errors.New("Failed_to_find_moof")
+	box_size := get_uint32(p, d)
+	if box_size == 1 {
+		if end - p < 16 {
+			return 0, parse_error(ErrTruncated, "incomplete_box_header", uint64(p), fourcc_string(get_uint32(p + 4, d)))
 		}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
-	}
+		largesize := get_uint64(uint64(p + 8), d)
+		if largesize > uint64(end - p) {
+			return 0, parse_error(ErrTruncated, "incomplete_" + fourcc_string(get_uint32(p + 4, d)), uint64(p), fourcc_string(get_uint32(p + 4, d)))
+		}
 
-	//moof_start_offset := bytes_total - bytes_remaining
-	moof_box_size := box_size
-	fmt.Println("MOOF box size = ", moof_box_size)
-	return nil
-}
+		box_size = uint32(largesize)
+	} else if box_size == 0 {
+		box_size = end - p
+	}
 
-func GetMoov(seg_data []byte) error {
-	bytes_total := uint32(len(seg_data))
-	bytes_remaining := bytes_total
-	var box_size uint32
-	var box_type uint32
+	if box_size < 8 {
+		return 0, parse_error(ErrInvalidData, "invalid_box_size", uint64(p), fourcc_string(get_uint32(p + 4, d)))
+	}
 
-	if bytes_remaining > 8 {
-		box_size = get_uint32(0, seg_data)
-		box_type = get_uint32(4, seg_data)
-	} else {
-		fmt.Println("Error: invalid segment data")
-		return errors.New("Failed_to_find_moov")
+	// A box running past the end of the data is truncated
+	if box_size > end - p {
+		return 0, parse_error(ErrTruncated, "incomplete_" + fourcc_string(get_uint32(p + 4, d)), uint64(p), fourcc_string(get_uint32(p + 4, d)))
 	}
 
-	for box_type != mp4_fourcc('m', 'o', 'o', 'v') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			fmt.Println("MOOV box not found")
-			return errors.New("Failed_to_find_moov")
+	return box_size, nil
+}
+
+// find_box scans the sibling boxes in d[start:end] for the first box of type
+// box_type. parent_path is the path of the box holding them, "" for top-level
+// boxes. It returns the start offset and the size of that box.
+func find_box(d []byte, start uint32, end uint32, parent_path string, box_type uint32) (uint32, uint32, error) {
+	p := start
+	for p < end && end - p >= 8 {
+		box_size, err := read_box_size(d, p, end)
+		if err != nil {
+			if e, ok := err.(*Parse_error); ok {
+				e.Path = box_path(parent_path, get_uint32(p + 4, d))
+			}
+
+			return 0, 0, err
+		}
+
+		if get_uint32(p + 4, d) == box_type {
+			return p, box_size, nil
 		}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+		p += box_size
 	}
 
-	//moov_start_offset := bytes_total - bytes_remaining
-	moov_box_size := box_size
-	fmt.Println("MOOV box size = ", moov_box_size)
-	return nil
+	return 0, 0, parse_error(ErrBoxNotFound, "Failed_to_find_" + fourcc_string(box_type), uint64(p), box_path(parent_path, box_type))
 }
 
-func GetMdat(seg_data []byte) error {
-	bytes_total := uint32(len(seg_data))
-	bytes_remaining := bytes_total
-	var box_size uint32
-	var box_type uint32
+// find_top_level_box returns the offset and size of the first top-level box
+// of type box_type, logging lookup failures like the other Get functions.
+func find_top_level_box(seg_data []byte, box_type uint32) (uint32, uint32, error) {
+	err := check_segment_size(seg_data)
+	if err != nil {
+		return 0, 0, err
+	}
 
-	if bytes_remaining > 8 {
-		box_size = get_uint32(0, seg_data)
-		box_type = get_uint32(4, seg_data)
-	} else {
-		fmt.Println("Error: invalid segment data")
-		return errors.New("Failed_to_find_mdat")
+	start_offset, box_size, err := find_box(seg_data, 0, uint32(len(seg_data)), "", box_type)
+	if err != nil {
+		log_debug("box lookup failed", "error", err)
+		return 0, 0, err
 	}
 
-	for box_type != mp4_fourcc('m', 'd', 'a', 't') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			fmt.Println("MDAT box not found")
-			return errors.New("Failed_to_find_mdat")
-		}
+	return start_offset, box_size, nil
+}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+func GetFtyp(seg_data []byte) error {
+	_, ftyp_box_size, err := find_top_level_box(seg_data, mp4_fourcc('f', 't', 'y', 'p'))
+	if err != nil {
+		return err
 	}
 
-	//mdat_start_offset := bytes_total - bytes_remaining
-	mdat_box_size := box_size
-	fmt.Println("MDAT box size = ", mdat_box_size)
+	log_debug("ftyp", "size", ftyp_box_size)
 	return nil
 }
 
-func GetTfdt(seg_data []byte) (Tfdt_box, error) {
-	var tfdt Tfdt_box
-	bytes_total := uint32(len(seg_data))
-	bytes_remaining := bytes_total
-	var box_size uint32
-	var box_type uint32
+func GetMoof(seg_data []byte) error {
+	_, moof_box_size, err := find_top_level_box(seg_data, mp4_fourcc('m', 'o', 'o', 'f'))
+	if err != nil {
+		return err
+	}
 
-	if bytes_remaining > 8 {
-		box_size = get_uint32(0, seg_data)
-		box_type = get_uint32(4, seg_data)
-	} else {
-		return tfdt, errors.New("Failed_to_find_tfdt")
+	log_debug("moof", "size", moof_box_size)
+	return nil
+}
+
+func GetMoov(seg_data []byte) error {
+	_, moov_box_size, err := find_top_level_box(seg_data, mp4_fourcc('m', 'o', 'o', 'v'))
+	if err != nil {
+		return err
 	}
 
-	for box_type != mp4_fourcc('m', 'o', 'o', 'f') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			return tfdt, errors.New("Failed_to_find_moof")
-		}
+	log_debug("moov", "size", moov_box_size)
+	return nil
+}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+func GetMdat(seg_data []byte) error {
+	_, mdat_box_size, err := find_top_level_box(seg_data, mp4_fourcc('m', 'd', 'a', 't'))
+	if err != nil {
+		return err
 	}
 
-	moof_start_offset := bytes_total - bytes_remaining
-	// skip MOOF payload
-	box_size = get_uint32(moof_start_offset + 8, seg_data)
-	box_type = get_uint32(moof_start_offset + 12, seg_data)
-	bytes_remaining -= 8 
+	log_debug("mdat", "size", mdat_box_size)
+	return nil
+}
 
-	for box_type != mp4_fourcc('t', 'r', 'a', 'f') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			return tfdt, errors.New("Failed_to_find_traf")
-		}
+// find_first_tfdt returns the offset and size of the tfdt of the first traf
+// of the first moof.
+func find_first_tfdt(seg_data []byte) (uint32, uint32, error) {
+	err := check_segment_size(seg_data)
+	if err != nil {
+		return 0, 0, err
+	}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+	bytes_total := uint32(len(seg_data))
+	moof_start_offset, moof_box_size, err := find_box(seg_data, 0, bytes_total, "", mp4_fourcc('m', 'o', 'o', 'f'))
+	if err != nil {
+		return 0, 0, err
 	}
 
-	traf_start_offset := bytes_total - bytes_remaining
-	// skip TRAF payload
-	box_size = get_uint32(traf_start_offset + 8, seg_data)
-	box_type = get_uint32(traf_start_offset + 12, seg_data)
-	bytes_remaining -= 8 
+	traf_start_offset, traf_box_size, err := find_box(seg_data, moof_start_offset + 8, moof_start_offset + moof_box_size, "moof", mp4_fourcc('t', 'r', 'a', 'f'))
+	if err != nil {
+		return 0, 0, err
+	}
 
-	for box_type != mp4_fourcc('t', 'f', 'd', 't') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			return tfdt, errors.New("Failed_to_find_tfdt")
-		}
+	tfdt_start_offset, tfdt_box_size, err := find_box(seg_data, traf_start_offset + 8, traf_start_offset + traf_box_size, "moof/traf", mp4_fourcc('t', 'f', 'd', 't'))
+	if err != nil {
+		return 0, 0, err
+	}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+	// version, flags
+	if tfdt_box_size < 12 {
+		return 0, 0, parse_error(ErrTruncated, "incomplete_tfdt", uint64(tfdt_start_offset), "moof/traf/tfdt")
 	}
 
-	tfdt_start_offset := bytes_total - bytes_remaining
-	tfdt_box_size := box_size
+	return tfdt_start_offset, tfdt_box_size, nil
+}
+
+func GetTfdt(seg_data []byte) (Tfdt_box, error) {
+	var tfdt Tfdt_box
+	tfdt_start_offset, tfdt_box_size, err := find_first_tfdt(seg_data)
+	if err != nil {
+		return tfdt, err
+	}
 
 	tfdt.Header.Box_size = tfdt_box_size
+	tfdt.Header.Flag = get_uint32(tfdt_start_offset + 8, seg_data) & 0x00FFFFFF
 	tfdt_version := get_uint8(tfdt_start_offset + 8, seg_data)
 	if tfdt_version == 0 {
-		if (bytes_total - tfdt_start_offset - 12 < 4) {
-			return tfdt, errors.New("incomplete_tfdt_baseMediaDecodeTime")
+		if tfdt_box_size - 12 < 4 {
+			return tfdt, parse_error(ErrTruncated, "incomplete_tfdt_baseMediaDecodeTime", uint64(tfdt_start_offset + 12), "moof/traf/tfdt")
 		}
 
 		tfdt.Header.Version = 0
 		tfdt.BaseMediaDecodeTime_v0 = get_uint32(tfdt_start_offset + 12, seg_data)
 	} else if tfdt_version == 1 {
-		if (bytes_total - tfdt_start_offset - 12 < 8) {
-			return tfdt, errors.New("incomplete_tfdt_baseMediaDecodeTime")
+		if tfdt_box_size - 12 < 8 {
+			return tfdt, parse_error(ErrTruncated, "incomplete_tfdt_baseMediaDecodeTime", uint64(tfdt_start_offset + 12), "moof/traf/tfdt")
 		}
 
 		tfdt.Header.Version = 1
 		tfdt.BaseMediaDecodeTime_v1 = get_uint64(uint64(tfdt_start_offset + 12), seg_data)
+	} else {
+		return tfdt, parse_error(ErrUnsupportedVersion, "unsupported_tfdt_version", uint64(tfdt_start_offset + 8), "moof/traf/tfdt")
 	}
 
 	return tfdt, nil
 }
 
 func SetTfdtUint32(seg_data []byte, baseMediaDecodeTime uint32) error {
-	//seg_data := *segment_data
-	bytes_total := uint32(len(seg_data))
-	bytes_remaining := bytes_total
-	var box_size uint32
-	var box_type uint32
-
-	if bytes_remaining > 8 {
-		box_size = get_uint32(0, seg_data)
-		box_type = get_uint32(4, seg_data)
-	} else {
-		return errors.New("Failed_to_find_tfdt")
+	tfdt_start_offset, tfdt_box_size, err := find_first_tfdt(seg_data)
+	if err != nil {
+		return err
 	}
 
-	for box_type != mp4_fourcc('m', 'o', 'o', 'f') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			return errors.New("Failed_to_find_moof")
+	tfdt_version := get_uint8(tfdt_start_offset + 8, seg_data)
+	if tfdt_version == 0 {
+		if tfdt_box_size - 12 < 4 {
+			return parse_error(ErrTruncated, "incomplete_tfdt_baseMediaDecodeTime", uint64(tfdt_start_offset + 12), "moof/traf/tfdt")
 		}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+		set_uint32(tfdt_start_offset + 12, seg_data, baseMediaDecodeTime)
+	} else if tfdt_version == 1 {
+		return parse_error(ErrUnsupported, "setting_uint64_baseMediaDecodeTime_not_supported", uint64(tfdt_start_offset + 8), "moof/traf/tfdt")
+	} else {
+		return parse_error(ErrUnsupportedVersion, "unsupported_tfdt_version", uint64(tfdt_start_offset + 8), "moof/traf/tfdt")
 	}
 
-	moof_start_offset := bytes_total - bytes_remaining
-	// skip MOOF payload
-	box_size = get_uint32(moof_start_offset + 8, seg_data)
-	box_type = get_uint32(moof_start_offset + 12, seg_data)
-	bytes_remaining -= 8 
-
-	for box_type != mp4_fourcc('t', 'r', 'a', 'f') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			return errors.New("Failed_to_find_traf")
-		}
+	return nil
+}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+// SetTfdtUint64 sets baseMediaDecodeTime of the first tfdt of seg_data in
+// place. A version 0 tfdt only holds 32-bit times.
+func SetTfdtUint64(seg_data []byte, baseMediaDecodeTime uint64) error {
+	tfdt_start_offset, tfdt_box_size, err := find_first_tfdt(seg_data)
+	if err != nil {
+		return err
 	}
 
-	traf_start_offset := bytes_total - bytes_remaining
-	// skip TRAF payload
-	box_size = get_uint32(traf_start_offset + 8, seg_data)
-	box_type = get_uint32(traf_start_offset + 12, seg_data)
-	bytes_remaining -= 8 
+	tfdt_version := get_uint8(tfdt_start_offset + 8, seg_data)
+	if tfdt_version == 0 {
+		if baseMediaDecodeTime > 0xFFFFFFFF {
+			return parse_error(ErrUnsupported, "baseMediaDecodeTime_exceeds_tfdt_version_0", uint64(tfdt_start_offset + 8), "moof/traf/tfdt")
+		}
 
-	for box_type != mp4_fourcc('t', 'f', 'd', 't') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			return errors.New("Failed_to_find_tfdt")
+		return SetTfdtUint32(seg_data, uint32(baseMediaDecodeTime))
+	} else if tfdt_version == 1 {
+		if tfdt_box_size - 12 < 8 {
+			return parse_error(ErrTruncated, "incomplete_tfdt_baseMediaDecodeTime", uint64(tfdt_start_offset + 12), "moof/traf/tfdt")
 		}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+		set_uint64(tfdt_start_offset + 12, seg_data, baseMediaDecodeTime)
+		return nil
 	}
 
-	tfdt_start_offset := bytes_total - bytes_remaining
-	tfdt_version := get_uint8(tfdt_start_offset + 8, seg_data)
-	if tfdt_version == 0 {
-		if (bytes_total - tfdt_start_offset - 12 < 4) {
-			return errors.New("incomplete_tfdt_baseMediaDecodeTime")
-		}
+	return parse_error(ErrUnsupportedVersion, "unsupported_tfdt_version", uint64(tfdt_start_offset + 8), "moof/traf/tfdt")
+}
 
-		set_uint32(tfdt_start_offset + 12, seg_data, baseMediaDecodeTime)
-	} else if tfdt_version == 1 {
-		return errors.New("setting_uint64_baseMediaDecodeTime_not_supported")
+// BaseMediaDecodeTime returns baseMediaDecodeTime regardless of the tfdt version.
+func (tfdt Tfdt_box) BaseMediaDecodeTime() uint64 {
+	if tfdt.Header.Version == 1 {
+		return tfdt.BaseMediaDecodeTime_v1
 	}
 
-	return nil
+	return uint64(tfdt.BaseMediaDecodeTime_v0)
 }
 
-func GetSidx(seg_data []byte) (Sidx_box, error) {
-	var sidx_box Sidx_box
-	bytes_total := uint32(len(seg_data))
-	bytes_remaining := bytes_total
-	var box_size uint32
-	var box_type uint32
+// get_tkhd_track_id returns the track_ID of the tkhd inside the trak box at d[trak_start_offset].
+func get_tkhd_track_id(d []byte, trak_start_offset uint32, trak_box_size uint32) (uint32, error) {
+	tkhd_start_offset, tkhd_box_size, err := find_box(d, trak_start_offset + 8, trak_start_offset + trak_box_size, "moov/trak", mp4_fourcc('t', 'k', 'h', 'd'))
+	if err != nil {
+		return 0, err
+	}
 
-	if bytes_remaining > 8 {
-		box_size = get_uint32(0, seg_data)
-		box_type = get_uint32(4, seg_data)
-	} else {
-		fmt.Println("Error: invalid segment data")
-		return sidx_box, errors.New("Failed_to_find_sidx")
+	if tkhd_box_size < 12 {
+		return 0, parse_error(ErrTruncated, "incomplete_tkhd", uint64(tkhd_start_offset), "moov/trak/tkhd")
 	}
 
-	for box_type != mp4_fourcc('s', 'i', 'd', 'x') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			fmt.Println("SIDX box not found")
-			return sidx_box, errors.New("Failed_to_find_sidx")
-		}
+	// track_ID follows creation_time and modification_time
+	track_id_offset := uint32(20)
+	if get_uint8(tkhd_start_offset + 8, d) == 1 {
+		track_id_offset = 28
+	}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+	if tkhd_box_size < track_id_offset + 4 {
+		return 0, parse_error(ErrTruncated, "incomplete_tkhd", uint64(tkhd_start_offset), "moov/trak/tkhd")
 	}
 
-	sidx_start_offset := bytes_total - bytes_remaining
-	
-	// SIDX fields preceding "timescale":
-	// - 4 bytes box size
-	// - 4 bytes box type
-	// - 1 byte version
-	// - 3 bytes flag
-	// - 4 bytes reference_ID
-	sidx_box.Timescale = get_uint32(sidx_start_offset + 16, seg_data)
-	return sidx_box, nil
+	return get_uint32(tkhd_start_offset + track_id_offset, d), nil
 }
 
-func GetAvc1(seg_data []byte) (Avc1_box, error) {
-	var avc1 Avc1_box
-	bytes_total := uint32(len(seg_data))
-	bytes_remaining := bytes_total
-	var box_size uint32
-	var box_type uint32
+// GetMdhd returns the mdhd box of the track whose tkhd track_ID is track_id,
+// or of the first track if track_id is 0.
+func GetMdhd(seg_data []byte, track_id uint32) (Mdhd_box, error) {
+	var mdhd Mdhd_box
+	err := check_segment_size(seg_data)
+	if err != nil {
+		return mdhd, err
+	}
 
-	if bytes_remaining > 8 {
-		box_size = get_uint32(0, seg_data)
-		box_type = get_uint32(4, seg_data)
-	} else {
-		fmt.Println("Error: invalid segment data")
-		return avc1, errors.New("Failed_to_find_avc1")
+	bytes_total := uint32(len(seg_data))
+	moov_start_offset, moov_box_size, err := find_box(seg_data, 0, bytes_total, "", mp4_fourcc('m', 'o', 'o', 'v'))
+	if err != nil {
+		return mdhd, err
 	}
 
-	for box_type != mp4_fourcc('m', 'o', 'o', 'v') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			fmt.Println("MOOV box not found")
-			return avc1, errors.New("Failed_to_find_moov")
+	moov_end := moov_start_offset + moov_box_size
+	p := moov_start_offset + 8
+	for {
+		trak_start_offset, trak_box_size, err := find_box(seg_data, p, moov_end, "moov", mp4_fourcc('t', 'r', 'a', 'k'))
+		if err != nil {
+			return mdhd, err
 		}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
-	}
+		p = trak_start_offset + trak_box_size
+		if track_id != 0 {
+			trak_track_id, err := get_tkhd_track_id(seg_data, trak_start_offset, trak_box_size)
+			if err != nil {
+				return mdhd, err
+			}
 
-	moov_start_offset := bytes_total - bytes_remaining
-	// skip MOOV payload
-	box_size = get_uint32(moov_start_offset + 8, seg_data)
-	box_type = get_uint32(moov_start_offset + 12, seg_data)
-	bytes_remaining -= 8 
+			if trak_track_id != track_id {
+				continue
+			}
+		}
 
-	for box_type != mp4_fourcc('t', 'r', 'a', 'k') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			fmt.Println("TRAK box not found")
-			return avc1, errors.New("Failed_to_find_trak")
+		mdia_start_offset, mdia_box_size, err := find_box(seg_data, trak_start_offset + 8, p, "moov/trak", mp4_fourcc('m', 'd', 'i', 'a'))
+		if err != nil {
+			return mdhd, err
 		}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
-	}
+		mdhd_start_offset, mdhd_box_size, err := find_box(seg_data, mdia_start_offset + 8, mdia_start_offset + mdia_box_size, "moov/trak/mdia", mp4_fourcc('m', 'd', 'h', 'd'))
+		if err != nil {
+			return mdhd, err
+		}
 
-	// skip TRAK payload
-	trak_start_offset := bytes_total - bytes_remaining
-	box_size = get_uint32(trak_start_offset + 8, seg_data)
-	box_type = get_uint32(trak_start_offset + 12, seg_data)
-	bytes_remaining -= 8 
+		if mdhd_box_size < 12 {
+			return mdhd, parse_error(ErrTruncated, "incomplete_mdhd", uint64(mdhd_start_offset), "moov/trak/mdia/mdhd")
+		}
 
-	for box_type != mp4_fourcc('m', 'd', 'i', 'a') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			fmt.Println("MDIA box not found")
-			return avc1, errors.New("Failed_to_find_mdia")
+		mdhd.Header.Box_size = mdhd_box_size
+		mdhd.Header.Version = get_uint8(mdhd_start_offset + 8, seg_data)
+		mdhd.Header.Flag = get_uint32(mdhd_start_offset + 8, seg_data) & 0x00FFFFFF
+
+		var language_offset uint32
+		if mdhd.Header.Version == 1 {
+			if mdhd_box_size < 44 {
+				return mdhd, parse_error(ErrTruncated, "incomplete_mdhd", uint64(mdhd_start_offset), "moov/trak/mdia/mdhd")
+			}
+
+			mdhd.Timescale = get_uint32(mdhd_start_offset + 28, seg_data)
+			mdhd.Duration = get_uint64(uint64(mdhd_start_offset + 32), seg_data)
+			language_offset = mdhd_start_offset + 40
+		} else {
+			if mdhd_box_size < 32 {
+				return mdhd, parse_error(ErrTruncated, "incomplete_mdhd", uint64(mdhd_start_offset), "moov/trak/mdia/mdhd")
+			}
+
+			mdhd.Timescale = get_uint32(mdhd_start_offset + 20, seg_data)
+			mdhd.Duration = uint64(get_uint32(mdhd_start_offset + 24, seg_data))
+			language_offset = mdhd_start_offset + 28
 		}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+		// ISO-639-2/T language code, three 5-bit characters offset by 0x60
+		language := get_uint16(language_offset, seg_data)
+		mdhd.Language = string([]byte{byte(language >> 10 & 0x1F) + 0x60, byte(language >> 5 & 0x1F) + 0x60, byte(language & 0x1F) + 0x60})
+		return mdhd, nil
 	}
+}
 
-	// skip MDIA payload
-	mdia_start_offset := bytes_total - bytes_remaining
-	box_size = get_uint32(mdia_start_offset + 8, seg_data)
-	box_type = get_uint32(mdia_start_offset + 12, seg_data)
-	bytes_remaining -= 8 
-
-	for box_type != mp4_fourcc('m', 'i', 'n', 'f') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			fmt.Println("MINF box not found")
-			return avc1, errors.New("Failed_to_find_minf")
-		}
+// GetSidx returns the first top-level sidx of the segment, with its
+// references.
+func GetSidx(seg_data []byte) (Sidx_box, error) {
+	sidx_start_offset, sidx_box_size, err := find_top_level_box(seg_data, mp4_fourcc('s', 'i', 'd', 'x'))
+	if err != nil {
+		return Sidx_box{}, err
+	}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+	header_size := uint32(8)
+	if get_uint32(sidx_start_offset, seg_data) == 1 {
+		header_size = 16
 	}
 
-	// skip MINF payload
-	minf_start_offset := bytes_total - bytes_remaining
-	box_size = get_uint32(minf_start_offset + 8, seg_data)
-	box_type = get_uint32(minf_start_offset + 12, seg_data)
-	bytes_remaining -= 8 
+	sidx_box, err := parse_sidx(seg_data[sidx_start_offset + header_size : sidx_start_offset + sidx_box_size])
+	if err != nil {
+		return sidx_box, in_box(err, &Mp4_box{Type: mp4_fourcc('s', 'i', 'd', 'x'), Offset: uint64(sidx_start_offset), Header_size: header_size})
+	}
 
-	for box_type != mp4_fourcc('s', 't', 'b', 'l') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			fmt.Println("STBL box not found")
-			return avc1, errors.New("Failed_to_find_stbl")
-		}
+	sidx_box.Header.Box_size = sidx_box_size
+	return sidx_box, nil
+}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
+// GetAvc1 returns the picture size of the first avc1 sample entry of the moov.
+func GetAvc1(seg_data []byte) (Avc1_box, error) {
+	var avc1 Avc1_box
+	moov_start_offset, moov_box_size, err := find_top_level_box(seg_data, mp4_fourcc('m', 'o', 'o', 'v'))
+	if err != nil {
+		return avc1, err
 	}
 
-	// skip STBL payload
-	stbl_start_offset := bytes_total - bytes_remaining
-	box_size = get_uint32(stbl_start_offset + 8, seg_data)
-	box_type = get_uint32(stbl_start_offset + 12, seg_data)
-	bytes_remaining -= 8 
-
-	for box_type != mp4_fourcc('s', 't', 's', 'd') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			fmt.Println("STSD box not found")
-			return avc1, errors.New("Failed_to_find_stsd")
+	moov_end := moov_start_offset + moov_box_size
+	p := moov_start_offset + 8
+	for {
+		trak_start_offset, trak_box_size, err := find_box(seg_data, p, moov_end, "moov", mp4_fourcc('t', 'r', 'a', 'k'))
+		if err != nil {
+			log_debug("box lookup failed", "error", err)
+			return avc1, err
 		}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
-	}
+		p = trak_start_offset + trak_box_size
+		parent_start, parent_size := trak_start_offset, trak_box_size
+		path := "moov/trak"
+		for _, box_type := range []uint32{mp4_fourcc('m', 'd', 'i', 'a'), mp4_fourcc('m', 'i', 'n', 'f'), mp4_fourcc('s', 't', 'b', 'l'), mp4_fourcc('s', 't', 's', 'd')} {
+			parent_start, parent_size, err = find_box(seg_data, parent_start + 8, parent_start + parent_size, path, box_type)
+			if err != nil {
+				log_debug("box lookup failed", "error", err)
+				return avc1, err
+			}
+
+			path = box_path(path, box_type)
+		}
 
-	// skip STSD payload
-	stsd_start_offset := bytes_total - bytes_remaining
-	box_size = get_uint32(stsd_start_offset + 16, seg_data)
-	box_type = get_uint32(stsd_start_offset + 20, seg_data)
-	bytes_remaining -= 20
+		// stsd: version, flags and entry_count precede the sample entries
+		if parent_size < 16 {
+			return avc1, parse_error(ErrTruncated, "incomplete_stsd", uint64(parent_start), path)
+		}
 
-	for box_type != mp4_fourcc('a', 'v', 'c', '1') { 
-		if (bytes_remaining < box_size + 8 || box_size == 0) {
-			fmt.Println("AVC1 box not found")
-			return avc1, errors.New("Failed_to_find_avc1")
+		avc1_start_offset, avc1_box_size, err := find_box(seg_data, parent_start + 16, parent_start + parent_size, path, mp4_fourcc('a', 'v', 'c', '1'))
+		if err != nil {
+			continue
 		}
 
-		bytes_remaining -= box_size
-		box_size = get_uint32(bytes_total - bytes_remaining, seg_data)
-		box_type = get_uint32(bytes_total - bytes_remaining + 4, seg_data)
-	}
+		log_debug("avc1", "size", avc1_box_size)
 
-	avc1_start_offset := bytes_total - bytes_remaining
-	avc1_box_size := box_size
-	fmt.Println("AVC1 box size = ", avc1_box_size)
+		// SampleEntry (8 bytes) and 16 bytes of VisualSampleEntry fields precede width and height
+		if avc1_box_size < 36 {
+			return avc1, parse_error(ErrTruncated, "incomplete_avc1", uint64(avc1_start_offset), box_path(path, mp4_fourcc('a', 'v', 'c', '1')))
+		}
 
-	avc1.Video_height = get_uint16(avc1_start_offset + 28, seg_data)
-	avc1.Video_width = get_uint16(avc1_start_offset + 30, seg_data)
-	return avc1, nil
-}
\ No newline at end of file
+		avc1.Video_width = get_uint16(avc1_start_offset + 32, seg_data)
+		avc1.Video_height = get_uint16(avc1_start_offset + 34, seg_data)
+		return avc1, nil
+	}
+}
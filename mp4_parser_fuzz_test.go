@@ -0,0 +1,115 @@
+package media_utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The seeds of the fuzz targets of the box level features, beside the code
+// they cover. The unit tests build their own files.
+
+func fuzz_box(box_type string, payload []byte) []byte {
+	d := append_uint32(nil, uint32(8 + len(payload)))
+	d = append(d, box_type...)
+	return append(d, payload...)
+}
+
+// fuzz_segment returns a media segment with a sidx, an emsg, a prft and a
+// moof with a tfdt and a trun referencing the mdat.
+func fuzz_segment() []byte {
+	tfhd := fuzz_box("tfhd", append_uint32(append_uint32(append_uint32(nil, Tfhd_default_base_is_moof | Tfhd_default_sample_duration_present), 1), 1024))
+	tfdt := fuzz_box("tfdt", append_uint64(append_uint32(nil, 0x01000000), 90000))
+	trun := fuzz_box("trun", append_uint32(append_uint32(append_uint32(append_uint32(append_uint32(nil, Trun_data_offset_present | Trun_sample_size_present), 2), 0), 3), 2))
+	traf := fuzz_box("traf", append(append(tfhd, tfdt...), trun...))
+	moof := fuzz_box("moof", append(fuzz_box("mfhd", append_uint32(append_uint32(nil, 0), 1)), traf...))
+	set_uint32(uint32(len(moof) - 12), moof, uint32(len(moof) + 8))
+
+	sidx := append_uint32(nil, 0)
+	sidx = append_uint32(sidx, 1)
+	sidx = append_uint32(sidx, 90000)
+	sidx = append_uint32(sidx, 0)
+	sidx = append_uint32(sidx, 0)
+	sidx = append_uint32(sidx, 1)
+	sidx = append_uint32(sidx, uint32(len(moof) + 13))
+	sidx = append_uint32(sidx, 2048)
+	sidx = append_uint32(sidx, 0x90000000)
+
+	emsg, _ := BuildEmsg(Emsg_box{Scheme_id_uri: "urn:test", Value: "1", Timescale: 90000, Message_data: []byte("hi")})
+	prft := BuildPrft(Prft_box{Reference_track_id: 1, Ntp_timestamp: 1 << 62, Media_time: 90000})
+
+	var seg []byte
+	seg = append(seg, fuzz_box("styp", []byte("msdh\x00\x00\x00\x00msdh"))...)
+	seg = append(seg, fuzz_box("sidx", sidx)...)
+	seg = append(seg, prft...)
+	seg = append(seg, emsg...)
+	seg = append(seg, moof...)
+	return append(seg, fuzz_box("mdat", []byte{1, 2, 3, 4, 5})...)
+}
+
+// fuzz_init returns an init segment with one avc1 video track.
+func fuzz_init() []byte {
+	tkhd := fuzz_box("tkhd", append(append_uint32(append_uint32(append_uint32(append_uint32(nil, 3), 0), 0), 1), make([]byte, 68)...))
+	mdhd := fuzz_box("mdhd", append(append_uint32(append_uint32(append_uint32(append_uint32(nil, 0), 0), 0), 90000), 0, 0, 0, 0, 0x55, 0xc4, 0, 0))
+	hdlr := fuzz_box("hdlr", append(append_uint32(append_uint32(append_uint32(nil, 0), 0), mp4_fourcc('v', 'i', 'd', 'e')), make([]byte, 13)...))
+	avcc := fuzz_box("avcC", []byte{1, 0x64, 0, 0x1f, 0xff, 0xe1, 0, 4, 0x67, 0x64, 0, 0x1f, 1, 0, 2, 0x68, 0xee})
+	visual := make([]byte, 78)
+	visual[7] = 1
+	visual[25] = 0x40
+	visual[27] = 0x20
+	avc1 := fuzz_box("avc1", append(visual, avcc...))
+	stsd := fuzz_box("stsd", append(append_uint32(append_uint32(nil, 0), 1), avc1...))
+	empty_table := append_uint32(append_uint32(nil, 0), 0)
+	stbl := fuzz_box("stbl", bytes.Join([][]byte{stsd, fuzz_box("stts", empty_table), fuzz_box("stsc", empty_table), fuzz_box("stsz", append_uint32(empty_table, 0)), fuzz_box("stco", empty_table)}, nil))
+	minf := fuzz_box("minf", stbl)
+	mdia := fuzz_box("mdia", bytes.Join([][]byte{mdhd, hdlr, minf}, nil))
+	trak := fuzz_box("trak", append(tkhd, mdia...))
+	trex := fuzz_box("trex", append_uint32(append_uint32(append_uint32(append_uint32(append_uint32(append_uint32(nil, 0), 1), 1), 3000), 0), 0))
+	moov := fuzz_box("moov", append(trak, fuzz_box("mvex", trex)...))
+	return append(fuzz_box("ftyp", []byte("isom\x00\x00\x00\x00isom")), moov...)
+}
+
+// FuzzMp4Parser checks that the mp4_parser.go read paths never panic and that
+// SetTfdtUint32 writes what GetTfdt reads.
+func FuzzMp4Parser(f *testing.F) {
+	f.Add(fuzz_segment())
+	f.Add(fuzz_init())
+	f.Add(append(fuzz_init(), fuzz_segment()...))
+	f.Add([]byte{0, 0, 0, 1, 'm', 'o', 'o', 'f', 0, 0, 0, 0, 0, 0, 0, 16})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		GetFtyp(data)
+		GetMoof(data)
+		GetMoov(data)
+		GetMdat(data)
+		GetTfdt(data)
+		GetSidx(data)
+		GetAvc1(data)
+		GetMdhd(data, 0)
+		GetMdhd(data, 1)
+		data = append([]byte(nil), data...)
+		if SetTfdtUint32(data, 1) == nil {
+			tfdt, err := GetTfdt(data)
+			if err != nil || tfdt.BaseMediaDecodeTime_v0 + uint32(tfdt.BaseMediaDecodeTime_v1) != 1 {
+				t.Fatalf("tfdt after SetTfdtUint32: %+v, %v", tfdt, err)
+			}
+		}
+	})
+}
+
+// fuzz_samples returns the tracks of init_data and the samples of both inputs,
+// for the fuzz targets of the sample level features.
+func fuzz_samples(init_data []byte, seg_data []byte) ([]Track_info, []Mp4_sample) {
+	tracks, err := GetTracks(init_data)
+	if err != nil {
+		return nil, nil
+	}
+
+	var samples []Mp4_sample
+	for _, track := range tracks {
+		track.CodecString()
+		s, _ := GetTrackSamples(init_data, track)
+		samples = append(samples, s...)
+	}
+
+	s, _ := GetFragmentSamples(seg_data, tracks)
+	return tracks, append(samples, s...)
+}
@@ -0,0 +1,185 @@
+package media_utils
+
+import (
+	"time"
+)
+
+// prft flags: the moment the ntp_timestamp refers to
+const (
+	Prft_flag_encoder_input = 0x00
+	Prft_flag_encoder_output = 0x01
+	Prft_flag_moof_finalized = 0x02
+	Prft_flag_moof_written = 0x04
+	Prft_flag_arbitrary_consistent = 0x08
+	Prft_flag_captured = 0x18
+)
+
+// Seconds between the NTP epoch (1900) and the Unix epoch (1970)
+const ntp_unix_epoch_offset = 2208988800
+
+type Prft_box struct {
+	Header Box_header
+	Reference_track_id uint32
+	Ntp_timestamp uint64 // 32.32 fixed point seconds since 1900-01-01 UTC
+	Media_time uint64 // 32 bits in version 0
+}
+
+// NtpToTime converts a 64-bit NTP timestamp to time.Time.
+func NtpToTime(ntp uint64) time.Time {
+	seconds := int64(ntp >> 32) - ntp_unix_epoch_offset
+	nanoseconds := int64((ntp & 0xFFFFFFFF) * 1000000000 >> 32)
+	return time.Unix(seconds, nanoseconds).UTC()
+}
+
+// TimeToNtp converts t to a 64-bit NTP timestamp.
+func TimeToNtp(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntp_unix_epoch_offset)
+	fraction := (uint64(t.Nanosecond()) << 32) / 1000000000
+	return seconds << 32 | fraction
+}
+
+// Time returns the wall clock time of the prft ntp_timestamp.
+func (prft Prft_box) Time() time.Time {
+	return NtpToTime(prft.Ntp_timestamp)
+}
+
+// MediaTimeToWallClock maps a media time of the reference track (in timescale
+// units) to wall clock time, using the prft media_time/ntp_timestamp pair.
+func (prft Prft_box) MediaTimeToWallClock(media_time uint64, timescale uint32) time.Time {
+	if timescale == 0 {
+		return prft.Time()
+	}
+
+	delta := int64(media_time) - int64(prft.Media_time)
+	seconds := delta / int64(timescale)
+	remainder := delta % int64(timescale)
+	return prft.Time().Add(time.Duration(seconds) * time.Second + time.Duration(remainder * int64(time.Second) / int64(timescale)))
+}
+
+func parse_prft(d []byte, prft_start_offset uint32, prft_box_size uint32) (Prft_box, error) {
+	var prft Prft_box
+	if prft_box_size < 12 {
+		return prft, parse_error(ErrTruncated, "incomplete_prft", uint64(prft_start_offset), "prft")
+	}
+
+	prft.Header.Box_size = prft_box_size
+	prft.Header.Version = get_uint8(prft_start_offset + 8, d)
+	prft.Header.Flag = get_uint32(prft_start_offset + 8, d) & 0x00FFFFFF
+
+	p := prft_start_offset + 12
+	if prft.Header.Version == 0 {
+		if prft_box_size < 28 {
+			return prft, parse_error(ErrTruncated, "incomplete_prft", uint64(prft_start_offset), "prft")
+		}
+
+		prft.Reference_track_id = get_uint32(p, d)
+		prft.Ntp_timestamp = get_uint64(uint64(p + 4), d)
+		prft.Media_time = uint64(get_uint32(p + 12, d))
+	} else if prft.Header.Version == 1 {
+		if prft_box_size < 32 {
+			return prft, parse_error(ErrTruncated, "incomplete_prft", uint64(prft_start_offset), "prft")
+		}
+
+		prft.Reference_track_id = get_uint32(p, d)
+		prft.Ntp_timestamp = get_uint64(uint64(p + 4), d)
+		prft.Media_time = get_uint64(uint64(p + 12), d)
+	} else {
+		return prft, parse_error(ErrUnsupportedVersion, "unsupported_prft_version", uint64(prft_start_offset + 8), "prft")
+	}
+
+	return prft, nil
+}
+
+// GetPrft returns the first top-level prft box of the segment.
+func GetPrft(seg_data []byte) (Prft_box, error) {
+	prfts, err := GetPrfts(seg_data)
+	if err != nil {
+		return Prft_box{}, err
+	}
+
+	return prfts[0], nil
+}
+
+// GetPrfts returns all top-level prft boxes of the segment, in file order
+// (one per CMAF chunk in low-latency segments).
+func GetPrfts(seg_data []byte) ([]Prft_box, error) {
+	var prfts []Prft_box
+	err := check_segment_size(seg_data)
+	if err != nil {
+		return prfts, err
+	}
+
+	bytes_total := uint32(len(seg_data))
+	p := uint32(0)
+	for p < bytes_total {
+		prft_start_offset, prft_box_size, err := find_box(seg_data, p, bytes_total, "", mp4_fourcc('p', 'r', 'f', 't'))
+		if err != nil {
+			if len(prfts) == 0 {
+				return prfts, err
+			}
+
+			break
+		}
+
+		prft, err := parse_prft(seg_data, prft_start_offset, prft_box_size)
+		if err != nil {
+			return prfts, err
+		}
+
+		prfts = append(prfts, prft)
+		p = prft_start_offset + prft_box_size
+	}
+
+	return prfts, nil
+}
+
+// BuildPrft serializes a prft box. Version 0 is used when Header.Version is 0
+// and Media_time fits in 32 bits, version 1 otherwise.
+func BuildPrft(prft Prft_box) []byte {
+	version := prft.Header.Version
+	if prft.Media_time > 0xFFFFFFFF {
+		version = 1
+	}
+
+	box_size := uint32(28)
+	if version == 1 {
+		box_size = 32
+	}
+
+	box := make([]byte, 0, box_size)
+	box = append_uint32(box, box_size)
+	box = append_uint32(box, mp4_fourcc('p', 'r', 'f', 't'))
+	box = append_uint32(box, uint32(version) << 24 | prft.Header.Flag & 0x00FFFFFF)
+	box = append_uint32(box, prft.Reference_track_id)
+	box = append_uint64(box, prft.Ntp_timestamp)
+	if version == 1 {
+		box = append_uint64(box, prft.Media_time)
+	} else {
+		box = append_uint32(box, uint32(prft.Media_time))
+	}
+
+	return box
+}
+
+// InsertPrft returns a copy of the media segment with the prft box inserted
+// ahead of the first moof, before any emsg boxes.
+func InsertPrft(seg_data []byte, prft Prft_box) ([]byte, error) {
+	err := check_segment_size(seg_data)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes_total := uint32(len(seg_data))
+	moof_start_offset, _, err := find_box(seg_data, 0, bytes_total, "", mp4_fourcc('m', 'o', 'o', 'f'))
+	if err != nil {
+		return nil, err
+	}
+
+	pos := moof_start_offset
+	emsg_start_offset, _, err := find_box(seg_data, 0, moof_start_offset, "", mp4_fourcc('e', 'm', 's', 'g'))
+	if err == nil {
+		pos = emsg_start_offset
+	}
+
+	return insert_top_level_box(seg_data, pos, BuildPrft(prft))
+}
@@ -0,0 +1,37 @@
+package media_utils
+
+import (
+	"errors"
+	"testing"
+)
+
+// FuzzPrft checks that an inserted prft is read back.
+func FuzzPrft(f *testing.F) {
+	f.Add(fuzz_segment())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// The prfts already present must be valid
+		if _, err := GetPrfts(data); err != nil && !errors.Is(err, ErrBoxNotFound) {
+			return
+		}
+
+		inserted := Prft_box{Reference_track_id: 7, Ntp_timestamp: 1 << 62, Media_time: 1 << 33}
+		out, err := InsertPrft(data, inserted)
+		if err != nil {
+			return
+		}
+
+		prfts, err := GetPrfts(out)
+		if err != nil {
+			t.Fatalf("prfts of the output: %v", err)
+		}
+
+		found := false
+		for _, prft := range prfts {
+			found = found || (prft.Reference_track_id == 7 && prft.Ntp_timestamp == inserted.Ntp_timestamp && prft.Media_time == inserted.Media_time)
+		}
+
+		if !found {
+			t.Fatalf("inserted prft not read back: %+v", prfts)
+		}
+	})
+}
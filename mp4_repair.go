@@ -0,0 +1,498 @@
+package media_utils
+
+import (
+	"fmt"
+)
+
+// Repair issue kinds
+const (
+	Repair_trailing_garbage = "trailing_garbage" // bytes that do not start a box, dropped
+	Repair_incomplete_box = "incomplete_box" // a box running past the end of the data, dropped
+	Repair_truncated_mdat = "truncated_mdat" // an mdat running past the end of the data, resized
+	Repair_samples_trimmed = "samples_trimmed" // trun samples whose data is missing, removed
+	Repair_fragment_dropped = "fragment_dropped" // a moof and its mdat left without samples
+	Repair_sidx_dropped = "sidx_dropped" // a sidx no longer matching the repaired segment
+)
+
+// Repair_issue is a defect found by RepairSegment and what was lost fixing it.
+type Repair_issue struct {
+	Kind string
+	Offset uint64 // in the input
+	Path string
+	Track_id uint32
+	Lost_samples int // -1 if unknown
+	Lost_bytes uint64 // input bytes not carried to the output
+	Lost_start int64 // decode time of the first lost sample in the track timescale, -1 if unknown
+	Lost_duration uint64 // in the track timescale
+	Message string
+}
+
+func (issue Repair_issue) String() string {
+	s := fmt.Sprintf("%s at offset %d", issue.Kind, issue.Offset)
+	if issue.Path != "" {
+		s += " " + issue.Path
+	}
+
+	if issue.Track_id != 0 {
+		s += fmt.Sprintf(" track %d", issue.Track_id)
+	}
+
+	if issue.Lost_samples < 0 {
+		s += ", unknown number of samples lost"
+	} else if issue.Lost_samples > 0 {
+		s += fmt.Sprintf(", %d samples lost", issue.Lost_samples)
+		if issue.Lost_start >= 0 {
+			s += fmt.Sprintf(" from %d for %d ticks", issue.Lost_start, issue.Lost_duration)
+		}
+	}
+
+	if issue.Lost_bytes > 0 {
+		s += fmt.Sprintf(", %d bytes dropped", issue.Lost_bytes)
+	}
+
+	if issue.Message != "" {
+		s += ": " + issue.Message
+	}
+
+	return s
+}
+
+// Repair_report lists what RepairSegment fixed. A segment without issues is
+// returned unchanged.
+type Repair_report struct {
+	Input_size uint64
+	Output_size uint64
+	Lost_samples int // -1 if an issue lost an unknown number of samples
+	Issues []Repair_issue
+}
+
+// add_lost_samples counts the samples lost by an issue in the report total.
+func (report *Repair_report) add_lost_samples(lost int) {
+	if lost < 0 || report.Lost_samples < 0 {
+		report.Lost_samples = -1
+	} else {
+		report.Lost_samples += lost
+	}
+}
+
+// valid_box_type tells whether a box type is made of printable characters
+// (or ©), to tell a box header from garbage.
+func valid_box_type(box_type uint32) bool {
+	for shift := 0; shift < 32; shift += 8 {
+		c := byte(box_type >> shift)
+		if (c < 0x20 || c > 0x7E) && c != 0xA9 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// partial_moof_samples counts the samples of a moof of moof_size bytes cut
+// at the end of d, from the sample_count of its truns. The count is exact if
+// no trun or traf header falls past the cut.
+func partial_moof_samples(d []byte, header_size uint64, moof_size uint64) (int, bool) {
+	count := 0
+	end := uint64(len(d))
+	for p := header_size; p < moof_size; {
+		if end - min(p, end) < 8 {
+			return count, false
+		}
+
+		box_size := uint64(get_uint32(0, d[p:]))
+		if box_size < 8 {
+			return count, false
+		}
+
+		if get_uint32(4, d[p:]) == mp4_fourcc('t', 'r', 'a', 'f') {
+			for q := p + 8; q < p + box_size; {
+				if end - min(q, end) < 8 {
+					return count, false
+				}
+
+				child_size := uint64(get_uint32(0, d[q:]))
+				if child_size < 8 {
+					return count, false
+				}
+
+				if get_uint32(4, d[q:]) == mp4_fourcc('t', 'r', 'u', 'n') {
+					// version, flags and sample_count
+					if end - q < 16 {
+						return count, false
+					}
+
+					count += int(get_uint32(12, d[q:]))
+				}
+
+				q += child_size
+			}
+		}
+
+		p += box_size
+	}
+
+	return count, true
+}
+
+// repair_top_level returns data without the garbage and incomplete boxes at
+// its end, with the size of a last mdat running past the end fixed, and the
+// index of the truncated_mdat issue or -1.
+func repair_top_level(data []byte, report *Repair_report) ([]byte, int) {
+	end := uint64(len(data))
+	previous_type := uint32(0)
+	for p := uint64(0); p < end; {
+		if end - p < 8 {
+			// A box header cut short: the mdat of a preceding moof, whose
+			// samples are counted with it, or a box of unknown content
+			lost := -1
+			if previous_type == mp4_fourcc('m', 'o', 'o', 'f') {
+				lost = 0
+			}
+
+			report.Issues = append(report.Issues, Repair_issue{Kind: Repair_trailing_garbage, Offset: p, Lost_samples: lost, Lost_bytes: end - p, Lost_start: -1, Message: "incomplete_box_header"})
+			report.add_lost_samples(lost)
+			return data[:p], -1
+		}
+
+		if !valid_box_type(get_uint32(4, data[p:])) {
+			report.Issues = append(report.Issues, Repair_issue{Kind: Repair_trailing_garbage, Offset: p, Lost_bytes: end - p, Lost_start: -1})
+			return data[:p], -1
+		}
+
+		box_type := get_uint32(4, data[p:])
+		box_size := uint64(get_uint32(0, data[p:]))
+		header_size := uint64(8)
+		if box_size == 1 {
+			if end - p < 16 {
+				lost := 0
+				if box_type == mp4_fourcc('m', 'o', 'o', 'f') {
+					lost = -1
+				}
+
+				report.Issues = append(report.Issues, Repair_issue{Kind: Repair_incomplete_box, Offset: p, Path: fourcc_string(box_type), Lost_samples: lost, Lost_bytes: end - p, Lost_start: -1, Message: "incomplete_box_header"})
+				report.add_lost_samples(lost)
+				return data[:p], -1
+			}
+
+			box_size = get_uint64(p + 8, data)
+			header_size = 16
+		} else if box_size == 0 {
+			box_size = end - p
+		}
+
+		if box_size < header_size {
+			report.Issues = append(report.Issues, Repair_issue{Kind: Repair_trailing_garbage, Offset: p, Lost_bytes: end - p, Lost_start: -1, Message: "invalid_box_size"})
+			return data[:p], -1
+		}
+
+		if box_size > end - p {
+			if box_type != mp4_fourcc('m', 'd', 'a', 't') {
+				issue := Repair_issue{Kind: Repair_incomplete_box, Offset: p, Path: fourcc_string(box_type), Lost_bytes: end - p, Lost_start: -1, Message: fmt.Sprintf("%d of %d bytes", end - p, box_size)}
+				if box_type == mp4_fourcc('m', 'o', 'o', 'f') {
+					// The samples of the truns whose header made it
+					count, exact := partial_moof_samples(data[p:], header_size, box_size)
+					issue.Lost_samples = count
+					if !exact {
+						issue.Lost_samples = -1
+						if count > 0 {
+							issue.Message += fmt.Sprintf(", at least %d samples", count)
+						}
+					}
+				}
+
+				report.Issues = append(report.Issues, issue)
+				report.add_lost_samples(issue.Lost_samples)
+				return data[:p], -1
+			}
+
+			fixed := append([]byte(nil), data...)
+			if header_size == 16 {
+				set_uint64(uint32(p + 8), fixed, end - p)
+			} else {
+				set_uint32(uint32(p), fixed, uint32(end - p))
+			}
+
+			report.Issues = append(report.Issues, Repair_issue{Kind: Repair_truncated_mdat, Offset: p, Path: "mdat", Lost_start: -1, Message: fmt.Sprintf("%d of %d bytes", end - p, box_size)})
+			return fixed, len(report.Issues) - 1
+		}
+
+		previous_type = box_type
+		p += box_size
+	}
+
+	return data, -1
+}
+
+// repair_relocation is a box holding a data offset to update once the boxes
+// have moved: a trun data_offset relative to the moof, or a tfhd base_data_offset.
+type repair_relocation struct {
+	moof *Mp4_box
+	mdat *Mp4_box
+	box *Mp4_box
+}
+
+// moof_encrypted tells whether a moof holds sample auxiliary information
+// (senc, saiz, saio), whose sample counts and offsets RepairSegment does not update.
+func moof_encrypted(moof *Mp4_box) bool {
+	return moof.Find("traf/senc") != nil || moof.Find("traf/saiz") != nil || moof.Find("traf/saio") != nil
+}
+
+// repair_moof removes the trun samples whose data does not end before
+// data_end, and the truns and trafs left empty. It returns the data offsets
+// to update and the end of the data of the samples kept.
+func repair_moof(moof *Mp4_box, mdat *Mp4_box, data_end uint64, tracks []Track_info, report *Repair_report) ([]repair_relocation, uint64, error) {
+	var relocations []repair_relocation
+	kept_end := uint64(0)
+	trimmed := false
+	next_base := moof.Offset
+	for _, traf := range moof.ChildrenOfType(mp4_fourcc('t', 'r', 'a', 'f')) {
+		tfhd_box := traf.Child(mp4_fourcc('t', 'f', 'h', 'd'))
+		if tfhd_box == nil {
+			return nil, 0, box_not_found(traf, "tfhd")
+		}
+
+		tfhd, err := parse_tfhd(tfhd_box.Payload)
+		if err != nil {
+			return nil, 0, in_box(err, tfhd_box)
+		}
+
+		track, _ := FindTrack(tracks, tfhd.Track_id, "")
+		default_size := track.Default_sample_size
+		if tfhd.Header.Flag & Tfhd_default_sample_size_present != 0 {
+			default_size = tfhd.Default_sample_size
+		}
+
+		default_duration := track.Default_sample_duration
+		if tfhd.Header.Flag & Tfhd_default_sample_duration_present != 0 {
+			default_duration = tfhd.Default_sample_duration
+		}
+
+		base := next_base
+		moof_relative := true
+		if tfhd.Header.Flag & Tfhd_base_data_offset_present != 0 {
+			base = tfhd.Base_data_offset
+			moof_relative = false
+			relocations = append(relocations, repair_relocation{moof, mdat, tfhd_box})
+		} else if tfhd.Header.Flag & Tfhd_default_base_is_moof != 0 {
+			base = moof.Offset
+		}
+
+		dts := int64(-1)
+		if tfdt_box := traf.Child(mp4_fourcc('t', 'f', 'd', 't')); tfdt_box != nil {
+			if tfdt, err := parse_tfdt(tfdt_box.Payload); err == nil {
+				dts = int64(tfdt)
+			}
+		}
+
+		next := base
+		for _, trun_box := range traf.ChildrenOfType(mp4_fourcc('t', 'r', 'u', 'n')) {
+			trun, err := parse_trun(trun_box.Payload)
+			if err != nil {
+				return nil, 0, in_box(err, trun_box)
+			}
+
+			start := next
+			if trun.Header.Flag & Trun_data_offset_present != 0 {
+				start = uint64(int64(base) + int64(trun.Data_offset))
+				if moof_relative {
+					relocations = append(relocations, repair_relocation{moof, mdat, trun_box})
+				}
+			}
+
+			kept := 0
+			p := start
+			lost_duration := uint64(0)
+			for i, s := range trun.Samples {
+				size, duration := default_size, default_duration
+				if trun.Header.Flag & Trun_sample_size_present != 0 {
+					size = s.Size
+				}
+
+				if trun.Header.Flag & Trun_sample_duration_present != 0 {
+					duration = s.Duration
+				}
+
+				if kept == i && p + uint64(size) <= data_end {
+					kept++
+					if dts >= 0 {
+						dts += int64(duration)
+					}
+				} else {
+					lost_duration += uint64(duration)
+				}
+
+				p += uint64(size)
+			}
+
+			next = p
+			if kept > 0 {
+				kept_end = max(kept_end, start)
+				for _, s := range trun.Samples[:kept] {
+					if trun.Header.Flag & Trun_sample_size_present != 0 {
+						kept_end += uint64(s.Size)
+					} else {
+						kept_end += uint64(default_size)
+					}
+				}
+			}
+
+			if kept == len(trun.Samples) {
+				continue
+			}
+
+			trimmed = true
+			lost := len(trun.Samples) - kept
+			report.add_lost_samples(lost)
+			report.Issues = append(report.Issues, Repair_issue{Kind: Repair_samples_trimmed, Offset: trun_box.Offset, Path: trun_box.Path(), Track_id: tfhd.Track_id, Lost_samples: lost, Lost_start: dts, Lost_duration: lost_duration, Message: fmt.Sprintf("%d of %d samples kept", kept, len(trun.Samples))})
+			if kept == 0 {
+				traf.RemoveChild(trun_box)
+				continue
+			}
+
+			header_size := uint32(8)
+			if trun.Header.Flag & Trun_data_offset_present != 0 {
+				header_size += 4
+			}
+
+			if trun.Header.Flag & Trun_first_sample_flags_present != 0 {
+				header_size += 4
+			}
+
+			payload := append([]byte(nil), trun_box.Payload[:header_size + uint32(kept) * trun_sample_record_size(trun.Header.Flag)]...)
+			set_uint32(4, payload, uint32(kept))
+			trun_box.Payload = payload
+		}
+
+		next_base = next
+		if traf.Child(mp4_fourcc('t', 'r', 'u', 'n')) == nil {
+			moof.RemoveChild(traf)
+		}
+	}
+
+	// A fragment dropped as a whole takes its auxiliary information along
+	if trimmed && moof.Child(mp4_fourcc('t', 'r', 'a', 'f')) != nil && moof_encrypted(moof) {
+		return nil, 0, box_error(ErrUnsupported, "encrypted_track_not_supported", moof)
+	}
+
+	return relocations, kept_end, nil
+}
+
+// RepairSegment repairs a truncated or corrupted fragmented MP4 segment:
+// garbage and boxes running past the end of the data are dropped, a last
+// mdat running past the end is resized to the samples fully present, the
+// trun samples whose data is missing are removed, along with the moof and
+// mdat left without samples, and the data offsets are updated to the new
+// box sizes. tracks supplies the trex default sample sizes and durations.
+// The samples of a moof cut short are counted from the truns whose header
+// is present, or reported as an unknown loss (-1); fragments entirely past
+// the end of the data leave no trace and are not counted. Encrypted
+// fragments (with senc, saiz or saio) can only be kept whole or dropped: one
+// needing its samples trimmed gives encrypted_track_not_supported.
+func RepairSegment(data []byte, tracks []Track_info) ([]byte, Repair_report, error) {
+	report := Repair_report{Input_size: uint64(len(data))}
+	fixed, mdat_issue := repair_top_level(data, &report)
+	boxes, err := ParseBoxes(fixed)
+	if err != nil {
+		return nil, report, err
+	}
+
+	var kept []*Mp4_box
+	var relocations []repair_relocation
+	for i := 0; i < len(boxes); i++ {
+		moof := boxes[i]
+		if moof.Type != mp4_fourcc('m', 'o', 'o', 'f') {
+			kept = append(kept, moof)
+			continue
+		}
+
+		var mdat *Mp4_box
+		data_end := uint64(0)
+		if i + 1 < len(boxes) && boxes[i + 1].Type == mp4_fourcc('m', 'd', 'a', 't') {
+			mdat = boxes[i + 1]
+			data_end = mdat.Offset + mdat.Size
+			i++
+		}
+
+		moof_relocations, kept_end, err := repair_moof(moof, mdat, data_end, tracks, &report)
+		if err != nil {
+			return nil, report, err
+		}
+
+		if moof.Child(mp4_fourcc('t', 'r', 'a', 'f')) == nil {
+			dropped := moof.Size
+			if mdat != nil {
+				dropped += mdat.Size
+			}
+
+			report.Issues = append(report.Issues, Repair_issue{Kind: Repair_fragment_dropped, Offset: moof.Offset, Path: "moof", Lost_bytes: dropped, Lost_start: -1})
+			continue
+		}
+
+		if mdat != nil && mdat_issue >= 0 && data_end == uint64(len(fixed)) && kept_end < data_end {
+			// The partial samples at the end of the truncated mdat
+			data_start := mdat.Offset + uint64(mdat.Header_size)
+			mdat.Payload = mdat.Payload[:max(kept_end, data_start) - data_start]
+			report.Issues[mdat_issue].Lost_bytes += data_end - max(kept_end, data_start)
+		}
+
+		kept = append(kept, moof)
+		if mdat != nil {
+			kept = append(kept, mdat)
+		}
+
+		relocations = append(relocations, moof_relocations...)
+	}
+
+	if len(report.Issues) == 0 {
+		report.Output_size = report.Input_size
+		return data, report, nil
+	}
+
+	// The sidx references no longer match the repaired segment
+	boxes = kept
+	kept = nil
+	for _, box := range boxes {
+		if box.Type == mp4_fourcc('s', 'i', 'd', 'x') {
+			report.Issues = append(report.Issues, Repair_issue{Kind: Repair_sidx_dropped, Offset: box.Offset, Path: "sidx", Lost_bytes: box.Size, Lost_start: -1})
+			continue
+		}
+
+		kept = append(kept, box)
+	}
+
+	offsets := make(map[*Mp4_box]uint64)
+	offset := uint64(0)
+	for _, box := range kept {
+		offsets[box] = offset
+		offset += box.EncodedSize()
+	}
+
+	for _, r := range relocations {
+		if r.mdat == nil {
+			continue
+		}
+
+		// How far the moof and the data of the mdat moved
+		moof_delta := int64(offsets[r.moof]) - int64(r.moof.Offset)
+		new_data_start := offsets[r.mdat] + r.mdat.EncodedSize() - uint64(len(r.mdat.Payload))
+		data_delta := int64(new_data_start) - int64(r.mdat.Offset + uint64(r.mdat.Header_size))
+		payload := append([]byte(nil), r.box.Payload...)
+		if r.box.Type == mp4_fourcc('t', 'f', 'h', 'd') {
+			// saio offsets are relative to base_data_offset, which moves
+			// with the data rather than with the senc in the moof
+			if r.box.Parent.Child(mp4_fourcc('s', 'a', 'i', 'o')) != nil && data_delta != moof_delta {
+				return nil, report, box_error(ErrUnsupported, "encrypted_track_not_supported", r.box.Parent)
+			}
+
+			set_uint64(8, payload, uint64(int64(get_uint64(8, payload)) + data_delta))
+		} else {
+			set_uint32(8, payload, uint32(int32(get_uint32(8, payload)) + int32(data_delta - moof_delta)))
+		}
+
+		r.box.Payload = payload
+	}
+
+	out := SerializeBoxes(kept)
+	report.Output_size = uint64(len(out))
+	return out, report, nil
+}
@@ -0,0 +1,141 @@
+package media_utils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// mux_test_chunked_segment returns the tracks and a media segment of the
+// mux_test_tracks made of 250 ms chunks.
+func mux_test_chunked_segment(t *testing.T) ([]Track_info, []byte) {
+	tracks, seg := mux_test_segment(t)
+	parts, err := SplitSegment(seg, tracks, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chunked []byte
+	for _, part := range parts {
+		chunked = append(chunked, part.Data...)
+	}
+
+	return tracks, chunked
+}
+
+// TestRepairLostSamples cuts a segment at every byte past its first moof: a
+// cut inside a box always loses samples, which must not be reported as 0.
+func TestRepairLostSamples(t *testing.T) {
+	tracks, seg := mux_test_chunked_segment(t)
+	boxes, err := ParseBoxes(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boundaries := make(map[int]bool)
+	for _, box := range boxes {
+		boundaries[int(box.Offset)] = true
+	}
+
+	first_moof := FindBox(boxes, "moof")
+	for n := int(first_moof.Offset) + 1; n < len(seg); n++ {
+		if boundaries[n] {
+			continue
+		}
+
+		_, report, err := RepairSegment(seg[:n], tracks)
+		if err != nil {
+			t.Fatalf("cut at %d: %v", n, err)
+		}
+
+		if report.Lost_samples == 0 {
+			t.Fatalf("cut at %d: no samples lost: %+v", n, report.Issues)
+		}
+	}
+}
+
+// TestRepairPartialMoof cuts the last moof after the header of its last
+// trun: its samples are counted exactly.
+func TestRepairPartialMoof(t *testing.T) {
+	tracks, seg := mux_test_chunked_segment(t)
+	boxes, err := ParseBoxes(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moofs := FindBoxes(boxes, "moof")
+	moof := moofs[len(moofs) - 1]
+	count := 0
+	for _, trun := range moof.FindAll("traf/trun") {
+		count += int(get_uint32(4, trun.Payload))
+	}
+
+	_, report, err := RepairSegment(seg[:moof.Offset + moof.Size - 1], tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Lost_samples != count || len(report.Issues) != 1 || report.Issues[0].Kind != Repair_incomplete_box {
+		t.Errorf("%d samples lost, want %d: %+v", report.Lost_samples, count, report.Issues)
+	}
+}
+
+// TestRepairEncrypted cuts the mdat of a fragment with a senc: its samples
+// cannot be trimmed without the auxiliary information.
+func TestRepairEncrypted(t *testing.T) {
+	tracks, seg := mux_test_chunked_segment(t)
+	boxes, err := ParseBoxes(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moofs := FindBoxes(boxes, "moof")
+	moof := moofs[len(moofs) - 1]
+	senc := NewFullBox(mp4_fourcc('s', 'e', 'n', 'c'), 0, 0, append_uint32(nil, 0))
+	moof.Children[1].AddChild(senc)
+	for _, trun := range moof.FindAll("traf/trun") {
+		trun.Payload = append([]byte(nil), trun.Payload...)
+		set_uint32(8, trun.Payload, get_uint32(8, trun.Payload) + uint32(senc.EncodedSize()))
+	}
+
+	seg = SerializeBoxes(boxes)
+	_, _, err = RepairSegment(seg[:len(seg) - 1], tracks)
+	if !errors.Is(err, ErrUnsupported) || !strings.HasPrefix(err.Error(), "encrypted_track_not_supported") {
+		t.Errorf("encrypted fragment trimmed: %v", err)
+	}
+
+	// Dropped as a whole
+	_, report, err := RepairSegment(seg[:moof.Offset + 20], tracks)
+	if err != nil || len(report.Issues) != 1 {
+		t.Errorf("encrypted fragment dropped: %v, %+v", err, report.Issues)
+	}
+}
+
+// FuzzRepairSegment checks that a repaired segment parses, but for tracks
+// missing from the init segment, and is left as is by a second repair.
+func FuzzRepairSegment(f *testing.F) {
+	seg := fuzz_segment()
+	f.Add(fuzz_init(), seg)
+	f.Add(fuzz_init(), seg[:len(seg) - 3])
+	f.Fuzz(func(t *testing.T, init_data []byte, seg_data []byte) {
+		tracks, err := GetTracks(init_data)
+		if err != nil {
+			return
+		}
+
+		repaired, _, err := RepairSegment(seg_data, tracks)
+		if err != nil {
+			return
+		}
+
+		if _, err := GetFragmentSamples(repaired, tracks); err != nil && !errors.Is(err, ErrBoxNotFound) && !errors.Is(err, ErrUnsupported) {
+			t.Fatalf("repaired segment: %v", err)
+		}
+
+		again, report, err := RepairSegment(repaired, tracks)
+		if err != nil || !bytes.Equal(again, repaired) {
+			t.Fatalf("second repair: %+v %v", report, err)
+		}
+	})
+}
@@ -0,0 +1,1099 @@
+package media_utils
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Track_rewrite describes the change of one track. Zero New_track_id or
+// New_timescale keeps the original value.
+type Track_rewrite struct {
+	Track_id uint32
+	New_track_id uint32
+	New_timescale uint32
+}
+
+type track_rewrite_state struct {
+	new_track_id uint32
+	timescale uint32
+	new_timescale uint32
+	trex_default_sample_duration uint32
+}
+
+// Track_rewriter changes track_IDs and media timescales consistently across an
+// init segment (or progressive file) and its media segments. Timestamps are
+// rescaled as absolute decode/presentation times and the durations derived from
+// them, so rounding never accumulates across samples or segments.
+type Track_rewriter struct {
+	tracks map[uint32]*track_rewrite_state
+}
+
+// scale_time rescales t from timescale from to timescale to, rounding to nearest.
+func scale_time(t uint64, from uint32, to uint32) uint64 {
+	if from == to || from == 0 {
+		return t
+	}
+
+	hi, lo := bits.Mul64(t, uint64(to))
+	lo, carry := bits.Add64(lo, uint64(from / 2), 0)
+	hi += carry
+	if hi >= uint64(from) {
+		return math.MaxUint64
+	}
+
+	q, _ := bits.Div64(hi, lo, uint64(from))
+	return q
+}
+
+func scale_signed_time(t int64, from uint32, to uint32) int64 {
+	if t < 0 {
+		return -int64(scale_time(uint64(-t), from, to))
+	}
+
+	return int64(scale_time(uint64(t), from, to))
+}
+
+func (s *track_rewrite_state) scale(t uint64) uint64 {
+	return scale_time(t, s.timescale, s.new_timescale)
+}
+
+func (s *track_rewrite_state) rescaled() bool {
+	return s.timescale != s.new_timescale
+}
+
+// rescale_durations rescales consecutive durations starting at decode time dts.
+func (s *track_rewrite_state) rescale_durations(dts uint64, durations []uint64) []uint64 {
+	scaled := make([]uint64, len(durations))
+	for i, d := range durations {
+		scaled[i] = s.scale(dts + d) - s.scale(dts)
+		dts += d
+	}
+
+	return scaled
+}
+
+func tkhd_track_id_offset(payload []byte) (uint32, error) {
+	offset := uint32(12)
+	if len(payload) > 0 && payload[0] == 1 {
+		offset = 20
+	}
+
+	if uint32(len(payload)) < offset + 4 {
+		return 0, parse_error(ErrTruncated, "incomplete_tkhd", 0, "")
+	}
+
+	return offset, nil
+}
+
+// NewTrackRewriter reads the tracks, timescales and trex defaults of an init
+// segment or progressive file. Tracks without a Track_rewrite are left as they are.
+func NewTrackRewriter(init_data []byte, rewrites []Track_rewrite) (*Track_rewriter, error) {
+	boxes, err := ParseBoxes(init_data)
+	if err != nil {
+		return nil, err
+	}
+
+	moov := FindBox(boxes, "moov")
+	if moov == nil {
+		return nil, box_not_found(nil, "moov")
+	}
+
+	tr := &Track_rewriter{tracks: make(map[uint32]*track_rewrite_state)}
+	for _, trak := range moov.ChildrenOfType(mp4_fourcc('t', 'r', 'a', 'k')) {
+		tkhd := trak.Child(mp4_fourcc('t', 'k', 'h', 'd'))
+		if tkhd == nil {
+			return nil, box_not_found(trak, "tkhd")
+		}
+
+		id_offset, err := tkhd_track_id_offset(tkhd.Payload)
+		if err != nil {
+			return nil, in_box(err, tkhd)
+		}
+
+		mdhd := trak.Find("mdia/mdhd")
+		if mdhd == nil {
+			return nil, box_not_found(trak, "mdia/mdhd")
+		}
+
+		timescale_offset := uint32(12)
+		if mdhd.Version() == 1 {
+			timescale_offset = 20
+		}
+
+		if uint32(len(mdhd.Payload)) < timescale_offset + 4 {
+			return nil, incomplete_box(mdhd)
+		}
+
+		track_id := get_uint32(id_offset, tkhd.Payload)
+		timescale := get_uint32(timescale_offset, mdhd.Payload)
+		tr.tracks[track_id] = &track_rewrite_state{new_track_id: track_id, timescale: timescale, new_timescale: timescale}
+	}
+
+	for _, trex := range moov.FindAll("mvex/trex") {
+		if len(trex.Payload) < 16 {
+			return nil, incomplete_box(trex)
+		}
+
+		if s, ok := tr.tracks[get_uint32(4, trex.Payload)]; ok {
+			s.trex_default_sample_duration = get_uint32(12, trex.Payload)
+		}
+	}
+
+	for _, rw := range rewrites {
+		s, ok := tr.tracks[rw.Track_id]
+		if !ok {
+			return nil, parse_error(ErrBoxNotFound, "Failed_to_find_track", moov.Offset, moov.Path() + "/trak")
+		}
+
+		if rw.New_track_id != 0 {
+			s.new_track_id = rw.New_track_id
+		}
+
+		if rw.New_timescale != 0 {
+			s.new_timescale = rw.New_timescale
+		}
+	}
+
+	new_ids := make(map[uint32]bool)
+	for _, s := range tr.tracks {
+		if new_ids[s.new_track_id] {
+			return nil, errors.New("duplicate_track_id")
+		}
+
+		new_ids[s.new_track_id] = true
+	}
+
+	return tr, nil
+}
+
+func (tr *Track_rewriter) map_track_id(track_id uint32) uint32 {
+	if s, ok := tr.tracks[track_id]; ok {
+		return s.new_track_id
+	}
+
+	return track_id
+}
+
+// Bookkeeping of fields that point at file offsets, fixed once the new
+// layout is known
+type rewrite_offset_fixups struct {
+	truns []trun_offset_fixup
+	sidxs []sidx_offset_fixup
+	chunk_offsets []*Mp4_box
+	tfras []*Mp4_box
+	saios []saio_offset_fixup
+}
+
+type saio_offset_fixup struct {
+	moof *Mp4_box
+	saio *Mp4_box
+	senc *Mp4_box
+	entry_offset uint32
+}
+
+type trun_offset_fixup struct {
+	moof *Mp4_box
+	tfhd_box *Mp4_box
+	tfhd Tfhd_box
+	trun_box *Mp4_box
+	trun Trun_box
+	moof_relative bool
+}
+
+type sidx_offset_fixup struct {
+	box *Mp4_box
+	sidx Sidx_box
+	old_end uint64
+}
+
+// Rewrite applies the track_ID and timescale changes to an init segment,
+// media segment(s) or progressive file and returns the rewritten data.
+// It changes track_ID in tkhd, tref, trex, trep, tfhd, sidx, prft and tfra,
+// and rescales mdhd, elst, stts, ctts, trex, tfhd, tfdt, trun, sidx, prft and
+// tfra timing. trun data_offset, sidx referenced_size, tfra moof_offset,
+// saio and stco/co64 offsets follow boxes that change size.
+func (tr *Track_rewriter) Rewrite(data []byte) ([]byte, error) {
+	boxes, err := ParseBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixups rewrite_offset_fixups
+	for _, box := range boxes {
+		switch box.Type {
+		case mp4_fourcc('m', 'o', 'o', 'v'):
+			err = tr.rewrite_moov(box, &fixups)
+		case mp4_fourcc('m', 'o', 'o', 'f'):
+			err = tr.rewrite_moof(box, &fixups)
+		case mp4_fourcc('s', 'i', 'd', 'x'):
+			err = tr.rewrite_sidx(box, &fixups)
+		case mp4_fourcc('p', 'r', 'f', 't'):
+			err = tr.rewrite_prft(box)
+		case mp4_fourcc('m', 'f', 'r', 'a'):
+			err = tr.rewrite_mfra(box, &fixups)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// New top-level layout
+	new_offsets := make(map[*Mp4_box]uint64)
+	var new_offset uint64
+	for _, box := range boxes {
+		new_offsets[box] = new_offset
+		new_offset += box.EncodedSize()
+	}
+
+	map_offset := func(old uint64) uint64 {
+		for _, box := range boxes {
+			if old >= box.Offset && old < box.Offset + box.Size {
+				return new_offsets[box] + old - box.Offset
+			}
+		}
+
+		return new_offset + old - uint64(len(data))
+	}
+
+	err = tr.fix_offsets(&fixups, new_offsets, map_offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return SerializeBoxes(boxes), nil
+}
+
+func (tr *Track_rewriter) fix_offsets(fixups *rewrite_offset_fixups, new_offsets map[*Mp4_box]uint64, map_offset func(uint64) uint64) error {
+	for _, f := range fixups.truns {
+		old_base := f.moof.Offset
+		new_base := new_offsets[f.moof]
+		if !f.moof_relative {
+			old_base = f.tfhd.Base_data_offset
+			new_base = map_offset(old_base)
+			f.tfhd.Base_data_offset = new_base
+			f.tfhd_box.Payload = tfhd_payload(f.tfhd)
+		}
+
+		if f.trun.Header.Flag & Trun_data_offset_present != 0 {
+			target := uint64(int64(old_base) + int64(f.trun.Data_offset))
+			data_offset := int64(map_offset(target)) - int64(new_base)
+			if data_offset > math.MaxInt32 || data_offset < math.MinInt32 {
+				return box_error(ErrUnsupported, "trun_data_offset_overflow", f.trun_box)
+			}
+
+			f.trun.Data_offset = int32(data_offset)
+			f.trun_box.Payload = trun_payload(f.trun)
+		}
+	}
+
+	for _, f := range fixups.sidxs {
+		new_end := new_offsets[f.box] + f.box.EncodedSize()
+		start := f.old_end + f.sidx.First_offset
+		new_start := map_offset(start)
+		f.sidx.First_offset = new_start - new_end
+		for i := range f.sidx.References {
+			end := start + uint64(f.sidx.References[i].Referenced_size)
+			new_end := map_offset(end)
+			f.sidx.References[i].Referenced_size = uint32(new_end - new_start)
+			start, new_start = end, new_end
+		}
+
+		payload := sidx_payload(f.sidx)
+		if len(payload) != len(f.box.Payload) {
+			return box_error(ErrUnsupported, "sidx_first_offset_overflow", f.box)
+		}
+
+		f.box.Payload = payload
+	}
+
+	for _, box := range fixups.chunk_offsets {
+		if len(box.Payload) < 8 {
+			return incomplete_box(box)
+		}
+
+		entry_count := get_uint32(4, box.Payload)
+		is_co64 := box.Type == mp4_fourcc('c', 'o', '6', '4')
+		entry_size := uint32(4)
+		if is_co64 {
+			entry_size = 8
+		}
+
+		if (uint32(len(box.Payload)) - 8) / entry_size < entry_count {
+			return incomplete_box(box)
+		}
+
+		payload := append([]byte{}, box.Payload...)
+		for i := uint32(0); i < entry_count; i++ {
+			p := 8 + i * entry_size
+			if is_co64 {
+				set_uint64(p, payload, map_offset(get_uint64(uint64(p), payload)))
+			} else {
+				offset := map_offset(uint64(get_uint32(p, payload)))
+				if offset > 0xFFFFFFFF {
+					return box_error(ErrUnsupported, "chunk_offset_overflow", box)
+				}
+
+				set_uint32(p, payload, uint32(offset))
+			}
+		}
+
+		box.Payload = payload
+	}
+
+	for _, box := range fixups.tfras {
+		tfra, err := parse_tfra(box.Payload)
+		if err != nil {
+			return in_box(err, box)
+		}
+
+		for i := range tfra.entries {
+			tfra.entries[i].moof_offset = map_offset(tfra.entries[i].moof_offset)
+		}
+
+		box.Payload = tfra_payload(tfra)
+	}
+
+	for _, f := range fixups.saios {
+		senc_offset, ok := encoded_offset_of(f.moof, f.senc)
+		if !ok {
+			continue
+		}
+
+		offset := senc_offset + f.senc.EncodedSize() - f.senc.content_size() + 8
+		payload := append([]byte{}, f.saio.Payload...)
+		if f.saio.Version() == 1 {
+			set_uint64(f.entry_offset, payload, offset)
+		} else {
+			set_uint32(f.entry_offset, payload, uint32(offset))
+		}
+
+		f.saio.Payload = payload
+	}
+
+	return nil
+}
+
+func (tr *Track_rewriter) rewrite_moov(moov *Mp4_box, fixups *rewrite_offset_fixups) error {
+	max_track_id := uint32(0)
+	for _, trak := range moov.ChildrenOfType(mp4_fourcc('t', 'r', 'a', 'k')) {
+		tkhd := trak.Child(mp4_fourcc('t', 'k', 'h', 'd'))
+		if tkhd == nil {
+			return box_not_found(trak, "tkhd")
+		}
+
+		id_offset, err := tkhd_track_id_offset(tkhd.Payload)
+		if err != nil {
+			return in_box(err, tkhd)
+		}
+
+		track_id := get_uint32(id_offset, tkhd.Payload)
+		s, ok := tr.tracks[track_id]
+		if !ok {
+			return box_error(ErrInvalidData, "unknown_track_id", tkhd)
+		}
+
+		tkhd.Payload = append([]byte{}, tkhd.Payload...)
+		set_uint32(id_offset, tkhd.Payload, s.new_track_id)
+		if s.new_track_id > max_track_id {
+			max_track_id = s.new_track_id
+		}
+
+		tref := trak.Child(mp4_fourcc('t', 'r', 'e', 'f'))
+		if tref != nil {
+			for _, ref := range tref.Children {
+				payload := append([]byte{}, ref.Payload...)
+				for p := uint32(0); p + 4 <= uint32(len(payload)); p += 4 {
+					set_uint32(p, payload, tr.map_track_id(get_uint32(p, payload)))
+				}
+
+				ref.Payload = payload
+			}
+		}
+
+		if s.rescaled() {
+			err = tr.rescale_trak(trak, s)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, path := range []string{"mdia/minf/stbl/stco", "mdia/minf/stbl/co64"} {
+			for _, box := range trak.FindAll(path) {
+				fixups.chunk_offsets = append(fixups.chunk_offsets, box)
+			}
+		}
+	}
+
+	for _, box := range moov.FindAll("mvex/trex") {
+		if len(box.Payload) < 16 {
+			return incomplete_box(box)
+		}
+
+		payload := append([]byte{}, box.Payload...)
+		if s, ok := tr.tracks[get_uint32(4, payload)]; ok {
+			set_uint32(4, payload, s.new_track_id)
+			set_uint32(12, payload, uint32(s.scale(uint64(s.trex_default_sample_duration))))
+		}
+
+		box.Payload = payload
+	}
+
+	for _, box := range moov.FindAll("mvex/trep") {
+		if len(box.Payload) < 8 {
+			return incomplete_box(box)
+		}
+
+		box.Payload = append([]byte{}, box.Payload...)
+		set_uint32(4, box.Payload, tr.map_track_id(get_uint32(4, box.Payload)))
+	}
+
+	// next_track_ID is the last field of mvhd
+	mvhd := moov.Child(mp4_fourcc('m', 'v', 'h', 'd'))
+	if mvhd != nil && len(mvhd.Payload) >= 4 {
+		p := uint32(len(mvhd.Payload) - 4)
+		if get_uint32(p, mvhd.Payload) <= max_track_id {
+			mvhd.Payload = append([]byte{}, mvhd.Payload...)
+			set_uint32(p, mvhd.Payload, max_track_id + 1)
+		}
+	}
+
+	return nil
+}
+
+// rescale_trak changes the media timescale of a trak: mdhd, the elst
+// media_time of each edit and the stts/ctts sample timing.
+func (tr *Track_rewriter) rescale_trak(trak *Mp4_box, s *track_rewrite_state) error {
+	mdhd := trak.Find("mdia/mdhd")
+	if mdhd == nil {
+		return box_not_found(trak, "mdia/mdhd")
+	}
+
+	payload := mdhd.Payload
+	var duration uint64
+	var tail []byte
+	if mdhd.Version() == 1 {
+		if len(payload) < 32 {
+			return incomplete_box(mdhd)
+		}
+
+		duration = get_uint64(24, payload)
+		tail = payload[32:]
+	} else {
+		if len(payload) < 20 {
+			return incomplete_box(mdhd)
+		}
+
+		duration = uint64(get_uint32(16, payload))
+		if duration == 0xFFFFFFFF {
+			duration = math.MaxUint64
+		}
+
+		tail = payload[20:]
+	}
+
+	if duration != math.MaxUint64 {
+		duration = s.scale(duration)
+	}
+
+	// Upgrade to version 1 if the rescaled duration needs 64 bits
+	new_payload := make([]byte, 0, len(payload) + 12)
+	if mdhd.Version() == 1 || (duration != math.MaxUint64 && duration > 0xFFFFFFFF) {
+		new_payload = append_uint32(new_payload, 0x01000000 | mdhd.Flags())
+		if mdhd.Version() == 1 {
+			new_payload = append(new_payload, payload[4:20]...)
+		} else {
+			new_payload = append_uint64(new_payload, uint64(get_uint32(4, payload)))
+			new_payload = append_uint64(new_payload, uint64(get_uint32(8, payload)))
+		}
+
+		new_payload = append_uint32(new_payload, s.new_timescale)
+		new_payload = append_uint64(new_payload, duration)
+	} else {
+		new_payload = append(new_payload, payload[:12]...)
+		new_payload = append_uint32(new_payload, s.new_timescale)
+		new_payload = append_uint32(new_payload, uint32(duration))
+	}
+
+	mdhd.Payload = append(new_payload, tail...)
+
+	for _, elst := range trak.FindAll("edts/elst") {
+		err := rescale_elst(elst, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	stbl := trak.Find("mdia/minf/stbl")
+	if stbl == nil {
+		return nil
+	}
+
+	return rescale_stts_ctts(stbl, s)
+}
+
+// rescale_elst rescales the media_time of the edits; segment_duration is in
+// the movie timescale and is kept. media_time -1 marks an empty edit.
+func rescale_elst(elst *Mp4_box, s *track_rewrite_state) error {
+	payload := append([]byte{}, elst.Payload...)
+	if len(payload) < 8 {
+		return incomplete_box(elst)
+	}
+
+	entry_count := get_uint32(4, payload)
+	entry_size := uint32(12)
+	if elst.Version() == 1 {
+		entry_size = 20
+	}
+
+	if (uint32(len(payload)) - 8) / entry_size < entry_count {
+		return incomplete_box(elst)
+	}
+
+	for i := uint32(0); i < entry_count; i++ {
+		p := 8 + i * entry_size
+		if elst.Version() == 1 {
+			media_time := int64(get_uint64(uint64(p + 8), payload))
+			if media_time >= 0 {
+				set_uint64(p + 8, payload, uint64(scale_signed_time(media_time, s.timescale, s.new_timescale)))
+			}
+		} else {
+			media_time := int32(get_uint32(p + 4, payload))
+			if media_time >= 0 {
+				scaled := scale_signed_time(int64(media_time), s.timescale, s.new_timescale)
+				if scaled > math.MaxInt32 {
+					return box_error(ErrUnsupported, "elst_media_time_overflow", elst)
+				}
+
+				set_uint32(p + 4, payload, uint32(scaled))
+			}
+		}
+	}
+
+	elst.Payload = payload
+	return nil
+}
+
+// run_length_encode packs consecutive equal values into (count, value) entries.
+func run_length_encode(values []uint64) ([]uint32, []uint64) {
+	var counts []uint32
+	var runs []uint64
+	for i, v := range values {
+		if i > 0 && runs[len(runs) - 1] == v && counts[len(counts) - 1] < math.MaxUint32 {
+			counts[len(counts) - 1]++
+		} else {
+			counts = append(counts, 1)
+			runs = append(runs, v)
+		}
+	}
+
+	return counts, runs
+}
+
+// rescale_stts_ctts rescales the sample table timing of progressive files.
+func rescale_stts_ctts(stbl *Mp4_box, s *track_rewrite_state) error {
+	stts := stbl.Child(mp4_fourcc('s', 't', 't', 's'))
+	if stts == nil {
+		return nil
+	}
+
+	deltas, err := parse_stts(stts.Payload)
+	if err != nil {
+		return in_box(err, stts)
+	}
+
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	var ctts_offsets []int64
+	ctts := stbl.Child(mp4_fourcc('c', 't', 't', 's'))
+	if ctts != nil {
+		ctts_offsets, err = parse_ctts(ctts.Payload, uint32(len(deltas)))
+		if err != nil {
+			return in_box(err, ctts)
+		}
+	}
+
+	new_deltas := s.rescale_durations(0, deltas)
+	for _, d := range new_deltas {
+		if d > 0xFFFFFFFF {
+			return box_error(ErrUnsupported, "stts_delta_overflow", stts)
+		}
+	}
+
+	counts, runs := run_length_encode(new_deltas)
+	payload := make([]byte, 0, 8 + 8 * len(counts))
+	payload = append_uint32(payload, 0)
+	payload = append_uint32(payload, uint32(len(counts)))
+	for i := range counts {
+		payload = append_uint32(payload, counts[i])
+		payload = append_uint32(payload, uint32(runs[i]))
+	}
+
+	stts.Payload = payload
+
+	if ctts_offsets == nil {
+		return nil
+	}
+
+	new_offsets := make([]uint64, len(ctts_offsets))
+	negative := false
+	dts := uint64(0)
+	for i, cto := range ctts_offsets {
+		scaled := scale_signed_time(int64(dts) + cto, s.timescale, s.new_timescale) - int64(s.scale(dts))
+		if scaled < math.MinInt32 || scaled > math.MaxUint32 {
+			return box_error(ErrUnsupported, "ctts_offset_overflow", ctts)
+		}
+
+		negative = negative || scaled < 0
+		new_offsets[i] = uint64(scaled)
+		dts += deltas[i]
+	}
+
+	counts, runs = run_length_encode(new_offsets)
+	version := ctts.Version()
+	if negative {
+		version = 1
+	}
+
+	payload = make([]byte, 0, 8 + 8 * len(counts))
+	payload = append_uint32(payload, uint32(version) << 24)
+	payload = append_uint32(payload, uint32(len(counts)))
+	for i := range counts {
+		payload = append_uint32(payload, counts[i])
+		payload = append_uint32(payload, uint32(runs[i]))
+	}
+
+	ctts.Payload = payload
+	return nil
+}
+
+// parse_stts expands a stts payload into per-sample durations.
+func parse_stts(payload []byte) ([]uint64, error) {
+	if len(payload) < 8 {
+		return nil, parse_error(ErrTruncated, "incomplete_stts", 0, "")
+	}
+
+	entry_count := get_uint32(4, payload)
+	if (uint32(len(payload)) - 8) / 8 < entry_count {
+		return nil, parse_error(ErrTruncated, "incomplete_stts", 8, "")
+	}
+
+	var deltas []uint64
+	for i := uint32(0); i < entry_count; i++ {
+		sample_count := get_uint32(8 + i * 8, payload)
+		sample_delta := uint64(get_uint32(12 + i * 8, payload))
+		if uint64(len(deltas)) + uint64(sample_count) > max_trun_sample_count * 16 {
+			return nil, parse_error(ErrInvalidData, "invalid_stts_sample_count", uint64(8 + i * 8), "")
+		}
+
+		for j := uint32(0); j < sample_count; j++ {
+			deltas = append(deltas, sample_delta)
+		}
+	}
+
+	return deltas, nil
+}
+
+// parse_ctts expands a ctts payload into per-sample composition offsets.
+// Samples beyond the table get offset 0.
+func parse_ctts(payload []byte, sample_count uint32) ([]int64, error) {
+	if len(payload) < 8 {
+		return nil, parse_error(ErrTruncated, "incomplete_ctts", 0, "")
+	}
+
+	version := payload[0]
+	entry_count := get_uint32(4, payload)
+	if (uint32(len(payload)) - 8) / 8 < entry_count {
+		return nil, parse_error(ErrTruncated, "incomplete_ctts", 8, "")
+	}
+
+	offsets := make([]int64, 0, sample_count)
+	for i := uint32(0); i < entry_count && uint32(len(offsets)) < sample_count; i++ {
+		count := get_uint32(8 + i * 8, payload)
+		v := get_uint32(12 + i * 8, payload)
+		offset := int64(v)
+		if version == 1 {
+			offset = int64(int32(v))
+		}
+
+		for j := uint32(0); j < count && uint32(len(offsets)) < sample_count; j++ {
+			offsets = append(offsets, offset)
+		}
+	}
+
+	for uint32(len(offsets)) < sample_count {
+		offsets = append(offsets, 0)
+	}
+
+	return offsets, nil
+}
+
+func (tr *Track_rewriter) rewrite_moof(moof *Mp4_box, fixups *rewrite_offset_fixups) error {
+	for traf_index, traf := range moof.ChildrenOfType(mp4_fourcc('t', 'r', 'a', 'f')) {
+		tfhd_box := traf.Child(mp4_fourcc('t', 'f', 'h', 'd'))
+		if tfhd_box == nil {
+			return box_not_found(traf, "tfhd")
+		}
+
+		tfhd, err := parse_tfhd(tfhd_box.Payload)
+		if err != nil {
+			return in_box(err, tfhd_box)
+		}
+
+		s, ok := tr.tracks[tfhd.Track_id]
+		if !ok {
+			return box_error(ErrInvalidData, "unknown_track_id", tfhd_box)
+		}
+
+		tfhd.Track_id = s.new_track_id
+
+		default_duration := s.trex_default_sample_duration
+		if tfhd.Header.Flag & Tfhd_default_sample_duration_present != 0 {
+			default_duration = tfhd.Default_sample_duration
+		}
+
+		new_default_duration := s.scale(uint64(default_duration))
+		if tfhd.Header.Flag & Tfhd_default_sample_duration_present != 0 {
+			tfhd.Default_sample_duration = uint32(new_default_duration)
+		}
+
+		tfhd_box.Payload = tfhd_payload(tfhd)
+
+		var dts uint64
+		tfdt_box := traf.Child(mp4_fourcc('t', 'f', 'd', 't'))
+		if tfdt_box != nil {
+			dts, err = parse_tfdt(tfdt_box.Payload)
+			if err != nil {
+				return in_box(err, tfdt_box)
+			}
+
+			tfdt_box.Payload = tfdt_payload(tfdt_box.Version(), s.scale(dts))
+		}
+
+		// The base data offset is the moof start unless tfhd has an explicit
+		// one. For later trafs without default-base-is-moof it is the end of the
+		// previous traf's data, which moves with it and needs no fixing.
+		moof_relative := tfhd.Header.Flag & Tfhd_base_data_offset_present == 0
+		needs_fixup := !moof_relative || traf_index == 0 || tfhd.Header.Flag & Tfhd_default_base_is_moof != 0
+
+		for _, trun_box := range traf.ChildrenOfType(mp4_fourcc('t', 'r', 'u', 'n')) {
+			trun, err := parse_trun(trun_box.Payload)
+			if err != nil {
+				return in_box(err, trun_box)
+			}
+
+			if s.rescaled() {
+				dts = rescale_trun(&trun, s, dts, default_duration, new_default_duration)
+			}
+
+			trun_box.Payload = trun_payload(trun)
+			if needs_fixup {
+				fixups.truns = append(fixups.truns, trun_offset_fixup{moof: moof, tfhd_box: tfhd_box, tfhd: tfhd, trun_box: trun_box, trun: trun, moof_relative: moof_relative})
+			}
+		}
+
+		if moof_relative {
+			err = add_saio_fixup(moof, traf, fixups)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rescale_trun rescales the sample durations and composition offsets of a
+// trun whose first sample decodes at dts, and returns the decode time
+// following its last sample. Samples relying on the default duration get
+// explicit durations if the rescaled durations are not all equal to the
+// rescaled default.
+func rescale_trun(trun *Trun_box, s *track_rewrite_state, dts uint64, default_duration uint32, new_default_duration uint64) uint64 {
+	durations := make([]uint64, len(trun.Samples))
+	for i, sample := range trun.Samples {
+		if trun.Header.Flag & Trun_sample_duration_present != 0 {
+			durations[i] = uint64(sample.Duration)
+		} else {
+			durations[i] = uint64(default_duration)
+		}
+	}
+
+	new_durations := s.rescale_durations(dts, durations)
+	for i, d := range new_durations {
+		if d != new_default_duration {
+			trun.Header.Flag |= Trun_sample_duration_present
+		}
+
+		if trun.Header.Flag & Trun_sample_composition_time_offsets_present != 0 {
+			cto := trun.Samples[i].Composition_time_offset
+			trun.Samples[i].Composition_time_offset = scale_signed_time(int64(dts) + cto, s.timescale, s.new_timescale) - int64(s.scale(dts))
+		}
+
+		dts += durations[i]
+	}
+
+	if trun.Header.Flag & Trun_sample_duration_present != 0 {
+		for i := range trun.Samples {
+			trun.Samples[i].Duration = uint32(new_durations[i])
+		}
+	}
+
+	return dts
+}
+
+// saio_entry_offset returns the position of the single saio offset entry in
+// the saio payload, or false if the saio has several entries.
+func saio_entry_offset(saio *Mp4_box) (uint32, bool, error) {
+	p := uint32(4)
+	if saio.Flags() & 1 != 0 {
+		p += 8 // aux_info_type, aux_info_type_parameter
+	}
+
+	entry_size := uint32(4)
+	if saio.Version() == 1 {
+		entry_size = 8
+	}
+
+	if uint32(len(saio.Payload)) < p + 4 {
+		return 0, false, incomplete_box(saio)
+	}
+
+	if get_uint32(p, saio.Payload) != 1 {
+		return 0, false, nil
+	}
+
+	if uint32(len(saio.Payload)) < p + 4 + entry_size {
+		return 0, false, incomplete_box(saio)
+	}
+
+	return p + 4, true, nil
+}
+
+// add_saio_fixup records a moof-relative saio offset that points at the
+// sample auxiliary information of the senc in the same traf.
+func add_saio_fixup(moof *Mp4_box, traf *Mp4_box, fixups *rewrite_offset_fixups) error {
+	saio := traf.Child(mp4_fourcc('s', 'a', 'i', 'o'))
+	senc := traf.Child(mp4_fourcc('s', 'e', 'n', 'c'))
+	if saio == nil || senc == nil {
+		return nil
+	}
+
+	p, ok, err := saio_entry_offset(saio)
+	if err != nil || !ok {
+		return err
+	}
+
+	var offset uint64
+	if saio.Version() == 1 {
+		offset = get_uint64(uint64(p), saio.Payload)
+	} else {
+		offset = uint64(get_uint32(p, saio.Payload))
+	}
+
+	// senc sample data follows version, flags and sample_count
+	if offset == senc.Offset + uint64(senc.Header_size) + 8 - moof.Offset {
+		fixups.saios = append(fixups.saios, saio_offset_fixup{moof: moof, saio: saio, senc: senc, entry_offset: p})
+	}
+
+	return nil
+}
+
+// encoded_offset_of returns the offset of target relative to the start of
+// root in the serialized tree.
+func encoded_offset_of(root *Mp4_box, target *Mp4_box) (uint64, bool) {
+	if root == target {
+		return 0, true
+	}
+
+	offset := root.EncodedSize() - root.content_size() + uint64(len(root.Payload))
+	for _, c := range root.Children {
+		if sub, ok := encoded_offset_of(c, target); ok {
+			return offset + sub, true
+		}
+
+		offset += c.EncodedSize()
+	}
+
+	return 0, false
+}
+
+func (tr *Track_rewriter) rewrite_sidx(box *Mp4_box, fixups *rewrite_offset_fixups) error {
+	sidx, err := parse_sidx(box.Payload)
+	if err != nil {
+		return in_box(err, box)
+	}
+
+	if s, ok := tr.tracks[sidx.Reference_id]; ok {
+		sidx.Reference_id = s.new_track_id
+		if s.rescaled() {
+			from := sidx.Timescale
+			t := sidx.Earliest_presentation_time
+			sidx.Earliest_presentation_time = scale_time(t, from, s.new_timescale)
+			for i := range sidx.References {
+				d := uint64(sidx.References[i].Subsegment_duration)
+				sidx.References[i].Subsegment_duration = uint32(scale_time(t + d, from, s.new_timescale) - scale_time(t, from, s.new_timescale))
+				t += d
+			}
+
+			sidx.Timescale = s.new_timescale
+		}
+	}
+
+	// Sized for the largest first_offset the layout can produce
+	if sidx.First_offset > 0xFFFFFFFF {
+		sidx.Header.Version = 1
+	}
+
+	box.Payload = sidx_payload(sidx)
+	fixups.sidxs = append(fixups.sidxs, sidx_offset_fixup{box: box, sidx: sidx, old_end: box.Offset + box.Size})
+	return nil
+}
+
+func (tr *Track_rewriter) rewrite_prft(box *Mp4_box) error {
+	prft, err := parse_prft(box.Bytes(), 0, uint32(box.EncodedSize()))
+	if err != nil {
+		return in_box(err, box)
+	}
+
+	if s, ok := tr.tracks[prft.Reference_track_id]; ok {
+		prft.Reference_track_id = s.new_track_id
+		prft.Media_time = s.scale(prft.Media_time)
+	}
+
+	box.Payload = BuildPrft(prft)[8:]
+	return nil
+}
+
+func (tr *Track_rewriter) rewrite_mfra(mfra *Mp4_box, fixups *rewrite_offset_fixups) error {
+	for _, box := range mfra.ChildrenOfType(mp4_fourcc('t', 'f', 'r', 'a')) {
+		tfra, err := parse_tfra(box.Payload)
+		if err != nil {
+			return in_box(err, box)
+		}
+
+		if s, ok := tr.tracks[tfra.track_id]; ok {
+			tfra.track_id = s.new_track_id
+			for i := range tfra.entries {
+				tfra.entries[i].time = s.scale(tfra.entries[i].time)
+			}
+		}
+
+		box.Payload = tfra_payload(tfra)
+		fixups.tfras = append(fixups.tfras, box)
+	}
+
+	return nil
+}
+
+type tfra_entry struct {
+	time uint64
+	moof_offset uint64
+	traf_number uint32
+	trun_number uint32
+	sample_number uint32
+}
+
+type tfra_fields struct {
+	version uint8
+	track_id uint32
+	length_sizes uint32
+	entries []tfra_entry
+}
+
+func read_sized_uint(p uint32, d []byte, size uint32) uint32 {
+	v := uint32(0)
+	for i := uint32(0); i < size; i++ {
+		v = v << 8 | uint32(d[p+i])
+	}
+
+	return v
+}
+
+func append_sized_uint(d []byte, v uint32, size uint32) []byte {
+	for i := int(size) - 1; i >= 0; i-- {
+		d = append(d, byte(v >> (8 * uint(i))))
+	}
+
+	return d
+}
+
+func parse_tfra(payload []byte) (tfra_fields, error) {
+	var tfra tfra_fields
+	if len(payload) < 16 {
+		return tfra, parse_error(ErrTruncated, "incomplete_tfra", 0, "")
+	}
+
+	tfra.version = payload[0]
+	tfra.track_id = get_uint32(4, payload)
+	tfra.length_sizes = get_uint32(8, payload) & 0x3F
+	entry_count := get_uint32(12, payload)
+
+	traf_size := (tfra.length_sizes >> 4 & 3) + 1
+	trun_size := (tfra.length_sizes >> 2 & 3) + 1
+	sample_size := (tfra.length_sizes & 3) + 1
+	entry_size := traf_size + trun_size + sample_size + 8
+	if tfra.version == 1 {
+		entry_size += 8
+	}
+
+	p := uint32(16)
+	if (uint32(len(payload)) - p) / entry_size < entry_count {
+		return tfra, parse_error(ErrTruncated, "incomplete_tfra", uint64(p), "")
+	}
+
+	tfra.entries = make([]tfra_entry, entry_count)
+	for i := range tfra.entries {
+		e := &tfra.entries[i]
+		if tfra.version == 1 {
+			e.time = get_uint64(uint64(p), payload)
+			e.moof_offset = get_uint64(uint64(p + 8), payload)
+			p += 16
+		} else {
+			e.time = uint64(get_uint32(p, payload))
+			e.moof_offset = uint64(get_uint32(p + 4, payload))
+			p += 8
+		}
+
+		e.traf_number = read_sized_uint(p, payload, traf_size)
+		p += traf_size
+		e.trun_number = read_sized_uint(p, payload, trun_size)
+		p += trun_size
+		e.sample_number = read_sized_uint(p, payload, sample_size)
+		p += sample_size
+	}
+
+	return tfra, nil
+}
+
+func tfra_payload(tfra tfra_fields) []byte {
+	version := tfra.version
+	for _, e := range tfra.entries {
+		if e.time > 0xFFFFFFFF || e.moof_offset > 0xFFFFFFFF {
+			version = 1
+		}
+	}
+
+	payload := make([]byte, 0, 16 + len(tfra.entries) * 28)
+	payload = append_uint32(payload, uint32(version) << 24)
+	payload = append_uint32(payload, tfra.track_id)
+	payload = append_uint32(payload, tfra.length_sizes)
+	payload = append_uint32(payload, uint32(len(tfra.entries)))
+	for _, e := range tfra.entries {
+		if version == 1 {
+			payload = append_uint64(payload, e.time)
+			payload = append_uint64(payload, e.moof_offset)
+		} else {
+			payload = append_uint32(payload, uint32(e.time))
+			payload = append_uint32(payload, uint32(e.moof_offset))
+		}
+
+		payload = append_sized_uint(payload, e.traf_number, (tfra.length_sizes >> 4 & 3) + 1)
+		payload = append_sized_uint(payload, e.trun_number, (tfra.length_sizes >> 2 & 3) + 1)
+		payload = append_sized_uint(payload, e.sample_number, (tfra.length_sizes & 3) + 1)
+	}
+
+	return payload
+}
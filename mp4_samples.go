@@ -0,0 +1,391 @@
+package media_utils
+
+// Sample flags (trex, tfhd and trun)
+const (
+	Sample_is_non_sync_sample = 0x00010000
+)
+
+// Mp4_sample is one sample of a track, from either a progressive sample
+// table or a track fragment run.
+type Mp4_sample struct {
+	Track_id uint32
+	Dts int64
+	Pts int64
+	Duration uint32
+	Size uint32
+	Offset uint64 // offset of the sample data in the parsed data
+	Flags uint32 // sample flags, fragmented tracks only
+	Is_sync bool
+	Sample_description_index uint32
+	Sample_dependency uint8 // sdtp entry, 0 if the track has no sdtp
+	Data []byte // nil if the sample lies outside the parsed data
+}
+
+// SampleDependsOn returns sample_depends_on of a sample flags field:
+// 1 if the sample depends on others, 2 if it does not (an I-frame), 0 if unknown.
+func SampleDependsOn(flags uint32) uint8 {
+	return uint8(flags >> 24 & 0x03)
+}
+
+func sample_data(data []byte, offset uint64, size uint32) []byte {
+	if offset > uint64(len(data)) || uint64(size) > uint64(len(data)) - offset {
+		return nil
+	}
+
+	return data[offset : offset+uint64(size)]
+}
+
+// parse_sdtp returns the per-sample entries of a sdtp payload.
+func parse_sdtp(box *Mp4_box) ([]uint8, error) {
+	if box == nil {
+		return nil, nil
+	}
+
+	if len(box.Payload) < 4 {
+		return nil, incomplete_box(box)
+	}
+
+	return box.Payload[4:], nil
+}
+
+// parse_sample_sizes expands a stsz or stz2 payload into per-sample sizes.
+func parse_sample_sizes(box *Mp4_box) ([]uint32, error) {
+	payload := box.Payload
+	if len(payload) < 12 {
+		return nil, incomplete_box(box)
+	}
+
+	sample_count := get_uint32(8, payload)
+	if sample_count > max_trun_sample_count * 16 {
+		return nil, box_error(ErrInvalidData, "invalid_" + box.TypeString() + "_sample_count", box)
+	}
+
+	if box.Type == mp4_fourcc('s', 't', 's', 'z') {
+		sample_size := get_uint32(4, payload)
+		sizes := make([]uint32, 0, sample_count)
+		if sample_size != 0 {
+			for i := uint32(0); i < sample_count; i++ {
+				sizes = append(sizes, sample_size)
+			}
+
+			return sizes, nil
+		}
+
+		if (uint32(len(payload)) - 12) / 4 < sample_count {
+			return nil, incomplete_box(box)
+		}
+
+		for i := uint32(0); i < sample_count; i++ {
+			sizes = append(sizes, get_uint32(12 + i * 4, payload))
+		}
+
+		return sizes, nil
+	}
+
+	field_size := uint64(payload[7])
+	if field_size != 4 && field_size != 8 && field_size != 16 {
+		return nil, box_error(ErrInvalidData, "invalid_stz2_field_size", box)
+	}
+
+	if uint64(len(payload) - 12) * 8 < uint64(sample_count) * field_size {
+		return nil, incomplete_box(box)
+	}
+
+	r := new_bit_reader(payload[12:])
+	sizes := make([]uint32, 0, sample_count)
+	for i := uint32(0); i < sample_count; i++ {
+		sizes = append(sizes, uint32(r.read_bits(uint(field_size))))
+	}
+
+	return sizes, nil
+}
+
+type stsc_entry struct {
+	first_chunk uint32
+	samples_per_chunk uint32
+	sample_description_index uint32
+}
+
+func parse_stsc(payload []byte) ([]stsc_entry, error) {
+	if len(payload) < 8 {
+		return nil, parse_error(ErrTruncated, "incomplete_stsc", 0, "")
+	}
+
+	entry_count := get_uint32(4, payload)
+	if (uint32(len(payload)) - 8) / 12 < entry_count {
+		return nil, parse_error(ErrTruncated, "incomplete_stsc", 8, "")
+	}
+
+	entries := make([]stsc_entry, entry_count)
+	for i := range entries {
+		p := 8 + uint32(i) * 12
+		entries[i] = stsc_entry{first_chunk: get_uint32(p, payload), samples_per_chunk: get_uint32(p + 4, payload), sample_description_index: get_uint32(p + 8, payload)}
+	}
+
+	return entries, nil
+}
+
+// GetTrackSamples expands the sample table (stsz/stz2, stsc, stco/co64, stts,
+// ctts, stss) of a progressive track. data is the file the track was parsed
+// from; sample offsets are chunk offsets into it.
+func GetTrackSamples(data []byte, track Track_info) ([]Mp4_sample, error) {
+	stbl := track.Trak.Find("mdia/minf/stbl")
+	if stbl == nil {
+		return nil, box_not_found(track.Trak, "mdia/minf/stbl")
+	}
+
+	size_box := stbl.Child(mp4_fourcc('s', 't', 's', 'z'))
+	if size_box == nil {
+		size_box = stbl.Child(mp4_fourcc('s', 't', 'z', '2'))
+	}
+
+	if size_box == nil {
+		return nil, box_not_found(stbl, "stsz")
+	}
+
+	sizes, err := parse_sample_sizes(size_box)
+	if err != nil {
+		return nil, err
+	}
+
+	stsc := stbl.Child(mp4_fourcc('s', 't', 's', 'c'))
+	if stsc == nil {
+		return nil, box_not_found(stbl, "stsc")
+	}
+
+	chunks, err := parse_stsc(stsc.Payload)
+	if err != nil {
+		return nil, in_box(err, stsc)
+	}
+
+	offset_box := stbl.Child(mp4_fourcc('s', 't', 'c', 'o'))
+	if offset_box == nil {
+		offset_box = stbl.Child(mp4_fourcc('c', 'o', '6', '4'))
+	}
+
+	if offset_box == nil {
+		return nil, box_not_found(stbl, "stco")
+	}
+
+	chunk_offsets, err := parse_chunk_offsets(offset_box)
+	if err != nil {
+		return nil, err
+	}
+
+	stts := stbl.Child(mp4_fourcc('s', 't', 't', 's'))
+	if stts == nil {
+		return nil, box_not_found(stbl, "stts")
+	}
+
+	durations, err := parse_stts(stts.Payload)
+	if err != nil {
+		return nil, in_box(err, stts)
+	}
+
+	var composition_offsets []int64
+	if ctts := stbl.Child(mp4_fourcc('c', 't', 't', 's')); ctts != nil {
+		composition_offsets, err = parse_ctts(ctts.Payload, uint32(len(sizes)))
+		if err != nil {
+			return nil, in_box(err, ctts)
+		}
+	}
+
+	var sync_samples map[uint32]bool
+	if stss := stbl.Child(mp4_fourcc('s', 't', 's', 's')); stss != nil {
+		if len(stss.Payload) < 8 {
+			return nil, incomplete_box(stss)
+		}
+
+		entry_count := get_uint32(4, stss.Payload)
+		if (uint32(len(stss.Payload)) - 8) / 4 < entry_count {
+			return nil, incomplete_box(stss)
+		}
+
+		sync_samples = make(map[uint32]bool)
+		for i := uint32(0); i < entry_count; i++ {
+			sync_samples[get_uint32(8 + i * 4, stss.Payload)] = true
+		}
+	}
+
+	dependencies, err := parse_sdtp(stbl.Child(mp4_fourcc('s', 'd', 't', 'p')))
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]Mp4_sample, 0, len(sizes))
+	var dts int64
+	for entry_index, entry := range chunks {
+		last_chunk := uint32(len(chunk_offsets))
+		if entry_index + 1 < len(chunks) {
+			last_chunk = chunks[entry_index + 1].first_chunk - 1
+		}
+
+		if entry.first_chunk == 0 || last_chunk > uint32(len(chunk_offsets)) {
+			return nil, box_error(ErrInvalidData, "invalid_stsc_chunk_index", stsc)
+		}
+
+		for chunk := entry.first_chunk; chunk <= last_chunk && len(samples) < len(sizes); chunk++ {
+			offset := chunk_offsets[chunk - 1]
+			for i := uint32(0); i < entry.samples_per_chunk && len(samples) < len(sizes); i++ {
+				n := len(samples)
+				sample := Mp4_sample{Track_id: track.Track_id, Dts: dts, Pts: dts, Size: sizes[n], Offset: offset, Is_sync: true, Sample_description_index: entry.sample_description_index}
+				if n < len(durations) {
+					sample.Duration = uint32(durations[n])
+				}
+
+				if n < len(composition_offsets) {
+					sample.Pts += composition_offsets[n]
+				}
+
+				if sync_samples != nil {
+					sample.Is_sync = sync_samples[uint32(n + 1)]
+				}
+
+				if n < len(dependencies) {
+					sample.Sample_dependency = dependencies[n]
+				}
+
+				sample.Data = sample_data(data, offset, sample.Size)
+				samples = append(samples, sample)
+				offset += uint64(sample.Size)
+				dts += int64(sample.Duration)
+			}
+		}
+	}
+
+	if len(samples) < len(sizes) {
+		return samples, box_error(ErrInvalidData, "sample_table_chunks_short_of_samples", stsc)
+	}
+
+	return samples, nil
+}
+
+// GetFragmentSamples returns the samples of every moof in seg_data, in file
+// order. tracks supplies the trex defaults; a traf without tfdt continues
+// from the end of the previous traf of its track in seg_data.
+func GetFragmentSamples(seg_data []byte, tracks []Track_info) ([]Mp4_sample, error) {
+	boxes, err := ParseBoxes(seg_data)
+	if err != nil {
+		return nil, err
+	}
+
+	next_dts := make(map[uint32]int64)
+	var samples []Mp4_sample
+	for _, moof := range boxes {
+		if moof.Type != mp4_fourcc('m', 'o', 'o', 'f') {
+			continue
+		}
+
+		// Base of a traf without base_data_offset or default-base-is-moof:
+		// the moof for the first traf, the end of the previous traf's data after.
+		implicit_base := moof.Offset
+		for _, traf := range moof.ChildrenOfType(mp4_fourcc('t', 'r', 'a', 'f')) {
+			tfhd_box := traf.Child(mp4_fourcc('t', 'f', 'h', 'd'))
+			if tfhd_box == nil {
+				return nil, box_not_found(traf, "tfhd")
+			}
+
+			tfhd, err := parse_tfhd(tfhd_box.Payload)
+			if err != nil {
+				return nil, in_box(err, tfhd_box)
+			}
+
+			track, err := FindTrack(tracks, tfhd.Track_id, "")
+			if err != nil {
+				return nil, err
+			}
+
+			sample_description_index := track.Default_sample_description_index
+			default_duration := track.Default_sample_duration
+			default_size := track.Default_sample_size
+			default_flags := track.Default_sample_flags
+			if tfhd.Header.Flag & Tfhd_sample_description_index_present != 0 {
+				sample_description_index = tfhd.Sample_description_index
+			}
+
+			if tfhd.Header.Flag & Tfhd_default_sample_duration_present != 0 {
+				default_duration = tfhd.Default_sample_duration
+			}
+
+			if tfhd.Header.Flag & Tfhd_default_sample_size_present != 0 {
+				default_size = tfhd.Default_sample_size
+			}
+
+			if tfhd.Header.Flag & Tfhd_default_sample_flags_present != 0 {
+				default_flags = tfhd.Default_sample_flags
+			}
+
+			base := implicit_base
+			if tfhd.Header.Flag & Tfhd_base_data_offset_present != 0 {
+				base = tfhd.Base_data_offset
+			} else if tfhd.Header.Flag & Tfhd_default_base_is_moof != 0 {
+				base = moof.Offset
+			}
+
+			dts := next_dts[tfhd.Track_id]
+			if tfdt := traf.Child(mp4_fourcc('t', 'f', 'd', 't')); tfdt != nil {
+				t, err := parse_tfdt(tfdt.Payload)
+				if err != nil {
+					return nil, in_box(err, tfdt)
+				}
+
+				dts = int64(t)
+			}
+
+			dependencies, err := parse_sdtp(traf.Child(mp4_fourcc('s', 'd', 't', 'p')))
+			if err != nil {
+				return nil, err
+			}
+
+			traf_sample_index := 0
+			offset := base
+			for _, trun_box := range traf.ChildrenOfType(mp4_fourcc('t', 'r', 'u', 'n')) {
+				trun, err := parse_trun(trun_box.Payload)
+				if err != nil {
+					return nil, in_box(err, trun_box)
+				}
+
+				if trun.Header.Flag & Trun_data_offset_present != 0 {
+					offset = uint64(int64(base) + int64(trun.Data_offset))
+				}
+
+				for i, s := range trun.Samples {
+					sample := Mp4_sample{Track_id: tfhd.Track_id, Dts: dts, Pts: dts, Duration: default_duration, Size: default_size, Offset: offset, Flags: default_flags, Sample_description_index: sample_description_index}
+					if trun.Header.Flag & Trun_sample_duration_present != 0 {
+						sample.Duration = s.Duration
+					}
+
+					if trun.Header.Flag & Trun_sample_size_present != 0 {
+						sample.Size = s.Size
+					}
+
+					if trun.Header.Flag & Trun_sample_flags_present != 0 {
+						sample.Flags = s.Flags
+					} else if i == 0 && trun.Header.Flag & Trun_first_sample_flags_present != 0 {
+						sample.Flags = trun.First_sample_flags
+					}
+
+					if trun.Header.Flag & Trun_sample_composition_time_offsets_present != 0 {
+						sample.Pts += s.Composition_time_offset
+					}
+
+					sample.Is_sync = sample.Flags & Sample_is_non_sync_sample == 0
+					if traf_sample_index < len(dependencies) {
+						sample.Sample_dependency = dependencies[traf_sample_index]
+					}
+
+					traf_sample_index++
+					sample.Data = sample_data(seg_data, offset, sample.Size)
+					samples = append(samples, sample)
+					offset += uint64(sample.Size)
+					dts += int64(sample.Duration)
+				}
+			}
+
+			next_dts[tfhd.Track_id] = dts
+			implicit_base = offset
+		}
+	}
+
+	return samples, nil
+}
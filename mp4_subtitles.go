@@ -0,0 +1,319 @@
+package media_utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Webvtt_cue is a cue of a WebVTT-in-MP4 (wvtt) track, with times in the
+// track timescale. A cue carried by consecutive samples, as packagers split
+// cues at sample boundaries, is merged into one. Comment holds the text of a
+// vtta box (a NOTE block), which has no payload.
+type Webvtt_cue struct {
+	Start int64
+	End int64
+	Id string // iden
+	Settings string // sttg
+	Payload string // payl
+	Source_id int64 // vsid, -1 if absent
+	Comment string // vtta
+}
+
+// ParseWvttSample returns the cues of one wvtt sample. The times are left
+// unset. An empty cue sample (vtte) has no cues.
+func ParseWvttSample(data []byte) ([]Webvtt_cue, error) {
+	boxes, err := ParseBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var cues []Webvtt_cue
+	for _, box := range boxes {
+		switch box.Type {
+		case mp4_fourcc('v', 't', 't', 'c'):
+			cue := Webvtt_cue{Source_id: -1}
+			for _, child := range box.Children {
+				switch child.Type {
+				case mp4_fourcc('i', 'd', 'e', 'n'):
+					cue.Id = string(child.Payload)
+				case mp4_fourcc('s', 't', 't', 'g'):
+					cue.Settings = string(child.Payload)
+				case mp4_fourcc('p', 'a', 'y', 'l'):
+					cue.Payload = string(child.Payload)
+				case mp4_fourcc('v', 's', 'i', 'd'):
+					if len(child.Payload) < 4 {
+						return nil, incomplete_box(child)
+					}
+
+					cue.Source_id = int64(get_uint32(0, child.Payload))
+				}
+			}
+
+			cues = append(cues, cue)
+		case mp4_fourcc('v', 't', 't', 'a'):
+			cues = append(cues, Webvtt_cue{Source_id: -1, Comment: string(box.Payload)})
+		}
+	}
+
+	return cues, nil
+}
+
+// same_cue tells whether b continues cue a in the next sample.
+func same_cue(a Webvtt_cue, b Webvtt_cue) bool {
+	if a.End != b.Start {
+		return false
+	}
+
+	if a.Source_id >= 0 || b.Source_id >= 0 {
+		return a.Source_id == b.Source_id
+	}
+
+	return a.Id == b.Id && a.Settings == b.Settings && a.Payload == b.Payload && a.Comment == b.Comment
+}
+
+// Webvtt_extractor collects the cues of a wvtt track from its samples, e.g.
+// those of GetFragmentSamples of each media segment, added in decode order.
+type Webvtt_extractor struct {
+	Track Track_info
+	Config string // vttC: the WebVTT file header, with its STYLE and REGION blocks
+	Cues []Webvtt_cue
+
+	last_sample_cues []int // indexes in Cues of the cues of the previous sample
+}
+
+func NewWebvttExtractor(track Track_info) (*Webvtt_extractor, error) {
+	if track.Sample_entry == nil || track.Sample_entry.Type != mp4_fourcc('w', 'v', 't', 't') {
+		return nil, errors.New("not_a_wvtt_track")
+	}
+
+	e := &Webvtt_extractor{Track: track, Config: "WEBVTT"}
+	if vttc := track.Sample_entry.Child(mp4_fourcc('v', 't', 't', 'C')); vttc != nil && len(vttc.Payload) > 0 {
+		e.Config = strings.TrimRight(string(vttc.Payload), "\r\n\x00")
+	}
+
+	return e, nil
+}
+
+// AddSamples adds the cues of the samples of the track. The samples of other
+// tracks are ignored.
+func (e *Webvtt_extractor) AddSamples(samples []Mp4_sample) error {
+	for _, s := range samples {
+		if s.Track_id != e.Track.Track_id {
+			continue
+		}
+
+		if s.Data == nil && s.Size > 0 {
+			return parse_error(ErrTruncated, "sample_outside_data", s.Offset, "")
+		}
+
+		cues, err := ParseWvttSample(s.Data)
+		if err != nil {
+			return err
+		}
+
+		var sample_cues []int
+		for _, cue := range cues {
+			cue.Start = s.Pts
+			cue.End = s.Pts + int64(s.Duration)
+			merged := false
+			for _, i := range e.last_sample_cues {
+				if same_cue(e.Cues[i], cue) {
+					e.Cues[i].End = cue.End
+					sample_cues = append(sample_cues, i)
+					merged = true
+					break
+				}
+			}
+
+			if !merged {
+				e.Cues = append(e.Cues, cue)
+				sample_cues = append(sample_cues, len(e.Cues) - 1)
+			}
+		}
+
+		e.last_sample_cues = sample_cues
+	}
+
+	return nil
+}
+
+// webvtt_timestamp formats ticks of timescale as hh:mm:ss.ttt.
+func webvtt_timestamp(ticks int64, timescale uint32) string {
+	ms := int64(0)
+	if timescale != 0 {
+		ms = ticks * 1000 / int64(timescale)
+	}
+
+	sign := ""
+	if ms < 0 {
+		sign = "-"
+		ms = -ms
+	}
+
+	return fmt.Sprintf("%s%02d:%02d:%02d.%03d", sign, ms / 3600000, ms / 60000 % 60, ms / 1000 % 60, ms % 1000)
+}
+
+// Write writes the cues as a WebVTT file.
+func (e *Webvtt_extractor) Write(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString(e.Config + "\n")
+	for _, cue := range e.Cues {
+		b.WriteString("\n")
+		if cue.Comment != "" {
+			b.WriteString("NOTE " + strings.TrimRight(cue.Comment, "\n") + "\n")
+			continue
+		}
+
+		if cue.Id != "" {
+			b.WriteString(cue.Id + "\n")
+		}
+
+		b.WriteString(webvtt_timestamp(cue.Start, e.Track.Timescale) + " --> " + webvtt_timestamp(cue.End, e.Track.Timescale))
+		if cue.Settings != "" {
+			b.WriteString(" " + cue.Settings)
+		}
+
+		b.WriteString("\n" + strings.TrimRight(cue.Payload, "\n") + "\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Ttml_extractor merges the TTML documents of the samples of a stpp track into
+// one document: the head (styling, layout) of the first document, and the
+// body content of every document in decode order. ISO/IEC 14496-30 TTML time
+// expressions are relative to the track, so the documents are merged as is.
+// With Sample_relative, packagers that write times relative to each sample
+// are supported: the body content of each sample is wrapped in a div that
+// begins at the sample time.
+// A p element restated by a later document, as a cue spanning several samples
+// is, is written once (track relative times only). An xml:id already used by
+// an earlier document gets a _2, _3... suffix.
+type Ttml_extractor struct {
+	Track Track_info
+	Sample_relative bool
+
+	head []byte // the first document up to the end of the body start tag
+	tail []byte // the first document from the body end tag
+	body bytes.Buffer
+	paragraphs map[string]bool // the p elements written, without their xml:id
+	ids map[string]bool // the xml:id values written
+}
+
+func NewTtmlExtractor(track Track_info) (*Ttml_extractor, error) {
+	if track.Sample_entry == nil || track.Sample_entry.Type != mp4_fourcc('s', 't', 'p', 'p') {
+		return nil, errors.New("not_a_stpp_track")
+	}
+
+	return &Ttml_extractor{Track: track, paragraphs: make(map[string]bool), ids: make(map[string]bool)}, nil
+}
+
+var ttml_body_start = regexp.MustCompile(`<([A-Za-z_][\w.-]*:)?body(\s[^>]*)?>`)
+var ttml_body_end = regexp.MustCompile(`</([A-Za-z_][\w.-]*:)?body\s*>`)
+var ttml_empty_body = regexp.MustCompile(`<([A-Za-z_][\w.-]*:)?body(\s[^>]*)?/>`)
+var ttml_root_end = regexp.MustCompile(`</([A-Za-z_][\w.-]*:)?tt\s*>`)
+var ttml_paragraph = regexp.MustCompile(`(?s)<([A-Za-z_][\w.-]*:)?p(\s[^>]*)?(/>|>.*?</([A-Za-z_][\w.-]*:)?p\s*>)`)
+var ttml_xml_id = regexp.MustCompile(`\sxml:id\s*=\s*("[^"]*"|'[^']*')`)
+
+// unique_ids renames the xml:id attributes of content already used.
+func (e *Ttml_extractor) unique_ids(content []byte) []byte {
+	return ttml_xml_id.ReplaceAllFunc(content, func(attr []byte) []byte {
+		quoted := ttml_xml_id.FindSubmatch(attr)[1]
+		id := string(quoted[1:len(quoted) - 1])
+		unique := id
+		for n := 2; e.ids[unique]; n++ {
+			unique = fmt.Sprintf("%s_%d", id, n)
+		}
+
+		e.ids[unique] = true
+		return []byte(fmt.Sprintf("%cxml:id=%c%s%c", attr[0], quoted[0], unique, quoted[0]))
+	})
+}
+
+// drop_restated_paragraphs removes the p elements of content already written.
+func (e *Ttml_extractor) drop_restated_paragraphs(content []byte) []byte {
+	return ttml_paragraph.ReplaceAllFunc(content, func(p []byte) []byte {
+		key := string(ttml_xml_id.ReplaceAll(p, nil))
+		if e.paragraphs[key] {
+			return nil
+		}
+
+		e.paragraphs[key] = true
+		return p
+	})
+}
+
+// AddSamples adds the documents of the samples of the track. The samples of
+// other tracks are ignored.
+func (e *Ttml_extractor) AddSamples(samples []Mp4_sample) error {
+	for _, s := range samples {
+		if s.Track_id != e.Track.Track_id {
+			continue
+		}
+
+		if s.Data == nil && s.Size > 0 {
+			return parse_error(ErrTruncated, "sample_outside_data", s.Offset, "")
+		}
+
+		document := s.Data
+		if ttml_empty_body.Match(document) {
+			continue
+		}
+
+		start := ttml_body_start.FindIndex(document)
+		end := ttml_body_end.FindIndex(document)
+		if start == nil || end == nil || end[0] < start[1] {
+			continue // no body: nothing is displayed during the sample
+		}
+
+		if e.head == nil {
+			e.head = e.unique_ids(append([]byte(nil), document[:start[1]]...))
+			// IMSC image subtitles carry the images as subsamples after the document
+			tail_end := len(document)
+			if root_end := ttml_root_end.FindIndex(document); root_end != nil {
+				tail_end = root_end[1]
+			}
+
+			e.tail = append([]byte(nil), document[end[0]:tail_end]...)
+		}
+
+		content := document[start[1]:end[0]]
+		if !e.Sample_relative {
+			content = e.drop_restated_paragraphs(content)
+		}
+
+		content = e.unique_ids(content)
+		if e.Sample_relative {
+			// The times of the children of a div are relative to its begin
+			prefix := ttml_body_start.FindSubmatch(document)[1]
+			fmt.Fprintf(&e.body, "<%sdiv begin=\"%s\">", prefix, webvtt_timestamp(s.Pts, e.Track.Timescale))
+			e.body.Write(content)
+			fmt.Fprintf(&e.body, "</%sdiv>", prefix)
+		} else {
+			e.body.Write(content)
+		}
+	}
+
+	return nil
+}
+
+// Write writes the merged TTML document.
+func (e *Ttml_extractor) Write(w io.Writer) error {
+	if e.head == nil {
+		return errors.New("no_ttml_document")
+	}
+
+	for _, part := range [][]byte{e.head, e.body.Bytes(), e.tail} {
+		_, err := w.Write(part)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package media_utils
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func subtitles_test_vttc(id string, settings string, payload string) []byte {
+	cue := NewContainerBox(mp4_fourcc('v', 't', 't', 'c'))
+	if id != "" {
+		cue.AddChild(NewBox(mp4_fourcc('i', 'd', 'e', 'n'), []byte(id)))
+	}
+
+	if settings != "" {
+		cue.AddChild(NewBox(mp4_fourcc('s', 't', 't', 'g'), []byte(settings)))
+	}
+
+	cue.AddChild(NewBox(mp4_fourcc('p', 'a', 'y', 'l'), []byte(payload)))
+	return cue.Bytes()
+}
+
+func subtitles_test_sample(track_id uint32, pts int64, duration uint32, data []byte) Mp4_sample {
+	return Mp4_sample{Track_id: track_id, Dts: pts, Pts: pts, Duration: duration, Size: uint32(len(data)), Is_sync: true, Data: data}
+}
+
+func TestWebvttExtractor(t *testing.T) {
+	entry := NewBox(mp4_fourcc('w', 'v', 't', 't'), make([]byte, 8))
+	entry.AddChild(NewBox(mp4_fourcc('v', 't', 't', 'C'), []byte("WEBVTT\n\nSTYLE\n::cue { color: yellow }\n")))
+	e, err := NewWebvttExtractor(Track_info{Track_id: 3, Timescale: 1000, Sample_entry: entry})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := subtitles_test_vttc("1", "line:0 align:start", "Hello")
+	samples := []Mp4_sample{
+		subtitles_test_sample(3, 0, 1000, hello),
+		subtitles_test_sample(1, 0, 3000, []byte{1, 2, 3}), // another track
+		// The first cue goes on, a second one starts
+		subtitles_test_sample(3, 1000, 1500, append(append([]byte(nil), hello...), subtitles_test_vttc("", "", "World\n")...)),
+		// A gap
+		subtitles_test_sample(3, 2500, 500, NewBox(mp4_fourcc('v', 't', 't', 'e'), nil).Bytes()),
+		// The same cue after the gap is a new one
+		subtitles_test_sample(3, 3000, 1000, append(NewBox(mp4_fourcc('v', 't', 't', 'a'), []byte("a comment")).Bytes(), hello...)),
+	}
+
+	err = e.AddSamples(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = e.Write(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "WEBVTT\n\nSTYLE\n::cue { color: yellow }\n" +
+		"\n1\n00:00:00.000 --> 00:00:02.500 line:0 align:start\nHello\n" +
+		"\n00:00:01.000 --> 00:00:02.500\nWorld\n" +
+		"\nNOTE a comment\n" +
+		"\n1\n00:00:03.000 --> 00:00:04.000 line:0 align:start\nHello\n"
+	if out.String() != want {
+		t.Errorf("WebVTT output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func subtitles_test_ttml(body string) []byte {
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>` +
+		`<tt xmlns="http://www.w3.org/ns/ttml" xmlns:tts="http://www.w3.org/ns/ttml#styling"><head><styling><style xml:id="s1" tts:color="white"/></styling></head>` +
+		body + `</tt>`)
+}
+
+func TestTtmlExtractor(t *testing.T) {
+	track := Track_info{Track_id: 2, Timescale: 1000, Sample_entry: NewBox(mp4_fourcc('s', 't', 'p', 'p'), nil)}
+	documents := [][]byte{
+		subtitles_test_ttml(`<body><div xml:id="d"><p xml:id="c1" begin="00:00:00.500" end="00:00:03.000" style="s1">One</p></div></body>`),
+		// c1 restated under another ID; the packager numbers the IDs per document
+		subtitles_test_ttml(`<body><div xml:id="d"><p xml:id="c9" begin="00:00:00.500" end="00:00:03.000" style="s1">One</p>` + "\n" +
+			`<p xml:id="c1" begin="00:00:02.000" end="00:00:04.000">Two<br/>lines</p></div></body>`),
+		subtitles_test_ttml(`<body/>`),
+		subtitles_test_ttml(`<body><div xml:id="d"><p xml:id="c1" begin="00:00:02.000" end="00:00:04.000">Two<br/>lines</p><p xml:id='c1' begin="00:00:05.000" end="00:00:06.000">Three</p></div></body>`),
+	}
+
+	var samples []Mp4_sample
+	for i, document := range documents {
+		samples = append(samples, subtitles_test_sample(2, int64(i) * 2000, 2000, document))
+	}
+
+	e, err := NewTtmlExtractor(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.AddSamples(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = e.Write(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head := `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<tt xmlns="http://www.w3.org/ns/ttml" xmlns:tts="http://www.w3.org/ns/ttml#styling"><head><styling><style xml:id="s1" tts:color="white"/></styling></head><body>`
+	want := head +
+		`<div xml:id="d"><p xml:id="c1" begin="00:00:00.500" end="00:00:03.000" style="s1">One</p></div>` +
+		`<div xml:id="d_2">` + "\n" + `<p xml:id="c1_2" begin="00:00:02.000" end="00:00:04.000">Two<br/>lines</p></div>` +
+		`<div xml:id="d_3"><p xml:id='c1_3' begin="00:00:05.000" end="00:00:06.000">Three</p></div>` +
+		`</body></tt>`
+	if out.String() != want {
+		t.Errorf("TTML output:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	// Sample relative times: every document is kept, in a div at the sample time
+	e, err = NewTtmlExtractor(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Sample_relative = true
+	err = e.AddSamples(samples[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	err = e.Write(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = head +
+		`<div begin="00:00:00.000"><div xml:id="d"><p xml:id="c1" begin="00:00:00.500" end="00:00:03.000" style="s1">One</p></div></div>` +
+		`<div begin="00:00:02.000"><div xml:id="d_2"><p xml:id="c9" begin="00:00:00.500" end="00:00:03.000" style="s1">One</p>` + "\n" +
+		`<p xml:id="c1_2" begin="00:00:02.000" end="00:00:04.000">Two<br/>lines</p></div></div>` +
+		`</body></tt>`
+	if out.String() != want {
+		t.Errorf("sample relative TTML output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+// FuzzWebvttExtractor checks that the cues of two samples span one or both
+// samples.
+func FuzzWebvttExtractor(f *testing.F) {
+	hello := subtitles_test_vttc("1", "line:0", "Hello")
+	f.Add(hello, append(append([]byte(nil), hello...), subtitles_test_vttc("", "", "World")...))
+	f.Add(NewBox(mp4_fourcc('v', 't', 't', 'e'), nil).Bytes(), NewBox(mp4_fourcc('v', 't', 't', 'a'), []byte("a comment")).Bytes())
+	f.Fuzz(func(t *testing.T, a []byte, b []byte) {
+		e, err := NewWebvttExtractor(Track_info{Track_id: 3, Timescale: 1000, Sample_entry: NewBox(mp4_fourcc('w', 'v', 't', 't'), nil)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e.AddSamples([]Mp4_sample{subtitles_test_sample(3, 0, 1000, a), subtitles_test_sample(3, 1000, 1000, b)}) != nil {
+			return
+		}
+
+		for _, cue := range e.Cues {
+			if (cue.Start != 0 && cue.Start != 1000) || (cue.End != 1000 && cue.End != 2000) || cue.End <= cue.Start {
+				t.Fatalf("cue %+v", cue)
+			}
+		}
+
+		e.Write(io.Discard)
+	})
+}
+
+// FuzzTtmlExtractor checks the TTML extractor on a document restated by two
+// samples.
+func FuzzTtmlExtractor(f *testing.F) {
+	f.Add(subtitles_test_ttml(`<body><div xml:id="d"><p xml:id="c1" begin="00:00:00.500" end="00:00:03.000">One</p></div></body>`), false)
+	f.Fuzz(func(t *testing.T, document []byte, sample_relative bool) {
+		e, err := NewTtmlExtractor(Track_info{Track_id: 2, Timescale: 1000, Sample_entry: NewBox(mp4_fourcc('s', 't', 'p', 'p'), nil)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.Sample_relative = sample_relative
+		if e.AddSamples([]Mp4_sample{subtitles_test_sample(2, 0, 2000, document), subtitles_test_sample(2, 2000, 2000, document)}) == nil {
+			e.Write(io.Discard)
+		}
+	})
+}
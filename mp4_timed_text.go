@@ -0,0 +1,200 @@
+package media_utils
+
+import (
+	"errors"
+	"unicode/utf16"
+)
+
+// Chapter is a chapter of a Nero chpl box or of a chapter text track.
+type Chapter struct {
+	Start_ms int64
+	Title string
+}
+
+// ParseTextSample returns the text of a tx3g or QuickTime text sample: a
+// 16-bit length and UTF-8 or UTF-16 (with BOM) text, followed by modifier
+// boxes (styl, hlit, ...) which are ignored.
+func ParseTextSample(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", parse_error(ErrTruncated, "incomplete_text_sample", 0, "")
+	}
+
+	length := uint32(get_uint16(0, data))
+	if length > uint32(len(data)) - 2 {
+		return "", parse_error(ErrTruncated, "incomplete_text_sample", 0, "")
+	}
+
+	text := data[2 : 2 + length]
+	if len(text) >= 2 && text[0] == 0xFE && text[1] == 0xFF {
+		units := make([]uint16, 0, len(text) / 2)
+		for p := uint32(2); p + 1 < length; p += 2 {
+			units = append(units, get_uint16(p, text))
+		}
+
+		return string(utf16.Decode(units)), nil
+	}
+
+	return string(text), nil
+}
+
+func is_text_track(track Track_info) bool {
+	return track.Codec == "tx3g" || track.Codec == "text"
+}
+
+// GetTextCues returns the cues of a progressive tx3g or text track, for
+// WriteSrt or WriteWebVtt. Empty samples, which clear the text, are not
+// returned. Cue times are media times of the track: edit lists are not applied.
+func GetTextCues(data []byte, track Track_info) ([]Caption_cue, error) {
+	if !is_text_track(track) {
+		return nil, errors.New("not_a_text_track")
+	}
+
+	if track.Timescale == 0 {
+		return nil, errors.New("invalid_timescale")
+	}
+
+	samples, err := GetTrackSamples(data, track)
+	if err != nil {
+		return nil, err
+	}
+
+	var cues []Caption_cue
+	for _, s := range samples {
+		if s.Data == nil {
+			return nil, parse_error(ErrTruncated, "sample_outside_data", s.Offset, "")
+		}
+
+		text, err := ParseTextSample(s.Data)
+		if err != nil {
+			return nil, shift_error(err, s.Offset)
+		}
+
+		if text == "" {
+			continue
+		}
+
+		cues = append(cues, Caption_cue{Start: MediaTimeToDuration(s.Pts, track.Timescale), End: MediaTimeToDuration(s.Pts + int64(s.Duration), track.Timescale), Text: text})
+	}
+
+	return cues, nil
+}
+
+// udta_children returns the boxes of a udta, including a QuickTime udta kept
+// as a leaf because of its 32-bit zero terminator.
+func udta_children(udta *Mp4_box) []*Mp4_box {
+	if len(udta.Children) > 0 || len(udta.Payload) < 8 {
+		return udta.Children
+	}
+
+	payload := udta.Payload
+	if len(payload) % 4 == 0 && get_uint32(uint32(len(payload) - 4), payload) == 0 {
+		payload = payload[:len(payload) - 4]
+	}
+
+	children, _ := ParseBoxes(payload)
+	for _, child := range children {
+		child.Parent = udta
+		child.Offset += udta.Offset + uint64(udta.Header_size)
+	}
+
+	return children
+}
+
+// parse_chpl decodes a Nero chapter list: start times in 100 ns units and
+// titles of up to 255 bytes.
+func parse_chpl(payload []byte) ([]Chapter, error) {
+	if len(payload) < 5 {
+		return nil, parse_error(ErrTruncated, "incomplete_chpl", 0, "")
+	}
+
+	p := uint32(4)
+	if payload[0] == 1 {
+		p += 4 // reserved
+	}
+
+	if p >= uint32(len(payload)) {
+		return nil, parse_error(ErrTruncated, "incomplete_chpl", uint64(p), "")
+	}
+
+	count := int(payload[p])
+	p++
+	var chapters []Chapter
+	for i := 0; i < count; i++ {
+		if uint32(len(payload)) - p < 9 {
+			return chapters, parse_error(ErrTruncated, "incomplete_chpl", uint64(p), "")
+		}
+
+		start := get_uint64(uint64(p), payload)
+		length := uint32(payload[p + 8])
+		p += 9
+		if uint32(len(payload)) - p < length {
+			return chapters, parse_error(ErrTruncated, "incomplete_chpl", uint64(p - 1), "")
+		}
+
+		chapters = append(chapters, Chapter{Start_ms: int64(start / 10000), Title: string(payload[p : p + length])})
+		p += length
+	}
+
+	return chapters, nil
+}
+
+// ChapterTrackIds returns the IDs of the text tracks referenced as chapters
+// (tref chap) by the tracks.
+func ChapterTrackIds(tracks []Track_info) []uint32 {
+	var ids []uint32
+	for _, track := range tracks {
+		for _, chap := range track.Trak.FindAll("tref/chap") {
+			for p := uint32(0); p + 4 <= uint32(len(chap.Payload)); p += 4 {
+				ids = append(ids, get_uint32(p, chap.Payload))
+			}
+		}
+	}
+
+	return ids
+}
+
+// GetChapters returns the chapters of a progressive file: the samples of the
+// QuickTime chapter track referenced by a tref chap box, or else the Nero
+// chpl box of moov/udta.
+func GetChapters(data []byte) ([]Chapter, error) {
+	tracks, err := GetTracks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ChapterTrackIds(tracks) {
+		track, err := FindTrack(tracks, id, "")
+		if err != nil || !is_text_track(track) {
+			continue
+		}
+
+		cues, err := GetTextCues(data, track)
+		if err != nil {
+			return nil, err
+		}
+
+		var chapters []Chapter
+		for _, cue := range cues {
+			chapters = append(chapters, Chapter{Start_ms: cue.Start.Milliseconds(), Title: cue.Text})
+		}
+
+		return chapters, nil
+	}
+
+	boxes, err := ParseBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	moov := FindBox(boxes, "moov")
+	for _, udta := range moov.ChildrenOfType(mp4_fourcc('u', 'd', 't', 'a')) {
+		for _, box := range udta_children(udta) {
+			if box.Type == mp4_fourcc('c', 'h', 'p', 'l') {
+				chapters, err := parse_chpl(box.Payload)
+				return chapters, in_box(err, box)
+			}
+		}
+	}
+
+	return nil, box_not_found(moov, "udta/chpl")
+}
@@ -0,0 +1,30 @@
+package media_utils
+
+import (
+	"testing"
+)
+
+// FuzzTimedText checks the chapter and text track readers; text cues are
+// never empty.
+func FuzzTimedText(f *testing.F) {
+	f.Add(largesize_progressive_file())
+	f.Add(fuzz_init())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ParseTextSample(data)
+		GetChapters(data)
+		tracks, err := GetTracks(data)
+		if err != nil {
+			return
+		}
+
+		ChapterTrackIds(tracks)
+		for _, track := range tracks {
+			cues, _ := GetTextCues(data, track)
+			for _, cue := range cues {
+				if cue.Text == "" || cue.End < cue.Start {
+					t.Fatalf("cue %+v", cue)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package media_utils
+
+import (
+	"fmt"
+)
+
+// Timeline issue kinds
+const (
+	Timeline_gap = "gap"
+	Timeline_overlap = "overlap"
+	Timeline_tfdt_regression = "tfdt_regression"
+	Timeline_missing_tfdt = "missing_tfdt"
+	Timeline_timescale_mismatch = "timescale_mismatch"
+)
+
+// Fragment_timing is the decode time span of one track fragment (traf).
+type Fragment_timing struct {
+	Segment_index int
+	Track_id uint32
+	Base_media_decode_time uint64
+	Duration uint64
+	Sample_count int
+}
+
+// Timeline_issue is a discontinuity found by the Timeline_validator. For gaps,
+// overlaps and regressions, Delta_ticks and Delta_ms are the tfdt minus the
+// expected decode time, in the track timescale and in milliseconds.
+type Timeline_issue struct {
+	Kind string
+	Segment_index int
+	Track_id uint32
+	Expected uint64
+	Actual uint64
+	Delta_ticks int64
+	Delta_ms float64
+	Message string
+}
+
+func (issue Timeline_issue) String() string {
+	return fmt.Sprintf("segment %d track %d: %s", issue.Segment_index, issue.Track_id, issue.Message)
+}
+
+type track_timeline struct {
+	timescale uint32
+	default_sample_duration uint32
+	started bool
+	last_tfdt uint64
+	next_dts uint64 // tfdt plus the duration of the last fragment
+}
+
+// Timeline_validator checks that consecutive media segments of an init
+// segment continue each other: the tfdt of every track fragment must equal
+// the tfdt of the previous fragment of the track plus the sum of its trun
+// sample durations. Segments are added in playback order.
+type Timeline_validator struct {
+	Tolerance uint64 // discontinuities of up to this many ticks are ignored
+	Fragments []Fragment_timing
+	Issues []Timeline_issue
+
+	tracks map[uint32]*track_timeline
+	segment_index int
+}
+
+func NewTimelineValidator(tracks []Track_info) *Timeline_validator {
+	v := &Timeline_validator{tracks: make(map[uint32]*track_timeline)}
+	for _, track := range tracks {
+		v.tracks[track.Track_id] = &track_timeline{timescale: track.Timescale, default_sample_duration: track.Default_sample_duration}
+	}
+
+	return v
+}
+
+func (v *Timeline_validator) issue(kind string, track_id uint32, format string, args ...any) *Timeline_issue {
+	v.Issues = append(v.Issues, Timeline_issue{Kind: kind, Segment_index: v.segment_index, Track_id: track_id, Message: fmt.Sprintf(format, args...)})
+	return &v.Issues[len(v.Issues) - 1]
+}
+
+func ticks_to_ms(ticks int64, timescale uint32) float64 {
+	if timescale == 0 {
+		return 0
+	}
+
+	return float64(ticks) * 1000 / float64(timescale)
+}
+
+// traf_timing returns the tfdt and the duration of a track fragment.
+func traf_timing(traf *Mp4_box, tfhd Tfhd_box, default_sample_duration uint32) (uint64, bool, uint64, int, error) {
+	if tfhd.Header.Flag & Tfhd_default_sample_duration_present != 0 {
+		default_sample_duration = tfhd.Default_sample_duration
+	}
+
+	var tfdt uint64
+	has_tfdt := false
+	if tfdt_box := traf.Child(mp4_fourcc('t', 'f', 'd', 't')); tfdt_box != nil {
+		t, err := parse_tfdt(tfdt_box.Payload)
+		if err != nil {
+			return 0, false, 0, 0, in_box(err, tfdt_box)
+		}
+
+		tfdt, has_tfdt = t, true
+	}
+
+	duration := uint64(0)
+	sample_count := 0
+	for _, trun_box := range traf.ChildrenOfType(mp4_fourcc('t', 'r', 'u', 'n')) {
+		trun, err := parse_trun(trun_box.Payload)
+		if err != nil {
+			return 0, false, 0, 0, in_box(err, trun_box)
+		}
+
+		for _, s := range trun.Samples {
+			if trun.Header.Flag & Trun_sample_duration_present != 0 {
+				duration += uint64(s.Duration)
+			} else {
+				duration += uint64(default_sample_duration)
+			}
+		}
+
+		sample_count += len(trun.Samples)
+	}
+
+	return tfdt, has_tfdt, duration, sample_count, nil
+}
+
+// AddSegment checks the next media segment and returns the issues found in it.
+func (v *Timeline_validator) AddSegment(seg_data []byte) ([]Timeline_issue, error) {
+	first_issue := len(v.Issues)
+	defer func() { v.segment_index++ }()
+
+	boxes, err := ParseBoxes(seg_data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sidx_box := range FindBoxes(boxes, "sidx") {
+		sidx, err := parse_sidx(sidx_box.Payload)
+		if err != nil {
+			return nil, in_box(err, sidx_box)
+		}
+
+		if t, ok := v.tracks[sidx.Reference_id]; ok && sidx.Timescale != t.timescale {
+			v.issue(Timeline_timescale_mismatch, sidx.Reference_id, "sidx timescale %d differs from the track timescale %d", sidx.Timescale, t.timescale)
+		}
+	}
+
+	for _, traf := range FindBoxes(boxes, "moof/traf") {
+		tfhd_box := traf.Child(mp4_fourcc('t', 'f', 'h', 'd'))
+		if tfhd_box == nil {
+			return nil, box_not_found(traf, "tfhd")
+		}
+
+		tfhd, err := parse_tfhd(tfhd_box.Payload)
+		if err != nil {
+			return nil, in_box(err, tfhd_box)
+		}
+
+		t, ok := v.tracks[tfhd.Track_id]
+		if !ok {
+			return nil, box_error(ErrInvalidData, fmt.Sprintf("unknown_track_id %d", tfhd.Track_id), tfhd_box)
+		}
+
+		tfdt, has_tfdt, duration, sample_count, err := traf_timing(traf, tfhd, t.default_sample_duration)
+		if err != nil {
+			return nil, err
+		}
+
+		if !has_tfdt {
+			v.issue(Timeline_missing_tfdt, tfhd.Track_id, "no tfdt, assuming it continues the previous fragment at %d", t.next_dts)
+			tfdt = t.next_dts
+		} else if t.started && tfdt != t.next_dts {
+			delta := int64(tfdt - t.next_dts)
+			magnitude := uint64(delta)
+			if delta < 0 {
+				magnitude = uint64(-delta)
+			}
+
+			if magnitude > v.Tolerance {
+				var issue *Timeline_issue
+				switch {
+				case tfdt < t.last_tfdt:
+					issue = v.issue(Timeline_tfdt_regression, tfhd.Track_id, "tfdt %d is before the tfdt %d of the previous fragment (%d ticks, %.3f ms)", tfdt, t.last_tfdt, delta, ticks_to_ms(delta, t.timescale))
+				case delta > 0:
+					issue = v.issue(Timeline_gap, tfhd.Track_id, "gap of %d ticks (%.3f ms): tfdt %d, expected %d", delta, ticks_to_ms(delta, t.timescale), tfdt, t.next_dts)
+				default:
+					issue = v.issue(Timeline_overlap, tfhd.Track_id, "overlap of %d ticks (%.3f ms): tfdt %d, expected %d", -delta, ticks_to_ms(-delta, t.timescale), tfdt, t.next_dts)
+				}
+
+				issue.Expected = t.next_dts
+				issue.Actual = tfdt
+				issue.Delta_ticks = delta
+				issue.Delta_ms = ticks_to_ms(delta, t.timescale)
+			}
+		}
+
+		v.Fragments = append(v.Fragments, Fragment_timing{Segment_index: v.segment_index, Track_id: tfhd.Track_id, Base_media_decode_time: tfdt, Duration: duration, Sample_count: sample_count})
+		t.started = true
+		t.last_tfdt = tfdt
+		t.next_dts = tfdt + duration
+	}
+
+	return v.Issues[first_issue:], nil
+}
@@ -0,0 +1,37 @@
+package media_utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+// FuzzTimelineValidator checks that AddSegment returns the issues it found in
+// the segment.
+func FuzzTimelineValidator(f *testing.F) {
+	f.Add(fuzz_init(), fuzz_segment())
+	f.Fuzz(func(t *testing.T, init_data []byte, seg_data []byte) {
+		tracks, err := GetTracks(init_data)
+		if err != nil {
+			return
+		}
+
+		v := NewTimelineValidator(tracks)
+		for i := 0; i < 2; i++ {
+			before := len(v.Issues)
+			issues, err := v.AddSegment(seg_data)
+			if err != nil {
+				return
+			}
+
+			if !reflect.DeepEqual(issues, v.Issues[before:]) && len(issues) + before != 0 {
+				t.Fatalf("segment %d issues %+v, recorded %+v", i, issues, v.Issues[before:])
+			}
+
+			for _, issue := range issues {
+				if issue.Segment_index != i {
+					t.Fatalf("segment %d issue %v", i, issue)
+				}
+			}
+		}
+	})
+}
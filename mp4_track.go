@@ -0,0 +1,260 @@
+package media_utils
+
+import (
+	"fmt"
+)
+
+// Track_info describes a track of a moov box.
+type Track_info struct {
+	Track_id uint32
+	Handler_type string // "vide", "soun", "subt", "text", ...
+	Timescale uint32
+	Duration uint64
+	Language string
+	Sample_entry *Mp4_box // first stsd entry
+	Codec string // sample entry fourcc, e.g. "avc1"
+	Width uint16
+	Height uint16
+	Channel_count uint16
+	Sample_rate uint32
+
+	Avcc *Avcc_config
+	Hvcc *Hvcc_config
+	Esds *Esds_config
+	Audio_config *Audio_specific_config
+
+	// trex defaults, for fragmented tracks
+	Default_sample_description_index uint32
+	Default_sample_duration uint32
+	Default_sample_size uint32
+	Default_sample_flags uint32
+
+	Trak *Mp4_box
+}
+
+func mdhd_language(code uint16) string {
+	if code == 0 {
+		return ""
+	}
+
+	return string([]byte{byte(code >> 10 & 0x1F) + 0x60, byte(code >> 5 & 0x1F) + 0x60, byte(code & 0x1F) + 0x60})
+}
+
+// parse_track reads the track header, media header, handler and first sample
+// entry of a trak box.
+func parse_track(trak *Mp4_box) (Track_info, error) {
+	track := Track_info{Trak: trak, Default_sample_description_index: 1}
+	tkhd := trak.Child(mp4_fourcc('t', 'k', 'h', 'd'))
+	if tkhd == nil {
+		return track, box_not_found(trak, "tkhd")
+	}
+
+	id_offset, err := tkhd_track_id_offset(tkhd.Payload)
+	if err != nil {
+		return track, in_box(err, tkhd)
+	}
+
+	track.Track_id = get_uint32(id_offset, tkhd.Payload)
+
+	mdhd := trak.Find("mdia/mdhd")
+	if mdhd == nil {
+		return track, box_not_found(trak, "mdia/mdhd")
+	}
+
+	if mdhd.Version() == 1 {
+		if len(mdhd.Payload) < 34 {
+			return track, incomplete_box(mdhd)
+		}
+
+		track.Timescale = get_uint32(20, mdhd.Payload)
+		track.Duration = get_uint64(24, mdhd.Payload)
+		track.Language = mdhd_language(get_uint16(32, mdhd.Payload))
+	} else {
+		if len(mdhd.Payload) < 22 {
+			return track, incomplete_box(mdhd)
+		}
+
+		track.Timescale = get_uint32(12, mdhd.Payload)
+		track.Duration = uint64(get_uint32(16, mdhd.Payload))
+		track.Language = mdhd_language(get_uint16(20, mdhd.Payload))
+	}
+
+	hdlr := trak.Find("mdia/hdlr")
+	if hdlr != nil && len(hdlr.Payload) >= 12 {
+		track.Handler_type = fourcc_string(get_uint32(8, hdlr.Payload))
+	}
+
+	stsd := trak.Find("mdia/minf/stbl/stsd")
+	if stsd == nil || len(stsd.Children) == 0 {
+		return track, nil
+	}
+
+	entry := stsd.Children[0]
+	track.Sample_entry = entry
+	track.Codec = entry.TypeString()
+	if mp4_visual_sample_entries[entry.Type] && len(entry.Payload) >= 28 {
+		track.Width = get_uint16(24, entry.Payload)
+		track.Height = get_uint16(26, entry.Payload)
+	} else if mp4_audio_sample_entries[entry.Type] && len(entry.Payload) >= 28 {
+		track.Channel_count = get_uint16(16, entry.Payload)
+		track.Sample_rate = get_uint32(24, entry.Payload) >> 16
+	}
+
+	if avcc := entry.Child(mp4_fourcc('a', 'v', 'c', 'C')); avcc != nil {
+		config, err := ParseAvcc(avcc.Payload)
+		if err != nil {
+			return track, in_box(err, avcc)
+		}
+
+		track.Avcc = &config
+	}
+
+	if hvcc := entry.Child(mp4_fourcc('h', 'v', 'c', 'C')); hvcc != nil {
+		config, err := ParseHvcc(hvcc.Payload)
+		if err != nil {
+			return track, in_box(err, hvcc)
+		}
+
+		track.Hvcc = &config
+	}
+
+	if esds := entry.Child(mp4_fourcc('e', 's', 'd', 's')); esds != nil {
+		config, err := ParseEsds(esds.Payload)
+		if err != nil {
+			return track, in_box(err, esds)
+		}
+
+		track.Esds = &config
+		if config.Object_type_indication == 0x40 && len(config.Decoder_specific_info) > 0 {
+			asc, err := ParseAudioSpecificConfig(config.Decoder_specific_info)
+			if err != nil {
+				return track, at_box(err, esds)
+			}
+
+			track.Audio_config = &asc
+		}
+	}
+
+	return track, nil
+}
+
+// GetTracks returns the tracks of the moov box in data, which may be an init
+// segment or a complete MP4 file.
+func GetTracks(data []byte) ([]Track_info, error) {
+	boxes, err := ParseBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	moov := FindBox(boxes, "moov")
+	if moov == nil {
+		return nil, box_not_found(nil, "moov")
+	}
+
+	var tracks []Track_info
+	for _, trak := range moov.ChildrenOfType(mp4_fourcc('t', 'r', 'a', 'k')) {
+		track, err := parse_track(trak)
+		if err != nil {
+			return nil, err
+		}
+
+		tracks = append(tracks, track)
+	}
+
+	for _, trex := range moov.FindAll("mvex/trex") {
+		if len(trex.Payload) < 24 {
+			return nil, incomplete_box(trex)
+		}
+
+		for i := range tracks {
+			if tracks[i].Track_id == get_uint32(4, trex.Payload) {
+				tracks[i].Default_sample_description_index = get_uint32(8, trex.Payload)
+				tracks[i].Default_sample_duration = get_uint32(12, trex.Payload)
+				tracks[i].Default_sample_size = get_uint32(16, trex.Payload)
+				tracks[i].Default_sample_flags = get_uint32(20, trex.Payload)
+			}
+		}
+	}
+
+	return tracks, nil
+}
+
+// FindTrack returns the track with the given ID, or the first track of the
+// given handler type when track_id is 0.
+func FindTrack(tracks []Track_info, track_id uint32, handler_type string) (Track_info, error) {
+	for _, track := range tracks {
+		if track_id != 0 && track.Track_id == track_id {
+			return track, nil
+		}
+
+		if track_id == 0 && (handler_type == "" || track.Handler_type == handler_type) {
+			return track, nil
+		}
+	}
+
+	return Track_info{}, parse_error(ErrBoxNotFound, "Failed_to_find_track", 0, "moov/trak")
+}
+
+// CodecString returns the RFC 6381 codec string of the track, e.g.
+// avc1.64001f, hvc1.2.4.L153.B0 or mp4a.40.2, as used in HLS CODECS and DASH
+// @codecs. Encrypted tracks (encv, enca) report their original format. Other
+// codecs are reported by their sample entry type.
+func (track Track_info) CodecString() string {
+	codec := track.Codec
+	if track.Sample_entry != nil {
+		if frma := track.Sample_entry.Find("sinf/frma"); frma != nil && len(frma.Payload) >= 4 {
+			codec = fourcc_string(get_uint32(0, frma.Payload))
+		}
+	}
+
+	switch {
+	case track.Avcc != nil:
+		return fmt.Sprintf("%s.%02x%02x%02x", codec, track.Avcc.Profile, track.Avcc.Profile_compatibility, track.Avcc.Level)
+	case track.Hvcc != nil:
+		h := track.Hvcc
+		s := codec + "."
+		if h.General_profile_space > 0 {
+			s += string(rune('A' + h.General_profile_space - 1))
+		}
+
+		// The compatibility flags in reverse bit order
+		compatibility := uint32(0)
+		for i := 0; i < 32; i++ {
+			if h.General_profile_compatibility_flags & (1 << uint(i)) != 0 {
+				compatibility |= 1 << uint(31 - i)
+			}
+		}
+
+		tier := "L"
+		if h.General_tier_flag {
+			tier = "H"
+		}
+
+		s += fmt.Sprintf("%d.%X.%s%d", h.General_profile_idc, compatibility, tier, h.General_level_idc)
+
+		// The constraint indicator bytes, trailing zero bytes omitted
+		constraints := make([]byte, 6)
+		for i := range constraints {
+			constraints[i] = byte(h.General_constraint_indicator_flags >> uint(40 - 8 * i))
+		}
+
+		n := len(constraints)
+		for n > 0 && constraints[n - 1] == 0 {
+			n--
+		}
+
+		for _, c := range constraints[:n] {
+			s += fmt.Sprintf(".%X", c)
+		}
+
+		return s
+	case track.Esds != nil:
+		if track.Audio_config != nil {
+			return fmt.Sprintf("%s.%x.%d", codec, track.Esds.Object_type_indication, track.Audio_config.Audio_object_type)
+		}
+
+		return fmt.Sprintf("%s.%x", codec, track.Esds.Object_type_indication)
+	}
+
+	return codec
+}
@@ -0,0 +1,315 @@
+package media_utils
+
+import (
+	"fmt"
+)
+
+// SEI payload types
+const (
+	Sei_buffering_period = 0
+	Sei_pic_timing = 1
+	Sei_user_data_registered_itu_t_t35 = 4
+	Sei_user_data_unregistered = 5
+	Sei_recovery_point = 6
+	Sei_mastering_display_colour_volume = 137
+	Sei_content_light_level_info = 144
+	Sei_alternative_transfer_characteristics = 147
+)
+
+var avc_nal_type_names = map[uint8]string{
+	1: "SLICE", 2: "DPA", 3: "DPB", 4: "DPC", 5: "IDR", 6: "SEI", 7: "SPS", 8: "PPS",
+	9: "AUD", 10: "END_SEQ", 11: "END_STREAM", 12: "FILLER", 13: "SPS_EXT", 14: "PREFIX", 15: "SUBSET_SPS", 20: "SLICE_EXT",
+}
+
+var hevc_nal_type_names = map[uint8]string{
+	0: "TRAIL_N", 1: "TRAIL_R", 2: "TSA_N", 3: "TSA_R", 4: "STSA_N", 5: "STSA_R", 6: "RADL_N", 7: "RADL_R", 8: "RASL_N", 9: "RASL_R",
+	16: "BLA_W_LP", 17: "BLA_W_RADL", 18: "BLA_N_LP", 19: "IDR_W_RADL", 20: "IDR_N_LP", 21: "CRA",
+	32: "VPS", 33: "SPS", 34: "PPS", 35: "AUD", 36: "EOS", 37: "EOB", 38: "FD", 39: "PREFIX_SEI", 40: "SUFFIX_SEI",
+}
+
+// Sei_message is one SEI message of a SEI NAL unit; Payload is RBSP data.
+type Sei_message struct {
+	Payload_type uint32
+	Payload []byte
+}
+
+type Nal_unit_info struct {
+	Type uint8
+	Type_name string
+	Temporal_id uint8 // HEVC only
+	Size int
+	Slice_type string // "I", "P", "B", "SP", "SI" for slices, "" otherwise or if not parsed
+	Sei_messages []Sei_message
+}
+
+// Picture_info classifies the NAL units of one sample (access unit).
+type Picture_info struct {
+	Nal_units []Nal_unit_info
+	Picture_type string // "I", "P" or "B" from the slice types, "" if unknown
+	Key_type string // "IDR", "CRA", "BLA", "I" (H.264 recovery point) or "" for non-key pictures
+	Is_irap bool // IDR/CRA/BLA
+	Is_rasl bool
+	Is_radl bool
+	Has_recovery_point bool
+	Sei_payload_types []uint32
+}
+
+// Nal_analyzer parses the length-prefixed NAL units of H.264/HEVC samples,
+// tracking the parameter set state needed to read slice headers.
+type Nal_analyzer struct {
+	codec int
+	nal_length_size int
+	// HEVC: num_extra_slice_header_bits per pps_pic_parameter_set_id
+	hevc_extra_slice_header_bits map[uint64]uint
+}
+
+// NalToRbsp removes the emulation prevention bytes of a NAL unit.
+func NalToRbsp(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+
+		rbsp = append(rbsp, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+
+	return rbsp
+}
+
+// NewNalAnalyzer returns a Nal_analyzer for an H.264 or HEVC track.
+func NewNalAnalyzer(track Track_info) (*Nal_analyzer, error) {
+	a := &Nal_analyzer{hevc_extra_slice_header_bits: make(map[uint64]uint)}
+	if track.Avcc != nil {
+		a.codec = es_codec_avc
+		a.nal_length_size = int(track.Avcc.Nal_length_size)
+	} else if track.Hvcc != nil {
+		a.codec = es_codec_hevc
+		a.nal_length_size = int(track.Hvcc.Nal_length_size)
+		for _, array := range track.Hvcc.Arrays {
+			if array.Nal_unit_type != 34 {
+				continue
+			}
+
+			for _, pps := range array.Nalus {
+				a.parse_hevc_pps(pps)
+			}
+		}
+	} else {
+		return nil, parse_error(ErrUnsupported, "unsupported_codec_" + track.Codec, 0, "")
+	}
+
+	return a, nil
+}
+
+func (a *Nal_analyzer) header_size() int {
+	if a.codec == es_codec_hevc {
+		return 2
+	}
+
+	return 1
+}
+
+func (a *Nal_analyzer) parse_hevc_pps(nalu []byte) {
+	if len(nalu) < 3 {
+		return
+	}
+
+	r := new_bit_reader(NalToRbsp(nalu[2:]))
+	pps_id := r.read_ue()
+	r.read_ue() // pps_seq_parameter_set_id
+	r.read_flag() // dependent_slice_segments_enabled_flag
+	r.read_flag() // output_flag_present_flag
+	extra_bits := uint(r.read_bits(3))
+	if r.err == nil {
+		a.hevc_extra_slice_header_bits[pps_id] = extra_bits
+	}
+}
+
+// slice_type reads the slice type from the slice header. HEVC slice types are
+// only read for the first slice segment of a picture, the others need SPS
+// state to be located.
+func (a *Nal_analyzer) slice_type(nal_type uint8, nalu []byte) string {
+	if len(nalu) <= a.header_size() {
+		return ""
+	}
+
+	r := new_bit_reader(NalToRbsp(nalu[a.header_size():]))
+	var slice_type uint64
+	if a.codec == es_codec_avc {
+		r.read_ue() // first_mb_in_slice
+		slice_type = r.read_ue() % 5
+		if r.err != nil {
+			return ""
+		}
+
+		return []string{"P", "B", "I", "SP", "SI"}[slice_type]
+	}
+
+	if !r.read_flag() { // first_slice_segment_in_pic_flag
+		return ""
+	}
+
+	if nal_type >= 16 && nal_type <= 23 {
+		r.read_flag() // no_output_of_prior_pics_flag
+	}
+
+	pps_id := r.read_ue()
+	extra_bits, ok := a.hevc_extra_slice_header_bits[pps_id]
+	if !ok {
+		return ""
+	}
+
+	r.skip_bits(uint64(extra_bits))
+	slice_type = r.read_ue()
+	if r.err != nil || slice_type > 2 {
+		return ""
+	}
+
+	return []string{"B", "P", "I"}[slice_type]
+}
+
+// ParseSeiMessages splits the RBSP of a SEI NAL unit (without NAL header) into SEI messages.
+func ParseSeiMessages(rbsp []byte) []Sei_message {
+	var messages []Sei_message
+	p := 0
+	// Stop at the rbsp_trailing_bits
+	for len(rbsp) - p > 1 || (len(rbsp) - p == 1 && rbsp[p] != 0x80) {
+		var payload_type, payload_size uint32
+		for p < len(rbsp) && rbsp[p] == 0xFF {
+			payload_type += 255
+			p++
+		}
+
+		if p >= len(rbsp) {
+			break
+		}
+
+		payload_type += uint32(rbsp[p])
+		p++
+		for p < len(rbsp) && rbsp[p] == 0xFF {
+			payload_size += 255
+			p++
+		}
+
+		if p >= len(rbsp) {
+			break
+		}
+
+		payload_size += uint32(rbsp[p])
+		p++
+		if uint32(len(rbsp) - p) < payload_size {
+			break
+		}
+
+		messages = append(messages, Sei_message{Payload_type: payload_type, Payload: rbsp[p : p+int(payload_size)]})
+		p += int(payload_size)
+	}
+
+	return messages
+}
+
+// AnalyzeSample classifies the NAL units of a video sample.
+func (a *Nal_analyzer) AnalyzeSample(sample Mp4_sample) (Picture_info, error) {
+	var pic Picture_info
+	if sample.Data == nil {
+		return pic, parse_error(ErrTruncated, "sample_outside_data", sample.Offset, "")
+	}
+
+	nalus, err := SplitNalUnits(sample.Data, a.nal_length_size)
+	if err != nil {
+		return pic, err
+	}
+
+	has_i, has_p, has_b := false, false, false
+	for _, nalu := range nalus {
+		if len(nalu) < a.header_size() {
+			continue
+		}
+
+		info := Nal_unit_info{Type: nal_unit_type(a.codec, nalu), Size: len(nalu)}
+		is_slice, is_sei := false, false
+		if a.codec == es_codec_hevc {
+			info.Type_name = hevc_nal_type_names[info.Type]
+			info.Temporal_id = nalu[1] & 0x07
+			if info.Temporal_id > 0 {
+				info.Temporal_id--
+			}
+
+			is_slice = info.Type <= 9 || (info.Type >= 16 && info.Type <= 21)
+			is_sei = info.Type == 39 || info.Type == 40
+			switch {
+			case info.Type >= 16 && info.Type <= 18:
+				pic.Is_irap, pic.Key_type = true, "BLA"
+			case info.Type == 19 || info.Type == 20:
+				pic.Is_irap, pic.Key_type = true, "IDR"
+			case info.Type == 21:
+				pic.Is_irap, pic.Key_type = true, "CRA"
+			case info.Type == 6 || info.Type == 7:
+				pic.Is_radl = true
+			case info.Type == 8 || info.Type == 9:
+				pic.Is_rasl = true
+			case info.Type == 34:
+				a.parse_hevc_pps(nalu)
+			}
+		} else {
+			info.Type_name = avc_nal_type_names[info.Type]
+			is_slice = info.Type == 1 || info.Type == 5
+			is_sei = info.Type == 6
+			if info.Type == 5 {
+				pic.Is_irap, pic.Key_type = true, "IDR"
+			}
+		}
+
+		if info.Type_name == "" {
+			info.Type_name = fmt.Sprintf("NAL_%d", info.Type)
+		}
+
+		if is_slice {
+			info.Slice_type = a.slice_type(info.Type, nalu)
+			switch info.Slice_type {
+			case "I", "SI":
+				has_i = true
+			case "P", "SP":
+				has_p = true
+			case "B":
+				has_b = true
+			}
+		}
+
+		if is_sei {
+			info.Sei_messages = ParseSeiMessages(NalToRbsp(nalu[a.header_size():]))
+			for _, m := range info.Sei_messages {
+				pic.Sei_payload_types = append(pic.Sei_payload_types, m.Payload_type)
+				if m.Payload_type == Sei_recovery_point {
+					pic.Has_recovery_point = true
+				}
+			}
+		}
+
+		pic.Nal_units = append(pic.Nal_units, info)
+	}
+
+	switch {
+	case has_b:
+		pic.Picture_type = "B"
+	case has_p:
+		pic.Picture_type = "P"
+	case has_i:
+		pic.Picture_type = "I"
+	}
+
+	// A H.264 I picture with a recovery point SEI is a random access point
+	if pic.Key_type == "" && a.codec == es_codec_avc && pic.Picture_type == "I" && pic.Has_recovery_point {
+		pic.Key_type = "I"
+	}
+
+	return pic, nil
+}
@@ -0,0 +1,27 @@
+package media_utils
+
+import (
+	"testing"
+)
+
+// FuzzParseSeiMessages checks that the SEI messages of a SEI NAL unit, after
+// its header, lie within the RBSP.
+func FuzzParseSeiMessages(f *testing.F) {
+	f.Add([]byte{0x04, 0x0A, 0xB5, 0x00, 0x31, 'G', 'A', '9', '4', 0x03, 0x40, 0xFF, 0x80})
+	f.Add([]byte{0x00, 0x00, 0x03, 0x01, 0xFF, 0x01, 0x00, 0x80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rbsp := NalToRbsp(data)
+		if len(rbsp) > len(data) {
+			t.Fatalf("%d byte RBSP of %d bytes", len(rbsp), len(data))
+		}
+
+		size := 0
+		for _, m := range ParseSeiMessages(rbsp) {
+			size += 2 + len(m.Payload)
+		}
+
+		if size > len(rbsp) {
+			t.Fatalf("%d bytes of SEI messages in %d bytes", size, len(rbsp))
+		}
+	})
+}
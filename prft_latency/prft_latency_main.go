@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/maxutility2011/media_utils"
+)
+
+type playlistSegment struct {
+	Uri string
+	Duration float64
+	Program_date_time time.Time // zero if neither signaled nor derivable
+	Pdt_signaled bool
+}
+
+// parseMediaPlaylist reads the segments of a local media playlist. Segments
+// without their own EXT-X-PROGRAM-DATE-TIME get one derived from the previous
+// segment's date and duration.
+func parseMediaPlaylist(data []byte) (string, []playlistSegment) {
+	var mapUri string
+	var segments []playlistSegment
+	var seg playlistSegment
+	var nextPdt time.Time
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#EXT-X-MAP") {
+			leftQuote := strings.Index(line, "\"")
+			rightQuote := strings.LastIndex(line, "\"")
+			if leftQuote >= 0 && rightQuote > leftQuote {
+				mapUri = line[leftQuote+1 : rightQuote]
+			}
+		} else if strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:") {
+			pdt, err := time.Parse(time.RFC3339Nano, line[len("#EXT-X-PROGRAM-DATE-TIME:"):])
+			if err != nil {
+				fmt.Printf("Invalid EXT-X-PROGRAM-DATE-TIME: %s\n", line)
+				continue
+			}
+
+			seg.Program_date_time = pdt
+			seg.Pdt_signaled = true
+		} else if strings.HasPrefix(line, "#EXTINF:") {
+			durationStr := line[len("#EXTINF:"):]
+			if comma := strings.Index(durationStr, ","); comma >= 0 {
+				durationStr = durationStr[:comma]
+			}
+
+			seg.Duration, _ = strconv.ParseFloat(durationStr, 64)
+		} else if !strings.HasPrefix(line, "#") {
+			seg.Uri = line
+			if !seg.Pdt_signaled && !nextPdt.IsZero() {
+				seg.Program_date_time = nextPdt
+			}
+
+			if !seg.Program_date_time.IsZero() {
+				nextPdt = seg.Program_date_time.Add(time.Duration(seg.Duration * float64(time.Second)))
+			}
+
+			segments = append(segments, seg)
+			seg = playlistSegment{}
+		}
+	}
+
+	return mapUri, segments
+}
+
+// localPath maps a playlist URI to the file hls_downloader saved it to: the
+// same relative path under the playlist folder, or the bare file name for
+// EXT-X-MAP segments.
+func localPath(playlistDir string, uri string) string {
+	if i := strings.Index(uri, "?"); i >= 0 {
+		uri = uri[:i]
+	}
+
+	path := filepath.Join(playlistDir, uri)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+
+	return filepath.Join(playlistDir, filepath.Base(uri))
+}
+
+func msBetween(a time.Time, b time.Time) float64 {
+	return float64(a.Sub(b)) / float64(time.Millisecond)
+}
+
+func main() {
+	playlistPtr := flag.String("playlist", "", "Local path of a media playlist downloaded by hls_downloader")
+	initPtr := flag.String("init", "", "Init segment path (default: the EXT-X-MAP of the playlist)")
+	timescalePtr := flag.Uint("timescale", 0, "Timescale of the prft reference track, if there is no init segment")
+	flag.Parse()
+
+	if *playlistPtr == "" {
+		fmt.Printf("Input media playlist path is required.\n")
+		os.Exit(1)
+	}
+
+	playlistData, err := os.ReadFile(*playlistPtr)
+	if err != nil {
+		fmt.Printf("Error: Failed to read playlist: %s. Error: %v\n", *playlistPtr, err)
+		os.Exit(1)
+	}
+
+	playlistDir := filepath.Dir(*playlistPtr)
+	mapUri, segments := parseMediaPlaylist(playlistData)
+
+	initPath := *initPtr
+	if initPath == "" && mapUri != "" {
+		initPath = localPath(playlistDir, mapUri)
+	}
+
+	var initData []byte
+	if initPath != "" {
+		initData, err = os.ReadFile(initPath)
+		if err != nil {
+			fmt.Printf("Error: Failed to read init segment: %s. Error: %v\n", initPath, err)
+			os.Exit(1)
+		}
+	}
+
+	// Download time is taken from the file modification time, i.e. when
+	// hls_downloader finished writing the segment.
+	fmt.Println("segment,prft_flags,prft_utc,segment_start_utc,download_utc,latency_ms,program_date_time,pdt_minus_prft_ms")
+	for _, seg := range segments {
+		segPath := localPath(playlistDir, seg.Uri)
+		segData, err := os.ReadFile(segPath)
+		if err != nil {
+			fmt.Printf("%s: failed to read segment. Error: %v\n", seg.Uri, err)
+			continue
+		}
+
+		info, err := os.Stat(segPath)
+		if err != nil {
+			fmt.Printf("%s: failed to stat segment. Error: %v\n", seg.Uri, err)
+			continue
+		}
+
+		downloadTime := info.ModTime().UTC()
+
+		prft, err := media_utils.GetPrft(segData)
+		if err != nil {
+			fmt.Printf("%s: no prft. Error: %v\n", seg.Uri, err)
+			continue
+		}
+
+		timescale := uint32(*timescalePtr)
+		if initData != nil {
+			mdhd, err := media_utils.GetMdhd(initData, prft.Reference_track_id)
+			if err == nil {
+				timescale = mdhd.Timescale
+			}
+		}
+
+		// Wall clock of the first sample of the reference track in the
+		// segment, derived from prft
+		segmentStart := prft.Time()
+		tfdt, err := media_utils.GetTrackTfdt(segData, prft.Reference_track_id)
+		if err == nil && timescale != 0 {
+			segmentStart = prft.MediaTimeToWallClock(tfdt.BaseMediaDecodeTime(), timescale)
+		}
+
+		latency := msBetween(downloadTime, prft.Time())
+		pdtStr := ""
+		pdtDiffStr := ""
+		if !seg.Program_date_time.IsZero() {
+			pdtStr = seg.Program_date_time.UTC().Format(time.RFC3339Nano)
+			pdtDiffStr = fmt.Sprintf("%.3f", msBetween(seg.Program_date_time, segmentStart))
+		}
+
+		fmt.Printf("%s,%d,%s,%s,%s,%.3f,%s,%s\n", seg.Uri, prft.Header.Flag, prft.Time().Format(time.RFC3339Nano), segmentStart.Format(time.RFC3339Nano), downloadTime.Format(time.RFC3339Nano), latency, pdtStr, pdtDiffStr)
+	}
+}
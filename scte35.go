@@ -0,0 +1,723 @@
+package media_utils
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const Scte35_table_id = 0xFC
+
+// splice_command_type values
+const (
+	Splice_null = 0x00
+	Splice_schedule = 0x04
+	Splice_insert_command = 0x05
+	Time_signal_command = 0x06
+	Bandwidth_reservation = 0x07
+	Private_command = 0xFF
+)
+
+// splice_descriptor_tag values
+const (
+	Avail_descriptor_tag = 0x00
+	Dtmf_descriptor_tag = 0x01
+	Segmentation_descriptor_tag = 0x02
+	Time_descriptor_tag = 0x03
+	Audio_descriptor_tag = 0x04
+)
+
+// "CUEI", the identifier of the SCTE-35 splice descriptors
+const Scte35_cuei_identifier = 0x43554549
+
+// segmentation_upid_type values with a nested structure
+const (
+	Upid_type_mpu = 0x0C
+	Upid_type_mid = 0x0D
+)
+
+type Splice_time struct {
+	Time_specified_flag bool
+	Pts_time uint64 // 90kHz, 33 bits
+}
+
+type Break_duration struct {
+	Auto_return bool
+	Duration uint64 // 90kHz, 33 bits
+}
+
+type Splice_insert_component struct {
+	Component_tag uint8
+	Splice_time Splice_time
+}
+
+type Splice_insert struct {
+	Splice_event_id uint32
+	Splice_event_cancel_indicator bool
+	Out_of_network_indicator bool
+	Program_splice_flag bool
+	Duration_flag bool
+	Splice_immediate_flag bool
+	Event_id_compliance_flag bool
+	Splice_time Splice_time // program_splice_flag == 1 && splice_immediate_flag == 0
+	Components []Splice_insert_component // program_splice_flag == 0
+	Break_duration Break_duration // duration_flag == 1
+	Unique_program_id uint16
+	Avail_num uint8
+	Avails_expected uint8
+}
+
+type Time_signal struct {
+	Splice_time Splice_time
+}
+
+// Segmentation_upid is a segmentation_upid of a segmentation_descriptor.
+// Upid_type_mid UPIDs carry their nested UPIDs in Mid; Upid_type_mpu UPIDs keep
+// the format_identifier as the first 4 bytes of Value.
+type Segmentation_upid struct {
+	Type uint8
+	Value []byte
+	Mid []Segmentation_upid
+}
+
+type Segmentation_component struct {
+	Component_tag uint8
+	Pts_offset uint64
+}
+
+type Segmentation_descriptor struct {
+	Segmentation_event_id uint32
+	Segmentation_event_cancel_indicator bool
+	Segmentation_event_id_compliance_indicator bool
+	Program_segmentation_flag bool
+	Segmentation_duration_flag bool
+	Delivery_not_restricted_flag bool
+	Web_delivery_allowed_flag bool
+	No_regional_blackout_flag bool
+	Archive_allowed_flag bool
+	Device_restrictions uint8
+	Components []Segmentation_component // program_segmentation_flag == 0
+	Segmentation_duration uint64 // 90kHz, 40 bits
+	Upid Segmentation_upid
+	Segmentation_type_id uint8
+	Segment_num uint8
+	Segments_expected uint8
+	Has_sub_segments bool
+	Sub_segment_num uint8
+	Sub_segments_expected uint8
+}
+
+// Splice_descriptor is one entry of the descriptor loop. Segmentation
+// descriptors are decoded; the bytes following the identifier of every other
+// descriptor are kept in Data.
+type Splice_descriptor struct {
+	Tag uint8
+	Identifier uint32
+	Segmentation *Segmentation_descriptor
+	Data []byte
+}
+
+type Splice_info_section struct {
+	Table_id uint8
+	Section_syntax_indicator bool
+	Private_indicator bool
+	Sap_type uint8 // 3 = not specified
+	Section_length uint16
+	Protocol_version uint8
+	Encrypted_packet bool
+	Encryption_algorithm uint8
+	Pts_adjustment uint64
+	Cw_index uint8
+	Tier uint16
+	Splice_command_length uint16
+	Splice_command_type uint8
+
+	// Decoded splice command. Commands other than splice_insert and
+	// time_signal keep their raw bytes in Command_data.
+	Splice_insert *Splice_insert
+	Time_signal *Time_signal
+	Command_data []byte
+
+	Descriptors []Splice_descriptor
+
+	// Encrypted sections are not decoded past the header; the encrypted
+	// command and descriptor bytes are kept in Encrypted_data.
+	Encrypted_data []byte
+	E_crc_32 uint32
+	Crc_32 uint32
+}
+
+// crc32_mpeg2 computes the CRC-32/MPEG-2 used by MPEG-2 PSI and SCTE-35 sections.
+// Running it over a section including its CRC_32 field yields 0.
+func crc32_mpeg2(d []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range d {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc & 0x80000000 != 0 {
+				crc = crc << 1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+func read_splice_time(r *bit_reader) Splice_time {
+	var st Splice_time
+	st.Time_specified_flag = r.read_flag()
+	if st.Time_specified_flag {
+		r.skip_bits(6)
+		st.Pts_time = r.read_bits(33)
+	} else {
+		r.skip_bits(7)
+	}
+
+	return st
+}
+
+func write_splice_time(w *bit_writer, st Splice_time) {
+	w.write_flag(st.Time_specified_flag)
+	if st.Time_specified_flag {
+		w.write_bits(6, 0x3F)
+		w.write_bits(33, st.Pts_time)
+	} else {
+		w.write_bits(7, 0x7F)
+	}
+}
+
+func read_break_duration(r *bit_reader) Break_duration {
+	var bd Break_duration
+	bd.Auto_return = r.read_flag()
+	r.skip_bits(6)
+	bd.Duration = r.read_bits(33)
+	return bd
+}
+
+func write_break_duration(w *bit_writer, bd Break_duration) {
+	w.write_flag(bd.Auto_return)
+	w.write_bits(6, 0x3F)
+	w.write_bits(33, bd.Duration)
+}
+
+func parse_splice_insert(r *bit_reader) *Splice_insert {
+	si := &Splice_insert{}
+	si.Splice_event_id = uint32(r.read_bits(32))
+	si.Splice_event_cancel_indicator = r.read_flag()
+	r.skip_bits(7)
+	if si.Splice_event_cancel_indicator {
+		return si
+	}
+
+	si.Out_of_network_indicator = r.read_flag()
+	si.Program_splice_flag = r.read_flag()
+	si.Duration_flag = r.read_flag()
+	si.Splice_immediate_flag = r.read_flag()
+	si.Event_id_compliance_flag = r.read_flag()
+	r.skip_bits(3)
+
+	if si.Program_splice_flag && !si.Splice_immediate_flag {
+		si.Splice_time = read_splice_time(r)
+	}
+
+	if !si.Program_splice_flag {
+		component_count := r.read_bits(8)
+		for i := uint64(0); i < component_count && r.err == nil; i++ {
+			var c Splice_insert_component
+			c.Component_tag = uint8(r.read_bits(8))
+			if !si.Splice_immediate_flag {
+				c.Splice_time = read_splice_time(r)
+			}
+
+			si.Components = append(si.Components, c)
+		}
+	}
+
+	if si.Duration_flag {
+		si.Break_duration = read_break_duration(r)
+	}
+
+	si.Unique_program_id = uint16(r.read_bits(16))
+	si.Avail_num = uint8(r.read_bits(8))
+	si.Avails_expected = uint8(r.read_bits(8))
+	return si
+}
+
+func write_splice_insert(w *bit_writer, si *Splice_insert) {
+	w.write_bits(32, uint64(si.Splice_event_id))
+	w.write_flag(si.Splice_event_cancel_indicator)
+	w.write_bits(7, 0x7F)
+	if si.Splice_event_cancel_indicator {
+		return
+	}
+
+	w.write_flag(si.Out_of_network_indicator)
+	w.write_flag(si.Program_splice_flag)
+	w.write_flag(si.Duration_flag)
+	w.write_flag(si.Splice_immediate_flag)
+	w.write_flag(si.Event_id_compliance_flag)
+	w.write_bits(3, 0x7)
+
+	if si.Program_splice_flag && !si.Splice_immediate_flag {
+		write_splice_time(w, si.Splice_time)
+	}
+
+	if !si.Program_splice_flag {
+		w.write_bits(8, uint64(len(si.Components)))
+		for _, c := range si.Components {
+			w.write_bits(8, uint64(c.Component_tag))
+			if !si.Splice_immediate_flag {
+				write_splice_time(w, c.Splice_time)
+			}
+		}
+	}
+
+	if si.Duration_flag {
+		write_break_duration(w, si.Break_duration)
+	}
+
+	w.write_bits(16, uint64(si.Unique_program_id))
+	w.write_bits(8, uint64(si.Avail_num))
+	w.write_bits(8, uint64(si.Avails_expected))
+}
+
+func parse_segmentation_upid(upid_type uint8, value []byte) (Segmentation_upid, error) {
+	upid := Segmentation_upid{Type: upid_type, Value: value}
+	if upid_type != Upid_type_mid {
+		return upid, nil
+	}
+
+	p := 0
+	for p < len(value) {
+		if len(value) - p < 2 {
+			return upid, parse_error(ErrTruncated, "incomplete_segmentation_upid", uint64(p), "")
+		}
+
+		sub_type := value[p]
+		sub_length := int(value[p+1])
+		p += 2
+		if len(value) - p < sub_length {
+			return upid, parse_error(ErrTruncated, "incomplete_segmentation_upid", uint64(p), "")
+		}
+
+		sub, err := parse_segmentation_upid(sub_type, value[p : p+sub_length])
+		if err != nil {
+			return upid, shift_error(err, uint64(p))
+		}
+
+		upid.Mid = append(upid.Mid, sub)
+		p += sub_length
+	}
+
+	return upid, nil
+}
+
+// segmentation_upid_bytes returns the upid bytes, rebuilt from Mid for MID UPIDs.
+func segmentation_upid_bytes(upid Segmentation_upid) []byte {
+	if upid.Type != Upid_type_mid || len(upid.Mid) == 0 {
+		return upid.Value
+	}
+
+	var value []byte
+	for _, sub := range upid.Mid {
+		sub_value := segmentation_upid_bytes(sub)
+		value = append(value, sub.Type, byte(len(sub_value)))
+		value = append(value, sub_value...)
+	}
+
+	return value
+}
+
+// String renders the UPID for logs: text for the character based types
+// (Ad-ID, TI, ADI, EIDR in text form, URI...), hex otherwise.
+func (upid Segmentation_upid) String() string {
+	switch upid.Type {
+	case Upid_type_mid:
+		parts := make([]string, 0, len(upid.Mid))
+		for _, sub := range upid.Mid {
+			parts = append(parts, sub.String())
+		}
+
+		return strings.Join(parts, ",")
+	case 0x01, 0x02, 0x03, 0x07, 0x09, 0x0E, 0x0F:
+		return string(upid.Value)
+	case Upid_type_mpu:
+		if len(upid.Value) >= 4 {
+			return string(upid.Value[:4]) + ":" + hex.EncodeToString(upid.Value[4:])
+		}
+	}
+
+	return "0x" + hex.EncodeToString(upid.Value)
+}
+
+func parse_segmentation_descriptor(d []byte) (*Segmentation_descriptor, error) {
+	sd := &Segmentation_descriptor{}
+	r := new_bit_reader(d)
+	sd.Segmentation_event_id = uint32(r.read_bits(32))
+	sd.Segmentation_event_cancel_indicator = r.read_flag()
+	sd.Segmentation_event_id_compliance_indicator = r.read_flag()
+	r.skip_bits(6)
+	if sd.Segmentation_event_cancel_indicator {
+		return sd, r.err
+	}
+
+	sd.Program_segmentation_flag = r.read_flag()
+	sd.Segmentation_duration_flag = r.read_flag()
+	sd.Delivery_not_restricted_flag = r.read_flag()
+	if !sd.Delivery_not_restricted_flag {
+		sd.Web_delivery_allowed_flag = r.read_flag()
+		sd.No_regional_blackout_flag = r.read_flag()
+		sd.Archive_allowed_flag = r.read_flag()
+		sd.Device_restrictions = uint8(r.read_bits(2))
+	} else {
+		r.skip_bits(5)
+	}
+
+	if !sd.Program_segmentation_flag {
+		component_count := r.read_bits(8)
+		for i := uint64(0); i < component_count && r.err == nil; i++ {
+			var c Segmentation_component
+			c.Component_tag = uint8(r.read_bits(8))
+			r.skip_bits(7)
+			c.Pts_offset = r.read_bits(33)
+			sd.Components = append(sd.Components, c)
+		}
+	}
+
+	if sd.Segmentation_duration_flag {
+		sd.Segmentation_duration = r.read_bits(40)
+	}
+
+	upid_type := uint8(r.read_bits(8))
+	upid_length := r.read_bits(8)
+	upid_value := r.read_bytes(upid_length)
+	if r.err != nil {
+		return sd, parse_error(ErrTruncated, "incomplete_segmentation_descriptor", r.byte_pos(), "")
+	}
+
+	var err error
+	sd.Upid, err = parse_segmentation_upid(upid_type, append([]byte{}, upid_value...))
+	if err != nil {
+		return sd, shift_error(err, r.byte_pos() - upid_length)
+	}
+
+	sd.Segmentation_type_id = uint8(r.read_bits(8))
+	sd.Segment_num = uint8(r.read_bits(8))
+	sd.Segments_expected = uint8(r.read_bits(8))
+
+	// sub_segment_num and sub_segments_expected were added later to the
+	// Provider/Distributor Placement Opportunity Start types; older encoders omit them.
+	switch sd.Segmentation_type_id {
+	case 0x34, 0x36, 0x38, 0x3A, 0x44, 0x46:
+		if r.bits_left() >= 16 {
+			sd.Has_sub_segments = true
+			sd.Sub_segment_num = uint8(r.read_bits(8))
+			sd.Sub_segments_expected = uint8(r.read_bits(8))
+		}
+	}
+
+	if r.err != nil {
+		return sd, parse_error(ErrTruncated, "incomplete_segmentation_descriptor", r.byte_pos(), "")
+	}
+
+	return sd, nil
+}
+
+func write_segmentation_descriptor(w *bit_writer, sd *Segmentation_descriptor) error {
+	w.write_bits(32, uint64(sd.Segmentation_event_id))
+	w.write_flag(sd.Segmentation_event_cancel_indicator)
+	w.write_flag(sd.Segmentation_event_id_compliance_indicator)
+	w.write_bits(6, 0x3F)
+	if sd.Segmentation_event_cancel_indicator {
+		return nil
+	}
+
+	w.write_flag(sd.Program_segmentation_flag)
+	w.write_flag(sd.Segmentation_duration_flag)
+	w.write_flag(sd.Delivery_not_restricted_flag)
+	if !sd.Delivery_not_restricted_flag {
+		w.write_flag(sd.Web_delivery_allowed_flag)
+		w.write_flag(sd.No_regional_blackout_flag)
+		w.write_flag(sd.Archive_allowed_flag)
+		w.write_bits(2, uint64(sd.Device_restrictions))
+	} else {
+		w.write_bits(5, 0x1F)
+	}
+
+	if !sd.Program_segmentation_flag {
+		w.write_bits(8, uint64(len(sd.Components)))
+		for _, c := range sd.Components {
+			w.write_bits(8, uint64(c.Component_tag))
+			w.write_bits(7, 0x7F)
+			w.write_bits(33, c.Pts_offset)
+		}
+	}
+
+	if sd.Segmentation_duration_flag {
+		w.write_bits(40, sd.Segmentation_duration)
+	}
+
+	upid_value := segmentation_upid_bytes(sd.Upid)
+	if len(upid_value) > 255 {
+		return errors.New("segmentation_upid_too_long")
+	}
+
+	w.write_bits(8, uint64(sd.Upid.Type))
+	w.write_bits(8, uint64(len(upid_value)))
+	w.write_bytes(upid_value)
+	w.write_bits(8, uint64(sd.Segmentation_type_id))
+	w.write_bits(8, uint64(sd.Segment_num))
+	w.write_bits(8, uint64(sd.Segments_expected))
+	if sd.Has_sub_segments {
+		w.write_bits(8, uint64(sd.Sub_segment_num))
+		w.write_bits(8, uint64(sd.Sub_segments_expected))
+	}
+
+	return nil
+}
+
+func parse_splice_descriptors(d []byte) ([]Splice_descriptor, error) {
+	var descriptors []Splice_descriptor
+	p := 0
+	for p < len(d) {
+		if len(d) - p < 2 {
+			return descriptors, parse_error(ErrTruncated, "incomplete_splice_descriptor", uint64(p), "")
+		}
+
+		tag := d[p]
+		length := int(d[p+1])
+		p += 2
+		if len(d) - p < length || length < 4 {
+			return descriptors, parse_error(ErrTruncated, "incomplete_splice_descriptor", uint64(p), "")
+		}
+
+		desc := Splice_descriptor{Tag: tag, Identifier: get_uint32(uint32(p), d)}
+		body := d[p+4 : p+length]
+		if tag == Segmentation_descriptor_tag && desc.Identifier == Scte35_cuei_identifier {
+			sd, err := parse_segmentation_descriptor(body)
+			if err != nil {
+				return descriptors, shift_error(err, uint64(p + 4))
+			}
+
+			desc.Segmentation = sd
+		} else {
+			desc.Data = append([]byte{}, body...)
+		}
+
+		descriptors = append(descriptors, desc)
+		p += length
+	}
+
+	return descriptors, nil
+}
+
+// ParseSpliceInfoSection decodes a binary SCTE-35 splice_info_section, as
+// carried in emsg message_data, in HLS EXT-X-DATERANGE SCTE35-OUT/IN/CMD
+// attributes or in a transport stream SCTE-35 PID. If the CRC_32 does not
+// match, the decoded section is returned along with a scte35_crc_mismatch error.
+func ParseSpliceInfoSection(data []byte) (Splice_info_section, error) {
+	var sis Splice_info_section
+
+	// Fixed header up to and including splice_command_type
+	if len(data) < 14 {
+		return sis, parse_error(ErrTruncated, "incomplete_splice_info_section", uint64(len(data)), "")
+	}
+
+	sis.Table_id = data[0]
+	if sis.Table_id != Scte35_table_id {
+		return sis, parse_error(ErrInvalidData, "invalid_scte35_table_id", 0, "")
+	}
+
+	sis.Section_syntax_indicator = data[1] & 0x80 != 0
+	sis.Private_indicator = data[1] & 0x40 != 0
+	sis.Sap_type = (data[1] >> 4) & 0x03
+	sis.Section_length = (uint16(data[1]) & 0x0F) << 8 | uint16(data[2])
+	sis.Protocol_version = data[3]
+	sis.Encrypted_packet = data[4] & 0x80 != 0
+	sis.Encryption_algorithm = (data[4] >> 1) & 0x3F
+	sis.Pts_adjustment = uint64(data[4] & 0x01) << 32 | uint64(get_uint32(5, data))
+	sis.Cw_index = data[9]
+	sis.Tier = uint16(data[10]) << 4 | uint16(data[11]) >> 4
+	sis.Splice_command_length = (uint16(data[11]) & 0x0F) << 8 | uint16(data[12])
+	sis.Splice_command_type = data[13]
+
+	section_end := 3 + int(sis.Section_length)
+	if section_end > len(data) || section_end < 14 + 4 {
+		return sis, parse_error(ErrTruncated, "incomplete_splice_info_section", 1, "")
+	}
+
+	sis.Crc_32 = get_uint32(uint32(section_end - 4), data)
+	var crc_err error
+	if crc32_mpeg2(data[:section_end]) != 0 {
+		crc_err = parse_error(ErrInvalidData, "scte35_crc_mismatch", uint64(section_end - 4), "")
+	}
+
+	if sis.Encrypted_packet {
+		// splice command, descriptor loop, alignment stuffing and E_CRC_32
+		sis.Encrypted_data = append([]byte{}, data[14 : section_end-4]...)
+		if section_end - 4 - 14 >= 4 {
+			sis.E_crc_32 = get_uint32(uint32(section_end - 8), data)
+		}
+
+		return sis, crc_err
+	}
+
+	// Legacy encoders may signal splice_command_length 0xFFF, in which case
+	// the command length is determined by parsing it.
+	command_data := data[14 : section_end-4]
+	if sis.Splice_command_length != 0xFFF {
+		if int(sis.Splice_command_length) > len(command_data) {
+			return sis, parse_error(ErrTruncated, "incomplete_splice_command", 14, "")
+		}
+
+		command_data = command_data[:sis.Splice_command_length]
+	}
+
+	r := new_bit_reader(command_data)
+	switch sis.Splice_command_type {
+	case Splice_insert_command:
+		sis.Splice_insert = parse_splice_insert(r)
+	case Time_signal_command:
+		sis.Time_signal = &Time_signal{Splice_time: read_splice_time(r)}
+	case Splice_null, Bandwidth_reservation:
+	default:
+		if sis.Splice_command_length == 0xFFF {
+			return sis, parse_error(ErrUnsupported, "unknown_splice_command_length", 13, "")
+		}
+
+		sis.Command_data = append([]byte{}, command_data...)
+		r.skip_bits(uint64(len(command_data)) * 8)
+	}
+
+	if r.err != nil {
+		return sis, parse_error(ErrTruncated, "incomplete_splice_command", 14, "")
+	}
+
+	p := 14 + int(r.byte_pos())
+	if sis.Splice_command_length == 0xFFF {
+		sis.Splice_command_length = uint16(r.byte_pos())
+	}
+
+	if section_end - 4 - p < 2 {
+		return sis, parse_error(ErrTruncated, "incomplete_descriptor_loop", uint64(p), "")
+	}
+
+	descriptor_loop_length := int(get_uint16(uint32(p), data))
+	p += 2
+	if section_end - 4 - p < descriptor_loop_length {
+		return sis, parse_error(ErrTruncated, "incomplete_descriptor_loop", uint64(p), "")
+	}
+
+	var err error
+	sis.Descriptors, err = parse_splice_descriptors(data[p : p+descriptor_loop_length])
+	if err != nil {
+		return sis, shift_error(err, uint64(p))
+	}
+
+	return sis, crc_err
+}
+
+// ParseSpliceInfoSectionHex decodes a hex encoded splice_info_section such as
+// the value of an EXT-X-DATERANGE SCTE35-OUT attribute ("0xFC30...").
+func ParseSpliceInfoSectionHex(s string) (Splice_info_section, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s = s[2:]
+	}
+
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return Splice_info_section{}, parse_error(ErrInvalidData, "invalid_scte35_hex", 0, "")
+	}
+
+	return ParseSpliceInfoSection(data)
+}
+
+// BuildSpliceInfoSection encodes a splice_info_section. Section_length,
+// Splice_command_length, Splice_command_type (from the decoded command) and
+// CRC_32 are computed; encrypted sections are not supported.
+func BuildSpliceInfoSection(sis Splice_info_section) ([]byte, error) {
+	if sis.Encrypted_packet {
+		return nil, errors.New("encrypted_splice_info_section_not_supported")
+	}
+
+	command_type := sis.Splice_command_type
+	var cmd bit_writer
+	if sis.Splice_insert != nil {
+		command_type = Splice_insert_command
+		write_splice_insert(&cmd, sis.Splice_insert)
+	} else if sis.Time_signal != nil {
+		command_type = Time_signal_command
+		write_splice_time(&cmd, sis.Time_signal.Splice_time)
+	} else if command_type != Splice_null && command_type != Bandwidth_reservation {
+		cmd.write_bytes(sis.Command_data)
+	}
+
+	var desc bit_writer
+	for _, d := range sis.Descriptors {
+		var body bit_writer
+		body.write_bits(32, uint64(d.Identifier))
+		if d.Segmentation != nil {
+			err := write_segmentation_descriptor(&body, d.Segmentation)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			body.write_bytes(d.Data)
+		}
+
+		if len(body.bytes()) > 255 {
+			return nil, errors.New("splice_descriptor_too_long")
+		}
+
+		desc.write_bits(8, uint64(d.Tag))
+		desc.write_bits(8, uint64(len(body.bytes())))
+		desc.write_bytes(body.bytes())
+	}
+
+	command_length := len(cmd.bytes())
+	descriptor_loop_length := len(desc.bytes())
+	if command_length > 0xFFE || descriptor_loop_length > 0xFFFF {
+		return nil, errors.New("splice_info_section_too_long")
+	}
+
+	// protocol_version .. splice_command_type (11 bytes), command, descriptor_loop_length, descriptors, CRC_32
+	section_length := 11 + command_length + 2 + descriptor_loop_length + 4
+	if section_length > 0xFFF {
+		return nil, errors.New("splice_info_section_too_long")
+	}
+
+	var w bit_writer
+	w.write_bits(8, Scte35_table_id)
+	w.write_flag(sis.Section_syntax_indicator)
+	w.write_flag(sis.Private_indicator)
+	w.write_bits(2, uint64(sis.Sap_type))
+	w.write_bits(12, uint64(section_length))
+	w.write_bits(8, uint64(sis.Protocol_version))
+	w.write_flag(false)
+	w.write_bits(6, uint64(sis.Encryption_algorithm))
+	w.write_bits(33, sis.Pts_adjustment)
+	w.write_bits(8, uint64(sis.Cw_index))
+	w.write_bits(12, uint64(sis.Tier))
+	w.write_bits(12, uint64(command_length))
+	w.write_bits(8, uint64(command_type))
+	w.write_bytes(cmd.bytes())
+	w.write_bits(16, uint64(descriptor_loop_length))
+	w.write_bytes(desc.bytes())
+
+	section := w.bytes()
+	return append_uint32(section, crc32_mpeg2(section)), nil
+}
+
+// BuildSpliceInfoSectionHex encodes a splice_info_section as an
+// EXT-X-DATERANGE style hexadecimal-sequence ("0xFC30...").
+func BuildSpliceInfoSectionHex(sis Splice_info_section) (string, error) {
+	data, err := BuildSpliceInfoSection(sis)
+	if err != nil {
+		return "", err
+	}
+
+	return "0x" + strings.ToUpper(hex.EncodeToString(data)), nil
+}
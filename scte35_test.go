@@ -0,0 +1,156 @@
+package media_utils
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// The splice_insert and time_signal samples of SCTE 35 (2019) section 14
+const scte35_test_splice_insert = "0xFC302F000000000000FFFFF014054800008F7FEFFE7369C02EFE0052CCF500000000000A0008435545490000013562DBA30A"
+const scte35_test_time_signal = "0xFC3034000000000000FFFFF00506FE72BD0050001E021C435545494800008E7FCF0001A599B00808000000002CA0A18A3402009AC9D17E"
+
+// scte35_test_round_trip builds sis and returns the section parsed back,
+// which must build to the same bytes.
+func scte35_test_round_trip(t *testing.T, sis Splice_info_section) Splice_info_section {
+	t.Helper()
+	data, err := BuildSpliceInfoSection(sis)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseSpliceInfoSection(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := BuildSpliceInfoSection(parsed)
+	if err != nil || !bytes.Equal(again, data) {
+		t.Fatalf("section built back as % X, want % X: %v", again, data, err)
+	}
+
+	return parsed
+}
+
+func TestSpliceInsert(t *testing.T) {
+	sis, err := ParseSpliceInfoSectionHex(scte35_test_splice_insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	si := sis.Splice_insert
+	if si == nil || sis.Splice_command_type != Splice_insert_command || si.Splice_event_id != 0x4800008F || !si.Out_of_network_indicator || !si.Program_splice_flag || si.Splice_time.Pts_time != 0x07369C02E || !si.Break_duration.Auto_return || si.Break_duration.Duration != 0x00052CCF5 {
+		t.Fatalf("splice_insert %+v", si)
+	}
+
+	if len(sis.Descriptors) != 1 || sis.Descriptors[0].Tag != Avail_descriptor_tag || sis.Descriptors[0].Identifier != Scte35_cuei_identifier || !bytes.Equal(sis.Descriptors[0].Data, []byte{0, 0, 1, 0x35}) {
+		t.Errorf("avail_descriptor %+v", sis.Descriptors)
+	}
+
+	built, err := BuildSpliceInfoSectionHex(sis)
+	if err != nil || built != scte35_test_splice_insert {
+		t.Errorf("splice_insert built as %s: %v", built, err)
+	}
+
+	// Component splice mode, and a cancel, which ends the command
+	components := &Splice_insert{Splice_event_id: 7, Out_of_network_indicator: true, Components: []Splice_insert_component{{1, Splice_time{true, 1 << 32}}, {2, Splice_time{}}}, Unique_program_id: 3, Avail_num: 1, Avails_expected: 2}
+	cancel := &Splice_insert{Splice_event_id: 8, Splice_event_cancel_indicator: true}
+	for _, want := range []*Splice_insert{components, cancel} {
+		parsed := scte35_test_round_trip(t, Splice_info_section{Sap_type: 3, Tier: 0xFFF, Splice_insert: want})
+		if parsed.Splice_command_type != Splice_insert_command || !reflect.DeepEqual(parsed.Splice_insert, want) {
+			t.Errorf("splice_insert %+v read back as %+v", want, parsed.Splice_insert)
+		}
+	}
+}
+
+func TestTimeSignalSegmentationDescriptor(t *testing.T) {
+	sis, err := ParseSpliceInfoSectionHex(scte35_test_time_signal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sis.Time_signal == nil || sis.Splice_command_type != Time_signal_command || sis.Time_signal.Splice_time != (Splice_time{true, 0x072BD0050}) || len(sis.Descriptors) != 1 {
+		t.Fatalf("time_signal %+v", sis)
+	}
+
+	sd := sis.Descriptors[0].Segmentation
+	if sd == nil || sd.Segmentation_event_id != 0x4800008E || sd.Segmentation_duration != 0x0001A599B0 || sd.Segmentation_type_id != 0x34 || sd.Segment_num != 2 || sd.Upid.Type != 0x08 || sd.Upid.String() != "0x000000002ca0a18a" || sd.Has_sub_segments {
+		t.Fatalf("segmentation_descriptor %+v", sd)
+	}
+
+	built, err := BuildSpliceInfoSectionHex(sis)
+	if err != nil || built != scte35_test_time_signal {
+		t.Errorf("time_signal built as %s: %v", built, err)
+	}
+
+	// Component segmentation, a MID UPID and sub-segments
+	want := &Segmentation_descriptor{Segmentation_event_id: 9, Delivery_not_restricted_flag: true, Components: []Segmentation_component{{1, 1 << 32}, {2, 0}}, Segmentation_duration_flag: true, Segmentation_duration: 1 << 39,
+		Upid: Segmentation_upid{Type: Upid_type_mid, Mid: []Segmentation_upid{{Type: 0x03, Value: []byte("ad-1")}, {Type: 0x09, Value: []byte("adi")}}},
+		Segmentation_type_id: 0x36, Segment_num: 1, Segments_expected: 1, Has_sub_segments: true, Sub_segment_num: 1, Sub_segments_expected: 4}
+	parsed := scte35_test_round_trip(t, Splice_info_section{Time_signal: &Time_signal{}, Descriptors: []Splice_descriptor{{Tag: Segmentation_descriptor_tag, Identifier: Scte35_cuei_identifier, Segmentation: want}}})
+	if len(parsed.Descriptors) != 1 || parsed.Descriptors[0].Segmentation == nil {
+		t.Fatalf("descriptors %+v", parsed.Descriptors)
+	}
+
+	got := parsed.Descriptors[0].Segmentation
+	if got.Upid.String() != "ad-1,adi" || !reflect.DeepEqual(got.Upid.Mid, want.Upid.Mid) {
+		t.Errorf("MID UPID %+v", got.Upid)
+	}
+
+	got.Upid = want.Upid
+	if parsed.Time_signal.Splice_time.Time_specified_flag || !reflect.DeepEqual(got, want) {
+		t.Errorf("segmentation_descriptor %+v read back as %+v", want, got)
+	}
+}
+
+func TestSpliceInfoSectionCrc(t *testing.T) {
+	data, err := BuildSpliceInfoSection(Splice_info_section{Time_signal: &Time_signal{Splice_time{true, 90000}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []int{len(data) - 9, len(data) - 1} {
+		corrupted := append([]byte(nil), data...)
+		corrupted[p] ^= 0x01
+		sis, err := ParseSpliceInfoSection(corrupted)
+		var e *Parse_error
+		if !errors.Is(err, ErrInvalidData) || !errors.As(err, &e) || e.Reason != "scte35_crc_mismatch" || e.Offset != uint64(len(data) - 4) {
+			t.Errorf("byte %d corrupted: %v", p, err)
+		}
+
+		// The section is still decoded
+		if sis.Time_signal == nil {
+			t.Errorf("byte %d corrupted: no time_signal", p)
+		}
+	}
+}
+
+// FuzzSpliceInfoSection checks that a section serializes back to a section
+// parsing to the same fields.
+func FuzzSpliceInfoSection(f *testing.F) {
+	sis, _ := ParseSpliceInfoSectionHex("FC302F000000000000FFFFF00506FE6F3A7B3C0019021743554549480000077FFF00000000012C0000000000000000000000000000000000000000000000000000")
+	section, _ := BuildSpliceInfoSection(sis)
+	f.Add(section)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sis, err := ParseSpliceInfoSection(data)
+		if err != nil {
+			return
+		}
+
+		built, err := BuildSpliceInfoSection(sis)
+		if err != nil {
+			return
+		}
+
+		again, err := ParseSpliceInfoSection(built)
+		if err != nil {
+			t.Fatalf("built section: %v", err)
+		}
+
+		rebuilt, err := BuildSpliceInfoSection(again)
+		if err != nil || !bytes.Equal(rebuilt, built) {
+			t.Fatalf("section %+v read back as %+v: %v", sis, again, err)
+		}
+	})
+}
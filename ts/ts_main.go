@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"github.com/maxutility2011/media_utils"
+)
+
+const usage = `Usage: ts <command> [flags] [files]
+
+Commands:
+  info      print the programs, streams and PCR range of a transport stream
+  demux     list the access units of every elementary stream, or write each
+            stream to a file in a directory (-output-dir)
+  remux     remux TS segments to fragmented MP4: init.mp4 and a .m4s media
+            segment per TS segment in a directory (-output-dir)
+  mux       mux fragmented MP4 media segments (with -init) to TS: a .ts
+            segment per media segment in a directory (-output-dir)
+
+The files of info, demux and remux are demuxed in order as one stream, e.g. the segments of an HLS
+rendition saved by hls_downloader. The input is read from stdin if no file
+is given or for "-".
+Run "ts <command> -h" for the flags of a command.
+`
+
+// readInput reads the file at path, or stdin for "" and "-".
+func readInput(path string) ([]byte, error) {
+	if path == "" || path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+
+	return os.ReadFile(path)
+}
+
+func inputName(path string) string {
+	if path == "" || path == "-" {
+		return "stdin"
+	}
+
+	return path
+}
+
+func writeJson(v any) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Printf("Error: Failed to marshal JSON. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(string(out))
+}
+
+// demuxInputs feeds the input files in order to the demuxer and returns the
+// access units.
+func demuxInputs(fs *flag.FlagSet) (*media_utils.Ts_demuxer, []media_utils.Ts_access_unit) {
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	demuxer := media_utils.NewTsDemuxer()
+	var units []media_utils.Ts_access_unit
+	for _, input := range inputs {
+		data, err := readInput(input)
+		if err != nil {
+			fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+
+		units = append(units, demuxer.Feed(data)...)
+	}
+
+	return demuxer, append(units, demuxer.Flush()...)
+}
+
+func printErrors(demuxer *media_utils.Ts_demuxer) {
+	for _, e := range demuxer.Errors {
+		fmt.Fprintf(os.Stderr, "%s\n", e.String())
+	}
+}
+
+func info(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	jsonPtr := fs.Bool("json", false, "Print the programs as JSON")
+	fs.Parse(args)
+	demuxer, units := demuxInputs(fs)
+	counts := make(map[uint16]int)
+	for _, unit := range units {
+		counts[unit.Pid]++
+	}
+
+	if *jsonPtr {
+		writeJson(struct {
+			Programs []media_utils.Ts_program
+			Access_units map[uint16]int
+			Errors []media_utils.Ts_error
+		}{demuxer.Programs, counts, demuxer.Errors})
+		return
+	}
+
+	for _, program := range demuxer.Programs {
+		fmt.Printf("program %d: PMT pid 0x%04x, PCR pid 0x%04x", program.Program_number, program.Pmt_pid, program.Pcr_pid)
+		if program.First_pcr >= 0 {
+			fmt.Printf(", PCR %.3f s to %.3f s", float64(program.First_pcr) / 27000000, float64(program.Last_pcr) / 27000000)
+		}
+
+		fmt.Println()
+		for _, stream := range program.Streams {
+			fmt.Printf("  pid 0x%04x: stream_type 0x%02x %s, %d access units\n", stream.Pid, stream.Stream_type, stream.Codec, counts[stream.Pid])
+		}
+	}
+
+	printErrors(demuxer)
+}
+
+// streamExtension returns the file extension of an elementary stream.
+func streamExtension(stream media_utils.Ts_stream) string {
+	switch stream.Codec {
+	case "avc":
+		return ".h264"
+	case "hevc":
+		return ".h265"
+	case "aac", "mp3", "ac3", "eac3", "id3":
+		return "." + stream.Codec
+	case "scte35":
+		return ".sections"
+	}
+
+	return ".es"
+}
+
+func demux(args []string) {
+	fs := flag.NewFlagSet("demux", flag.ExitOnError)
+	pidPtr := fs.Int("pid", -1, "Only this PID")
+	outputDirPtr := fs.String("output-dir", "", "Write each elementary stream to pid_<pid>.<ext> in this directory")
+	jsonPtr := fs.Bool("json", false, "Print the access units as JSON (without their data)")
+	fs.Parse(args)
+	demuxer, units := demuxInputs(fs)
+	var selected []media_utils.Ts_access_unit
+	for _, unit := range units {
+		if *pidPtr < 0 || int(unit.Pid) == *pidPtr {
+			selected = append(selected, unit)
+		}
+	}
+
+	if *outputDirPtr != "" {
+		files := make(map[uint16]*os.File)
+		for _, stream := range demuxer.Streams() {
+			if *pidPtr >= 0 && int(stream.Pid) != *pidPtr {
+				continue
+			}
+
+			f, err := os.Create(filepath.Join(*outputDirPtr, fmt.Sprintf("pid_%d%s", stream.Pid, streamExtension(stream))))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			defer f.Close()
+			files[stream.Pid] = f
+		}
+
+		for _, unit := range selected {
+			if f := files[unit.Pid]; f != nil {
+				_, err := f.Write(unit.Data)
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					os.Exit(1)
+				}
+			}
+		}
+
+		printErrors(demuxer)
+		return
+	}
+
+	if *jsonPtr {
+		type unitInfo struct {
+			Pid uint16
+			Pts int64
+			Dts int64
+			Size int
+			Random_access bool
+			Corrupt bool
+			Offset int64
+		}
+
+		var infos []unitInfo
+		for _, unit := range selected {
+			infos = append(infos, unitInfo{unit.Pid, unit.Pts, unit.Dts, len(unit.Data), unit.Random_access, unit.Corrupt, unit.Offset})
+		}
+
+		writeJson(struct {
+			Access_units []unitInfo
+			Errors []media_utils.Ts_error
+		}{infos, demuxer.Errors})
+		return
+	}
+
+	fmt.Printf("%-8s %-12s %-12s %-8s %-6s %-8s %s\n", "pid", "pts", "dts", "size", "rai", "corrupt", "offset")
+	for _, unit := range selected {
+		fmt.Printf("0x%04x   %-12d %-12d %-8d %-6t %-8t %d\n", unit.Pid, unit.Pts, unit.Dts, len(unit.Data), unit.Random_access, unit.Corrupt, unit.Offset)
+	}
+
+	printErrors(demuxer)
+}
+
+func remux(args []string) {
+	fs := flag.NewFlagSet("remux", flag.ExitOnError)
+	outputDirPtr := fs.String("output-dir", "", "Output directory for init.mp4 and <segment>.m4s (required)")
+	pidPtr := fs.Int("pid", -1, "Only this PID, for one CMAF track per init segment")
+	fs.Parse(args)
+	if *outputDirPtr == "" || fs.NArg() == 0 {
+		fmt.Printf("Error: An output directory (-output-dir) and at least one TS segment are required.\n")
+		os.Exit(1)
+	}
+
+	remuxer := media_utils.NewTsRemuxer()
+	if *pidPtr >= 0 {
+		remuxer.Pids = []uint16{uint16(*pidPtr)}
+	}
+
+	for i, input := range fs.Args() {
+		data, err := readInput(input)
+		if err != nil {
+			fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+
+		segment, err := remuxer.AddSegment(data)
+		if err != nil {
+			fmt.Printf("Error: Failed to remux %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+
+		// The init segment needs the parameter sets of the first segment
+		if i == 0 {
+			initData, err := remuxer.InitSegment()
+			if err != nil {
+				fmt.Printf("Error: Failed to build the init segment. Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			err = os.WriteFile(filepath.Join(*outputDirPtr, "init.mp4"), initData, 0644)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		name := strings.TrimSuffix(filepath.Base(inputName(input)), filepath.Ext(input)) + ".m4s"
+		err = os.WriteFile(filepath.Join(*outputDirPtr, name), segment, 0644)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	for _, e := range remuxer.Errors() {
+		fmt.Fprintf(os.Stderr, "%s\n", e.String())
+	}
+}
+
+func mux(args []string) {
+	fs := flag.NewFlagSet("mux", flag.ExitOnError)
+	initPtr := fs.String("init", "", "Init segment (required)")
+	outputDirPtr := fs.String("output-dir", "", "Output directory for <segment>.ts (required)")
+	fs.Parse(args)
+	if *initPtr == "" || *outputDirPtr == "" || fs.NArg() == 0 {
+		fmt.Printf("Error: An init segment (-init), an output directory (-output-dir) and at least one media segment are required.\n")
+		os.Exit(1)
+	}
+
+	initData, err := os.ReadFile(*initPtr)
+	if err != nil {
+		fmt.Printf("Error: Failed to read %s. Error: %v\n", *initPtr, err)
+		os.Exit(1)
+	}
+
+	tracks, err := media_utils.GetTracks(initData)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse the init segment. Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	muxer, err := media_utils.NewTsMuxer(tracks)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, input := range fs.Args() {
+		data, err := readInput(input)
+		if err != nil {
+			fmt.Printf("Error: Failed to read %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+
+		samples, err := media_utils.GetFragmentSamples(data, tracks)
+		if err != nil {
+			fmt.Printf("Error: Failed to parse %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+
+		segment, err := muxer.Segment(samples)
+		if err != nil {
+			fmt.Printf("Error: Failed to mux %s. Error: %v\n", inputName(input), err)
+			os.Exit(1)
+		}
+
+		name := strings.TrimSuffix(filepath.Base(inputName(input)), filepath.Ext(input)) + ".ts"
+		err = os.WriteFile(filepath.Join(*outputDirPtr, name), segment, 0644)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "info":
+		info(args)
+	case "demux":
+		demux(args)
+	case "remux":
+		remux(args)
+	case "mux":
+		mux(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Printf("Unknown command: %s\n\n%s", os.Args[1], usage)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,593 @@
+package media_utils
+
+import (
+	"fmt"
+)
+
+const Ts_packet_size = 188
+const Ts_sync_byte = 0x47
+
+const (
+	Ts_pid_pat = 0x0000
+	Ts_pid_null = 0x1FFF
+)
+
+// Stream types of the PMT
+const (
+	Ts_stream_type_mpeg1_audio = 0x03
+	Ts_stream_type_mpeg2_audio = 0x04
+	Ts_stream_type_private_pes = 0x06
+	Ts_stream_type_aac = 0x0F // ADTS
+	Ts_stream_type_aac_latm = 0x11
+	Ts_stream_type_metadata = 0x15 // ID3 timed metadata
+	Ts_stream_type_avc = 0x1B
+	Ts_stream_type_hevc = 0x24
+	Ts_stream_type_ac3 = 0x81
+	Ts_stream_type_scte35 = 0x86
+	Ts_stream_type_eac3 = 0x87
+)
+
+var ts_stream_type_codecs = map[uint8]string{
+	Ts_stream_type_mpeg1_audio: "mp3",
+	Ts_stream_type_mpeg2_audio: "mp3",
+	Ts_stream_type_aac: "aac",
+	Ts_stream_type_aac_latm: "aac_latm",
+	Ts_stream_type_metadata: "id3",
+	Ts_stream_type_avc: "avc",
+	Ts_stream_type_hevc: "hevc",
+	Ts_stream_type_ac3: "ac3",
+	Ts_stream_type_scte35: "scte35",
+	Ts_stream_type_eac3: "eac3",
+}
+
+// Error kinds of the TS demuxer
+const (
+	Ts_error_sync_lost = "sync_lost" // bytes skipped to find the next sync byte
+	Ts_error_invalid_packet = "invalid_packet"
+	Ts_error_incomplete_packet = "incomplete_packet" // at the end of the stream
+	Ts_error_transport_error = "transport_error" // transport_error_indicator set, packet skipped
+	Ts_error_continuity = "continuity_error" // packets lost: continuity_counter mismatch
+	Ts_error_crc = "crc_error" // PSI or SCTE-35 section skipped
+	Ts_error_invalid_pes = "invalid_pes"
+	Ts_error_invalid_adts = "invalid_adts"
+)
+
+type Ts_error struct {
+	Kind string
+	Pid uint16
+	Offset int64 // stream offset of the packet
+	Message string
+}
+
+func (e Ts_error) String() string {
+	s := fmt.Sprintf("%s at offset %d pid 0x%04x", e.Kind, e.Offset, e.Pid)
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+
+	return s
+}
+
+// Ts_packet is a decoded 188-byte transport stream packet.
+type Ts_packet struct {
+	Pid uint16
+	Transport_error bool
+	Payload_unit_start bool
+	Scrambling uint8
+	Continuity_counter uint8
+	Has_payload bool
+	Discontinuity bool // discontinuity_indicator of the adaptation field
+	Random_access bool // random_access_indicator of the adaptation field
+	Pcr int64 // 27 MHz, -1 if absent
+	Payload []byte
+}
+
+// ParseTsPacket decodes the packet header and adaptation field at the start of d.
+func ParseTsPacket(d []byte) (Ts_packet, error) {
+	pkt := Ts_packet{Pcr: -1}
+	if len(d) < Ts_packet_size {
+		return pkt, parse_error(ErrTruncated, "incomplete_ts_packet", 0, "")
+	}
+
+	if d[0] != Ts_sync_byte {
+		return pkt, parse_error(ErrInvalidData, "invalid_ts_sync_byte", 0, "")
+	}
+
+	pkt.Transport_error = d[1] & 0x80 != 0
+	pkt.Payload_unit_start = d[1] & 0x40 != 0
+	pkt.Pid = uint16(d[1] & 0x1F) << 8 | uint16(d[2])
+	pkt.Scrambling = d[3] >> 6
+	adaptation_field_control := d[3] >> 4 & 0x03
+	pkt.Continuity_counter = d[3] & 0x0F
+	pkt.Has_payload = adaptation_field_control & 0x01 != 0
+	p := 4
+	if adaptation_field_control & 0x02 != 0 {
+		length := int(d[4])
+		if 5 + length > Ts_packet_size {
+			return pkt, parse_error(ErrInvalidData, "invalid_adaptation_field_length", 4, "")
+		}
+
+		if length > 0 {
+			flags := d[5]
+			pkt.Discontinuity = flags & 0x80 != 0
+			pkt.Random_access = flags & 0x40 != 0
+			if flags & 0x10 != 0 && length >= 7 {
+				base := uint64(d[6]) << 25 | uint64(d[7]) << 17 | uint64(d[8]) << 9 | uint64(d[9]) << 1 | uint64(d[10]) >> 7
+				extension := uint64(d[10] & 0x01) << 8 | uint64(d[11])
+				pkt.Pcr = int64(base * 300 + extension)
+			}
+		}
+
+		p = 5 + length
+	}
+
+	if pkt.Has_payload {
+		pkt.Payload = d[p:Ts_packet_size]
+	}
+
+	return pkt, nil
+}
+
+// Ts_stream is an elementary stream of a PMT.
+type Ts_stream struct {
+	Pid uint16
+	Stream_type uint8
+	Codec string // "avc", "hevc", "aac", ... or the stream type in hex
+	Program_number uint16
+	Descriptors []byte
+}
+
+// Ts_program is a program of the PAT and its PMT.
+type Ts_program struct {
+	Program_number uint16
+	Pmt_pid uint16
+	Pcr_pid uint16
+	First_pcr int64 // 27 MHz, -1 if none
+	Last_pcr int64
+	Streams []Ts_stream
+}
+
+// Ts_access_unit is the payload of one PES packet, an access unit in HLS
+// streams, or one ADTS frame of an AAC stream. The 90 kHz PTS and DTS are
+// 33-bit values; Dts equals Pts when the PES has no DTS. SCTE-35 streams
+// give their sections, for ParseSpliceInfoSection, without times.
+type Ts_access_unit struct {
+	Pid uint16
+	Stream_type uint8
+	Pts int64 // -1 if absent
+	Dts int64 // -1 if absent
+	Random_access bool // random_access_indicator of the first packet
+	Corrupt bool // packets of the PES were lost
+	Offset int64 // stream offset of the first packet
+	Data []byte // Annex-B video, ADTS frame with its header, ...
+}
+
+// ts_pid holds the reassembly state of a PID.
+type ts_pid struct {
+	stream *Ts_stream // nil for the PAT and PMTs
+	continuity_counter int // -1 before the first packet
+	is_section bool
+
+	section []byte
+	section_active bool
+
+	pes []byte
+	pes_active bool
+	pes_offset int64
+	random_access bool
+	corrupt bool
+
+	adts_rest []byte // the start of an ADTS frame continued in the next PES
+	next_adts_pts int64
+}
+
+// Ts_demuxer demuxes an MPEG-2 transport stream, fed in pieces of any size
+// (e.g. the HLS segments of a rendition in order), into access units.
+type Ts_demuxer struct {
+	Programs []Ts_program
+	Errors []Ts_error
+
+	pids map[uint16]*ts_pid
+	rest []byte // bytes of an incomplete packet
+	offset int64 // stream offset of rest
+	output []Ts_access_unit
+}
+
+func NewTsDemuxer() *Ts_demuxer {
+	return &Ts_demuxer{pids: map[uint16]*ts_pid{Ts_pid_pat: {continuity_counter: -1, is_section: true}}}
+}
+
+// DemuxTs demuxes a complete transport stream.
+func DemuxTs(data []byte) (*Ts_demuxer, []Ts_access_unit) {
+	d := NewTsDemuxer()
+	units := d.Feed(data)
+	return d, append(units, d.Flush()...)
+}
+
+// Streams returns the elementary streams of all programs.
+func (d *Ts_demuxer) Streams() []Ts_stream {
+	var streams []Ts_stream
+	for _, program := range d.Programs {
+		streams = append(streams, program.Streams...)
+	}
+
+	return streams
+}
+
+func (d *Ts_demuxer) error(kind string, pid uint16, offset int64, format string, args ...any) {
+	d.Errors = append(d.Errors, Ts_error{Kind: kind, Pid: pid, Offset: offset, Message: fmt.Sprintf(format, args...)})
+}
+
+// Feed demuxes the next bytes of the stream and returns the access units completed.
+func (d *Ts_demuxer) Feed(data []byte) []Ts_access_unit {
+	buf := append(d.rest, data...)
+	p := 0
+	for len(buf) - p >= Ts_packet_size {
+		if buf[p] != Ts_sync_byte {
+			// The next sync byte followed by another one a packet later
+			q := p + 1
+			for q < len(buf) && (buf[q] != Ts_sync_byte || q + Ts_packet_size < len(buf) && buf[q + Ts_packet_size] != Ts_sync_byte) {
+				q++
+			}
+
+			d.error(Ts_error_sync_lost, Ts_pid_null, d.offset + int64(p), "%d bytes skipped", q - p)
+			p = q
+			continue
+		}
+
+		pkt, err := ParseTsPacket(buf[p:])
+		if err != nil {
+			d.error(Ts_error_invalid_packet, pkt.Pid, d.offset + int64(p), "%v", err)
+		} else {
+			d.process_packet(pkt, d.offset + int64(p))
+		}
+
+		p += Ts_packet_size
+	}
+
+	d.rest = append([]byte(nil), buf[p:]...)
+	d.offset += int64(p)
+	units := d.output
+	d.output = nil
+	return units
+}
+
+// Flush returns the access units of the PES packets still being reassembled,
+// at the end of the stream.
+func (d *Ts_demuxer) Flush() []Ts_access_unit {
+	if len(d.rest) > 0 {
+		d.error(Ts_error_incomplete_packet, Ts_pid_null, d.offset, "%d bytes", len(d.rest))
+		d.offset += int64(len(d.rest))
+		d.rest = nil
+	}
+
+	for _, stream := range d.Streams() {
+		if state := d.pids[stream.Pid]; state.pes_active {
+			d.finish_pes(stream.Pid, state)
+		}
+	}
+
+	units := d.output
+	d.output = nil
+	return units
+}
+
+func (d *Ts_demuxer) process_packet(pkt Ts_packet, offset int64) {
+	if pkt.Pid == Ts_pid_null {
+		return
+	}
+
+	if pkt.Transport_error {
+		d.error(Ts_error_transport_error, pkt.Pid, offset, "")
+		return
+	}
+
+	for i := range d.Programs {
+		program := &d.Programs[i]
+		if program.Pcr_pid == pkt.Pid && pkt.Pcr >= 0 {
+			if program.First_pcr < 0 {
+				program.First_pcr = pkt.Pcr
+			}
+
+			program.Last_pcr = pkt.Pcr
+		}
+	}
+
+	state := d.pids[pkt.Pid]
+	if state == nil || !pkt.Has_payload {
+		return
+	}
+
+	if state.continuity_counter >= 0 && !pkt.Discontinuity {
+		expected := uint8(state.continuity_counter + 1) & 0x0F
+		if pkt.Continuity_counter == uint8(state.continuity_counter) {
+			return // duplicate packet
+		}
+
+		if pkt.Continuity_counter != expected {
+			d.error(Ts_error_continuity, pkt.Pid, offset, "continuity_counter %d, expected %d", pkt.Continuity_counter, expected)
+			// The PES being reassembled misses packets
+			state.corrupt = true
+			state.section_active = false
+		}
+	}
+
+	state.continuity_counter = int(pkt.Continuity_counter)
+	if state.is_section {
+		d.add_section_payload(pkt, state, offset)
+	} else {
+		d.add_pes_payload(pkt, state, offset)
+	}
+}
+
+// add_section_payload reassembles the PSI or SCTE-35 sections of a PID.
+func (d *Ts_demuxer) add_section_payload(pkt Ts_packet, state *ts_pid, offset int64) {
+	payload := pkt.Payload
+	if pkt.Payload_unit_start {
+		if len(payload) == 0 || 1 + int(payload[0]) > len(payload) {
+			d.error(Ts_error_invalid_packet, pkt.Pid, offset, "invalid_pointer_field")
+			state.section_active = false
+			return
+		}
+
+		pointer := int(payload[0])
+		if state.section_active {
+			state.section = append(state.section, payload[1 : 1 + pointer]...)
+			d.process_sections(pkt.Pid, state, offset)
+		}
+
+		state.section = append([]byte(nil), payload[1 + pointer:]...)
+		state.section_active = true
+	} else if state.section_active {
+		state.section = append(state.section, payload...)
+	}
+
+	d.process_sections(pkt.Pid, state, offset)
+}
+
+func (d *Ts_demuxer) process_sections(pid uint16, state *ts_pid, offset int64) {
+	for state.section_active && len(state.section) >= 3 {
+		if state.section[0] == 0xFF {
+			// Stuffing up to the end of the packet
+			state.section = nil
+			state.section_active = false
+			return
+		}
+
+		section_size := 3 + int(get_uint16(1, state.section) & 0x0FFF)
+		if len(state.section) < section_size {
+			return
+		}
+
+		section := state.section[:section_size]
+		state.section = state.section[section_size:]
+		if (section[1] & 0x80 != 0 || section[0] == Scte35_table_id) && crc32_mpeg2(section) != 0 {
+			d.error(Ts_error_crc, pid, offset, "table_id 0x%02x", section[0])
+			continue
+		}
+
+		switch {
+		case state.stream != nil:
+			d.output = append(d.output, Ts_access_unit{Pid: pid, Stream_type: state.stream.Stream_type, Pts: -1, Dts: -1, Offset: offset, Data: append([]byte(nil), section...)})
+		case section[0] == 0x00 && pid == Ts_pid_pat:
+			d.parse_pat(section)
+		case section[0] == 0x02:
+			d.parse_pmt(pid, section)
+		}
+	}
+}
+
+// parse_pat registers the PMT PIDs of a program_association_section.
+func (d *Ts_demuxer) parse_pat(section []byte) {
+	for p := 8; p + 4 <= len(section) - 4; p += 4 {
+		program_number := get_uint16(uint32(p), section)
+		pid := get_uint16(uint32(p + 2), section) & 0x1FFF
+		if program_number == 0 {
+			continue // network PID
+		}
+
+		found := false
+		for i := range d.Programs {
+			if d.Programs[i].Program_number == program_number {
+				d.Programs[i].Pmt_pid = pid
+				found = true
+			}
+		}
+
+		if !found {
+			d.Programs = append(d.Programs, Ts_program{Program_number: program_number, Pmt_pid: pid, First_pcr: -1, Last_pcr: -1})
+		}
+
+		if d.pids[pid] == nil {
+			d.pids[pid] = &ts_pid{continuity_counter: -1, is_section: true}
+		}
+	}
+}
+
+// ts_stream_codec names the codec of a stream type, looking at the
+// descriptors of private PES streams (DVB AC-3 and E-AC-3).
+func ts_stream_codec(stream_type uint8, descriptors []byte) string {
+	if codec, ok := ts_stream_type_codecs[stream_type]; ok {
+		return codec
+	}
+
+	if stream_type == Ts_stream_type_private_pes {
+		for p := 0; p + 2 <= len(descriptors); p += 2 + int(descriptors[p + 1]) {
+			switch descriptors[p] {
+			case 0x6A:
+				return "ac3"
+			case 0x7A:
+				return "eac3"
+			}
+		}
+	}
+
+	return fmt.Sprintf("0x%02x", stream_type)
+}
+
+// parse_pmt sets the PCR PID and the elementary streams of a program from a
+// TS_program_map_section.
+func (d *Ts_demuxer) parse_pmt(pid uint16, section []byte) {
+	if len(section) < 16 {
+		return
+	}
+
+	var program *Ts_program
+	program_number := get_uint16(3, section)
+	for i := range d.Programs {
+		if d.Programs[i].Program_number == program_number && d.Programs[i].Pmt_pid == pid {
+			program = &d.Programs[i]
+		}
+	}
+
+	if program == nil {
+		return
+	}
+
+	program.Pcr_pid = get_uint16(8, section) & 0x1FFF
+	program.Streams = nil
+	p := 12 + int(get_uint16(10, section) & 0x0FFF)
+	end := len(section) - 4
+	for p + 5 <= end {
+		stream := Ts_stream{Stream_type: section[p], Pid: get_uint16(uint32(p + 1), section) & 0x1FFF, Program_number: program_number}
+		info_length := int(get_uint16(uint32(p + 3), section) & 0x0FFF)
+		p += 5
+		if p + info_length > end {
+			break
+		}
+
+		stream.Descriptors = append([]byte(nil), section[p : p + info_length]...)
+		stream.Codec = ts_stream_codec(stream.Stream_type, stream.Descriptors)
+		p += info_length
+		program.Streams = append(program.Streams, stream)
+	}
+
+	// A new version of the PMT keeps the state of the PIDs still present
+	for i := range program.Streams {
+		stream := &program.Streams[i]
+		state := d.pids[stream.Pid]
+		if state == nil {
+			state = &ts_pid{continuity_counter: -1, next_adts_pts: -1}
+			d.pids[stream.Pid] = state
+		}
+
+		state.stream = stream
+		state.is_section = stream.Stream_type == Ts_stream_type_scte35
+	}
+}
+
+// add_pes_payload reassembles the PES packets of a PID. A PES ends at the
+// start of the next one or, when its PES_packet_length is set, once complete.
+func (d *Ts_demuxer) add_pes_payload(pkt Ts_packet, state *ts_pid, offset int64) {
+	if pkt.Payload_unit_start {
+		if state.pes_active {
+			d.finish_pes(pkt.Pid, state)
+		}
+
+		state.pes = append([]byte(nil), pkt.Payload...)
+		state.pes_active = true
+		state.pes_offset = offset
+		state.random_access = pkt.Random_access
+		state.corrupt = false
+	} else if state.pes_active {
+		state.pes = append(state.pes, pkt.Payload...)
+	} else {
+		return // the start of the PES was not received
+	}
+
+	if len(state.pes) >= 6 {
+		length := int(get_uint16(4, state.pes))
+		if length != 0 && len(state.pes) >= 6 + length {
+			state.pes = state.pes[:6 + length]
+			d.finish_pes(pkt.Pid, state)
+		}
+	}
+}
+
+// ts_timestamp decodes a 33-bit PTS or DTS field.
+func ts_timestamp(d []byte) int64 {
+	return int64(d[0] >> 1 & 0x07) << 30 | int64(d[1]) << 22 | int64(d[2] >> 1) << 15 | int64(d[3]) << 7 | int64(d[4] >> 1)
+}
+
+func (d *Ts_demuxer) finish_pes(pid uint16, state *ts_pid) {
+	pes := state.pes
+	state.pes = nil
+	state.pes_active = false
+	if len(pes) < 6 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		d.error(Ts_error_invalid_pes, pid, state.pes_offset, "no packet_start_code_prefix")
+		return
+	}
+
+	unit := Ts_access_unit{Pid: pid, Stream_type: state.stream.Stream_type, Pts: -1, Dts: -1, Random_access: state.random_access, Corrupt: state.corrupt, Offset: state.pes_offset}
+	stream_id := pes[3]
+	switch stream_id {
+	case 0xBC, 0xBE, 0xBF, 0xF0, 0xF1, 0xF2, 0xF8, 0xFF:
+		// No PES header fields
+		unit.Data = pes[6:]
+	default:
+		if len(pes) < 9 || len(pes) < 9 + int(pes[8]) {
+			d.error(Ts_error_invalid_pes, pid, state.pes_offset, "incomplete_pes_header")
+			return
+		}
+
+		pts_dts_flags := pes[7] >> 6
+		if pts_dts_flags & 0x02 != 0 && pes[8] >= 5 {
+			unit.Pts = ts_timestamp(pes[9:])
+			unit.Dts = unit.Pts
+			if pts_dts_flags == 0x03 && pes[8] >= 10 {
+				unit.Dts = ts_timestamp(pes[14:])
+			}
+		}
+
+		unit.Data = pes[9 + int(pes[8]):]
+	}
+
+	if state.stream.Stream_type == Ts_stream_type_aac {
+		d.split_adts(state, unit)
+		return
+	}
+
+	d.output = append(d.output, unit)
+}
+
+// split_adts returns the ADTS frames of a PES as access units, with the PTS
+// of each frame derived from the PES PTS and 1024 samples per frame.
+func (d *Ts_demuxer) split_adts(state *ts_pid, unit Ts_access_unit) {
+	data := unit.Data
+	pts := unit.Pts
+	if len(state.adts_rest) > 0 {
+		data = append(state.adts_rest, data...)
+		if state.next_adts_pts >= 0 {
+			pts = state.next_adts_pts
+		}
+
+		state.adts_rest = nil
+	}
+
+	for len(data) > 0 {
+		header, err := ParseAdtsHeader(data)
+		if err != nil && len(data) >= 7 {
+			d.error(Ts_error_invalid_adts, unit.Pid, unit.Offset, "%v", err)
+			return
+		}
+
+		if err != nil || header.Frame_length > len(data) {
+			state.adts_rest = append([]byte(nil), data...)
+			break
+		}
+
+		frame := unit
+		frame.Data = data[:header.Frame_length]
+		frame.Pts = pts
+		frame.Dts = pts
+		d.output = append(d.output, frame)
+		data = data[header.Frame_length:]
+		if pts >= 0 && header.Sampling_frequency != 0 {
+			pts = (pts + 1024 * 90000 / int64(header.Sampling_frequency)) & (1 << 33 - 1)
+		}
+
+		unit.Random_access = false
+	}
+
+	state.next_adts_pts = pts
+}
@@ -0,0 +1,196 @@
+package media_utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// ts_test_packets splits payload into packets of pid, the first one with
+// payload_unit_start_indicator, stuffing the last one with an adaptation field.
+func ts_test_packets(pid uint16, cc *uint8, payload []byte) []byte {
+	var out []byte
+	start := true
+	for start || len(payload) > 0 {
+		n := min(len(payload), 184)
+		header := []byte{Ts_sync_byte, byte(pid >> 8), byte(pid), 0x10 | *cc & 0x0F}
+		if start {
+			header[1] |= 0x40
+		}
+
+		if n < 184 {
+			header[3] |= 0x20
+			header = append(header, byte(183 - n))
+			if n < 183 {
+				header = append(header, 0)
+				header = append(header, bytes.Repeat([]byte{0xFF}, 182 - n)...)
+			}
+		}
+
+		out = append(append(out, header...), payload[:n]...)
+		payload = payload[n:]
+		*cc = (*cc + 1) & 0x0F
+		start = false
+	}
+
+	return out
+}
+
+// ts_test_section returns a PSI section with its CRC, after a pointer_field.
+func ts_test_section(table_id uint8, table_id_extension uint16, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{table_id, 0xB0 | byte(length >> 8), byte(length), byte(table_id_extension >> 8), byte(table_id_extension), 0xC1, 0, 0}
+	section = append(section, body...)
+	section = append_uint32(section, crc32_mpeg2(section))
+	return append([]byte{0}, section...)
+}
+
+func ts_test_timestamp(prefix uint8, v int64) []byte {
+	return []byte{prefix << 4 | byte(v >> 29) & 0x0E | 1, byte(v >> 22), byte(v >> 14) | 1, byte(v >> 7), byte(v << 1) | 1}
+}
+
+// ts_test_pes returns a PES packet with a PTS, and a DTS if it differs.
+func ts_test_pes(stream_id uint8, pts int64, dts int64, data []byte) []byte {
+	header := []byte{0x80, 0x80, 5}
+	header = append(header, ts_test_timestamp(2, pts)...)
+	if dts != pts {
+		header = []byte{0x80, 0xC0, 10}
+		header = append(append(header, ts_test_timestamp(3, pts)...), ts_test_timestamp(1, dts)...)
+	}
+
+	length := len(header) + len(data)
+	pes := []byte{0, 0, 1, stream_id, byte(length >> 8), byte(length)}
+	return append(append(pes, header...), data...)
+}
+
+// ts_test_adts returns an ADTS frame of a 48 kHz stereo AAC-LC stream.
+func ts_test_adts(size int, fill byte) []byte {
+	frame_length := 7 + size
+	header := []byte{0xFF, 0xF1, 1 << 6 | 3 << 2, 2 << 6 | byte(frame_length >> 11), byte(frame_length >> 3), byte(frame_length) << 5 | 0x1F, 0xFC}
+	return append(header, bytes.Repeat([]byte{fill}, size)...)
+}
+
+// An AUD, the mux_test parameter sets and an IDR slice
+var ts_test_video_au = bytes.Join([][]byte{nil, {0x09, 0xF0}, mux_test_sps, mux_test_pps, append([]byte{0x65}, bytes.Repeat([]byte{0xAB}, 400)...)}, []byte{0, 0, 0, 1})
+
+// ts_test_stream returns a PAT, a PMT with an H.264 stream on PID 0x100 and
+// an AAC stream on PID 0x101, a video access unit over three packets and a
+// PES of two ADTS frames.
+func ts_test_stream() []byte {
+	var pat_cc, pmt_cc, video_cc, audio_cc uint8
+	pat := append_uint16(append_uint16(nil, 1), 0xE000 | 0x1000)
+	pmt := append_uint16(append_uint16(nil, 0xE000 | 0x100), 0xF000)
+	pmt = append(append_uint16(append_uint16(append(pmt, Ts_stream_type_avc), 0xE000 | 0x100), 0xF000), Ts_stream_type_aac)
+	pmt = append_uint16(append_uint16(pmt, 0xE000 | 0x101), 0xF000)
+
+	var out []byte
+	out = append(out, ts_test_packets(Ts_pid_pat, &pat_cc, ts_test_section(0x00, 1, pat))...)
+	out = append(out, ts_test_packets(0x1000, &pmt_cc, ts_test_section(0x02, 1, pmt))...)
+	out = append(out, ts_test_packets(0x100, &video_cc, ts_test_pes(0xE0, 93600, 90000, ts_test_video_au))...)
+	audio := append(ts_test_adts(20, 0x11), ts_test_adts(30, 0x22)...)
+	return append(out, ts_test_packets(0x101, &audio_cc, ts_test_pes(0xC0, 90000, 90000, audio))...)
+}
+
+func TestTsDemuxer(t *testing.T) {
+	d, units := DemuxTs(ts_test_stream())
+	if len(d.Errors) != 0 {
+		t.Fatalf("errors: %v", d.Errors)
+	}
+
+	streams := d.Streams()
+	if len(d.Programs) != 1 || d.Programs[0].Pmt_pid != 0x1000 || len(streams) != 2 || streams[0].Codec != "avc" || streams[1].Codec != "aac" {
+		t.Fatalf("programs: %+v", d.Programs)
+	}
+
+	if len(units) != 3 {
+		t.Fatalf("%d access units, want 3", len(units))
+	}
+
+	video := units[0]
+	if video.Pid != 0x100 || video.Pts != 93600 || video.Dts != 90000 || video.Corrupt || !bytes.Equal(video.Data, ts_test_video_au) {
+		t.Errorf("video access unit: pid 0x%x pts %d dts %d corrupt %t, %d bytes", video.Pid, video.Pts, video.Dts, video.Corrupt, len(video.Data))
+	}
+
+	// One access unit per ADTS frame, 1024 samples at 48 kHz apart
+	if units[1].Pts != 90000 || units[2].Pts != 90000 + 1920 || !bytes.Equal(units[1].Data, ts_test_adts(20, 0x11)) || !bytes.Equal(units[2].Data, ts_test_adts(30, 0x22)) {
+		t.Errorf("audio access units: %+v", units[1:])
+	}
+}
+
+func TestTsDemuxerContinuity(t *testing.T) {
+	stream := ts_test_stream()
+	// Drop the second packet of the video PES
+	lost := append(append([]byte(nil), stream[:3 * Ts_packet_size]...), stream[4 * Ts_packet_size:]...)
+	d, units := DemuxTs(lost)
+	if len(d.Errors) != 1 || d.Errors[0].Kind != Ts_error_continuity || d.Errors[0].Pid != 0x100 {
+		t.Fatalf("errors: %v", d.Errors)
+	}
+
+	// The video PES, short of its PES_packet_length, ends on Flush
+	if len(units) != 3 || units[2].Pid != 0x100 || !units[2].Corrupt || units[0].Corrupt || units[1].Corrupt {
+		t.Errorf("access units: %d", len(units))
+	}
+
+	// In pieces of any size
+	d = NewTsDemuxer()
+	var pieces []Ts_access_unit
+	for p := 0; p < len(stream); p += 100 {
+		pieces = append(pieces, d.Feed(stream[p:min(p + 100, len(stream))])...)
+	}
+
+	pieces = append(pieces, d.Flush()...)
+	if len(d.Errors) != 0 || len(pieces) != 3 || !bytes.Equal(pieces[0].Data, ts_test_video_au) {
+		t.Errorf("fed in pieces: %d access units, errors %v", len(pieces), d.Errors)
+	}
+}
+
+func TestTsDemuxerCrc(t *testing.T) {
+	stream := ts_test_stream()
+	// The last CRC byte of the PMT, at the end of its packet: the PMT is
+	// skipped, and with it the streams
+	stream[2 * Ts_packet_size - 1] ^= 0xFF
+	d, units := DemuxTs(stream)
+	if len(d.Errors) != 1 || d.Errors[0].Kind != Ts_error_crc || len(d.Streams()) != 0 || len(units) != 0 {
+		t.Errorf("errors %v, %d streams, %d access units", d.Errors, len(d.Streams()), len(units))
+	}
+}
+
+// FuzzTsDemuxer checks the transport stream demuxer, whole and fed in two
+// pieces, and that the remuxed init segment parses.
+func FuzzTsDemuxer(f *testing.F) {
+	stream := ts_test_stream()
+	f.Add(stream)
+	f.Add(stream[:len(stream) - 100])
+	f.Add(stream[Ts_packet_size:])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ParseTsPacket(data)
+		d, _ := DemuxTs(data)
+		d.Streams()
+
+		d = NewTsDemuxer()
+		d.Feed(data[:len(data) / 2])
+		d.Feed(data[len(data) / 2:])
+		d.Flush()
+
+		r := NewTsRemuxer()
+		var segments [][]byte
+		for _, piece := range [][]byte{data[:len(data) / 2], data[len(data) / 2:]} {
+			if seg, err := r.AddSegment(piece); err == nil {
+				segments = append(segments, seg)
+			}
+		}
+
+		init_data, err := r.InitSegment()
+		if err != nil {
+			return
+		}
+
+		tracks, err := GetTracks(init_data)
+		if err != nil {
+			t.Fatalf("remuxed init segment: %v", err)
+		}
+
+		for _, seg := range segments {
+			GetFragmentSamples(seg, tracks)
+		}
+	})
+}
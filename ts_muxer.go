@@ -0,0 +1,327 @@
+package media_utils
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+const (
+	ts_mux_pmt_pid = 0x1000
+	ts_mux_first_pid = 0x0100
+	ts_mux_program_number = 1
+	ts_mux_pcr_delay = 9000 // 100 ms ahead of the DTS, in 90 kHz
+)
+
+var ts_mux_avc_aud = []byte{0x09, 0xF0}
+var ts_mux_hevc_aud = []byte{0x46, 0x01, 0x50}
+
+type ts_mux_track struct {
+	info Track_info
+	pid uint16
+	stream_type uint8
+	stream_id uint8
+	continuity_counter uint8
+	es *Es_writer
+	es_buffer bytes.Buffer
+	dts_shift int64 // largest negative composition offset, in the track timescale
+}
+
+// Ts_muxer writes MPEG-2 TS segments from the samples of H.264, HEVC and AAC
+// tracks, e.g. those of GetTracks of an fMP4 init segment and
+// GetFragmentSamples of each media segment, so that the TS segments have the
+// boundaries of the fMP4 segments. Every segment starts with a PAT and PMT.
+// Video samples are converted to Annex-B with an access unit delimiter and
+// the parameter sets of the decoder configuration ahead of sync samples; AAC
+// frames get ADTS headers. The PCR is carried on the video PID. The PES DTS
+// of a track with negative composition offsets (trun version 1) is moved
+// back by the largest one seen, so that no PTS is before its DTS.
+type Ts_muxer struct {
+	tracks []*ts_mux_track
+	pcr_track *ts_mux_track
+	pat_continuity_counter uint8
+	pmt_continuity_counter uint8
+}
+
+// NewTsMuxer returns a muxer for the H.264, HEVC and AAC tracks among tracks.
+// The other tracks are ignored.
+func NewTsMuxer(tracks []Track_info) (*Ts_muxer, error) {
+	m := &Ts_muxer{}
+	video_count, audio_count := 0, 0
+	for _, track := range tracks {
+		t := &ts_mux_track{info: track, pid: ts_mux_first_pid + uint16(len(m.tracks))}
+		switch {
+		case track.Avcc != nil:
+			t.stream_type = Ts_stream_type_avc
+		case track.Hvcc != nil:
+			t.stream_type = Ts_stream_type_hevc
+		case track.Audio_config != nil:
+			t.stream_type = Ts_stream_type_aac
+		default:
+			continue
+		}
+
+		if track.Timescale == 0 {
+			return nil, errors.New("invalid_timescale")
+		}
+
+		es, err := NewEsWriter(track, &t.es_buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		t.es = es
+		if t.stream_type == Ts_stream_type_aac {
+			t.stream_id = 0xC0 + uint8(audio_count)
+			audio_count++
+		} else {
+			t.stream_id = 0xE0 + uint8(video_count)
+			video_count++
+			if m.pcr_track == nil {
+				m.pcr_track = t
+			}
+		}
+
+		m.tracks = append(m.tracks, t)
+	}
+
+	if len(m.tracks) == 0 {
+		return nil, parse_error(ErrUnsupported, "no_supported_tracks", 0, "")
+	}
+
+	if m.pcr_track == nil {
+		m.pcr_track = m.tracks[0]
+	}
+
+	return m, nil
+}
+
+func (m *Ts_muxer) find_track(track_id uint32) *ts_mux_track {
+	for _, t := range m.tracks {
+		if t.info.Track_id == track_id {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// append_ts_packets packetizes payload on pid. The first packet carries the
+// payload_unit_start_indicator if start is set, and an adaptation field with
+// the PCR (if pcr >= 0) and the random_access_indicator. The last packet is
+// completed with adaptation field stuffing.
+func append_ts_packets(out []byte, pid uint16, continuity_counter *uint8, payload []byte, start bool, pcr int64, random_access bool) []byte {
+	first := true
+	for first || len(payload) > 0 {
+		var adaptation_field []byte // without its length byte
+		if first && (pcr >= 0 || random_access) {
+			flags := byte(0)
+			if random_access {
+				flags |= 0x40
+			}
+
+			if pcr >= 0 {
+				flags |= 0x10
+			}
+
+			adaptation_field = append(adaptation_field, flags)
+			if pcr >= 0 {
+				base := uint64(pcr) / 300 & (1 << 33 - 1)
+				extension := uint64(pcr) % 300
+				adaptation_field = append(adaptation_field, byte(base >> 25), byte(base >> 17), byte(base >> 9), byte(base >> 1), byte(base << 7) | 0x7E | byte(extension >> 8), byte(extension))
+			}
+		}
+
+		room := Ts_packet_size - 4
+		if adaptation_field != nil {
+			room -= 1 + len(adaptation_field)
+		}
+
+		n := min(room, len(payload))
+		if stuffing := room - n; stuffing > 0 {
+			if adaptation_field == nil {
+				// The length byte alone stuffs one byte
+				stuffing--
+				adaptation_field = []byte{}
+				if stuffing > 0 {
+					adaptation_field = append(adaptation_field, 0)
+					stuffing--
+				}
+			}
+
+			adaptation_field = append(adaptation_field, bytes.Repeat([]byte{0xFF}, stuffing)...)
+		}
+
+		adaptation_field_control := byte(0x01)
+		if adaptation_field != nil {
+			adaptation_field_control |= 0x02
+		}
+
+		b1 := byte(pid >> 8 & 0x1F)
+		if first && start {
+			b1 |= 0x40
+		}
+
+		out = append(out, Ts_sync_byte, b1, byte(pid), adaptation_field_control << 4 | *continuity_counter & 0x0F)
+		*continuity_counter = (*continuity_counter + 1) & 0x0F
+		if adaptation_field != nil {
+			out = append(append(out, byte(len(adaptation_field))), adaptation_field...)
+		}
+
+		out = append(out, payload[:n]...)
+		payload = payload[n:]
+		first = false
+	}
+
+	return out
+}
+
+// append_psi_section writes a PSI section in one packet, padded with 0xFF.
+func append_psi_section(out []byte, pid uint16, continuity_counter *uint8, section []byte) []byte {
+	section = append_uint32(section, crc32_mpeg2(section))
+	payload := append([]byte{0}, section...) // pointer_field
+	payload = append(payload, bytes.Repeat([]byte{0xFF}, Ts_packet_size - 4 - len(payload))...)
+	return append_ts_packets(out, pid, continuity_counter, payload, true, -1, false)
+}
+
+// psi_section_header returns the header of a long-form section up to last_section_number.
+func psi_section_header(table_id uint8, table_id_extension uint16, body_size int) []byte {
+	section_length := 5 + body_size + 4
+	d := []byte{table_id, 0xB0 | byte(section_length >> 8), byte(section_length)}
+	d = append_uint16(d, table_id_extension)
+	return append(d, 0xC1, 0, 0) // version 0, current_next_indicator
+}
+
+func (m *Ts_muxer) append_psi(out []byte) []byte {
+	pat := append_uint16(append_uint16(nil, ts_mux_program_number), 0xE000 | ts_mux_pmt_pid)
+	out = append_psi_section(out, Ts_pid_pat, &m.pat_continuity_counter, append(psi_section_header(0x00, 1, len(pat)), pat...))
+
+	pmt := append_uint16(append_uint16(nil, 0xE000 | m.pcr_track.pid), 0xF000)
+	for _, t := range m.tracks {
+		var descriptors []byte
+		if language := t.info.Language; len(language) == 3 && language != "und" {
+			descriptors = append([]byte{0x0A, 4}, language...)
+			descriptors = append(descriptors, 0) // audio_type undefined
+		}
+
+		pmt = append(pmt, t.stream_type)
+		pmt = append_uint16(pmt, 0xE000 | t.pid)
+		pmt = append(append_uint16(pmt, 0xF000 | uint16(len(descriptors))), descriptors...)
+	}
+
+	return append_psi_section(out, ts_mux_pmt_pid, &m.pmt_continuity_counter, append(psi_section_header(0x02, ts_mux_program_number, len(pmt)), pmt...))
+}
+
+// append_ts_timestamp appends a PTS or DTS field with its 4-bit prefix.
+func append_ts_timestamp(d []byte, prefix uint8, ts int64) []byte {
+	v := uint64(ts) & (1 << 33 - 1)
+	return append(d, prefix << 4 | byte(v >> 29) & 0x0E | 1, byte(v >> 22), byte(v >> 14) | 1, byte(v >> 7), byte(v << 1) | 1)
+}
+
+// to_90khz converts a time of the track timescale to 90 kHz, without
+// overflowing for the large times of epoch-based tfdts.
+func (t *ts_mux_track) to_90khz(v int64) int64 {
+	timescale := int64(t.info.Timescale)
+	return v / timescale * 90000 + v % timescale * 90000 / timescale
+}
+
+// pes_payload returns the Annex-B access unit or ADTS frame of a sample.
+func (t *ts_mux_track) pes_payload(sample Mp4_sample) ([]byte, error) {
+	t.es_buffer.Reset()
+	err := t.es.WriteSample(sample)
+	if err != nil {
+		return nil, err
+	}
+
+	data := t.es_buffer.Bytes()
+	if t.stream_type == Ts_stream_type_aac {
+		return data, nil
+	}
+
+	// An access unit delimiter starts every access unit
+	aud := ts_mux_avc_aud
+	if t.stream_type == Ts_stream_type_hevc {
+		aud = ts_mux_hevc_aud
+	}
+
+	if len(data) > 4 && nal_unit_type(t.es.codec, data[4:]) == nal_unit_type(t.es.codec, aud) {
+		return data, nil
+	}
+
+	return append(append(append([]byte(nil), annexb_start_code...), aud...), data...), nil
+}
+
+// Segment returns a TS segment holding the samples of the tracks, in decode
+// order: a PAT and a PMT, then a PES per sample. The continuity counters
+// continue from the previous segment.
+func (m *Ts_muxer) Segment(samples []Mp4_sample) ([]byte, error) {
+	type pes_sample struct {
+		track *ts_mux_track
+		sample Mp4_sample
+		dts int64 // 90 kHz
+	}
+
+	var pes_samples []pes_sample
+	for _, s := range samples {
+		t := m.find_track(s.Track_id)
+		if t == nil {
+			continue
+		}
+
+		if s.Data == nil && s.Size > 0 {
+			return nil, parse_error(ErrTruncated, "sample_outside_data", s.Offset, "")
+		}
+
+		t.dts_shift = max(t.dts_shift, s.Dts - s.Pts)
+		pes_samples = append(pes_samples, pes_sample{t, s, 0})
+	}
+
+	for i := range pes_samples {
+		p := &pes_samples[i]
+		p.dts = p.track.to_90khz(p.sample.Dts - p.track.dts_shift)
+	}
+
+	sort.SliceStable(pes_samples, func(i, j int) bool {
+		return pes_samples[i].dts < pes_samples[j].dts
+	})
+
+	out := m.append_psi(nil)
+	for _, p := range pes_samples {
+		t := p.track
+		payload, err := t.pes_payload(p.sample)
+		if err != nil {
+			return nil, err
+		}
+
+		pts := t.to_90khz(p.sample.Pts)
+		header := []byte{0x80, 0x80, 5}
+		if t.stream_type != Ts_stream_type_aac {
+			header[0] |= 0x04 // data_alignment_indicator
+		}
+
+		if pts != p.dts {
+			header[1], header[2] = 0xC0, 10
+			header = append_ts_timestamp(append_ts_timestamp(header, 0x03, pts), 0x01, p.dts)
+		} else {
+			header = append_ts_timestamp(header, 0x02, pts)
+		}
+
+		// PES_packet_length 0: unbounded, for video access units over 64 KB
+		pes_length := len(header) + len(payload)
+		if pes_length > 0xFFFF {
+			pes_length = 0
+		}
+
+		pes := append([]byte{0, 0, 1, t.stream_id}, byte(pes_length >> 8), byte(pes_length))
+		pes = append(append(pes, header...), payload...)
+		pcr := int64(-1)
+		if t == m.pcr_track {
+			pcr = (max(p.dts - ts_mux_pcr_delay, 0) & (ts_timestamp_wrap - 1)) * 300
+		}
+
+		random_access := p.sample.Is_sync && t.stream_type != Ts_stream_type_aac
+		out = append_ts_packets(out, t.pid, &t.continuity_counter, pes, true, pcr, random_access)
+	}
+
+	return out, nil
+}
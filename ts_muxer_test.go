@@ -0,0 +1,226 @@
+package media_utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// ts_test_tracks returns the mux_test_tracks as read back from their init
+// segment.
+func ts_test_tracks(t *testing.T) []Track_info {
+	var init_data bytes.Buffer
+	m, err := NewFmp4Muxer(&init_data, mux_test_tracks(48000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.WriteInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, err := GetTracks(init_data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tracks
+}
+
+// ts_test_samples returns seconds of the mux_test samples, the video
+// starting at video_dts and the audio at audio_dts, one slice per second.
+func ts_test_samples(seconds int, video_dts int64, audio_dts int64) [][]Mp4_sample {
+	segments := make([][]Mp4_sample, seconds)
+	for k := range segments {
+		for i := k * 30; i < (k + 1) * 30; i++ {
+			segments[k] = append(segments[k], mux_test_video_sample(i, video_dts))
+		}
+
+		for j := k * 375 / 8; j < (k + 1) * 375 / 8; j++ {
+			segments[k] = append(segments[k], mux_test_audio_sample(j, audio_dts))
+		}
+	}
+
+	return segments
+}
+
+// TestTsMuxerEpochTime muxes samples with the times of an epoch-based tfdt:
+// the PES times are those times in 90 kHz, on 33 bits.
+func TestTsMuxerEpochTime(t *testing.T) {
+	const epoch = 1760000000
+	m, err := NewTsMuxer(ts_test_tracks(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := ts_test_samples(1, epoch * 90000, epoch * 48000)[0]
+	data, err := m.Segment(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, units := DemuxTs(data)
+	if len(d.Errors) != 0 || len(units) != len(samples) {
+		t.Fatalf("%d access units, want %d: %v", len(units), len(samples), d.Errors)
+	}
+
+	video, audio := 0, 0
+	for _, unit := range units {
+		var want Mp4_sample
+		if unit.Pid == d.Streams()[0].Pid {
+			want = mux_test_video_sample(video, epoch * 90000)
+			video++
+		} else {
+			want = mux_test_audio_sample(audio, epoch * 48000)
+			want.Pts = want.Pts * 90000 / 48000
+			want.Dts = want.Pts
+			audio++
+		}
+
+		if unit.Pts != want.Pts & (ts_timestamp_wrap - 1) || unit.Dts != want.Dts & (ts_timestamp_wrap - 1) {
+			t.Fatalf("pid 0x%x: pts %d dts %d, want %d %d", unit.Pid, unit.Pts, unit.Dts, want.Pts & (ts_timestamp_wrap - 1), want.Dts & (ts_timestamp_wrap - 1))
+		}
+	}
+}
+
+// TestTsRoundTrip muxes fMP4 samples to TS segments and remuxes them to
+// fMP4, the times crossing the 33-bit rollover: the samples come back
+// unchanged, with their times past it.
+func TestTsRoundTrip(t *testing.T) {
+	tracks := ts_test_tracks(t)
+	m, err := NewTsMuxer(tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1.5 s before the rollover, the audio start on a multiple of 8 so that
+	// its times convert exactly to 90 kHz and back
+	video_dts := ts_timestamp_wrap - 135000
+	audio_dts := video_dts * 48000 / 90000 &^ 7
+	segments := ts_test_samples(3, video_dts, audio_dts)
+	r := NewTsRemuxer()
+	var remuxed [][]byte
+	for _, samples := range segments {
+		data, err := m.Segment(samples)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seg, err := r.AddSegment(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		remuxed = append(remuxed, seg)
+	}
+
+	if len(r.Errors()) != 0 {
+		t.Fatalf("errors: %v", r.Errors())
+	}
+
+	init_data, err := r.InitSegment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remuxed_tracks, err := GetTracks(init_data)
+	if err != nil || len(remuxed_tracks) != 2 {
+		t.Fatalf("tracks: %+v, %v", remuxed_tracks, err)
+	}
+
+	for k, seg := range remuxed {
+		got, err := GetFragmentSamples(seg, remuxed_tracks)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != len(segments[k]) {
+			t.Fatalf("segment %d: %d samples, want %d", k, len(got), len(segments[k]))
+		}
+
+		want := make(map[uint32][]Mp4_sample)
+		for _, s := range segments[k] {
+			want[s.Track_id] = append(want[s.Track_id], s)
+		}
+
+		for _, s := range got {
+			w := want[s.Track_id][0]
+			want[s.Track_id] = want[s.Track_id][1:]
+			if s.Dts != w.Dts || s.Pts != w.Pts || s.Is_sync != w.Is_sync || !bytes.Equal(s.Data, w.Data) {
+				t.Fatalf("segment %d, track %d: dts %d pts %d sync %t, want dts %d pts %d sync %t", k, s.Track_id, s.Dts, s.Pts, s.Is_sync, w.Dts, w.Pts, w.Is_sync)
+			}
+		}
+	}
+}
+
+// TestTsMuxerNegativeCompositionOffsets muxes video with negative
+// composition offsets: the DTS moves back so that no PTS precedes its DTS.
+func TestTsMuxerNegativeCompositionOffsets(t *testing.T) {
+	m, err := NewTsMuxer(ts_test_tracks(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := ts_test_samples(1, 90000, 48000)[0]
+	for i := range samples {
+		if samples[i].Track_id == 1 {
+			samples[i].Pts -= 2 * 3000 * int64(i % 2) + 3000
+		}
+	}
+
+	data, err := m.Segment(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, units := DemuxTs(data)
+	if len(d.Errors) != 0 || len(units) != len(samples) {
+		t.Fatalf("%d access units, want %d: %v", len(units), len(samples), d.Errors)
+	}
+
+	video := 0
+	for _, unit := range units {
+		if unit.Pid != d.Streams()[0].Pid {
+			continue
+		}
+
+		// Offsets of 0 and -2 frames: the DTS moves back 2 frames
+		want := mux_test_video_sample(video, 90000)
+		if unit.Pts < unit.Dts || unit.Dts != want.Dts - 6000 {
+			t.Fatalf("video %d: pts %d dts %d", video, unit.Pts, unit.Dts)
+		}
+
+		video++
+	}
+}
+
+// FuzzTsMuxer checks that a segment is made of whole packets that demux.
+func FuzzTsMuxer(f *testing.F) {
+	f.Add(fuzz_init(), fuzz_segment())
+	f.Fuzz(func(t *testing.T, init_data []byte, seg_data []byte) {
+		tracks, samples := fuzz_samples(init_data, seg_data)
+		m, err := NewTsMuxer(tracks)
+		if err != nil {
+			return
+		}
+
+		data, err := m.Segment(samples)
+		if err != nil {
+			return
+		}
+
+		if len(data) % Ts_packet_size != 0 {
+			t.Fatalf("%d bytes", len(data))
+		}
+
+		for p := 0; p < len(data); p += Ts_packet_size {
+			if data[p] != 0x47 {
+				t.Fatalf("no sync byte at %d", p)
+			}
+		}
+
+		if _, err := DemuxTs(data); err != nil {
+			t.Fatalf("muxed segment: %v", err)
+		}
+	})
+}
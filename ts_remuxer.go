@@ -0,0 +1,354 @@
+package media_utils
+
+import (
+	"bytes"
+	"errors"
+	"math"
+)
+
+const ts_timestamp_wrap = int64(1) << 33
+
+// unwrap_timestamp returns the 33-bit timestamp ts extended to the value
+// closest to reference, so that timestamps keep increasing across rollovers.
+func unwrap_timestamp(ts int64, reference int64) int64 {
+	v := reference &^ (ts_timestamp_wrap - 1) | ts & (ts_timestamp_wrap - 1)
+	if v - reference > ts_timestamp_wrap / 2 && v >= ts_timestamp_wrap {
+		v -= ts_timestamp_wrap
+	} else if reference - v > ts_timestamp_wrap / 2 {
+		v += ts_timestamp_wrap
+	}
+
+	return v
+}
+
+// ts_stream_language returns the language of an ISO_639_language_descriptor.
+func ts_stream_language(descriptors []byte) string {
+	for p := 0; p + 2 <= len(descriptors); p += 2 + int(descriptors[p + 1]) {
+		if descriptors[p] == 0x0A && descriptors[p + 1] >= 3 && p + 5 <= len(descriptors) {
+			return string(descriptors[p + 2 : p + 5])
+		}
+	}
+
+	return ""
+}
+
+type ts_track struct {
+	pid uint16
+	info Track_info
+	codec int // es_codec_*
+	vps [][]byte
+	sps [][]byte
+	pps [][]byte
+	config_done bool // parameter sets seen afterwards stay in the samples
+}
+
+// Ts_remuxer remuxes the segments of an HLS TS rendition to fragmented MP4
+// without re-encoding: an init segment and one media segment per TS segment.
+// H.264 and HEVC access units are converted from Annex-B to 4-byte length
+// prefixed samples, their first parameter sets going to the avcC/hvcC; AAC
+// ADTS frames lose their headers, which give the esds. The tfdt and trun
+// times are the PTS/DTS of the TS, extended past the 33-bit rollover, with
+// the audio tracks in their sample rate timescale.
+type Ts_remuxer struct {
+	Pids []uint16 // streams to remux; all H.264, HEVC and AAC streams if empty
+
+	demuxer *Ts_demuxer
+	tracks []*ts_track
+	started bool
+	reference int64 // last unwrapped 90 kHz timestamp
+	sequence_number uint32
+}
+
+func NewTsRemuxer() *Ts_remuxer {
+	return &Ts_remuxer{demuxer: NewTsDemuxer()}
+}
+
+// Errors returns the errors of the TS demuxer.
+func (r *Ts_remuxer) Errors() []Ts_error {
+	return r.demuxer.Errors
+}
+
+// add_tracks creates the tracks from the streams of the PMT of the first segment.
+func (r *Ts_remuxer) add_tracks() {
+	for _, stream := range r.demuxer.Streams() {
+		selected := len(r.Pids) == 0
+		for _, pid := range r.Pids {
+			selected = selected || pid == stream.Pid
+		}
+
+		if !selected {
+			continue
+		}
+
+		t := &ts_track{pid: stream.Pid, info: Track_info{Track_id: uint32(len(r.tracks) + 1), Language: ts_stream_language(stream.Descriptors)}}
+		switch stream.Codec {
+		case "avc":
+			t.codec = es_codec_avc
+			t.info.Handler_type = "vide"
+			t.info.Timescale = 90000
+		case "hevc":
+			t.codec = es_codec_hevc
+			t.info.Handler_type = "vide"
+			t.info.Timescale = 90000
+		case "aac":
+			t.codec = es_codec_aac
+			t.info.Handler_type = "soun"
+		default:
+			continue
+		}
+
+		r.tracks = append(r.tracks, t)
+	}
+}
+
+func (r *Ts_remuxer) find_track(pid uint16) *ts_track {
+	for _, t := range r.tracks {
+		if t.pid == pid {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func (r *Ts_remuxer) unwrap(ts int64) int64 {
+	if !r.started {
+		r.started = true
+		r.reference = ts
+	}
+
+	r.reference = unwrap_timestamp(ts, r.reference)
+	return r.reference
+}
+
+// add_parameter_set adds a parameter set to the decoder configuration, and
+// tells whether it is known there.
+func (t *ts_track) add_parameter_set(sets *[][]byte, nalu []byte) bool {
+	for _, set := range *sets {
+		if bytes.Equal(set, nalu) {
+			return true
+		}
+	}
+
+	if t.config_done {
+		return false
+	}
+
+	*sets = append(*sets, append([]byte(nil), nalu...))
+	return true
+}
+
+// video_sample converts an Annex-B access unit to a length-prefixed sample,
+// without access unit delimiters, filler data and the parameter sets of the
+// decoder configuration.
+func (r *Ts_remuxer) video_sample(t *ts_track, unit Ts_access_unit) Mp4_sample {
+	sample := Mp4_sample{Track_id: t.info.Track_id}
+	for _, nalu := range SplitAnnexB(unit.Data) {
+		nal_type := nal_unit_type(t.codec, nalu)
+		known := false
+		if t.codec == es_codec_hevc {
+			switch {
+			case nal_type == 32:
+				known = t.add_parameter_set(&t.vps, nalu)
+			case nal_type == 33:
+				known = t.add_parameter_set(&t.sps, nalu)
+			case nal_type == 34:
+				known = t.add_parameter_set(&t.pps, nalu)
+			case nal_type == 35 || nal_type == 38:
+				known = true // access unit delimiter, filler data
+			case nal_type >= 16 && nal_type <= 23:
+				sample.Is_sync = true
+			}
+		} else {
+			switch nal_type {
+			case 7:
+				known = t.add_parameter_set(&t.sps, nalu)
+			case 8:
+				known = t.add_parameter_set(&t.pps, nalu)
+			case 9, 12:
+				known = true
+			case 5:
+				sample.Is_sync = true
+			}
+		}
+
+		if !known && len(nalu) > 0 {
+			sample.Data = append(append_uint32(sample.Data, uint32(len(nalu))), nalu...)
+		}
+	}
+
+	sample.Dts = r.unwrap(unit.Dts)
+	composition_offset := (unit.Pts - unit.Dts) & (ts_timestamp_wrap - 1)
+	if composition_offset > ts_timestamp_wrap / 2 {
+		composition_offset -= ts_timestamp_wrap
+	}
+
+	sample.Pts = sample.Dts + composition_offset
+	return sample
+}
+
+// audio_sample returns the raw AAC frame of an ADTS frame, and sets the
+// audio configuration of the track from the first one.
+func (r *Ts_remuxer) audio_sample(t *ts_track, unit Ts_access_unit) (Mp4_sample, error) {
+	header, err := ParseAdtsHeader(unit.Data)
+	if err != nil {
+		return Mp4_sample{}, err
+	}
+
+	if header.Sampling_frequency == 0 || header.Frame_length > len(unit.Data) {
+		return Mp4_sample{}, parse_error(ErrInvalidData, "invalid_adts_header", 0, "")
+	}
+
+	if t.info.Esds == nil {
+		t.info.Timescale = header.Sampling_frequency
+		t.info.Sample_rate = header.Sampling_frequency
+		t.info.Channel_count = uint16(header.Channel_configuration)
+		t.info.Esds = &Esds_config{Es_id: uint16(t.info.Track_id), Object_type_indication: 0x40, Stream_type: 0x05, Decoder_specific_info: header.AudioSpecificConfig()}
+	}
+
+	pts := r.unwrap(unit.Pts)
+	dts := (pts * int64(t.info.Timescale) + 45000) / 90000
+	return Mp4_sample{Track_id: t.info.Track_id, Dts: dts, Pts: dts, Duration: 1024, Is_sync: true, Data: unit.Data[header.Header_size:header.Frame_length]}, nil
+}
+
+// AddSegment demuxes the next TS segment and returns it as an fMP4 media
+// segment. The tracks are the H.264, HEVC and AAC streams of the PMT of the
+// first segment. The last sample of each track gets the duration of the
+// sample before it.
+func (r *Ts_remuxer) AddSegment(data []byte) ([]byte, error) {
+	units := append(r.demuxer.Feed(data), r.demuxer.Flush()...)
+	if r.tracks == nil {
+		r.add_tracks()
+		if len(r.tracks) == 0 {
+			return nil, parse_error(ErrUnsupported, "no_supported_streams", 0, "")
+		}
+	}
+
+	var samples []Mp4_sample
+	for _, unit := range units {
+		t := r.find_track(unit.Pid)
+		if t == nil || unit.Pts < 0 {
+			continue
+		}
+
+		if t.codec == es_codec_aac {
+			sample, err := r.audio_sample(t, unit)
+			if err != nil {
+				return nil, err
+			}
+
+			samples = append(samples, sample)
+		} else {
+			samples = append(samples, r.video_sample(t, unit))
+		}
+	}
+
+	var infos []Track_info
+	for _, t := range r.tracks {
+		if t.info.Timescale != 0 {
+			infos = append(infos, t.info)
+		}
+	}
+
+	if len(samples) == 0 || len(infos) == 0 {
+		return nil, errors.New("no_samples")
+	}
+
+	var buffer bytes.Buffer
+	m, err := NewFmp4Muxer(&buffer, infos)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Segment_duration = math.MaxUint32 // one segment
+	m.Cmaf = len(r.tracks) == 1
+	m.sequence_number = r.sequence_number
+	for _, sample := range samples {
+		err = m.WriteSample(sample)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = m.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	r.sequence_number = m.sequence_number
+	return buffer.Bytes(), nil
+}
+
+// build_config sets the decoder configuration of the track from the
+// parameter sets or ADTS headers seen so far.
+func (t *ts_track) build_config() error {
+	switch t.codec {
+	case es_codec_aac:
+		if t.info.Esds == nil {
+			return parse_error(ErrBoxNotFound, "missing_adts_header", 0, "")
+		}
+	case es_codec_avc:
+		if len(t.sps) == 0 || len(t.pps) == 0 || len(t.sps[0]) < 4 {
+			return parse_error(ErrBoxNotFound, "missing_parameter_sets", 0, "")
+		}
+
+		width, height, err := avc_sps_dimensions(t.sps[0])
+		if err != nil {
+			return err
+		}
+
+		t.info.Width, t.info.Height = width, height
+		t.info.Avcc = &Avcc_config{Configuration_version: 1, Profile: t.sps[0][1], Profile_compatibility: t.sps[0][2], Level: t.sps[0][3], Nal_length_size: 4, Sps: t.sps, Pps: t.pps}
+	case es_codec_hevc:
+		if len(t.vps) == 0 || len(t.sps) == 0 || len(t.pps) == 0 {
+			return parse_error(ErrBoxNotFound, "missing_parameter_sets", 0, "")
+		}
+
+		hvcc, width, height, err := hevc_sps_config(t.sps[0])
+		if err != nil {
+			return err
+		}
+
+		hvcc.Configuration_version = 1
+		hvcc.Nal_length_size = 4
+		hvcc.Arrays = []Hvcc_nal_array{{true, 32, t.vps}, {true, 33, t.sps}, {true, 34, t.pps}}
+		t.info.Width, t.info.Height = width, height
+		t.info.Hvcc = &hvcc
+	}
+
+	t.config_done = true
+	return nil
+}
+
+// InitSegment returns the init segment, once the segments added hold the
+// parameter sets of the video tracks and an ADTS frame of the audio tracks.
+// The parameter sets seen afterwards that differ from them are kept in the samples.
+func (r *Ts_remuxer) InitSegment() ([]byte, error) {
+	if len(r.tracks) == 0 {
+		return nil, parse_error(ErrUnsupported, "no_supported_streams", 0, "")
+	}
+
+	var infos []Track_info
+	for _, t := range r.tracks {
+		err := t.build_config()
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, t.info)
+	}
+
+	var buffer bytes.Buffer
+	m, err := NewFmp4Muxer(&buffer, infos)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Cmaf = len(r.tracks) == 1
+	err = m.WriteInit()
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}